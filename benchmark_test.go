@@ -0,0 +1,126 @@
+package nymsocketmanager_test
+
+import (
+	"strings"
+	"testing"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// startLoopback starts a NymSocketManager on a FakeNymClient, giving every received message to received
+func startLoopback(b *testing.B, received chan<- string) (*lib.NymSocketManager, lib.NymAddress) {
+	logger := zerolog.Logger{}
+
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	b.Cleanup(fakeNymClient.Close)
+
+	nymSocketManager, e := lib.NewNymSocketManager(fakeNymClient.URI(), func(msg lib.NymReceived, _ func(lib.NymMessage) error) {
+		if nil != received {
+			received <- msg.Message
+		}
+	}, &logger)
+	require.NoError(b, e)
+
+	_, e = nymSocketManager.Start()
+	require.NoError(b, e)
+	b.Cleanup(nymSocketManager.Stop)
+
+	return nymSocketManager, fakeNymClient.Address()
+}
+
+func BenchmarkNymSocketManagerSend(b *testing.B) {
+	nymSocketManager, _ := startLoopback(b, nil)
+	msg := lib.NewNymSend(strings.Repeat("x", 256), nymtest.RandomNymAddress())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e := nymSocketManager.Send(msg)
+		if nil != e {
+			b.Fatal(e)
+		}
+	}
+}
+
+func BenchmarkNymSocketManagerSendParallel(b *testing.B) {
+	nymSocketManager, _ := startLoopback(b, nil)
+	msg := lib.NewNymSend(strings.Repeat("x", 256), nymtest.RandomNymAddress())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			e := nymSocketManager.Send(msg)
+			if nil != e {
+				b.Error(e)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkNymSocketManagerRoundTrip measures a message sent to our own address until it is dispatched back
+func BenchmarkNymSocketManagerRoundTrip(b *testing.B) {
+	received := make(chan string, 1)
+	nymSocketManager, address := startLoopback(b, received)
+	msg := lib.NewNymSend(strings.Repeat("x", 256), address)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e := nymSocketManager.Send(msg)
+		if nil != e {
+			b.Fatal(e)
+		}
+		<-received
+	}
+}
+
+func BenchmarkMessageDispatcher(b *testing.B) {
+	logger := zerolog.Logger{}
+
+	dispatched := 0
+	nymSocketManager, e := lib.NewNymSocketManager("ws://unused", func(lib.NymReceived, func(lib.NymMessage) error) {
+		dispatched++
+	}, &logger)
+	require.NoError(b, e)
+
+	msgBytes, e := lib.EncodeNymMessage(lib.NewNymReceived(strings.Repeat("x", 256), "senderTag"))
+	require.NoError(b, e)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lib.MessageDispatcher(nymSocketManager, msgBytes)
+	}
+	b.StopTimer()
+	require.Equal(b, b.N, dispatched)
+}
+
+func BenchmarkEncodeNymMessage(b *testing.B) {
+	msg := lib.NewNymSendAnonymous(strings.Repeat("x", 256), nymtest.RandomNymAddress(), 5)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, e := lib.EncodeNymMessage(msg)
+		if nil != e {
+			b.Fatal(e)
+		}
+	}
+}
+
+func BenchmarkDecodeNymMessage(b *testing.B) {
+	msgBytes, e := lib.EncodeNymMessage(lib.NewNymReceived(strings.Repeat("x", 256), "senderTag"))
+	require.NoError(b, e)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, e := lib.DecodeNymMessage(msgBytes)
+		if nil != e {
+			b.Fatal(e)
+		}
+	}
+}
@@ -0,0 +1,503 @@
+// Package bridge shares nym-clients with local applications which cannot embed NymSocketManager.
+//
+// The Bridge runs a NymClientPool, restarting dropped nym-clients and routing replies through the nym-client which
+// received their senderTag, and exposes it over HTTP:
+//
+//	GET  /ws       websocket speaking the JSON protocol of the nym-client, plus subscriptions
+//	POST /send     sends the NymMessage in the body (send, sendAnonymous or reply), as application/json
+//	GET  /address  returns the selfAddress of the Bridge
+//
+// Requests from web pages of other origins are refused, and POST /send needs the application/json Content-Type, which
+// web pages cannot send to another origin without its consent. A web page can still rebind its own host name to
+// 127.0.0.1 and reach the Bridge as its own origin, so requests are only served for the Host localhost, IP addresses
+// and the AllowedHosts. Without Token, any local process can use the Bridge.
+//
+// On the websocket, applications send the send, sendAnonymous, reply and selfAddress messages of the nym-client
+// protocol, and subscribe to the received messages whose payload starts with a prefix:
+//
+//	{"type":"subscribe","prefix":"myapp:"}
+//	{"type":"unsubscribe","prefix":"myapp:"}
+//
+// Nothing is received before subscribing, the empty prefix matching every message. Requests carrying an "id" are
+// acknowledged with {"type":"ack","id":...} or answered with {"type":"error","id":...,"message":...}.
+package bridge
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+const (
+	SubscribeType   = "subscribe"
+	UnsubscribeType = "unsubscribe"
+	AckType         = "ack"
+)
+
+const (
+	// DefaultSubscriberBuffer is the number of received messages queued per application before dropping
+	DefaultSubscriberBuffer = 256
+	// maxRequestSize is the size of the biggest request accepted from an application
+	maxRequestSize = 1 << 20
+)
+
+type BridgeConfig struct {
+	// Applications need to present Token, as a bearer token or a token query parameter (optional)
+	Token string
+	// Host names the Bridge is reached by, besides localhost and IP addresses, e.g. behind a reverse proxy (optional)
+	AllowedHosts []string
+	// Defaults to DefaultSubscriberBuffer
+	SubscriberBuffer int
+	// Policy of the NymClientPool, when using several nym-clients
+	Policy lib.PoolPolicy
+}
+
+type BridgeStats struct {
+	Subscribers int
+	Sent        uint64
+	Delivered   uint64
+	// Received messages dropped because an application was not reading them fast enough
+	Dropped uint64
+}
+
+func NewBridge(connectionURIs []string, config BridgeConfig, parentLogger *zerolog.Logger) (*Bridge, error) {
+	if config.SubscriberBuffer < 0 {
+		err := xerrors.Errorf("subscriber buffer cannot be negative")
+		return nil, err
+	}
+
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	if 0 == config.SubscriberBuffer {
+		config.SubscriberBuffer = DefaultSubscriberBuffer
+	}
+
+	localLogger := parentLogger.With().Str(lib.ComponentField, "Bridge").Logger()
+
+	b := &Bridge{
+		config:      config,
+		subscribers: make(map[*subscriber]struct{}),
+		logger:      &localLogger,
+	}
+
+	var e error
+	b.pool, e = lib.NewNymClientPool(connectionURIs, b.handleReceived, config.Policy, parentLogger)
+	if nil != e {
+		return nil, e
+	}
+
+	b.mux = http.NewServeMux()
+	b.mux.HandleFunc("/ws", b.serveWebsocket)
+	b.mux.HandleFunc("/send", b.serveSend)
+	b.mux.HandleFunc("/address", b.serveAddress)
+
+	return b, nil
+}
+
+type Bridge struct {
+	sync.Mutex
+
+	config BridgeConfig
+	pool   *lib.NymClientPool
+	mux    *http.ServeMux
+
+	subscribers map[*subscriber]struct{}
+	stats       BridgeStats
+
+	logger *zerolog.Logger
+}
+
+// subscriber is a websocket connection of an application
+type subscriber struct {
+	sync.Mutex
+
+	prefixes map[string]struct{}
+	// Messages to write to the websocket, closed when the connection ends
+	out  chan []byte
+	done chan struct{}
+}
+
+func (s *subscriber) matches(message string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for prefix := range s.prefixes {
+		if strings.HasPrefix(message, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// request holds the fields of the messages of applications which are not part of the nym-client protocol
+type request struct {
+	Type   string `json:"type"`
+	Id     string `json:"id,omitempty"`
+	Prefix string `json:"prefix"`
+}
+
+// response acknowledges or rejects a request
+type response struct {
+	Type    string `json:"type"`
+	Id      string `json:"id,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Start starts the nym-clients of the Bridge. The returned chan is closed when the Bridge is stopped.
+func (b *Bridge) Start() (chan struct{}, error) {
+	return b.pool.Start()
+}
+
+// Stop stops the nym-clients and disconnects the applications
+func (b *Bridge) Stop() {
+	b.pool.Stop()
+
+	b.Lock()
+	defer b.Unlock()
+	for s := range b.subscribers {
+		close(s.done)
+		delete(b.subscribers, s)
+	}
+}
+
+// Pool returns the NymClientPool of the Bridge, e.g. to register middlewares on its NymSocketManagers
+func (b *Bridge) Pool() *lib.NymClientPool {
+	return b.pool
+}
+
+func (b *Bridge) Stats() BridgeStats {
+	b.Lock()
+	defer b.Unlock()
+
+	stats := b.stats
+	stats.Subscribers = len(b.subscribers)
+	return stats
+}
+
+func (b *Bridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !b.allowedHost(r) {
+		http.Error(w, "host not allowed", http.StatusForbidden)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+	if !b.authorized(r) {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	b.mux.ServeHTTP(w, r)
+}
+
+// allowedHost tells whether r was sent to a Host which cannot be rebound by a web page to the Bridge
+func (b *Bridge) allowedHost(r *http.Request) bool {
+	host, _, e := net.SplitHostPort(r.Host)
+	if nil != e {
+		host = r.Host
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	if strings.EqualFold("localhost", host) || nil != net.ParseIP(host) {
+		return true
+	}
+	for _, allowed := range b.config.AllowedHosts {
+		if strings.EqualFold(allowed, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin tells whether r does not come from a web page of another origin, as the websocket upgrader does
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if 0 == len(origin) {
+		return true
+	}
+
+	u, e := url.Parse(origin)
+	if nil != e {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func (b *Bridge) authorized(r *http.Request) bool {
+	if 0 == len(b.config.Token) {
+		return true
+	}
+
+	token := r.URL.Query().Get("token")
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = bearer
+	}
+	return subtle.ConstantTimeCompare([]byte(b.config.Token), []byte(token)) == 1
+}
+
+// handleReceived fans the received messages out to the matching subscribers
+func (b *Bridge) handleReceived(msg lib.NymReceived, _ func(lib.NymMessage) error) {
+	msgBytes, e := lib.EncodeNymMessage(msg)
+	if nil != e {
+		b.logger.Warn().Msgf("failed to encode received message: %v", e)
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	for s := range b.subscribers {
+		if !s.matches(msg.Message) {
+			continue
+		}
+
+		select {
+		case s.out <- msgBytes:
+			b.stats.Delivered++
+		default:
+			b.stats.Dropped++
+		}
+	}
+}
+
+// send sends the NymMessage encoded in msgBytes
+func (b *Bridge) send(msgBytes []byte) error {
+	msg, e := decodeSendable(msgBytes)
+	if nil != e {
+		return e
+	}
+	return b.sendMessage(msg)
+}
+
+// decodeSendable decodes msgBytes, only accepting the messages sending to the mixnet
+func decodeSendable(msgBytes []byte) (lib.NymMessage, error) {
+	msg, e := lib.DecodeNymMessage(msgBytes)
+	if nil != e {
+		return nil, e
+	}
+
+	switch msg.(type) {
+	case lib.NymSend, lib.NymSendAnonymous, lib.NymReply:
+		return msg, nil
+	default:
+		return nil, xerrors.Errorf("%v cannot be sent through the bridge", msg.Name())
+	}
+}
+
+func (b *Bridge) sendMessage(msg lib.NymMessage) error {
+	e := b.pool.Send(msg)
+	if nil != e {
+		return e
+	}
+
+	b.Lock()
+	b.stats.Sent++
+	b.Unlock()
+	return nil
+}
+
+func (b *Bridge) selfAddress() (lib.NymMessage, error) {
+	addresses := b.pool.GetNymClientIds()
+	if 0 == len(addresses) {
+		return nil, xerrors.Errorf("no nym-client is running")
+	}
+	return lib.NewSelfAddressReply(addresses[0].String()), nil
+}
+
+func (b *Bridge) serveSend(w http.ResponseWriter, r *http.Request) {
+	if http.MethodPost != r.Method {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mediaType, _, e := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if nil != e || "application/json" != mediaType {
+		http.Error(w, "content type needs to be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, e := io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if nil != e {
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	}
+
+	msg, e := decodeSendable(body)
+	if nil != e {
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	}
+
+	e = b.sendMessage(msg)
+	if nil != e {
+		b.logger.Debug().Msgf("failed to send message from %v: %v", r.RemoteAddr, e)
+		http.Error(w, e.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (b *Bridge) serveAddress(w http.ResponseWriter, r *http.Request) {
+	msg, e := b.selfAddress()
+	if nil != e {
+		http.Error(w, e.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	msgBytes, e := lib.EncodeNymMessage(msg)
+	if nil != e {
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(msgBytes)
+}
+
+func (b *Bridge) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	connection, e := upgrader.Upgrade(w, r, nil)
+	if nil != e {
+		b.logger.Debug().Msgf("failed to upgrade connection from %v: %v", r.RemoteAddr, e)
+		return
+	}
+	connection.SetReadLimit(maxRequestSize)
+
+	s := &subscriber{
+		prefixes: make(map[string]struct{}),
+		out:      make(chan []byte, b.config.SubscriberBuffer),
+		done:     make(chan struct{}),
+	}
+
+	b.Lock()
+	b.subscribers[s] = struct{}{}
+	b.Unlock()
+	b.logger.Debug().Msgf("application connected from %v", r.RemoteAddr)
+
+	writerDone := make(chan struct{})
+	go b.writeLoop(connection, s, writerDone)
+
+	b.readLoop(connection, s)
+
+	b.Lock()
+	if _, ok := b.subscribers[s]; ok {
+		close(s.done)
+		delete(b.subscribers, s)
+	}
+	b.Unlock()
+
+	<-writerDone
+	connection.Close()
+	b.logger.Debug().Msgf("application from %v disconnected", r.RemoteAddr)
+}
+
+func (b *Bridge) writeLoop(connection *websocket.Conn, s *subscriber, writerDone chan struct{}) {
+	defer close(writerDone)
+
+	for {
+		select {
+		case <-s.done:
+			connection.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		case msgBytes := <-s.out:
+			e := connection.WriteMessage(websocket.TextMessage, msgBytes)
+			if nil != e {
+				b.logger.Debug().Msgf("failed to write to application: %v", e)
+				connection.Close()
+				return
+			}
+		}
+	}
+}
+
+func (b *Bridge) readLoop(connection *websocket.Conn, s *subscriber) {
+	for {
+		messageType, msgBytes, e := connection.ReadMessage()
+		if nil != e {
+			return
+		}
+		if websocket.TextMessage != messageType {
+			continue
+		}
+
+		req := request{}
+		e = json.Unmarshal(msgBytes, &req)
+		if nil != e {
+			b.respond(s, response{Type: lib.NymErrorType, Message: "invalid JSON: " + e.Error()})
+			continue
+		}
+
+		switch req.Type {
+		case SubscribeType:
+			s.Lock()
+			s.prefixes[req.Prefix] = struct{}{}
+			s.Unlock()
+			b.acknowledge(s, req, nil)
+
+		case UnsubscribeType:
+			s.Lock()
+			delete(s.prefixes, req.Prefix)
+			s.Unlock()
+			b.acknowledge(s, req, nil)
+
+		case lib.NymSelfAddressType:
+			msg, e := b.selfAddress()
+			if nil != e {
+				b.acknowledge(s, req, e)
+				continue
+			}
+			msgBytes, e := lib.EncodeNymMessage(msg)
+			if nil != e {
+				b.acknowledge(s, req, e)
+				continue
+			}
+			b.write(s, msgBytes)
+
+		default:
+			b.acknowledge(s, req, b.send(msgBytes))
+		}
+	}
+}
+
+// acknowledge answers req with e, or with an ack if req has an id
+func (b *Bridge) acknowledge(s *subscriber, req request, e error) {
+	if nil != e {
+		b.respond(s, response{Type: lib.NymErrorType, Id: req.Id, Message: e.Error()})
+		return
+	}
+	if 0 != len(req.Id) {
+		b.respond(s, response{Type: AckType, Id: req.Id})
+	}
+}
+
+func (b *Bridge) respond(s *subscriber, r response) {
+	msgBytes, e := json.Marshal(r)
+	if nil != e {
+		b.logger.Warn().Msgf("failed to encode response: %v", e)
+		return
+	}
+	b.write(s, msgBytes)
+}
+
+// write queues msgBytes to s, waiting for room as responses cannot be dropped
+func (b *Bridge) write(s *subscriber, msgBytes []byte) {
+	select {
+	case s.out <- msgBytes:
+	case <-s.done:
+	}
+}
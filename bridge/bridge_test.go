@@ -0,0 +1,180 @@
+package bridge_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/bridge"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func startBridge(t *testing.T, config bridge.BridgeConfig) (*nymtest.FakeNymClient, *bridge.Bridge, *httptest.Server) {
+	logger := zerolog.Logger{}
+
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	t.Cleanup(fakeNymClient.Close)
+
+	b, e := bridge.NewBridge([]string{fakeNymClient.URI()}, config, &logger)
+	require.NoError(t, e)
+	_, e = b.Start()
+	require.NoError(t, e)
+	t.Cleanup(b.Stop)
+
+	server := httptest.NewServer(b)
+	t.Cleanup(server.Close)
+
+	return fakeNymClient, b, server
+}
+
+func dialApplication(t *testing.T, server *httptest.Server, query string) *websocket.Conn {
+	connection, _, e := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws"+query, nil)
+	require.NoError(t, e)
+	t.Cleanup(func() { connection.Close() })
+	return connection
+}
+
+// request sends v and returns the answer of the bridge
+func request(t *testing.T, connection *websocket.Conn, v interface{}) map[string]interface{} {
+	require.NoError(t, connection.WriteJSON(v))
+	return readJSON(t, connection)
+}
+
+func readJSON(t *testing.T, connection *websocket.Conn) map[string]interface{} {
+	connection.SetReadDeadline(time.Now().Add(time.Second))
+	answer := map[string]interface{}{}
+	require.NoError(t, connection.ReadJSON(&answer))
+	return answer
+}
+
+func TestBridgeFansReceivedMessagesOutByPrefix(t *testing.T) {
+	fakeNymClient, b, server := startBridge(t, bridge.BridgeConfig{})
+
+	first := dialApplication(t, server, "")
+	second := dialApplication(t, server, "")
+
+	require.Equal(t, "ack", request(t, first, map[string]string{"type": "subscribe", "prefix": "first:", "id": "1"})["type"])
+	require.Equal(t, "ack", request(t, second, map[string]string{"type": "subscribe", "prefix": "", "id": "1"})["type"])
+
+	// The fake nym-client loops messages sent to its own address back
+	send := lib.NewNymSend("first:hello", fakeNymClient.Address()).(lib.NymSend)
+	answer := request(t, second, map[string]interface{}{"type": "send", "message": send.Message, "recipient": send.Recipient, "id": "2"})
+	require.Equal(t, map[string]interface{}{"type": "ack", "id": "2"}, answer)
+
+	for _, connection := range []*websocket.Conn{first, second} {
+		received := readJSON(t, connection)
+		require.Equal(t, "received", received["type"])
+		require.Equal(t, "first:hello", received["message"])
+	}
+
+	// Only the second application gets messages without the prefix of the first one
+	require.NoError(t, second.WriteJSON(map[string]interface{}{"type": "send", "message": "other", "recipient": send.Recipient}))
+	require.Equal(t, "other", readJSON(t, second)["message"])
+
+	require.Equal(t, "selfAddress", request(t, first, map[string]string{"type": "selfAddress"})["type"])
+	answer = request(t, first, map[string]string{"type": "closedConnection", "id": "3"})
+	require.Equal(t, "error", answer["type"])
+	require.Equal(t, "3", answer["id"])
+
+	stats := b.Stats()
+	require.Equal(t, 2, stats.Subscribers)
+	require.Equal(t, uint64(2), stats.Sent)
+	require.Equal(t, uint64(3), stats.Delivered)
+}
+
+func TestBridgeHTTPAPI(t *testing.T) {
+	fakeNymClient, _, server := startBridge(t, bridge.BridgeConfig{Token: "secret"})
+
+	response, e := http.Get(server.URL + "/address")
+	require.NoError(t, e)
+	response.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+	response, e = http.Get(server.URL + "/address?token=secret")
+	require.NoError(t, e)
+	address := lib.NymSelfAddressReply{}
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&address))
+	response.Body.Close()
+	require.Equal(t, fakeNymClient.Address().String(), address.Address)
+
+	application := dialApplication(t, server, "?token=secret")
+	require.Equal(t, "ack", request(t, application, map[string]string{"type": "subscribe", "id": "1"})["type"])
+
+	msgBytes, e := lib.EncodeNymMessage(lib.NewNymSendAnonymous("over HTTP", fakeNymClient.Address(), 1))
+	require.NoError(t, e)
+	post := func(body []byte) int {
+		request, e := http.NewRequest(http.MethodPost, server.URL+"/send", bytes.NewReader(body))
+		require.NoError(t, e)
+		request.Header.Set("Authorization", "Bearer secret")
+		request.Header.Set("Content-Type", "application/json")
+		response, e := http.DefaultClient.Do(request)
+		require.NoError(t, e)
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	require.Equal(t, http.StatusAccepted, post(msgBytes))
+	received := readJSON(t, application)
+	require.Equal(t, "over HTTP", received["message"])
+	require.NotEmpty(t, received["senderTag"])
+
+	require.Equal(t, http.StatusBadRequest, post([]byte(`{"type":"selfAddress"}`)))
+	require.Equal(t, http.StatusBadRequest, post([]byte(`not JSON`)))
+}
+
+func TestBridgeRefusesCrossOriginRequests(t *testing.T) {
+	fakeNymClient, _, server := startBridge(t, bridge.BridgeConfig{})
+
+	msgBytes, e := lib.EncodeNymMessage(lib.NewNymSend("from a web page", fakeNymClient.Address()))
+	require.NoError(t, e)
+	post := func(contentType string, origin string) int {
+		request, e := http.NewRequest(http.MethodPost, server.URL+"/send", bytes.NewReader(msgBytes))
+		require.NoError(t, e)
+		request.Header.Set("Content-Type", contentType)
+		if 0 != len(origin) {
+			request.Header.Set("Origin", origin)
+		}
+		response, e := http.DefaultClient.Do(request)
+		require.NoError(t, e)
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	// What web pages can send to another origin without preflight
+	require.Equal(t, http.StatusUnsupportedMediaType, post("text/plain", ""))
+	require.Equal(t, http.StatusForbidden, post("application/json", "https://example.com"))
+	require.Equal(t, http.StatusAccepted, post("application/json; charset=utf-8", server.URL))
+
+	_, _, e = websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws",
+		http.Header{"Origin": []string{"https://example.com"}})
+	require.Error(t, e)
+}
+
+func TestBridgeRefusesReboundHosts(t *testing.T) {
+	_, _, server := startBridge(t, bridge.BridgeConfig{AllowedHosts: []string{"bridge.example"}})
+
+	get := func(host string) int {
+		request, e := http.NewRequest(http.MethodGet, server.URL+"/address", nil)
+		require.NoError(t, e)
+		request.Host = host
+		// The page of the rebound host name is its own origin
+		request.Header.Set("Origin", "http://"+host)
+		response, e := http.DefaultClient.Do(request)
+		require.NoError(t, e)
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	require.Equal(t, http.StatusForbidden, get("attacker.example:9000"))
+	require.Equal(t, http.StatusOK, get("localhost:9000"))
+	require.Equal(t, http.StatusOK, get("[::1]:9000"))
+	require.Equal(t, http.StatusOK, get("bridge.example"))
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+)
+
+/*
+ * nymbench measures a NymSocketManager sending messages to its own address:
+ *
+ *	nymbench --messages 10000 --size 256 --concurrency 4     # against an in-process fake nym-client
+ *	nymbench --uri ws://127.0.0.1:1977 --messages 100        # against a real one, through the mixnet
+ *
+ * It reports as JSON the send throughput, the latency until the messages are dispatched back to the
+ * messageHandler, the number of goroutines and the allocations per message. With the fake nym-client, the
+ * allocations of the fake are counted as well.
+ */
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// payloadPrefix starts every message of the benchmark, followed by its sequence number
+const payloadPrefix = "nymbench:"
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+type config struct {
+	uri         string
+	messages    int
+	size        int
+	concurrency int
+	timeout     time.Duration
+}
+
+type latencies struct {
+	MeanMs float64 `json:"meanMs"`
+	P50Ms  float64 `json:"p50Ms"`
+	P90Ms  float64 `json:"p90Ms"`
+	P99Ms  float64 `json:"p99Ms"`
+	MaxMs  float64 `json:"maxMs"`
+}
+
+type goroutines struct {
+	Before int `json:"before"`
+	Peak   int `json:"peak"`
+	After  int `json:"after"`
+}
+
+type result struct {
+	// URI of the nym-client, "fake" for the in-process one
+	Target      string `json:"target"`
+	Messages    int    `json:"messages"`
+	Size        int    `json:"size"`
+	Concurrency int    `json:"concurrency"`
+
+	Received int `json:"received"`
+	Lost     int `json:"lost"`
+
+	SendSeconds       float64 `json:"sendSeconds"`
+	SendThroughput    float64 `json:"sendThroughput"`
+	ReceiveThroughput float64 `json:"receiveThroughput"`
+
+	Latency    latencies  `json:"latency"`
+	Goroutines goroutines `json:"goroutines"`
+
+	AllocsPerMessage float64 `json:"allocsPerMessage"`
+	BytesPerMessage  float64 `json:"bytesPerMessage"`
+}
+
+// run executes the benchmark described by args and returns the exit code
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("nymbench", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	uri := flags.String("uri", "", "websocket URI of the nym-client, an in-process fake one is used if empty")
+	messages := flags.Int("messages", 1000, "number of messages to send")
+	size := flags.Int("size", 256, "size of the messages in bytes")
+	concurrency := flags.Int("concurrency", 1, "number of goroutines sending")
+	timeout := flags.Duration("timeout", 30*time.Second, "time to wait for the messages to come back")
+	output := flags.String("output", outputJSON, "output format: json or text")
+	verbose := flags.Bool("verbose", false, "log the activity of the NymSocketManager on stderr")
+
+	e := flags.Parse(args)
+	if nil != e {
+		return 2
+	}
+
+	if outputText != *output && outputJSON != *output {
+		fmt.Fprintf(stderr, "unknown output format %v\n", *output)
+		return 2
+	}
+
+	level := zerolog.WarnLevel
+	if *verbose {
+		level = zerolog.DebugLevel
+	}
+	logger := zerolog.New(zerolog.ConsoleWriter{
+		Out:        stderr,
+		TimeFormat: time.RFC3339,
+	}).Level(level).
+		With().Timestamp().Logger()
+
+	r, e := benchmark(config{
+		uri:         *uri,
+		messages:    *messages,
+		size:        *size,
+		concurrency: *concurrency,
+		timeout:     *timeout,
+	}, &logger)
+	if nil != e {
+		fmt.Fprintf(stderr, "nymbench: %v\n", e)
+		return 1
+	}
+
+	if outputJSON == *output {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(r)
+	} else {
+		printText(stdout, r)
+	}
+
+	if 0 != r.Lost {
+		return 1
+	}
+	return 0
+}
+
+func benchmark(c config, logger *zerolog.Logger) (result, error) {
+	if c.messages <= 0 || c.concurrency <= 0 {
+		return result{}, xerrors.Errorf("messages and concurrency need to be positive")
+	}
+
+	if c.size < len(payloadPrefix)+len(strconv.Itoa(c.messages))+1 {
+		return result{}, xerrors.Errorf("size needs to be at least %d bytes", len(payloadPrefix)+len(strconv.Itoa(c.messages))+1)
+	}
+
+	r := result{
+		Target:      c.uri,
+		Messages:    c.messages,
+		Size:        c.size,
+		Concurrency: c.concurrency,
+	}
+
+	if 0 == len(c.uri) {
+		fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+		defer fakeNymClient.Close()
+		c.uri = fakeNymClient.URI()
+		r.Target = "fake"
+	}
+
+	// Send times in UnixNano, indexed by sequence number
+	sentAt := make([]int64, c.messages)
+
+	receivedMutex := sync.Mutex{}
+	received := make([]bool, c.messages)
+	measured := make([]time.Duration, 0, c.messages)
+	allReceived := make(chan struct{})
+
+	nymSocketManager, e := lib.NewNymSocketManager(c.uri, func(msg lib.NymReceived, _ func(lib.NymMessage) error) {
+		now := time.Now()
+
+		seq, ok := parsePayload(msg.Message)
+		if !ok || c.messages <= seq {
+			return
+		}
+
+		receivedMutex.Lock()
+		defer receivedMutex.Unlock()
+		if received[seq] {
+			return
+		}
+		received[seq] = true
+		measured = append(measured, now.Sub(time.Unix(0, atomic.LoadInt64(&sentAt[seq]))))
+		if len(measured) == c.messages {
+			close(allReceived)
+		}
+	}, logger)
+	if nil != e {
+		return result{}, e
+	}
+
+	stopped, e := nymSocketManager.Start()
+	if nil != e {
+		return result{}, e
+	}
+	defer nymSocketManager.Stop()
+
+	self := nymSocketManager.GetNymClientId()
+	padding := strings.Repeat("x", c.size)
+
+	runtime.GC()
+	r.Goroutines.Before = runtime.NumGoroutine()
+	before := runtime.MemStats{}
+	runtime.ReadMemStats(&before)
+
+	sampling := make(chan struct{})
+	samplingDone := make(chan int)
+	go sampleGoroutines(sampling, samplingDone)
+
+	// Sending
+	next := int64(-1)
+	sendErrors := make(chan error, c.concurrency)
+	wg := sync.WaitGroup{}
+	start := time.Now()
+	for i := 0; i < c.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				seq := int(atomic.AddInt64(&next, 1))
+				if c.messages <= seq {
+					return
+				}
+
+				payload := payloadPrefix + strconv.Itoa(seq) + ":"
+				payload += padding[:c.size-len(payload)]
+
+				atomic.StoreInt64(&sentAt[seq], time.Now().UnixNano())
+				e := nymSocketManager.Send(lib.NewNymSend(payload, self))
+				if nil != e {
+					sendErrors <- e
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	sendDuration := time.Since(start)
+
+	select {
+	case e := <-sendErrors:
+		close(sampling)
+		<-samplingDone
+		return result{}, xerrors.Errorf("failed to send: %v", e)
+	default:
+	}
+
+	// Receiving
+	select {
+	case <-allReceived:
+	case <-stopped:
+	case <-time.After(c.timeout):
+	}
+	receiveDuration := time.Since(start)
+
+	after := runtime.MemStats{}
+	runtime.ReadMemStats(&after)
+	close(sampling)
+	r.Goroutines.Peak = <-samplingDone
+
+	receivedMutex.Lock()
+	sort.Slice(measured, func(i, j int) bool { return measured[i] < measured[j] })
+	r.Received = len(measured)
+	r.Latency = summarize(measured)
+	receivedMutex.Unlock()
+
+	r.Lost = c.messages - r.Received
+	r.SendSeconds = sendDuration.Seconds()
+	r.SendThroughput = float64(c.messages) / sendDuration.Seconds()
+	r.ReceiveThroughput = float64(r.Received) / receiveDuration.Seconds()
+	r.AllocsPerMessage = float64(after.Mallocs-before.Mallocs) / float64(c.messages)
+	r.BytesPerMessage = float64(after.TotalAlloc-before.TotalAlloc) / float64(c.messages)
+
+	nymSocketManager.Stop()
+	r.Goroutines.After = runtime.NumGoroutine()
+
+	return r, nil
+}
+
+// parsePayload returns the sequence number of a message of the benchmark
+func parsePayload(message string) (int, bool) {
+	rest, ok := strings.CutPrefix(message, payloadPrefix)
+	if !ok {
+		return 0, false
+	}
+	seq, _, ok := strings.Cut(rest, ":")
+	if !ok {
+		return 0, false
+	}
+	n, e := strconv.Atoi(seq)
+	return n, nil == e
+}
+
+// sampleGoroutines returns on done the highest number of goroutines seen until stop is closed
+func sampleGoroutines(stop chan struct{}, done chan int) {
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+
+	peak := runtime.NumGoroutine()
+	for {
+		select {
+		case <-ticker.C:
+			if n := runtime.NumGoroutine(); peak < n {
+				peak = n
+			}
+		case <-stop:
+			done <- peak
+			return
+		}
+	}
+}
+
+// summarize computes the statistics of sorted
+func summarize(sorted []time.Duration) latencies {
+	if 0 == len(sorted) {
+		return latencies{}
+	}
+
+	total := time.Duration(0)
+	for _, d := range sorted {
+		total += d
+	}
+
+	percentile := func(p float64) float64 {
+		index := int(math.Ceil(p*float64(len(sorted)))) - 1
+		if index < 0 {
+			index = 0
+		}
+		return milliseconds(sorted[index])
+	}
+
+	return latencies{
+		MeanMs: milliseconds(total / time.Duration(len(sorted))),
+		P50Ms:  percentile(0.5),
+		P90Ms:  percentile(0.9),
+		P99Ms:  percentile(0.99),
+		MaxMs:  milliseconds(sorted[len(sorted)-1]),
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func printText(w io.Writer, r result) {
+	fmt.Fprintf(w, "target:       %v\n", r.Target)
+	fmt.Fprintf(w, "messages:     %d of %d bytes, %d sending goroutines\n", r.Messages, r.Size, r.Concurrency)
+	fmt.Fprintf(w, "received:     %d (%d lost)\n", r.Received, r.Lost)
+	fmt.Fprintf(w, "send:         %.0f msg/s (%.3fs)\n", r.SendThroughput, r.SendSeconds)
+	fmt.Fprintf(w, "receive:      %.0f msg/s\n", r.ReceiveThroughput)
+	fmt.Fprintf(w, "latency:      mean %.3fms, p50 %.3fms, p90 %.3fms, p99 %.3fms, max %.3fms\n",
+		r.Latency.MeanMs, r.Latency.P50Ms, r.Latency.P90Ms, r.Latency.P99Ms, r.Latency.MaxMs)
+	fmt.Fprintf(w, "goroutines:   %d before, %d peak, %d after\n", r.Goroutines.Before, r.Goroutines.Peak, r.Goroutines.After)
+	fmt.Fprintf(w, "allocations:  %.1f allocs/msg, %.0f B/msg\n", r.AllocsPerMessage, r.BytesPerMessage)
+}
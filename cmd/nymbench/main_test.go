@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunRejectsInvalidArguments(t *testing.T) {
+	stderr := &bytes.Buffer{}
+
+	require.Equal(t, 2, run([]string{"--unknown"}, &bytes.Buffer{}, stderr))
+	require.Equal(t, 2, run([]string{"--output", "xml"}, &bytes.Buffer{}, stderr))
+	require.Equal(t, 1, run([]string{"--messages", "0"}, &bytes.Buffer{}, stderr))
+	require.Equal(t, 1, run([]string{"--size", "4"}, &bytes.Buffer{}, stderr))
+	require.Equal(t, 1, run([]string{"--uri", "ws://127.0.0.1:1"}, &bytes.Buffer{}, stderr))
+}
+
+func TestRunReportsJSON(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	require.Equal(t, 0, run([]string{"--messages", "200", "--concurrency", "2", "--timeout", "5s"}, stdout, &bytes.Buffer{}))
+
+	r := result{}
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &r))
+	require.Equal(t, "fake", r.Target)
+	require.Equal(t, 200, r.Received)
+	require.Equal(t, 0, r.Lost)
+	require.Positive(t, r.SendThroughput)
+	require.LessOrEqual(t, r.Latency.P50Ms, r.Latency.P99Ms)
+	require.LessOrEqual(t, r.Latency.P99Ms, r.Latency.MaxMs)
+	require.Positive(t, r.Goroutines.Peak)
+	require.Positive(t, r.AllocsPerMessage)
+}
+
+func TestSummarizeComputesPercentiles(t *testing.T) {
+	sorted := []time.Duration{}
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+
+	l := summarize(sorted)
+	require.Equal(t, 50.5, l.MeanMs)
+	require.Equal(t, 50.0, l.P50Ms)
+	require.Equal(t, 90.0, l.P90Ms)
+	require.Equal(t, 99.0, l.P99Ms)
+	require.Equal(t, 100.0, l.MaxMs)
+	require.Equal(t, latencies{}, summarize(nil))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+
+	"github.com/notrustverify/nymsocketmanager/bridge"
+)
+
+/*
+ * nymbridge shares nym-clients with the local applications which cannot embed NymSocketManager:
+ *
+ *	nymbridge --uri ws://127.0.0.1:1977 --listen 127.0.0.1:9000 --token secret
+ *
+ * Applications then connect to ws://127.0.0.1:9000/ws?token=secret, see the bridge package for the API.
+ */
+
+const defaultNymClientURI = "ws://127.0.0.1:1977"
+
+func main() {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr, interrupt))
+}
+
+// run starts the bridge described by args and returns the exit code once it stops
+func run(args []string, stdout io.Writer, stderr io.Writer, interrupt <-chan os.Signal) int {
+	flags := flag.NewFlagSet("nymbridge", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	uris := flags.String("uri", defaultNymClientURI, "comma separated websocket URIs of the nym-clients")
+	listen := flags.String("listen", "127.0.0.1:9000", "local address of the HTTP API")
+	token := flags.String("token", "", "token the applications need to present (optional)")
+	allowHosts := flags.String("allow-hosts", "", "comma separated host names of the HTTP API, besides localhost and IP addresses (optional)")
+	buffer := flags.Int("buffer", bridge.DefaultSubscriberBuffer, "received messages queued per application before dropping")
+	verbose := flags.Bool("verbose", false, "log the activity of the bridge on stderr")
+
+	e := flags.Parse(args)
+	if nil != e {
+		return 2
+	}
+
+	level := zerolog.InfoLevel
+	if *verbose {
+		level = zerolog.DebugLevel
+	}
+	logger := zerolog.New(zerolog.ConsoleWriter{
+		Out:        stderr,
+		TimeFormat: time.RFC3339,
+	}).Level(level).
+		With().Timestamp().Logger()
+
+	config := bridge.BridgeConfig{Token: *token, SubscriberBuffer: *buffer}
+	if 0 != len(*allowHosts) {
+		config.AllowedHosts = strings.Split(*allowHosts, ",")
+	}
+
+	e = serve(strings.Split(*uris, ","), *listen, config, stdout, interrupt, &logger)
+	if nil != e {
+		fmt.Fprintf(stderr, "nymbridge: %v\n", e)
+		return 1
+	}
+	return 0
+}
+
+func serve(uris []string, listen string, config bridge.BridgeConfig, stdout io.Writer, interrupt <-chan os.Signal, logger *zerolog.Logger) error {
+	b, e := bridge.NewBridge(uris, config, logger)
+	if nil != e {
+		return e
+	}
+
+	stopped, e := b.Start()
+	if nil != e {
+		return xerrors.Errorf("failed to connect to the nym-clients: %v", e)
+	}
+	defer b.Stop()
+
+	listener, e := net.Listen("tcp", listen)
+	if nil != e {
+		return e
+	}
+
+	server := &http.Server{Handler: b}
+	defer server.Close()
+	go func() {
+		e := server.Serve(listener)
+		logger.Debug().Msgf("stopped serving the HTTP API: %v", e)
+	}()
+
+	fmt.Fprintf(stdout, "bridging %v on %v\n", b.Pool().GetNymClientIds(), listener.Addr())
+
+	select {
+	case <-stopped:
+		return xerrors.Errorf("the nym-clients stopped")
+	case <-interrupt:
+	}
+	return nil
+}
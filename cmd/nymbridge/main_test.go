@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunRejectsInvalidArguments(t *testing.T) {
+	stderr := &bytes.Buffer{}
+
+	require.Equal(t, 2, run([]string{"--unknown"}, &bytes.Buffer{}, stderr, nil))
+	require.Equal(t, 1, run([]string{"--buffer", "-1"}, &bytes.Buffer{}, stderr, nil))
+	require.Equal(t, 1, run([]string{"--uri", "ws://127.0.0.1:1", "--listen", "127.0.0.1:0"}, &bytes.Buffer{}, stderr, nil))
+}
+
+func TestRunUntilInterrupted(t *testing.T) {
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer fakeNymClient.Close()
+
+	stdout := &bytes.Buffer{}
+	interrupt := make(chan os.Signal, 1)
+	interrupt <- os.Interrupt
+
+	args := []string{"--uri", fakeNymClient.URI(), "--listen", "127.0.0.1:0"}
+	require.Equal(t, 0, run(args, stdout, &bytes.Buffer{}, interrupt))
+	require.True(t, strings.Contains(stdout.String(), fakeNymClient.Address().String()))
+	require.Eventually(t, func() bool { return 0 == fakeNymClient.ConnectionCount() }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+)
+
+/*
+ * nymctl interacts with a nym-client from the command line:
+ *
+ *	nymctl address
+ *	echo "hello" | nymctl send <recipient>
+ *	echo "hello" | nymctl send-anon --surbs 5 <recipient>
+ *	nymctl listen
+ *	nymctl echo
+ */
+
+const defaultNymClientURI = "ws://127.0.0.1:1977"
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+const usage = `Usage: nymctl [flags] <command> [arguments]
+
+Commands:
+  address                       print the address of the nym-client and its gateway
+  send <recipient>              send stdin to recipient
+  send-anon [--surbs N] <recipient>
+                                send stdin to recipient anonymously, along with N reply SURBs
+  listen                        print the received messages until interrupted
+  echo                          reply the received messages to their sender until interrupted
+
+Flags:
+`
+
+func main() {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr, interrupt))
+}
+
+// nymctl holds what the commands share
+type nymctl struct {
+	uri    string
+	output string
+	logger *zerolog.Logger
+
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	// Serializes the writes to stdout, messages being printed from the handler
+	stdoutMutex sync.Mutex
+
+	interrupt <-chan os.Signal
+}
+
+// run executes the command described by args and returns the exit code
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer, interrupt <-chan os.Signal) int {
+	flags := flag.NewFlagSet("nymctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+
+	uri := flags.String("uri", defaultNymClientURI, "websocket URI of the nym-client")
+	output := flags.String("output", outputText, "output format: text or json")
+	verbose := flags.Bool("verbose", false, "log the activity of the NymSocketManager on stderr")
+
+	e := flags.Parse(args)
+	if nil != e {
+		return 2
+	}
+
+	if outputText != *output && outputJSON != *output {
+		fmt.Fprintf(stderr, "unknown output format %v\n", *output)
+		return 2
+	}
+
+	if 0 == flags.NArg() {
+		flags.Usage()
+		return 2
+	}
+
+	level := zerolog.WarnLevel
+	if *verbose {
+		level = zerolog.DebugLevel
+	}
+	logger := zerolog.New(zerolog.ConsoleWriter{
+		Out:        stderr,
+		TimeFormat: time.RFC3339,
+	}).Level(level).
+		With().Timestamp().Logger()
+
+	c := &nymctl{
+		uri:       *uri,
+		output:    *output,
+		logger:    &logger,
+		stdin:     stdin,
+		stdout:    stdout,
+		stderr:    stderr,
+		interrupt: interrupt,
+	}
+
+	command, commandArgs := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "address":
+		e = c.address(commandArgs)
+	case "send":
+		e = c.send(commandArgs, false)
+	case "send-anon":
+		e = c.send(commandArgs, true)
+	case "listen":
+		e = c.listen(commandArgs, false)
+	case "echo":
+		e = c.listen(commandArgs, true)
+	default:
+		fmt.Fprintf(stderr, "unknown command %v\n", command)
+		flags.Usage()
+		return 2
+	}
+
+	if nil != e {
+		fmt.Fprintf(stderr, "nymctl %v: %v\n", command, e)
+		return 1
+	}
+	return 0
+}
+
+// start returns a started NymSocketManager, to be stopped by the caller
+func (c *nymctl) start(messageHandler func(lib.NymReceived, func(lib.NymMessage) error)) (*lib.NymSocketManager, chan struct{}, error) {
+	if nil == messageHandler {
+		messageHandler = func(lib.NymReceived, func(lib.NymMessage) error) {}
+	}
+
+	nymSocketManager, e := lib.NewNymSocketManager(c.uri, messageHandler, c.logger)
+	if nil != e {
+		return nil, nil, xerrors.Errorf("failed to create the NymSocketManager: %v", e)
+	}
+
+	stopped, e := nymSocketManager.Start()
+	if nil != e {
+		return nil, nil, xerrors.Errorf("failed to connect to the nym-client at %v: %v", c.uri, e)
+	}
+
+	return nymSocketManager, stopped, nil
+}
+
+func (c *nymctl) address(args []string) error {
+	if 0 != len(args) {
+		return xerrors.Errorf("unexpected arguments %v", args)
+	}
+
+	nymSocketManager, _, e := c.start(nil)
+	if nil != e {
+		return e
+	}
+	defer nymSocketManager.Stop()
+
+	address := nymSocketManager.GetNymClientId()
+	if outputJSON == c.output {
+		return c.printJSON(struct {
+			Address lib.NymAddress `json:"address"`
+			Gateway string         `json:"gateway"`
+		}{address, address.Gateway()})
+	}
+
+	c.printf("address: %v\ngateway: %v\n", address, address.Gateway())
+	return nil
+}
+
+func (c *nymctl) send(args []string, anonymous bool) error {
+	flags := flag.NewFlagSet("send", flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	surbs := flags.Uint("surbs", 10, "number of reply SURBs sent along the message (send-anon only)")
+
+	e := flags.Parse(args)
+	if nil != e {
+		return e
+	}
+	if 1 != flags.NArg() {
+		return xerrors.Errorf("expected exactly one recipient")
+	}
+
+	recipient, e := lib.ParseNymAddress(flags.Arg(0))
+	if nil != e {
+		return e
+	}
+
+	message, e := io.ReadAll(c.stdin)
+	if nil != e {
+		return xerrors.Errorf("failed to read stdin: %v", e)
+	}
+
+	var msg lib.NymMessage
+	if anonymous {
+		msg = lib.NewNymSendAnonymous(string(message), recipient, *surbs)
+	} else {
+		msg = lib.NewNymSend(string(message), recipient)
+	}
+
+	nymSocketManager, _, e := c.start(nil)
+	if nil != e {
+		return e
+	}
+	defer nymSocketManager.Stop()
+
+	e = nymSocketManager.Send(msg)
+	if nil != e {
+		return e
+	}
+
+	if outputJSON == c.output {
+		return c.printJSON(struct {
+			Recipient lib.NymAddress `json:"recipient"`
+			Bytes     int            `json:"bytes"`
+		}{recipient, len(message)})
+	}
+	c.printf("sent %d bytes to %v\n", len(message), recipient)
+	return nil
+}
+
+// listen prints the received messages until interrupted, replying them to their sender if echo is set
+func (c *nymctl) listen(args []string, echo bool) error {
+	if 0 != len(args) {
+		return xerrors.Errorf("unexpected arguments %v", args)
+	}
+
+	nymSocketManager, stopped, e := c.start(func(msg lib.NymReceived, send func(lib.NymMessage) error) {
+		c.printReceived(msg)
+
+		if echo && 0 != len(msg.SenderTag) {
+			e := send(lib.NewNymReply(msg.SenderTag, msg.Message))
+			if nil != e {
+				c.logger.Warn().Msgf("failed to reply to %v: %v", msg.SenderTag, e)
+			}
+		}
+	})
+	if nil != e {
+		return e
+	}
+
+	c.logger.Info().Msgf("listening on %v", nymSocketManager.GetNymClientId())
+
+	select {
+	case <-stopped:
+		return xerrors.Errorf("connection to the nym-client closed")
+	case <-c.interrupt:
+		nymSocketManager.Stop()
+	}
+	return nil
+}
+
+func (c *nymctl) printReceived(msg lib.NymReceived) {
+	if outputJSON == c.output {
+		e := c.printJSON(msg)
+		if nil != e {
+			c.logger.Warn().Msgf("failed to print message: %v", e)
+		}
+		return
+	}
+
+	if 0 != len(msg.SenderTag) {
+		c.printf("from %v: %v\n", msg.SenderTag, msg.Message)
+		return
+	}
+	c.printf("%v\n", msg.Message)
+}
+
+// printJSON prints v as a single JSON line
+func (c *nymctl) printJSON(v interface{}) error {
+	line, e := json.Marshal(v)
+	if nil != e {
+		return e
+	}
+
+	c.printf("%s\n", line)
+	return nil
+}
+
+func (c *nymctl) printf(format string, a ...interface{}) {
+	c.stdoutMutex.Lock()
+	defer c.stdoutMutex.Unlock()
+	fmt.Fprintf(c.stdout, format, a...)
+}
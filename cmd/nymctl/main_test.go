@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is a bytes.Buffer safe to read while being written
+type syncBuffer struct {
+	sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buffer.String()
+}
+
+func TestRunRejectsUnknownCommandsAndFormats(t *testing.T) {
+	stderr := &syncBuffer{}
+
+	require.Equal(t, 2, run([]string{}, nil, &syncBuffer{}, stderr, nil))
+	require.Equal(t, 2, run([]string{"unknown"}, nil, &syncBuffer{}, stderr, nil))
+	require.Equal(t, 2, run([]string{"--output", "yaml", "address"}, nil, &syncBuffer{}, stderr, nil))
+	require.Equal(t, 1, run([]string{"send", "not an address"}, nil, &syncBuffer{}, stderr, nil))
+}
+
+func TestAddress(t *testing.T) {
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer fakeNymClient.Close()
+
+	stdout := &syncBuffer{}
+	require.Equal(t, 0, run([]string{"--uri", fakeNymClient.URI(), "--output", "json", "address"}, nil, stdout, &syncBuffer{}, nil))
+
+	printed := struct {
+		Address string `json:"address"`
+		Gateway string `json:"gateway"`
+	}{}
+	require.NoError(t, json.Unmarshal([]byte(stdout.String()), &printed))
+	require.Equal(t, fakeNymClient.Address().String(), printed.Address)
+	require.Equal(t, fakeNymClient.Address().Gateway(), printed.Gateway)
+}
+
+func TestSendAnonReadsStdin(t *testing.T) {
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer fakeNymClient.Close()
+
+	recipient := nymtest.RandomNymAddress()
+	args := []string{"--uri", fakeNymClient.URI(), "send-anon", "--surbs", "3", recipient.String()}
+	require.Equal(t, 0, run(args, strings.NewReader("hello"), &syncBuffer{}, &syncBuffer{}, nil))
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case msg := <-fakeNymClient.Requests():
+			if _, ok := msg.(lib.NymSendAnonymous); !ok {
+				continue
+			}
+			require.Equal(t, lib.NewNymSendAnonymous("hello", recipient, 3), msg)
+			return
+		case <-timeout:
+			require.Fail(t, "message not sent")
+			return
+		}
+	}
+}
+
+func TestEchoPrintsAndRepliesUntilInterrupted(t *testing.T) {
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer fakeNymClient.Close()
+
+	stdout := &syncBuffer{}
+	interrupt := make(chan os.Signal)
+	exitCode := make(chan int)
+	go func() {
+		exitCode <- run([]string{"--uri", fakeNymClient.URI(), "--output", "json", "echo"}, nil, stdout, &syncBuffer{}, interrupt)
+	}()
+
+	require.Eventually(t, func() bool { return 1 == fakeNymClient.ConnectionCount() }, time.Second, 10*time.Millisecond)
+	require.NoError(t, fakeNymClient.Push(lib.NewNymReceived("ping", "senderTag")))
+
+	require.Eventually(t, func() bool { return strings.Contains(stdout.String(), "ping") }, time.Second, 10*time.Millisecond)
+	printed := lib.NymReceived{}
+	require.NoError(t, json.Unmarshal([]byte(stdout.String()), &printed))
+	require.Equal(t, lib.NewNymReceived("ping", "senderTag"), printed)
+
+	timeout := time.After(time.Second)
+	for replied := false; !replied; {
+		select {
+		case msg := <-fakeNymClient.Requests():
+			if reply, ok := msg.(lib.NymReply); ok {
+				require.Equal(t, lib.NewNymReply("senderTag", "ping"), reply)
+				replied = true
+			}
+		case <-timeout:
+			require.Fail(t, "message not replied")
+			return
+		}
+	}
+
+	close(interrupt)
+	require.Equal(t, 0, <-exitCode)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/socks5"
+	"github.com/notrustverify/nymsocketmanager/tunnel"
+)
+
+/*
+ * nymtunnel forwards a TCP port over the mixnet:
+ *
+ *	nymtunnel serve --target 127.0.0.1:22                          # on the machine of the service
+ *	nymtunnel connect --server <address> --listen 127.0.0.1:2222   # on the machine reaching it
+ *
+ * or offers a SOCKS5 proxy whose connections leave the mixnet at an exit:
+ *
+ *	nymtunnel exit --allow "*.example.com:443,10.0.0.0/8"          # on the exit machine
+ *	nymtunnel socks --exit <address> --listen 127.0.0.1:1080       # on the machine of the SOCKS5 clients
+ */
+
+const defaultNymClientURI = "ws://127.0.0.1:1977"
+
+const usage = `Usage: nymtunnel [flags] <command> [arguments]
+
+Commands:
+  serve --target <host:port>                     expose the TCP service at target through the nym-client
+  connect --server <address> --listen <host:port>
+                                                 tunnel the connections accepted on listen to the server
+  exit --allow <patterns>                        dial the targets requested by SOCKS5 proxies, within the allowlist
+  socks --exit <address> --listen <host:port>    run a SOCKS5 proxy whose connections leave through the exit
+
+Flags:
+`
+
+func main() {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr, interrupt))
+}
+
+// run executes the command described by args and returns the exit code
+func run(args []string, stdout io.Writer, stderr io.Writer, interrupt <-chan os.Signal) int {
+	flags := flag.NewFlagSet("nymtunnel", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+
+	uri := flags.String("uri", defaultNymClientURI, "websocket URI of the nym-client")
+	verbose := flags.Bool("verbose", false, "log the activity of the tunnel on stderr")
+
+	e := flags.Parse(args)
+	if nil != e {
+		return 2
+	}
+
+	if 0 == flags.NArg() {
+		flags.Usage()
+		return 2
+	}
+
+	level := zerolog.InfoLevel
+	if *verbose {
+		level = zerolog.DebugLevel
+	}
+	logger := zerolog.New(zerolog.ConsoleWriter{
+		Out:        stderr,
+		TimeFormat: time.RFC3339,
+	}).Level(level).
+		With().Timestamp().Logger()
+
+	command, commandArgs := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "serve":
+		e = serve(*uri, commandArgs, stdout, stderr, interrupt, &logger)
+	case "connect":
+		e = connect(*uri, commandArgs, stdout, stderr, interrupt, &logger)
+	case "exit":
+		e = exit(*uri, commandArgs, stdout, stderr, interrupt, &logger)
+	case "socks":
+		e = socks(*uri, commandArgs, stdout, stderr, interrupt, &logger)
+	default:
+		fmt.Fprintf(stderr, "unknown command %v\n", command)
+		flags.Usage()
+		return 2
+	}
+
+	if nil != e {
+		fmt.Fprintf(stderr, "nymtunnel %v: %v\n", command, e)
+		return 1
+	}
+	return 0
+}
+
+func serve(uri string, args []string, stdout io.Writer, stderr io.Writer, interrupt <-chan os.Signal, logger *zerolog.Logger) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	target := flags.String("target", "", "TCP address of the service to expose")
+	window := flags.Uint64("window", tunnel.DefaultWindow, "frames in flight per stream")
+
+	e := flags.Parse(args)
+	if nil != e {
+		return e
+	}
+
+	server, e := tunnel.NewServer(tunnel.ServerConfig{Target: *target, Window: *window}, logger)
+	if nil != e {
+		return e
+	}
+	defer server.Close()
+
+	nymSocketManager, stopped, e := start(uri, server.Handle, logger)
+	if nil != e {
+		return e
+	}
+
+	fmt.Fprintf(stdout, "exposing %v on %v\n", *target, nymSocketManager.GetNymClientId())
+
+	return wait(nymSocketManager, stopped, interrupt)
+}
+
+func connect(uri string, args []string, stdout io.Writer, stderr io.Writer, interrupt <-chan os.Signal, logger *zerolog.Logger) error {
+	flags := flag.NewFlagSet("connect", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	serverAddress := flags.String("server", "", "Nym address of the nymtunnel server")
+	listen := flags.String("listen", "127.0.0.1:0", "local TCP address to accept connections on")
+	window := flags.Uint64("window", tunnel.DefaultWindow, "frames in flight per stream")
+	surbs := flags.Uint("surbs", tunnel.DefaultSurbsPerFrame, "reply SURBs attached to every frame")
+
+	e := flags.Parse(args)
+	if nil != e {
+		return e
+	}
+
+	server, e := lib.ParseNymAddress(*serverAddress)
+	if nil != e {
+		return e
+	}
+
+	client, e := tunnel.NewClient(server, tunnel.ClientConfig{SurbsPerFrame: *surbs, Window: *window}, logger)
+	if nil != e {
+		return e
+	}
+	defer client.Close()
+
+	listener, e := net.Listen("tcp", *listen)
+	if nil != e {
+		return e
+	}
+	defer listener.Close()
+
+	nymSocketManager, stopped, e := start(uri, client.Handle, logger)
+	if nil != e {
+		return e
+	}
+	client.SetSender(nymSocketManager.Send)
+
+	go func() {
+		e := client.Serve(listener)
+		logger.Debug().Msgf("stopped accepting connections: %v", e)
+	}()
+
+	fmt.Fprintf(stdout, "tunnelling %v to %v\n", listener.Addr(), server)
+
+	return wait(nymSocketManager, stopped, interrupt)
+}
+
+func exit(uri string, args []string, stdout io.Writer, stderr io.Writer, interrupt <-chan os.Signal, logger *zerolog.Logger) error {
+	flags := flag.NewFlagSet("exit", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	allow := flags.String("allow", "", "comma separated patterns of the targets allowed, \"*\" for any")
+	token := flags.String("token", "", "token the SOCKS5 proxies need to present (optional)")
+	idleTimeout := flags.Duration("idle-timeout", tunnel.DefaultServerIdleTimeout, "reset streams idle for this long")
+
+	e := flags.Parse(args)
+	if nil != e {
+		return e
+	}
+
+	exit, e := socks5.NewExit(socks5.ExitConfig{
+		Allow:  splitList(*allow),
+		Tunnel: tunnel.ServerConfig{Token: *token, IdleTimeout: *idleTimeout},
+	}, logger)
+	if nil != e {
+		return e
+	}
+	defer exit.Close()
+
+	nymSocketManager, stopped, e := start(uri, exit.Handle, logger)
+	if nil != e {
+		return e
+	}
+
+	fmt.Fprintf(stdout, "exit running on %v\n", nymSocketManager.GetNymClientId())
+
+	return wait(nymSocketManager, stopped, interrupt)
+}
+
+func socks(uri string, args []string, stdout io.Writer, stderr io.Writer, interrupt <-chan os.Signal, logger *zerolog.Logger) error {
+	flags := flag.NewFlagSet("socks", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	exitAddress := flags.String("exit", "", "Nym address of the nymtunnel exit")
+	listen := flags.String("listen", "127.0.0.1:1080", "local TCP address of the SOCKS5 proxy")
+	users := flags.String("users", "", "comma separated user:password pairs SOCKS5 clients authenticate with (optional)")
+	token := flags.String("token", "", "token presented to the exit (optional)")
+	idleTimeout := flags.Duration("idle-timeout", 0, "reset streams idle for this long (optional)")
+
+	e := flags.Parse(args)
+	if nil != e {
+		return e
+	}
+
+	exit, e := lib.ParseNymAddress(*exitAddress)
+	if nil != e {
+		return e
+	}
+
+	credentials := make(map[string]string)
+	for _, user := range splitList(*users) {
+		username, password, ok := strings.Cut(user, ":")
+		if !ok {
+			return xerrors.Errorf("invalid user %v, expected user:password", user)
+		}
+		credentials[username] = password
+	}
+
+	server, e := socks5.NewServer(exit, socks5.ServerConfig{
+		Users:  credentials,
+		Tunnel: tunnel.ClientConfig{Token: *token, IdleTimeout: *idleTimeout},
+	}, logger)
+	if nil != e {
+		return e
+	}
+	defer server.Close()
+
+	listener, e := net.Listen("tcp", *listen)
+	if nil != e {
+		return e
+	}
+	defer listener.Close()
+
+	nymSocketManager, stopped, e := start(uri, server.Handle, logger)
+	if nil != e {
+		return e
+	}
+	server.SetSender(nymSocketManager.Send)
+
+	go func() {
+		e := server.Serve(listener)
+		logger.Debug().Msgf("stopped accepting connections: %v", e)
+	}()
+
+	fmt.Fprintf(stdout, "SOCKS5 proxy on %v exiting through %v\n", listener.Addr(), exit)
+
+	return wait(nymSocketManager, stopped, interrupt)
+}
+
+// splitList splits a comma separated list, ignoring empty elements
+func splitList(list string) []string {
+	elements := []string{}
+	for _, element := range strings.Split(list, ",") {
+		if element = strings.TrimSpace(element); 0 != len(element) {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+func start(uri string, messageHandler func(lib.NymReceived, func(lib.NymMessage) error), logger *zerolog.Logger) (*lib.NymSocketManager, chan struct{}, error) {
+	nymSocketManager, e := lib.NewNymSocketManager(uri, messageHandler, logger)
+	if nil != e {
+		return nil, nil, xerrors.Errorf("failed to create the NymSocketManager: %v", e)
+	}
+
+	stopped, e := nymSocketManager.Start()
+	if nil != e {
+		return nil, nil, xerrors.Errorf("failed to connect to the nym-client at %v: %v", uri, e)
+	}
+
+	return nymSocketManager, stopped, nil
+}
+
+// wait blocks until interrupted or the connection to the nym-client closes
+func wait(nymSocketManager *lib.NymSocketManager, stopped chan struct{}, interrupt <-chan os.Signal) error {
+	select {
+	case <-stopped:
+		return xerrors.Errorf("connection to the nym-client closed")
+	case <-interrupt:
+		nymSocketManager.Stop()
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunRejectsInvalidArguments(t *testing.T) {
+	stderr := &bytes.Buffer{}
+
+	require.Equal(t, 2, run([]string{}, &bytes.Buffer{}, stderr, nil))
+	require.Equal(t, 2, run([]string{"unknown"}, &bytes.Buffer{}, stderr, nil))
+	require.Equal(t, 1, run([]string{"serve"}, &bytes.Buffer{}, stderr, nil))
+	require.Equal(t, 1, run([]string{"connect", "--server", "not an address"}, &bytes.Buffer{}, stderr, nil))
+	require.Equal(t, 1, run([]string{"exit"}, &bytes.Buffer{}, stderr, nil))
+	require.Equal(t, 1, run([]string{"socks", "--exit", nymtest.RandomNymAddress().String(), "--users", "nopassword"}, &bytes.Buffer{}, stderr, nil))
+}
+
+func TestServeUntilInterrupted(t *testing.T) {
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer fakeNymClient.Close()
+
+	stdout := &bytes.Buffer{}
+	interrupt := make(chan os.Signal, 1)
+	interrupt <- os.Interrupt
+
+	args := []string{"--uri", fakeNymClient.URI(), "serve", "--target", "127.0.0.1:1"}
+	require.Equal(t, 0, run(args, stdout, &bytes.Buffer{}, interrupt))
+	require.True(t, strings.Contains(stdout.String(), fakeNymClient.Address().String()))
+	require.Eventually(t, func() bool { return 0 == fakeNymClient.ConnectionCount() }, time.Second, 10*time.Millisecond)
+}
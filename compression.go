@@ -0,0 +1,231 @@
+package nymsocketmanager
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * The NymCompressor transparently compresses the payloads of outgoing messages to save mixnet packets.
+ * Compressed payloads are wrapped in a JSON envelope naming the algorithm, so receivers using a NymCompressor detect
+ * and decompress them whatever algorithm they are configured with. Payloads that are not envelopes are given as is
+ * to the messageHandler, so peers not compressing can still be talked to.
+ *
+ *	nymSocketManager.UseCompression(CompressionConfig{Algorithm: CompressionZstd})
+ *
+ * When combined with the NymSecureLayer, the NymSecureLayer needs to be registered first so that payloads are
+ * compressed before being encrypted.
+ */
+
+type CompressionAlgorithm string
+
+const (
+	CompressionGzip CompressionAlgorithm = "gzip"
+	CompressionZstd CompressionAlgorithm = "zstd"
+)
+
+const (
+	// DefaultCompressionThreshold is the payload size (in bytes) under which compression is skipped
+	DefaultCompressionThreshold = 512
+	// DefaultMaxDecompressedSize is the size (in bytes) over which received payloads are dropped
+	DefaultMaxDecompressedSize = 16 * 1024 * 1024
+)
+
+type CompressionConfig struct {
+	// Algorithm used for outgoing payloads. Defaults to CompressionGzip.
+	Algorithm CompressionAlgorithm
+	// Payloads smaller than Threshold are sent uncompressed. Defaults to DefaultCompressionThreshold.
+	Threshold int
+	// Decompressed payloads bigger than MaxDecompressedSize are dropped. Defaults to DefaultMaxDecompressedSize.
+	MaxDecompressedSize int64
+}
+
+func NewNymCompressor(config CompressionConfig, parentLogger *zerolog.Logger) (*NymCompressor, error) {
+	if 0 == len(config.Algorithm) {
+		config.Algorithm = CompressionGzip
+	}
+	if CompressionGzip != config.Algorithm && CompressionZstd != config.Algorithm {
+		err := xerrors.Errorf("unknown compression algorithm %v", config.Algorithm)
+		return nil, err
+	}
+
+	if config.Threshold < 0 || config.MaxDecompressedSize < 0 {
+		err := xerrors.Errorf("threshold and maximum decompressed size cannot be negative")
+		return nil, err
+	}
+
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	if 0 == config.Threshold {
+		config.Threshold = DefaultCompressionThreshold
+	}
+	if 0 == config.MaxDecompressedSize {
+		config.MaxDecompressedSize = DefaultMaxDecompressedSize
+	}
+
+	// EncodeAll can be used concurrently
+	zstdEncoder, e := zstd.NewWriter(nil)
+	if nil != e {
+		err := xerrors.Errorf("failed to create zstd encoder: %v", e)
+		return nil, err
+	}
+
+	localLogger := parentLogger.With().Str(ComponentField, "NymCompressor").Logger()
+
+	return &NymCompressor{
+		config:      config,
+		zstdEncoder: zstdEncoder,
+		logger:      &localLogger,
+	}, nil
+}
+
+type NymCompressor struct {
+	config      CompressionConfig
+	zstdEncoder *zstd.Encoder
+
+	logger *zerolog.Logger
+}
+
+// UseCompression creates a NymCompressor and registers it on both the received and sent messages of n
+func (n *NymSocketManager) UseCompression(config CompressionConfig) (*NymCompressor, error) {
+	compressor, e := NewNymCompressor(config, n.logger)
+	if nil != e {
+		return nil, e
+	}
+
+	n.Use(compressor.Middleware())
+	n.UseSend(compressor.SendMiddleware())
+	return compressor, nil
+}
+
+// compressedEnvelope is the JSON carried in the Message of compressed NymMessages
+type compressedEnvelope struct {
+	Algorithm CompressionAlgorithm `json:"nymCompressed"`
+	Data      []byte               `json:"data"`
+}
+
+// SendMiddleware compresses the payloads of outgoing messages above the threshold
+func (c *NymCompressor) SendMiddleware() NymSendMiddleware {
+	return func(next NymSender) NymSender {
+		return func(msg NymMessage) error {
+			payload, ok := GetPayload(msg)
+			if !ok {
+				return next(msg)
+			}
+
+			compressed, e := c.Compress(payload)
+			if nil != e {
+				c.logger.Warn().Msgf("failed to compress %v, sending it uncompressed: %v", msg.Name(), e)
+				return next(msg)
+			}
+
+			msg, _ = WithPayload(msg, compressed)
+			return next(msg)
+		}
+	}
+}
+
+// Middleware decompresses received envelopes before the rest of the chain
+func (c *NymCompressor) Middleware() NymMiddleware {
+	return func(next NymHandler) NymHandler {
+		return func(msg NymReceived, send func(NymMessage) error) {
+			payload, e := c.Decompress(msg.Message)
+			if nil != e {
+				c.logger.Warn().Msgf("dropping message from %v: %v", msg.SenderTag, e)
+				return
+			}
+
+			msg.Message = payload
+			next(msg, send)
+		}
+	}
+}
+
+// Compress returns the envelope of payload, or payload itself when under the threshold or when compressing would
+// not make it smaller
+func (c *NymCompressor) Compress(payload string) (string, error) {
+	if len(payload) < c.config.Threshold {
+		return payload, nil
+	}
+
+	var data []byte
+	switch c.config.Algorithm {
+	case CompressionZstd:
+		data = c.zstdEncoder.EncodeAll([]byte(payload), nil)
+	default:
+		buffer := bytes.Buffer{}
+		writer := gzip.NewWriter(&buffer)
+		_, e := writer.Write([]byte(payload))
+		if nil == e {
+			e = writer.Close()
+		}
+		if nil != e {
+			return "", xerrors.Errorf("failed to gzip payload: %v", e)
+		}
+		data = buffer.Bytes()
+	}
+
+	envelopeBytes, e := json.Marshal(compressedEnvelope{Algorithm: c.config.Algorithm, Data: data})
+	if nil != e {
+		return "", e
+	}
+
+	if len(envelopeBytes) >= len(payload) {
+		c.logger.Debug().Msg("compression would not save space, sending payload as is")
+		return payload, nil
+	}
+	return string(envelopeBytes), nil
+}
+
+// Decompress returns the payload held by the envelope, or message itself if it is not an envelope
+func (c *NymCompressor) Decompress(message string) (string, error) {
+	envelope := compressedEnvelope{}
+	e := json.Unmarshal([]byte(message), &envelope)
+	if nil != e || 0 == len(envelope.Algorithm) {
+		return message, nil
+	}
+
+	var reader io.Reader
+	switch envelope.Algorithm {
+	case CompressionGzip:
+		gzipReader, e := gzip.NewReader(bytes.NewReader(envelope.Data))
+		if nil != e {
+			return "", xerrors.Errorf("invalid gzip payload: %v", e)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+
+	case CompressionZstd:
+		zstdReader, e := zstd.NewReader(bytes.NewReader(envelope.Data),
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(uint64(c.config.MaxDecompressedSize)))
+		if nil != e {
+			return "", xerrors.Errorf("invalid zstd payload: %v", e)
+		}
+		defer zstdReader.Close()
+		reader = zstdReader
+
+	default:
+		return "", xerrors.Errorf("unknown compression algorithm %v", envelope.Algorithm)
+	}
+
+	// Reading one byte more than allowed tells whether the payload exceeds the limit
+	payload, e := io.ReadAll(io.LimitReader(reader, c.config.MaxDecompressedSize+1))
+	if nil != e {
+		return "", xerrors.Errorf("failed to decompress %v payload: %v", envelope.Algorithm, e)
+	}
+	if int64(len(payload)) > c.config.MaxDecompressedSize {
+		return "", xerrors.Errorf("decompressed payload exceeds %d bytes", c.config.MaxDecompressedSize)
+	}
+
+	return string(payload), nil
+}
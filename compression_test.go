@@ -0,0 +1,101 @@
+package nymsocketmanager_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNymCompressorShouldHaveAKnownAlgorithm(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	_, e := lib.NewNymCompressor(lib.CompressionConfig{Algorithm: "lz4"}, &logger)
+	require.Error(t, e)
+
+	_, e = lib.NewNymCompressor(lib.CompressionConfig{}, nil)
+	require.Error(t, e)
+}
+
+func TestNymCompressorRoundTrip(t *testing.T) {
+	logger := zerolog.Logger{}
+	payload := strings.Repeat(`{"key":"value"},`, 200)
+
+	for _, algorithm := range []lib.CompressionAlgorithm{lib.CompressionGzip, lib.CompressionZstd} {
+		sender, e := lib.NewNymCompressor(lib.CompressionConfig{Algorithm: algorithm}, &logger)
+		require.NoError(t, e)
+		// Receivers decompress whatever the algorithm they are configured with
+		receiver, e := lib.NewNymCompressor(lib.CompressionConfig{}, &logger)
+		require.NoError(t, e)
+
+		var sent lib.NymMessage
+		e = lib.ChainNymSendMiddleware(func(m lib.NymMessage) error {
+			sent = m
+			return nil
+		}, sender.SendMiddleware())(lib.NewNymSend(payload, nymtest.RandomNymAddress()))
+		require.NoError(t, e)
+
+		compressed, _ := lib.GetPayload(sent)
+		require.Less(t, len(compressed), len(payload), algorithm)
+
+		var received string
+		lib.ChainNymMiddleware(func(m lib.NymReceived, _ func(lib.NymMessage) error) {
+			received = m.Message
+		}, receiver.Middleware())(lib.NewNymReceived(compressed, "").(lib.NymReceived), noSend)
+		require.Equal(t, payload, received, algorithm)
+	}
+}
+
+func TestNymCompressorSkipsSmallPayloads(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	compressor, e := lib.NewNymCompressor(lib.CompressionConfig{Threshold: 100}, &logger)
+	require.NoError(t, e)
+
+	small := strings.Repeat("a", 99)
+	compressed, e := compressor.Compress(small)
+	require.NoError(t, e)
+	require.Equal(t, small, compressed)
+
+	var sent lib.NymMessage
+	e = lib.ChainNymSendMiddleware(func(m lib.NymMessage) error {
+		sent = m
+		return nil
+	}, compressor.SendMiddleware())(lib.NewNymReply("tag", small))
+	require.NoError(t, e)
+	require.Equal(t, lib.NewNymReply("tag", small), sent)
+
+	// Uncompressed payloads are given as is
+	decompressed, e := compressor.Decompress(small)
+	require.NoError(t, e)
+	require.Equal(t, small, decompressed)
+}
+
+func TestNymCompressorLimitsDecompressedSize(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	compressor, e := lib.NewNymCompressor(lib.CompressionConfig{MaxDecompressedSize: 1024}, &logger)
+	require.NoError(t, e)
+
+	buffer := bytes.Buffer{}
+	writer := gzip.NewWriter(&buffer)
+	_, e = writer.Write(make([]byte, 1024*1024))
+	require.NoError(t, e)
+	require.NoError(t, writer.Close())
+	bomb := `{"nymCompressed":"gzip","data":"` + base64.StdEncoding.EncodeToString(buffer.Bytes()) + `"}`
+
+	_, e = compressor.Decompress(bomb)
+	require.Error(t, e)
+
+	handled := false
+	lib.ChainNymMiddleware(func(lib.NymReceived, func(lib.NymMessage) error) {
+		handled = true
+	}, compressor.Middleware())(lib.NewNymReceived(bomb, "").(lib.NymReceived), noSend)
+	require.False(t, handled)
+}
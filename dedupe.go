@@ -0,0 +1,369 @@
+package nymsocketmanager
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * The NymDeduplicator drops the messages already received, as retries and at-least-once delivery produce duplicates.
+ * Payloads are wrapped in a JSON envelope carrying a message ID; received IDs are remembered for a time window,
+ * within a bounded number of entries, and duplicates are dropped before the messageHandler.
+ *
+ * The send middleware gives a new ID to every outgoing payload, replies excepted when their senderTag never sent an
+ * envelope within the window, as such peers would not understand it. A retry has to keep the ID of the original
+ * message, so retried messages are built once with WithMessageId and sent as many times as needed.
+ *
+ * With ResendReply, the first reply of the messageHandler to a message is cached, envelope included, and sent again
+ * unchanged, through the SURBs of the duplicate, whenever a duplicate is received. The original reply and the resent
+ * ones therefore share their ID, which suits idempotent request/response flows.
+ *
+ *	nymSocketManager.UseDedupe(DedupeConfig{ResendReply: true})
+ */
+
+const (
+	// DefaultDedupeWindow is how long received message IDs are remembered
+	DefaultDedupeWindow = 10 * time.Minute
+	// DefaultDedupeMaxEntries is the number of message IDs remembered at most
+	DefaultDedupeMaxEntries = 10000
+)
+
+type DedupeConfig struct {
+	// How long received message IDs are remembered. Defaults to DefaultDedupeWindow.
+	Window time.Duration
+	// Number of message IDs remembered at most, the oldest being forgotten first. Defaults to DefaultDedupeMaxEntries.
+	MaxEntries int
+	// Answer duplicates with the cached reply of the original message
+	ResendReply bool
+}
+
+type DedupeStats struct {
+	Delivered     uint64
+	Duplicates    uint64
+	RepliesResent uint64
+}
+
+func NewNymDeduplicator(config DedupeConfig, parentLogger *zerolog.Logger) (*NymDeduplicator, error) {
+	if config.Window < 0 || config.MaxEntries < 0 {
+		err := xerrors.Errorf("window and maximum entries cannot be negative")
+		return nil, err
+	}
+
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	if 0 == config.Window {
+		config.Window = DefaultDedupeWindow
+	}
+	if 0 == config.MaxEntries {
+		config.MaxEntries = DefaultDedupeMaxEntries
+	}
+
+	localLogger := parentLogger.With().Str(ComponentField, "NymDeduplicator").Logger()
+
+	return &NymDeduplicator{
+		config:        config,
+		seen:          make(map[string]*list.Element),
+		order:         list.New(),
+		envelopePeers: make(map[string]*list.Element),
+		peerOrder:     list.New(),
+		logger:        &localLogger,
+	}, nil
+}
+
+type NymDeduplicator struct {
+	sync.Mutex
+
+	config DedupeConfig
+
+	// seen indexes the elements of order, which holds the seenMessages from the oldest to the newest
+	seen  map[string]*list.Element
+	order *list.List
+
+	// envelopePeers indexes the elements of peerOrder, which holds the envelopePeers from the least to the most
+	// recently seen, to only wrap the replies to peers using envelopes
+	envelopePeers map[string]*list.Element
+	peerOrder     *list.List
+
+	stats DedupeStats
+
+	logger *zerolog.Logger
+}
+
+// envelopePeer is a senderTag which sent an envelope
+type envelopePeer struct {
+	senderTag string
+	lastSeen  time.Time
+}
+
+type seenMessage struct {
+	id         string
+	receivedAt time.Time
+	reply      *string
+}
+
+// UseDedupe creates a NymDeduplicator and registers it on both the received and sent messages of n
+func (n *NymSocketManager) UseDedupe(config DedupeConfig) (*NymDeduplicator, error) {
+	deduplicator, e := NewNymDeduplicator(config, n.logger)
+	if nil != e {
+		return nil, e
+	}
+
+	n.Use(deduplicator.Middleware())
+	n.UseSend(deduplicator.SendMiddleware())
+	return deduplicator, nil
+}
+
+// dedupeEnvelope is the JSON carried in the Message of NymMessages going through the NymDeduplicator
+type dedupeEnvelope struct {
+	Id      string `json:"nymMessageId"`
+	Payload string `json:"payload"`
+}
+
+// NewMessageId returns a random message ID
+func NewMessageId() string {
+	id := make([]byte, 16)
+	// crypto/rand never fails on supported platforms
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// WithMessageId wraps the payload of msg in an envelope carrying id, to be sent as many times as needed.
+// The send middleware of the NymDeduplicator keeps the ID of payloads already wrapped.
+func WithMessageId(msg NymMessage, id string) (NymMessage, error) {
+	if 0 == len(id) {
+		err := xerrors.Errorf("message ID needs to be defined")
+		return nil, err
+	}
+
+	payload, ok := GetPayload(msg)
+	if !ok {
+		err := xerrors.Errorf("%v has no payload", msg.Name())
+		return nil, err
+	}
+
+	if _, ok := decodeDedupeEnvelope(payload); ok {
+		err := xerrors.Errorf("%v already has a message ID", msg.Name())
+		return nil, err
+	}
+
+	envelopeBytes, e := json.Marshal(dedupeEnvelope{Id: id, Payload: payload})
+	if nil != e {
+		return nil, e
+	}
+
+	msg, _ = WithPayload(msg, string(envelopeBytes))
+	return msg, nil
+}
+
+// SendMiddleware gives a new message ID to the outgoing payloads which do not have one, replies to senderTags which
+// did not send any envelope excepted
+func (d *NymDeduplicator) SendMiddleware() NymSendMiddleware {
+	return func(next NymSender) NymSender {
+		return func(msg NymMessage) error {
+			payload, ok := GetPayload(msg)
+			if !ok {
+				return next(msg)
+			}
+			if _, ok := decodeDedupeEnvelope(payload); ok {
+				return next(msg)
+			}
+			if reply, ok := msg.(NymReply); ok && !d.usesEnvelopes(reply.SenderTag, time.Now()) {
+				return next(msg)
+			}
+
+			withId, e := WithMessageId(msg, NewMessageId())
+			if nil != e {
+				return e
+			}
+			return next(withId)
+		}
+	}
+}
+
+// Middleware drops duplicates before the rest of the chain, answering them with the cached reply if configured
+func (d *NymDeduplicator) Middleware() NymMiddleware {
+	return func(next NymHandler) NymHandler {
+		return func(msg NymReceived, send func(NymMessage) error) {
+			envelope, ok := decodeDedupeEnvelope(msg.Message)
+			if !ok {
+				// Not an envelope, cannot be deduplicated
+				next(msg, send)
+				return
+			}
+
+			reply, duplicate := d.record(envelope.Id, msg.SenderTag, time.Now())
+			if duplicate {
+				d.logger.Debug().Msgf("dropping duplicate %v from %v", envelope.Id, msg.SenderTag)
+				d.resendReply(envelope.Id, msg.SenderTag, reply, send)
+				return
+			}
+
+			msg.Message = envelope.Payload
+			if !d.config.ResendReply || 0 == len(msg.SenderTag) {
+				next(msg, send)
+				return
+			}
+
+			// Cache the first reply to the sender, with its ID so that it is resent unchanged
+			var replyOnce sync.Once
+			next(msg, func(m NymMessage) error {
+				if r, ok := m.(NymReply); ok && r.SenderTag == msg.SenderTag {
+					var e error
+					replyOnce.Do(func() { m, e = d.cacheReply(envelope.Id, r) })
+					if nil != e {
+						return e
+					}
+				}
+				return send(m)
+			})
+		}
+	}
+}
+
+func (d *NymDeduplicator) Stats() DedupeStats {
+	d.Lock()
+	defer d.Unlock()
+	return d.stats
+}
+
+// Len returns the number of message IDs remembered
+func (d *NymDeduplicator) Len() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.order.Len()
+}
+
+// record remembers id, returning whether it was already seen and its cached reply
+func (d *NymDeduplicator) record(id string, senderTag string, now time.Time) (*string, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.expire(now)
+
+	if 0 != len(senderTag) {
+		d.recordPeer(senderTag, now)
+	}
+
+	if element, ok := d.seen[id]; ok {
+		d.stats.Duplicates++
+		return element.Value.(*seenMessage).reply, true
+	}
+
+	d.seen[id] = d.order.PushBack(&seenMessage{id: id, receivedAt: now})
+	for d.order.Len() > d.config.MaxEntries {
+		d.remove(d.order.Front())
+	}
+
+	d.stats.Delivered++
+	return nil, false
+}
+
+// cacheReply gives reply a message ID, unless it already has one, and caches its payload for the duplicates of id
+func (d *NymDeduplicator) cacheReply(id string, reply NymReply) (NymMessage, error) {
+	var withId NymMessage = reply
+	if _, ok := decodeDedupeEnvelope(reply.Message); !ok {
+		var e error
+		withId, e = WithMessageId(reply, NewMessageId())
+		if nil != e {
+			return nil, e
+		}
+	}
+	payload, _ := GetPayload(withId)
+
+	d.Lock()
+	defer d.Unlock()
+
+	if element, ok := d.seen[id]; ok {
+		element.Value.(*seenMessage).reply = &payload
+	}
+	return withId, nil
+}
+
+// recordPeer remembers that senderTag sent an envelope
+// called from methods that already acquired the lock
+func (d *NymDeduplicator) recordPeer(senderTag string, now time.Time) {
+	if element, ok := d.envelopePeers[senderTag]; ok {
+		element.Value.(*envelopePeer).lastSeen = now
+		d.peerOrder.MoveToBack(element)
+		return
+	}
+
+	d.envelopePeers[senderTag] = d.peerOrder.PushBack(&envelopePeer{senderTag: senderTag, lastSeen: now})
+	for d.peerOrder.Len() > d.config.MaxEntries {
+		d.removePeer(d.peerOrder.Front())
+	}
+}
+
+// usesEnvelopes tells whether senderTag sent an envelope within the window
+func (d *NymDeduplicator) usesEnvelopes(senderTag string, now time.Time) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	element, ok := d.envelopePeers[senderTag]
+	return ok && now.Sub(element.Value.(*envelopePeer).lastSeen) < d.config.Window
+}
+
+func (d *NymDeduplicator) resendReply(id string, senderTag string, reply *string, send func(NymMessage) error) {
+	if !d.config.ResendReply || nil == reply || 0 == len(senderTag) {
+		return
+	}
+
+	e := send(NewNymReply(senderTag, *reply))
+	if nil != e {
+		d.logger.Warn().Msgf("failed to resend reply to %v: %v", id, e)
+		return
+	}
+
+	d.Lock()
+	d.stats.RepliesResent++
+	d.Unlock()
+}
+
+// expire forgets the message IDs and senderTags received before the window
+// called from methods that already acquired the lock
+func (d *NymDeduplicator) expire(now time.Time) {
+	for element := d.order.Front(); nil != element; element = d.order.Front() {
+		if now.Sub(element.Value.(*seenMessage).receivedAt) < d.config.Window {
+			break
+		}
+		d.remove(element)
+	}
+
+	for element := d.peerOrder.Front(); nil != element; element = d.peerOrder.Front() {
+		if now.Sub(element.Value.(*envelopePeer).lastSeen) < d.config.Window {
+			break
+		}
+		d.removePeer(element)
+	}
+}
+
+// called from methods that already acquired the lock
+func (d *NymDeduplicator) remove(element *list.Element) {
+	delete(d.seen, element.Value.(*seenMessage).id)
+	d.order.Remove(element)
+}
+
+// called from methods that already acquired the lock
+func (d *NymDeduplicator) removePeer(element *list.Element) {
+	delete(d.envelopePeers, element.Value.(*envelopePeer).senderTag)
+	d.peerOrder.Remove(element)
+}
+
+func decodeDedupeEnvelope(message string) (dedupeEnvelope, bool) {
+	envelope := dedupeEnvelope{}
+	e := json.Unmarshal([]byte(message), &envelope)
+	if nil != e || 0 == len(envelope.Id) {
+		return dedupeEnvelope{}, false
+	}
+	return envelope, true
+}
@@ -0,0 +1,156 @@
+package nymsocketmanager_test
+
+import (
+	"testing"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNymDeduplicatorDropsDuplicates(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	deduplicator, e := lib.NewNymDeduplicator(lib.DedupeConfig{}, &logger)
+	require.NoError(t, e)
+
+	msg, e := lib.WithMessageId(lib.NewNymSend("payload", nymtest.RandomNymAddress()), lib.NewMessageId())
+	require.NoError(t, e)
+	_, e = lib.WithMessageId(msg, lib.NewMessageId())
+	require.Error(t, e)
+
+	// The send middleware keeps the ID of retried messages
+	sent := []string{}
+	sender := lib.ChainNymSendMiddleware(func(m lib.NymMessage) error {
+		payload, _ := lib.GetPayload(m)
+		sent = append(sent, payload)
+		return nil
+	}, deduplicator.SendMiddleware())
+	require.NoError(t, sender(msg))
+	require.NoError(t, sender(msg))
+	require.NoError(t, sender(lib.NewNymSend("payload", nymtest.RandomNymAddress())))
+	require.Equal(t, sent[0], sent[1])
+	require.NotEqual(t, sent[0], sent[2])
+
+	received := []string{}
+	handler := lib.ChainNymMiddleware(func(m lib.NymReceived, _ func(lib.NymMessage) error) {
+		received = append(received, m.Message)
+	}, deduplicator.Middleware())
+	for _, payload := range sent {
+		handler(lib.NewNymReceived(payload, "").(lib.NymReceived), noSend)
+	}
+	// Messages without envelope are given as is
+	handler(lib.NewNymReceived("plain", "").(lib.NymReceived), noSend)
+
+	require.Equal(t, []string{"payload", "payload", "plain"}, received)
+	require.Equal(t, lib.DedupeStats{Delivered: 2, Duplicates: 1}, deduplicator.Stats())
+}
+
+func TestNymDeduplicatorIsBounded(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	deduplicator, e := lib.NewNymDeduplicator(lib.DedupeConfig{MaxEntries: 2}, &logger)
+	require.NoError(t, e)
+
+	handled := 0
+	handler := lib.ChainNymMiddleware(func(lib.NymReceived, func(lib.NymMessage) error) {
+		handled++
+	}, deduplicator.Middleware())
+
+	messages := []string{}
+	for i := 0; i < 3; i++ {
+		msg, e := lib.WithMessageId(lib.NewNymReply("tag", "payload"), lib.NewMessageId())
+		require.NoError(t, e)
+		payload, _ := lib.GetPayload(msg)
+		messages = append(messages, payload)
+		handler(lib.NewNymReceived(payload, "").(lib.NymReceived), noSend)
+	}
+	require.Equal(t, 2, deduplicator.Len())
+
+	// The oldest ID was forgotten
+	handler(lib.NewNymReceived(messages[0], "").(lib.NymReceived), noSend)
+	handler(lib.NewNymReceived(messages[2], "").(lib.NymReceived), noSend)
+	require.Equal(t, 4, handled)
+}
+
+func TestNymDeduplicatorResendsCachedReply(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	deduplicator, e := lib.NewNymDeduplicator(lib.DedupeConfig{ResendReply: true}, &logger)
+	require.NoError(t, e)
+
+	handled := 0
+	handler := lib.ChainNymMiddleware(func(m lib.NymReceived, send func(lib.NymMessage) error) {
+		handled++
+		_ = send(lib.NewNymReply(m.SenderTag, "answer to "+m.Message))
+	}, deduplicator.Middleware())
+
+	replies := []lib.NymMessage{}
+	send := func(m lib.NymMessage) error {
+		replies = append(replies, m)
+		return nil
+	}
+
+	msg, e := lib.WithMessageId(lib.NewNymSendAnonymous("request", nymtest.RandomNymAddress(), 1), lib.NewMessageId())
+	require.NoError(t, e)
+	payload, _ := lib.GetPayload(msg)
+
+	handler(lib.NewNymReceived(payload, "first").(lib.NymReceived), send)
+	// The retry comes with other SURBs
+	handler(lib.NewNymReceived(payload, "retry").(lib.NymReceived), send)
+
+	require.Equal(t, 1, handled)
+	require.Len(t, replies, 2)
+	first, isReply := replies[0].(lib.NymReply)
+	require.True(t, isReply)
+	retry, isReply := replies[1].(lib.NymReply)
+	require.True(t, isReply)
+	require.Equal(t, "first", first.SenderTag)
+	require.Equal(t, "retry", retry.SenderTag)
+	// The resent reply is the original envelope, ID included
+	require.Equal(t, first.Message, retry.Message)
+	_, e = lib.WithMessageId(first, lib.NewMessageId())
+	require.Error(t, e)
+	require.Equal(t, uint64(1), deduplicator.Stats().RepliesResent)
+
+	// The peer dedupes the reply and its resent copy
+	answers := []string{}
+	peer := lib.ChainNymMiddleware(func(m lib.NymReceived, _ func(lib.NymMessage) error) {
+		answers = append(answers, m.Message)
+	}, deduplicator.Middleware())
+	peer(lib.NewNymReceived(first.Message, "").(lib.NymReceived), noSend)
+	peer(lib.NewNymReceived(retry.Message, "").(lib.NymReceived), noSend)
+	require.Equal(t, []string{"answer to request"}, answers)
+}
+
+func TestNymDeduplicatorOnlyWrapsRepliesToItsPeers(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	deduplicator, e := lib.NewNymDeduplicator(lib.DedupeConfig{}, &logger)
+	require.NoError(t, e)
+
+	sent := []lib.NymMessage{}
+	sender := lib.ChainNymSendMiddleware(func(m lib.NymMessage) error {
+		sent = append(sent, m)
+		return nil
+	}, deduplicator.SendMiddleware())
+	handler := lib.ChainNymMiddleware(func(m lib.NymReceived, send func(lib.NymMessage) error) {
+		_ = send(lib.NewNymReply(m.SenderTag, "answer"))
+	}, deduplicator.Middleware())
+
+	msg, e := lib.WithMessageId(lib.NewNymSendAnonymous("request", nymtest.RandomNymAddress(), 1), lib.NewMessageId())
+	require.NoError(t, e)
+	payload, _ := lib.GetPayload(msg)
+
+	handler(lib.NewNymReceived("plain request", "plain").(lib.NymReceived), sender)
+	handler(lib.NewNymReceived(payload, "dedupe").(lib.NymReceived), sender)
+
+	// The peer without envelope gets its reply as is
+	require.Len(t, sent, 2)
+	require.Equal(t, lib.NewNymReply("plain", "answer"), sent[0])
+	reply, isReply := sent[1].(lib.NymReply)
+	require.True(t, isReply)
+	require.Equal(t, "dedupe", reply.SenderTag)
+	require.NotEqual(t, "answer", reply.Message)
+}
@@ -0,0 +1,16 @@
+package nymsocketmanager
+
+// MessageDispatcher exposes the messageDispatcher of a NymSocketManager to the tests
+var MessageDispatcher = (*NymSocketManager).messageDispatcher
+
+// StickyRecipients returns the recipients whose nym-client is remembered, from the least to the most recently used
+func (p *NymClientPool) StickyRecipients() []NymAddress {
+	p.Lock()
+	defer p.Unlock()
+
+	recipients := []NymAddress{}
+	for element := p.stickyOrder.Front(); nil != element; element = element.Next() {
+		recipients = append(recipients, element.Value.(*stickyRecipient).recipient)
+	}
+	return recipients
+}
@@ -0,0 +1,262 @@
+package nymsocketmanager
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * The FaultInjector wraps a Dialer to make the nym-client look flaky, to test how a service copes with it:
+ *
+ *	injector, _ := NewFaultInjector(FaultConfig{Seed: 42, Drop: 0.1, Latency: 50 * time.Millisecond}, &logger)
+ *	nymSocketManager.SetDialer(injector.Dial)
+ *
+ * Each fault happens with its probability. Dial failures are drawn from a random source seeded with Seed, and each
+ * connection draws its faults from a source per direction, derived from Seed and the number of connections dialed
+ * before it. A run is therefore reproduced as long as the connections are dialed and the frames of each direction
+ * are sent in the same order. Drops, duplicates, reordering, corruption and latency apply to the frames received from
+ * the nym-client; sent frames can fail with WriteError. Disconnect is drawn for every frame in both directions.
+ */
+
+type FaultConfig struct {
+	// Seed of the random source drawing the faults
+	Seed int64
+	// Defaults to DialWebsocket
+	Dialer Dialer
+
+	// Probabilities, between 0 and 1, of each fault
+	DialFailure float64
+	Disconnect  float64
+	WriteError  float64
+	Drop        float64
+	Duplicate   float64
+	// A reordered frame is held back and delivered after the next one
+	Reorder float64
+	// A corrupted frame is truncated, making its JSON invalid
+	Corrupt float64
+
+	// Delay added to every received frame, plus a random part up to Jitter
+	Latency time.Duration
+	Jitter  time.Duration
+}
+
+type FaultStats struct {
+	DialFailures uint64
+	Disconnects  uint64
+	WriteErrors  uint64
+	Dropped      uint64
+	Duplicated   uint64
+	Reordered    uint64
+	Corrupted    uint64
+}
+
+func NewFaultInjector(config FaultConfig, parentLogger *zerolog.Logger) (*FaultInjector, error) {
+	for _, probability := range []float64{config.DialFailure, config.Disconnect, config.WriteError, config.Drop, config.Duplicate, config.Reorder, config.Corrupt} {
+		if probability < 0 || 1 < probability {
+			err := xerrors.Errorf("fault probabilities need to be between 0 and 1")
+			return nil, err
+		}
+	}
+
+	if config.Latency < 0 || config.Jitter < 0 {
+		err := xerrors.Errorf("latency and jitter cannot be negative")
+		return nil, err
+	}
+
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	if nil == config.Dialer {
+		config.Dialer = DialWebsocket
+	}
+
+	localLogger := parentLogger.With().Str(ComponentField, "FaultInjector").Logger()
+
+	return &FaultInjector{
+		config: config,
+		random: rand.New(rand.NewSource(config.Seed)),
+		logger: &localLogger,
+	}, nil
+}
+
+type FaultInjector struct {
+	sync.Mutex
+
+	config FaultConfig
+	// Draws the dial failures
+	random *rand.Rand
+	dialed int64
+	stats  FaultStats
+
+	logger *zerolog.Logger
+}
+
+// Dial opens a connection through the Dialer of the config, unless a dial failure is injected.
+// It is meant to be given to SetDialer.
+func (f *FaultInjector) Dial(connectionURI string) (Conn, error) {
+	if f.inject(f.random, f.config.DialFailure, &f.stats.DialFailures) {
+		f.logger.Debug().Msgf("injecting dial failure to %v", connectionURI)
+		return nil, xerrors.Errorf("injected dial failure to %v", connectionURI)
+	}
+
+	conn, e := f.config.Dialer(connectionURI)
+	if nil != e {
+		return nil, e
+	}
+
+	f.Lock()
+	f.dialed++
+	seed := f.config.Seed + 2*f.dialed
+	f.Unlock()
+
+	return &faultConn{
+		conn:        conn,
+		injector:    f,
+		readRandom:  rand.New(rand.NewSource(seed)),
+		writeRandom: rand.New(rand.NewSource(seed + 1)),
+	}, nil
+}
+
+func (f *FaultInjector) Stats() FaultStats {
+	f.Lock()
+	defer f.Unlock()
+	return f.stats
+}
+
+// inject draws from random whether a fault of probability happens, counting it in counter
+func (f *FaultInjector) inject(random *rand.Rand, probability float64, counter *uint64) bool {
+	if 0 == probability {
+		return false
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if random.Float64() < probability {
+		*counter++
+		return true
+	}
+	return false
+}
+
+// delay draws from random the latency of a received frame
+func (f *FaultInjector) delay(random *rand.Rand) time.Duration {
+	if 0 == f.config.Jitter {
+		return f.config.Latency
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	return f.config.Latency + time.Duration(random.Int63n(int64(f.config.Jitter)+1))
+}
+
+// truncation draws from random where a corrupted frame of length size is cut
+func (f *FaultInjector) truncation(random *rand.Rand, size int) int {
+	if size <= 1 {
+		return 0
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	return 1 + random.Intn(size-1)
+}
+
+type faultFrame struct {
+	messageType int
+	data        []byte
+}
+
+type faultConn struct {
+	conn     Conn
+	injector *FaultInjector
+	// Random sources of the faults of each direction, so that one does not shift the draws of the other
+	readRandom  *rand.Rand
+	writeRandom *rand.Rand
+
+	// Only used by ReadMessage: frames to deliver before reading again, and the frames held back by a reordering
+	pending []faultFrame
+	held    []faultFrame
+}
+
+func (c *faultConn) ReadMessage() (int, []byte, error) {
+	f := c.injector
+
+	for {
+		if 0 != len(c.pending) {
+			frame := c.pending[0]
+			c.pending = c.pending[1:]
+			return frame.messageType, frame.data, nil
+		}
+
+		messageType, data, e := c.conn.ReadMessage()
+		if nil != e {
+			return messageType, data, e
+		}
+
+		if f.inject(c.readRandom, f.config.Disconnect, &f.stats.Disconnects) {
+			f.logger.Debug().Msg("injecting disconnection on read")
+			c.conn.Close()
+			return 0, nil, xerrors.Errorf("injected disconnection")
+		}
+
+		if f.inject(c.readRandom, f.config.Drop, &f.stats.Dropped) {
+			f.logger.Debug().Msgf("dropping frame %s", data)
+			continue
+		}
+
+		if delay := f.delay(c.readRandom); 0 < delay {
+			time.Sleep(delay)
+		}
+
+		if f.inject(c.readRandom, f.config.Corrupt, &f.stats.Corrupted) {
+			data = data[:f.truncation(c.readRandom, len(data))]
+			f.logger.Debug().Msgf("corrupting frame into %s", data)
+		}
+
+		frames := []faultFrame{{messageType: messageType, data: data}}
+		if f.inject(c.readRandom, f.config.Duplicate, &f.stats.Duplicated) {
+			frames = append(frames, faultFrame{messageType: messageType, data: append([]byte{}, data...)})
+		}
+
+		if 0 != len(c.held) {
+			frames = append(frames, c.held...)
+			c.held = nil
+		} else if f.inject(c.readRandom, f.config.Reorder, &f.stats.Reordered) {
+			c.held = frames
+			continue
+		}
+
+		c.pending = frames[1:]
+		return frames[0].messageType, frames[0].data, nil
+	}
+}
+
+func (c *faultConn) WriteMessage(messageType int, data []byte) error {
+	f := c.injector
+
+	if websocket.CloseMessage != messageType {
+		if f.inject(c.writeRandom, f.config.Disconnect, &f.stats.Disconnects) {
+			f.logger.Debug().Msg("injecting disconnection on write")
+			c.conn.Close()
+			return xerrors.Errorf("injected disconnection")
+		}
+
+		if f.inject(c.writeRandom, f.config.WriteError, &f.stats.WriteErrors) {
+			f.logger.Debug().Msgf("injecting write error on frame %s", data)
+			return xerrors.Errorf("injected write error")
+		}
+	}
+
+	return c.conn.WriteMessage(messageType, data)
+}
+
+func (c *faultConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,125 @@
+package nymsocketmanager_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// replayFrames returns a Dialer of connections receiving frames and closing
+func replayFrames(t *testing.T, frames ...string) lib.Dialer {
+	recording := &strings.Builder{}
+	for _, frame := range frames {
+		fmt.Fprintf(recording, "{\"time\":\"2023-05-04T10:00:00Z\",\"direction\":\"in\",\"frame\":%q}\n", frame)
+	}
+
+	replayer, e := lib.NewReplayer(strings.NewReader(recording.String()), lib.ReplayConfig{Instant: true, CloseAtEnd: true})
+	require.NoError(t, e)
+	return replayer.Dial
+}
+
+// readAll reads the frames of conn until it fails
+func readAll(conn lib.Conn) []string {
+	frames := []string{}
+	for {
+		_, frame, e := conn.ReadMessage()
+		if nil != e {
+			return frames
+		}
+		frames = append(frames, string(frame))
+	}
+}
+
+func TestFaultInjectorDuplicatesAndReordersFrames(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	injector, e := lib.NewFaultInjector(lib.FaultConfig{Dialer: replayFrames(t, "a", "b", "c", "d"), Reorder: 1}, &logger)
+	require.NoError(t, e)
+	conn, e := injector.Dial("")
+	require.NoError(t, e)
+	require.Equal(t, []string{"b", "a", "d", "c"}, readAll(conn))
+	require.Equal(t, uint64(2), injector.Stats().Reordered)
+
+	injector, e = lib.NewFaultInjector(lib.FaultConfig{Dialer: replayFrames(t, "a", "b"), Duplicate: 1}, &logger)
+	require.NoError(t, e)
+	conn, e = injector.Dial("")
+	require.NoError(t, e)
+	require.Equal(t, []string{"a", "a", "b", "b"}, readAll(conn))
+}
+
+func TestFaultInjectorCorruptsFrames(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	injector, e := lib.NewFaultInjector(lib.FaultConfig{Dialer: replayFrames(t, `{"type":"selfAddress"}`), Corrupt: 1}, &logger)
+	require.NoError(t, e)
+	conn, e := injector.Dial("")
+	require.NoError(t, e)
+
+	frames := readAll(conn)
+	require.Len(t, frames, 1)
+	_, e = lib.DecodeNymMessage([]byte(frames[0]))
+	require.Error(t, e)
+}
+
+func TestFaultInjectorIsReproducibleWithItsSeed(t *testing.T) {
+	logger := zerolog.Logger{}
+	frames := strings.Split("abcdefghijklmnopqrstuvwxyz", "")
+
+	run := func(seed int64, writes int) ([]string, uint64) {
+		injector, e := lib.NewFaultInjector(lib.FaultConfig{
+			Seed:       seed,
+			Dialer:     replayFrames(t, frames...),
+			Drop:       0.2,
+			Duplicate:  0.2,
+			Reorder:    0.2,
+			WriteError: 0.5,
+		}, &logger)
+		require.NoError(t, e)
+		conn, e := injector.Dial("")
+		require.NoError(t, e)
+
+		for i := 0; i < writes; i++ {
+			conn.WriteMessage(websocket.TextMessage, []byte("{}"))
+		}
+		return readAll(conn), injector.Stats().WriteErrors
+	}
+
+	received, writeErrors := run(42, 10)
+	again, againWriteErrors := run(42, 10)
+	require.Equal(t, received, again)
+	require.Equal(t, writeErrors, againWriteErrors)
+	require.NotEqual(t, frames, received)
+
+	// The frames sent, whose order with the received ones depends on scheduling, do not change the received ones
+	again, _ = run(42, 0)
+	require.Equal(t, received, again)
+}
+
+func TestFaultInjectorFailsDialsAndWrites(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	injector, e := lib.NewFaultInjector(lib.FaultConfig{Dialer: replayFrames(t), DialFailure: 1}, &logger)
+	require.NoError(t, e)
+
+	nymSocketManager, e := lib.NewNymSocketManager("replay://", func(lib.NymReceived, func(lib.NymMessage) error) {}, &logger)
+	require.NoError(t, e)
+	nymSocketManager.SetDialer(injector.Dial)
+	_, e = nymSocketManager.Start()
+	require.Error(t, e)
+	require.Equal(t, uint64(1), injector.Stats().DialFailures)
+
+	injector, e = lib.NewFaultInjector(lib.FaultConfig{Dialer: replayFrames(t), WriteError: 1}, &logger)
+	require.NoError(t, e)
+	conn, e := injector.Dial("")
+	require.NoError(t, e)
+	require.Error(t, conn.WriteMessage(websocket.TextMessage, []byte("{}")))
+	require.Equal(t, uint64(1), injector.Stats().WriteErrors)
+
+	_, e = lib.NewFaultInjector(lib.FaultConfig{Drop: 2}, &logger)
+	require.Error(t, e)
+}
@@ -3,9 +3,12 @@ module github.com/notrustverify/nymsocketmanager
 go 1.20
 
 require (
+	github.com/fxamacker/cbor/v2 v2.5.0
 	github.com/gorilla/websocket v1.5.0
+	github.com/klauspost/compress v1.16.7
 	github.com/rs/zerolog v1.29.1
 	github.com/stretchr/testify v1.8.2
+	github.com/vmihailenco/msgpack/v5 v5.4.1
 	golang.org/x/xerrors v0.0.0-20220907171357-04be3eba64a2
 )
 
@@ -14,6 +17,8 @@ require (
 	github.com/mattn/go-colorable v0.1.12 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/sys v0.0.0-20210927094055-39ccf1dd6fa6 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
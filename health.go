@@ -0,0 +1,229 @@
+package nymsocketmanager
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * NymHealth tells whether the mixnet link of a NymSocketManager works, by periodically sending it a Probe:
+ *
+ *	health, _ := NewNymHealth(nymSocketManager, HealthConfig{}, &logger)
+ *	health.Start()
+ *	defer health.Stop()
+ *	http.Handle("/livez", health.LiveHandler())
+ *	http.Handle("/readyz", health.ReadyHandler())
+ *
+ * The NymSocketManager is live while connected to its nym-client, and ready once live, a probe came back and
+ * fewer than FailureThreshold probes failed in a row since.
+ */
+
+const (
+	// DefaultHealthInterval is the time between two probes
+	DefaultHealthInterval = 30 * time.Second
+	// DefaultProbeTimeout is how long a probe has to come back
+	DefaultProbeTimeout = 10 * time.Second
+	// DefaultFailureThreshold is the number of consecutive failed probes making the NymSocketManager not ready
+	DefaultFailureThreshold = 3
+)
+
+type HealthConfig struct {
+	// Defaults to DefaultHealthInterval
+	Interval time.Duration
+	// Defaults to DefaultProbeTimeout
+	Timeout time.Duration
+	// Defaults to DefaultFailureThreshold
+	FailureThreshold int
+}
+
+type HealthStatus struct {
+	Live  bool `json:"live"`
+	Ready bool `json:"ready"`
+	// The self-test of the last Start failed, see SelfTestConfig
+	Degraded bool `json:"degraded"`
+
+	Probes              uint64 `json:"probes"`
+	Failures            uint64 `json:"failures"`
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+
+	LastProbe   time.Time `json:"lastProbe"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	// Round-trip time of the last successful probe, in nanoseconds once encoded
+	LastRTT   time.Duration `json:"lastRtt"`
+	LastError string        `json:"lastError,omitempty"`
+}
+
+func NewNymHealth(nymSocketManager *NymSocketManager, config HealthConfig, parentLogger *zerolog.Logger) (*NymHealth, error) {
+	if nil == nymSocketManager {
+		err := xerrors.Errorf("NymSocketManager needs to be defined")
+		return nil, err
+	}
+
+	if config.Interval < 0 || config.Timeout < 0 || config.FailureThreshold < 0 {
+		err := xerrors.Errorf("interval, timeout and failure threshold cannot be negative")
+		return nil, err
+	}
+
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	if 0 == config.Interval {
+		config.Interval = DefaultHealthInterval
+	}
+	if 0 == config.Timeout {
+		config.Timeout = DefaultProbeTimeout
+	}
+	if 0 == config.FailureThreshold {
+		config.FailureThreshold = DefaultFailureThreshold
+	}
+
+	localLogger := parentLogger.With().Str(ComponentField, "NymHealth").Logger()
+
+	return &NymHealth{
+		config:           config,
+		nymSocketManager: nymSocketManager,
+		logger:           &localLogger,
+	}, nil
+}
+
+type NymHealth struct {
+	sync.Mutex
+
+	config           HealthConfig
+	nymSocketManager *NymSocketManager
+
+	status HealthStatus
+	// Serializes the probes of Check and of the periodic loop
+	probeMutex sync.Mutex
+
+	stopChan chan struct{}
+	stopped  chan struct{}
+
+	logger *zerolog.Logger
+}
+
+// Start probes right away, then every Interval until Stop
+func (h *NymHealth) Start() {
+	h.Lock()
+	defer h.Unlock()
+
+	if nil != h.stopChan {
+		return
+	}
+
+	h.stopChan = make(chan struct{})
+	h.stopped = make(chan struct{})
+	go h.loop(h.stopChan, h.stopped)
+}
+
+func (h *NymHealth) Stop() {
+	h.Lock()
+	stopChan, stopped := h.stopChan, h.stopped
+	h.stopChan, h.stopped = nil, nil
+	h.Unlock()
+
+	if nil == stopChan {
+		return
+	}
+	close(stopChan)
+	<-stopped
+}
+
+func (h *NymHealth) loop(stopChan chan struct{}, stopped chan struct{}) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		h.Check()
+
+		select {
+		case <-ticker.C:
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// Check probes now and returns the resulting status
+func (h *NymHealth) Check() HealthStatus {
+	h.probeMutex.Lock()
+	defer h.probeMutex.Unlock()
+
+	now := time.Now()
+	rtt, e := h.nymSocketManager.Probe(h.config.Timeout)
+
+	h.Lock()
+	h.status.Probes++
+	h.status.LastProbe = now
+	if nil != e {
+		h.status.Failures++
+		h.status.ConsecutiveFailures++
+		h.status.LastError = e.Error()
+		h.logger.Warn().Msgf("probe failed (%d in a row): %v", h.status.ConsecutiveFailures, e)
+	} else {
+		h.status.ConsecutiveFailures = 0
+		h.status.LastSuccess = now
+		h.status.LastRTT = rtt
+		h.status.LastError = ""
+	}
+	h.Unlock()
+
+	return h.Status()
+}
+
+func (h *NymHealth) Status() HealthStatus {
+	live := h.nymSocketManager.IsRunning()
+	degraded := h.nymSocketManager.IsDegraded()
+
+	h.Lock()
+	defer h.Unlock()
+
+	status := h.status
+	status.Live = live
+	status.Degraded = degraded
+	status.Ready = live && !status.LastSuccess.IsZero() && status.ConsecutiveFailures < h.config.FailureThreshold
+	return status
+}
+
+func (h *NymHealth) IsLive() bool {
+	return h.Status().Live
+}
+
+func (h *NymHealth) IsReady() bool {
+	return h.Status().Ready
+}
+
+// LiveHandler answers the HealthStatus as JSON, with 200 when live and 503 otherwise
+func (h *NymHealth) LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := h.Status()
+		writeHealthStatus(w, status, status.Live)
+	})
+}
+
+// ReadyHandler answers the HealthStatus as JSON, with 200 when ready and 503 otherwise
+func (h *NymHealth) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := h.Status()
+		writeHealthStatus(w, status, status.Ready)
+	})
+}
+
+func writeHealthStatus(w http.ResponseWriter, status HealthStatus, healthy bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if healthy {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
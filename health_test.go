@@ -0,0 +1,108 @@
+package nymsocketmanager_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNymHealthProbesThroughTheMixnet(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer fakeNymClient.Close()
+
+	handled := make(chan lib.NymReceived, 1)
+	nymSocketManager, e := lib.NewNymSocketManager(fakeNymClient.URI(), func(msg lib.NymReceived, _ func(lib.NymMessage) error) {
+		handled <- msg
+	}, &logger)
+	require.NoError(t, e)
+
+	health, e := lib.NewNymHealth(nymSocketManager, lib.HealthConfig{Timeout: time.Second}, &logger)
+	require.NoError(t, e)
+	require.False(t, health.IsLive())
+
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+
+	// Live but not ready until a probe came back
+	require.True(t, health.IsLive())
+	require.False(t, health.IsReady())
+
+	status := health.Check()
+	require.True(t, status.Ready)
+	require.Equal(t, uint64(1), status.Probes)
+	require.Positive(t, status.LastRTT)
+
+	recorder := httptest.NewRecorder()
+	health.ReadyHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	encoded := lib.HealthStatus{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &encoded))
+	require.True(t, encoded.Ready)
+
+	// Probes do not reach the messageHandler
+	select {
+	case msg := <-handled:
+		t.Fatalf("probe handed to the messageHandler: %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	nymSocketManager.Stop()
+
+	status = health.Check()
+	require.False(t, status.Live)
+	require.False(t, status.Ready)
+	require.Equal(t, 1, status.ConsecutiveFailures)
+	require.NotEmpty(t, status.LastError)
+
+	recorder = httptest.NewRecorder()
+	health.LiveHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+}
+
+func TestNymHealthCountsConsecutiveFailures(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	nymSocketManager, e := lib.NewNymSocketManager("replay://", func(lib.NymReceived, func(lib.NymMessage) error) {}, &logger)
+	require.NoError(t, e)
+	nymSocketManager.SetDialer(silentNymClient(t))
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+	defer nymSocketManager.Stop()
+
+	health, e := lib.NewNymHealth(nymSocketManager, lib.HealthConfig{Interval: 10 * time.Millisecond, Timeout: 10 * time.Millisecond}, &logger)
+	require.NoError(t, e)
+	health.Start()
+	require.Eventually(t, func() bool { return 3 <= health.Status().ConsecutiveFailures }, time.Second, 10*time.Millisecond)
+	health.Stop()
+
+	status := health.Status()
+	require.True(t, status.Live)
+	require.False(t, status.Ready)
+	require.Equal(t, status.Probes, status.Failures)
+	require.True(t, strings.Contains(status.LastError, "timed-out"))
+}
+
+func TestNymHealthNeedsAValidConfig(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	_, e := lib.NewNymHealth(nil, lib.HealthConfig{}, &logger)
+	require.Error(t, e)
+
+	nymSocketManager, e := lib.NewNymSocketManager("ws://unused", func(lib.NymReceived, func(lib.NymMessage) error) {}, &logger)
+	require.NoError(t, e)
+	_, e = lib.NewNymHealth(nymSocketManager, lib.HealthConfig{Timeout: -1}, &logger)
+	require.Error(t, e)
+
+	_, e = nymSocketManager.Probe(time.Second)
+	require.Error(t, e)
+}
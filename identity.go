@@ -0,0 +1,224 @@
+package nymsocketmanager
+
+import (
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+/*
+ * The address of the nym-client is fetched by Start. When its identity is watched, the NymSocketManager also asks
+ * for it every Interval, and notices when the nym-client was restarted with another identity or gateway, be it
+ * while running or between two Starts:
+ *
+ *	nymSocketManager.WatchIdentity(IdentityWatchConfig{
+ *		Policy:   IdentityChangeStop,
+ *		OnChange: func(change IdentityChange) { ... },
+ *	})
+ *
+ * With IdentityChangeStop, the last accepted address stays the reference: Start keeps failing on the new address
+ * until it is accepted.
+ *
+ *	nymSocketManager.AcceptIdentity()
+ *	_, e := nymSocketManager.Start()
+ */
+
+// DefaultIdentityWatchInterval is the time between two requests of the address of the nym-client
+const DefaultIdentityWatchInterval = time.Minute
+
+type IdentityChangePolicy int
+
+const (
+	// IdentityChangeWarn adopts the new address, logging a warning
+	IdentityChangeWarn IdentityChangePolicy = iota
+	// IdentityChangeContinue silently adopts the new address
+	IdentityChangeContinue
+	// IdentityChangeStop stops the NymSocketManager, or fails its Start
+	IdentityChangeStop
+)
+
+type IdentityChange struct {
+	Old NymAddress
+	New NymAddress
+}
+
+// IdentityChanged tells whether the nym-client got new keys
+func (c IdentityChange) IdentityChanged() bool {
+	return c.Old.Identity() != c.New.Identity() || c.Old.EncryptionKey() != c.New.EncryptionKey()
+}
+
+// GatewayChanged tells whether the nym-client moved to another gateway
+func (c IdentityChange) GatewayChanged() bool {
+	return c.Old.Gateway() != c.New.Gateway()
+}
+
+type IdentityWatchConfig struct {
+	// Defaults to DefaultIdentityWatchInterval
+	Interval time.Duration
+	Policy   IdentityChangePolicy
+	// Called on every change, before applying the Policy (optional)
+	OnChange func(IdentityChange)
+}
+
+// WatchIdentity detects changes of the address of the nym-client, from the next Start
+func (n *NymSocketManager) WatchIdentity(config IdentityWatchConfig) error {
+	if config.Interval < 0 {
+		err := xerrors.Errorf("identity watch interval cannot be negative")
+		return err
+	}
+
+	if config.Policy < IdentityChangeWarn || IdentityChangeStop < config.Policy {
+		err := xerrors.Errorf("unknown identity change policy %d", config.Policy)
+		return err
+	}
+
+	if 0 == config.Interval {
+		config.Interval = DefaultIdentityWatchInterval
+	}
+
+	n.selfAddressMutex.Lock()
+	defer n.selfAddressMutex.Unlock()
+	n.identityWatch = &config
+	return nil
+}
+
+// UnwatchIdentity stops detecting changes of the address of the nym-client, any new address being adopted
+func (n *NymSocketManager) UnwatchIdentity() {
+	n.selfAddressMutex.Lock()
+	defer n.selfAddressMutex.Unlock()
+	n.identityWatch = nil
+}
+
+func (n *NymSocketManager) getIdentityWatch() *IdentityWatchConfig {
+	n.selfAddressMutex.Lock()
+	defer n.selfAddressMutex.Unlock()
+	return n.identityWatch
+}
+
+// startIdentityWatch requests the address of the nym-client every Interval, until stopped is closed
+func (n *NymSocketManager) startIdentityWatch(stopped chan struct{}) {
+	watch := n.getIdentityWatch()
+	if nil == watch {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(watch.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-stopped:
+				return
+			}
+
+			if nil == n.getIdentityWatch() {
+				return
+			}
+
+			e := n.send(NewSelfAddressRequest())
+			if nil != e {
+				n.logger.Debug().Msgf("failed to request the address of the nym-client: %v", e)
+			}
+		}
+	}()
+}
+
+// dispatchSelfAddress processes the address of the nym-client, requested by Start or by the identity watch
+func (n *NymSocketManager) dispatchSelfAddress(msg NymSelfAddressReply) {
+	address, e := ParseNymAddress(msg.Address)
+	if nil != e {
+		n.logger.Warn().Msgf("Got %v reply with invalid address: %v", msg.Type, e)
+	} else {
+		n.logger.Debug().Msgf("Got %v reply: Address is %v", msg.Type, msg.Address)
+	}
+
+	n.selfAddressMutex.Lock()
+
+	// Start checks the address by itself
+	if nil != n.selfAddressReceivedChan {
+		n.startClientID, n.clientIDParseErr = address, e
+		close(n.selfAddressReceivedChan)
+		n.selfAddressReceivedChan = nil
+		n.selfAddressMutex.Unlock()
+		return
+	}
+
+	// Otherwise keep the last accepted address
+	previous := n.clientID
+	n.selfAddressMutex.Unlock()
+
+	if nil != e {
+		return
+	}
+
+	e = n.checkIdentity(previous, address)
+	if nil != e {
+		n.Stop()
+		return
+	}
+	n.acceptClientID(address)
+}
+
+// AcceptIdentity accepts the address rejected by the identity watch, so that the next Start uses it
+func (n *NymSocketManager) AcceptIdentity() error {
+	n.selfAddressMutex.Lock()
+	defer n.selfAddressMutex.Unlock()
+
+	if n.rejectedClientID.IsZero() {
+		err := xerrors.Errorf("no address of the nym-client was rejected")
+		return err
+	}
+
+	n.logger.Info().Msgf("accepting address %v of the nym-client, replacing %v", n.rejectedClientID, n.clientID)
+	n.clientID = n.rejectedClientID
+	n.rejectedClientID = NymAddress{}
+	return nil
+}
+
+// acceptClientID makes address the reference of the identity watch
+func (n *NymSocketManager) acceptClientID(address NymAddress) {
+	n.selfAddressMutex.Lock()
+	defer n.selfAddressMutex.Unlock()
+
+	n.clientID = address
+	n.rejectedClientID = NymAddress{}
+}
+
+// checkIdentity applies the identity watch to a change from previous to current, failing if it needs to stop
+func (n *NymSocketManager) checkIdentity(previous NymAddress, current NymAddress) error {
+	if previous.IsZero() || previous == current {
+		return nil
+	}
+
+	watch := n.getIdentityWatch()
+	if nil == watch {
+		return nil
+	}
+
+	change := IdentityChange{Old: previous, New: current}
+	if nil != watch.OnChange {
+		watch.OnChange(change)
+	}
+
+	switch watch.Policy {
+	case IdentityChangeStop:
+		n.selfAddressMutex.Lock()
+		n.rejectedClientID = current
+		n.selfAddressMutex.Unlock()
+
+		err := xerrors.Errorf("address of the nym-client changed from %v to %v, see AcceptIdentity", previous, current)
+		n.logger.Warn().Msgf("%v, stopping", err)
+		return err
+
+	case IdentityChangeWarn:
+		n.logger.Warn().Msgf("address of the nym-client changed from %v to %v (identity changed: %v, gateway changed: %v)",
+			previous, current, change.IdentityChanged(), change.GatewayChanged())
+
+	default:
+		n.logger.Debug().Msgf("address of the nym-client changed from %v to %v", previous, current)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package nymsocketmanager_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchIdentityNoticesChangesWhileRunning(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer fakeNymClient.Close()
+
+	nymSocketManager, e := lib.NewNymSocketManager(fakeNymClient.URI(), func(lib.NymReceived, func(lib.NymMessage) error) {}, &logger)
+	require.NoError(t, e)
+
+	changesMutex := sync.Mutex{}
+	changes := []lib.IdentityChange{}
+	require.NoError(t, nymSocketManager.WatchIdentity(lib.IdentityWatchConfig{
+		Interval: 10 * time.Millisecond,
+		OnChange: func(change lib.IdentityChange) {
+			changesMutex.Lock()
+			defer changesMutex.Unlock()
+			changes = append(changes, change)
+		},
+	}))
+
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+	defer nymSocketManager.Stop()
+
+	old := fakeNymClient.Address()
+	fakeNymClient.SetAddress(nymtest.RandomNymAddress())
+
+	require.Eventually(t, func() bool { return fakeNymClient.Address() == nymSocketManager.GetNymClientId() }, time.Second, 10*time.Millisecond)
+	require.True(t, nymSocketManager.IsRunning())
+
+	changesMutex.Lock()
+	defer changesMutex.Unlock()
+	require.Equal(t, []lib.IdentityChange{{Old: old, New: fakeNymClient.Address()}}, changes)
+	require.True(t, changes[0].IdentityChanged())
+	require.True(t, changes[0].GatewayChanged())
+}
+
+func TestWatchIdentityCanStopOnChanges(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer fakeNymClient.Close()
+
+	nymSocketManager, e := lib.NewNymSocketManager(fakeNymClient.URI(), func(lib.NymReceived, func(lib.NymMessage) error) {}, &logger)
+	require.NoError(t, e)
+	require.NoError(t, nymSocketManager.WatchIdentity(lib.IdentityWatchConfig{Interval: 10 * time.Millisecond, Policy: lib.IdentityChangeStop}))
+
+	stopped, e := nymSocketManager.Start()
+	require.NoError(t, e)
+
+	fakeNymClient.SetAddress(nymtest.RandomNymAddress())
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("NymSocketManager did not stop on identity change")
+	}
+
+	// The last accepted address stays the reference until the new one is accepted
+	for i := 0; i < 2; i++ {
+		_, e = nymSocketManager.Start()
+		require.Error(t, e)
+		require.False(t, nymSocketManager.IsRunning())
+	}
+	require.NoError(t, nymSocketManager.AcceptIdentity())
+	require.Error(t, nymSocketManager.AcceptIdentity())
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+	require.Equal(t, fakeNymClient.Address(), nymSocketManager.GetNymClientId())
+	nymSocketManager.Stop()
+
+	// Changes between two Starts are noticed as well
+	accepted := fakeNymClient.Address()
+	fakeNymClient.SetAddress(nymtest.RandomNymAddress())
+	for i := 0; i < 2; i++ {
+		_, e = nymSocketManager.Start()
+		require.Error(t, e)
+		require.False(t, nymSocketManager.IsRunning())
+		require.Equal(t, accepted, nymSocketManager.GetNymClientId())
+	}
+
+	nymSocketManager.UnwatchIdentity()
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+	defer nymSocketManager.Stop()
+	require.Equal(t, fakeNymClient.Address(), nymSocketManager.GetNymClientId())
+}
+
+func TestIdentityChangeTellsWhatChanged(t *testing.T) {
+	address := nymtest.RandomNymAddress()
+	otherGateway := nymtest.RandomNymAddress().Gateway()
+	moved := lib.MustParseNymAddress(strings.TrimSuffix(address.String(), address.Gateway()) + otherGateway)
+
+	change := lib.IdentityChange{Old: address, New: moved}
+	require.True(t, change.GatewayChanged())
+	require.False(t, change.IdentityChanged())
+}
+
+func TestWatchIdentityNeedsAValidConfig(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	nymSocketManager, e := lib.NewNymSocketManager("ws://unused", func(lib.NymReceived, func(lib.NymMessage) error) {}, &logger)
+	require.NoError(t, e)
+
+	require.Error(t, nymSocketManager.WatchIdentity(lib.IdentityWatchConfig{Interval: -1}))
+	require.Error(t, nymSocketManager.WatchIdentity(lib.IdentityWatchConfig{Policy: 42}))
+}
@@ -0,0 +1,335 @@
+package nymsocketmanager
+
+import (
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+/*
+ * Middlewares wrap the messageHandler of a NymSocketManager or a SocketManager to apply cross-cutting logic
+ * (logging, recovery, metrics, ...) on every received message before it reaches the application.
+ * Middlewares registered first are the outermost ones: they see the message first and return last.
+ *
+ * A recover middleware is installed by default around all the others, so that a panicking messageHandler drops its
+ * message instead of crashing the process. It can be removed with DisableRecover, e.g. to let the panics through.
+ *
+ * Send middlewares similarly wrap the Send of a NymSocketManager, which is also the function given to the
+ * messageHandler, to transform outgoing messages (e.g. payload envelopes). Send middlewares registered first are
+ * the innermost ones, so that envelopes added on send are removed in the reverse order on receive.
+ */
+
+// NymHandler is the signature of the messageHandler of a NymSocketManager
+type NymHandler func(NymReceived, func(NymMessage) error)
+
+// NymMiddleware wraps a NymHandler into another one
+type NymMiddleware func(NymHandler) NymHandler
+
+// SocketHandler is the signature of the messageHandler of a SocketManager
+type SocketHandler func([]byte, func([]byte) error)
+
+// SocketMiddleware wraps a SocketHandler into another one
+type SocketMiddleware func(SocketHandler) SocketHandler
+
+// NymSender is the signature of the Send of a NymSocketManager
+type NymSender func(NymMessage) error
+
+// NymSendMiddleware wraps a NymSender into another one
+type NymSendMiddleware func(NymSender) NymSender
+
+// ChainNymMiddleware wraps handler with middlewares, the first middleware being the outermost
+func ChainNymMiddleware(handler NymHandler, middlewares ...NymMiddleware) NymHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// ChainSocketMiddleware wraps handler with middlewares, the first middleware being the outermost
+func ChainSocketMiddleware(handler SocketHandler, middlewares ...SocketMiddleware) SocketHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Use appends middlewares to the chain applied to every NymReceived before the messageHandler
+func (n *NymSocketManager) Use(middlewares ...NymMiddleware) {
+	n.handlerMutex.Lock()
+	defer n.handlerMutex.Unlock()
+
+	n.middlewares = append(n.middlewares, middlewares...)
+	n.chainHandler()
+}
+
+// EnableRecover installs back the default recover middleware, outermost of the chain
+func (n *NymSocketManager) EnableRecover() {
+	n.handlerMutex.Lock()
+	defer n.handlerMutex.Unlock()
+
+	n.noRecover = false
+	n.chainHandler()
+}
+
+// DisableRecover removes the default recover middleware: panics of the chain then crash the process
+func (n *NymSocketManager) DisableRecover() {
+	n.handlerMutex.Lock()
+	defer n.handlerMutex.Unlock()
+
+	n.noRecover = true
+	n.chainHandler()
+}
+
+// chainHandler wraps the messageHandler by the registered middlewares. handlerMutex needs to be held.
+func (n *NymSocketManager) chainHandler() {
+	middlewares := n.middlewares
+	if !n.noRecover {
+		middlewares = append([]NymMiddleware{NymRecoverMiddleware(n.logger)}, middlewares...)
+	}
+	n.handler = ChainNymMiddleware(n.messageHandler, middlewares...)
+}
+
+// getHandler returns the messageHandler wrapped by the registered middlewares
+func (n *NymSocketManager) getHandler() NymHandler {
+	n.handlerMutex.RLock()
+	defer n.handlerMutex.RUnlock()
+
+	if nil == n.handler {
+		return n.messageHandler
+	}
+	return n.handler
+}
+
+// ChainNymSendMiddleware wraps sender with middlewares, the first middleware being the outermost
+func ChainNymSendMiddleware(sender NymSender, middlewares ...NymSendMiddleware) NymSender {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		sender = middlewares[i](sender)
+	}
+	return sender
+}
+
+// UseSend adds middlewares to the chain applied to every message given to Send.
+// Send middlewares registered first are the innermost ones, so that layers registered on both Use and UseSend in
+// the same order stack correctly: the first one registered is the closest to the nym-client in both directions.
+func (n *NymSocketManager) UseSend(middlewares ...NymSendMiddleware) {
+	n.handlerMutex.Lock()
+	defer n.handlerMutex.Unlock()
+
+	for _, middleware := range middlewares {
+		n.sendMiddlewares = append([]NymSendMiddleware{middleware}, n.sendMiddlewares...)
+	}
+	n.sender = ChainNymSendMiddleware(n.send, n.sendMiddlewares...)
+}
+
+// getSender returns the send function wrapped by the registered send middlewares
+func (n *NymSocketManager) getSender() NymSender {
+	n.handlerMutex.RLock()
+	defer n.handlerMutex.RUnlock()
+
+	if nil == n.sender {
+		return n.send
+	}
+	return n.sender
+}
+
+// Use appends middlewares to the chain applied to every received message before the messageHandler
+func (s *SocketManager) Use(middlewares ...SocketMiddleware) {
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+
+	s.middlewares = append(s.middlewares, middlewares...)
+	s.chainHandler()
+}
+
+// EnableRecover installs back the default recover middleware, outermost of the chain
+func (s *SocketManager) EnableRecover() {
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+
+	s.noRecover = false
+	s.chainHandler()
+}
+
+// DisableRecover removes the default recover middleware: panics of the chain then crash the process
+func (s *SocketManager) DisableRecover() {
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+
+	s.noRecover = true
+	s.chainHandler()
+}
+
+// chainHandler wraps the messageHandler by the registered middlewares. handlerMutex needs to be held.
+func (s *SocketManager) chainHandler() {
+	middlewares := s.middlewares
+	if !s.noRecover {
+		middlewares = append([]SocketMiddleware{SocketRecoverMiddleware(s.logger)}, middlewares...)
+	}
+	s.handler = ChainSocketMiddleware(s.messageHandler, middlewares...)
+}
+
+// getHandler returns the messageHandler wrapped by the registered middlewares
+func (s *SocketManager) getHandler() SocketHandler {
+	s.handlerMutex.RLock()
+	defer s.handlerMutex.RUnlock()
+
+	if nil == s.handler {
+		return s.messageHandler
+	}
+	return s.handler
+}
+
+/*********************************************
+ * Recover
+ *********************************************/
+
+// NymRecoverMiddleware stops a panic in the handler from crashing the whole process.
+// The panic is logged and the message is dropped.
+func NymRecoverMiddleware(parentLogger *zerolog.Logger) NymMiddleware {
+	logger := middlewareLogger(parentLogger, "RecoverMiddleware")
+
+	return func(next NymHandler) NymHandler {
+		return func(msg NymReceived, send func(NymMessage) error) {
+			defer func() {
+				if r := recover(); nil != r {
+					logger.Error().Msgf("recovered from panic while handling %v: %v\n%s", msg, r, debug.Stack())
+				}
+			}()
+			next(msg, send)
+		}
+	}
+}
+
+// SocketRecoverMiddleware stops a panic in the handler from crashing the whole process.
+// The panic is logged and the message is dropped.
+func SocketRecoverMiddleware(parentLogger *zerolog.Logger) SocketMiddleware {
+	logger := middlewareLogger(parentLogger, "RecoverMiddleware")
+
+	return func(next SocketHandler) SocketHandler {
+		return func(msg []byte, send func([]byte) error) {
+			defer func() {
+				if r := recover(); nil != r {
+					logger.Error().Msgf("recovered from panic while handling \"%s\": %v\n%s", string(msg), r, debug.Stack())
+				}
+			}()
+			next(msg, send)
+		}
+	}
+}
+
+/*********************************************
+ * Logging
+ *********************************************/
+
+// NymLoggingMiddleware logs every received message along with the time spent in the handler
+func NymLoggingMiddleware(parentLogger *zerolog.Logger) NymMiddleware {
+	logger := middlewareLogger(parentLogger, "LoggingMiddleware")
+
+	return func(next NymHandler) NymHandler {
+		return func(msg NymReceived, send func(NymMessage) error) {
+			start := time.Now()
+			next(msg, send)
+			logger.Debug().Msgf("handled %v in %v", msg, time.Since(start))
+		}
+	}
+}
+
+// SocketLoggingMiddleware logs every received message along with the time spent in the handler
+func SocketLoggingMiddleware(parentLogger *zerolog.Logger) SocketMiddleware {
+	logger := middlewareLogger(parentLogger, "LoggingMiddleware")
+
+	return func(next SocketHandler) SocketHandler {
+		return func(msg []byte, send func([]byte) error) {
+			start := time.Now()
+			next(msg, send)
+			logger.Debug().Msgf("handled \"%s\" in %v", string(msg), time.Since(start))
+		}
+	}
+}
+
+/*********************************************
+ * Filter
+ *********************************************/
+
+// NymFilterMiddleware only lets through the messages for which accept returns true.
+// It can be used for authorization, e.g. to only accept messages carrying a senderTag.
+func NymFilterMiddleware(accept func(NymReceived) bool) NymMiddleware {
+	return func(next NymHandler) NymHandler {
+		return func(msg NymReceived, send func(NymMessage) error) {
+			if accept(msg) {
+				next(msg, send)
+			}
+		}
+	}
+}
+
+/*********************************************
+ * Metrics
+ *********************************************/
+
+// HandlerMetrics counts the messages going through the handler it is plugged on
+type HandlerMetrics struct {
+	received      uint64
+	panicked      uint64
+	totalDuration int64
+}
+
+// HandlerMetricsSnapshot is a copy of the counters of HandlerMetrics at some point in time
+type HandlerMetricsSnapshot struct {
+	Received      uint64
+	Panicked      uint64
+	TotalDuration time.Duration
+}
+
+func NewHandlerMetrics() *HandlerMetrics {
+	return &HandlerMetrics{}
+}
+
+func (m *HandlerMetrics) Snapshot() HandlerMetricsSnapshot {
+	return HandlerMetricsSnapshot{
+		Received:      atomic.LoadUint64(&m.received),
+		Panicked:      atomic.LoadUint64(&m.panicked),
+		TotalDuration: time.Duration(atomic.LoadInt64(&m.totalDuration)),
+	}
+}
+
+// track runs handle and records its outcome. Panics are re-raised once counted.
+func (m *HandlerMetrics) track(handle func()) {
+	start := time.Now()
+	atomic.AddUint64(&m.received, 1)
+	defer func() {
+		atomic.AddInt64(&m.totalDuration, int64(time.Since(start)))
+		if r := recover(); nil != r {
+			atomic.AddUint64(&m.panicked, 1)
+			panic(r)
+		}
+	}()
+	handle()
+}
+
+func (m *HandlerMetrics) NymMiddleware() NymMiddleware {
+	return func(next NymHandler) NymHandler {
+		return func(msg NymReceived, send func(NymMessage) error) {
+			m.track(func() { next(msg, send) })
+		}
+	}
+}
+
+func (m *HandlerMetrics) SocketMiddleware() SocketMiddleware {
+	return func(next SocketHandler) SocketHandler {
+		return func(msg []byte, send func([]byte) error) {
+			m.track(func() { next(msg, send) })
+		}
+	}
+}
+
+func middlewareLogger(parentLogger *zerolog.Logger, component string) *zerolog.Logger {
+	if nil == parentLogger {
+		nopLogger := zerolog.Nop()
+		return &nopLogger
+	}
+	localLogger := parentLogger.With().Str(ComponentField, component).Logger()
+	return &localLogger
+}
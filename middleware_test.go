@@ -0,0 +1,150 @@
+package nymsocketmanager_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func noSend(lib.NymMessage) error { return nil }
+
+func TestChainNymMiddlewareOrder(t *testing.T) {
+	calls := []string{}
+
+	tracing := func(name string) lib.NymMiddleware {
+		return func(next lib.NymHandler) lib.NymHandler {
+			return func(msg lib.NymReceived, send func(lib.NymMessage) error) {
+				calls = append(calls, name)
+				next(msg, send)
+			}
+		}
+	}
+
+	handler := lib.ChainNymMiddleware(func(lib.NymReceived, func(lib.NymMessage) error) {
+		calls = append(calls, "handler")
+	}, tracing("first"), tracing("second"))
+
+	handler(lib.NymReceived{}, noSend)
+	require.Equal(t, []string{"first", "second", "handler"}, calls)
+}
+
+func TestNymRecoverMiddlewareRecoversFromPanic(t *testing.T) {
+	metrics := lib.NewHandlerMetrics()
+
+	handler := lib.ChainNymMiddleware(func(lib.NymReceived, func(lib.NymMessage) error) {
+		panic("boom")
+	}, lib.NymRecoverMiddleware(nil), metrics.NymMiddleware())
+
+	require.NotPanics(t, func() { handler(lib.NymReceived{}, noSend) })
+	require.Equal(t, uint64(1), metrics.Snapshot().Received)
+	require.Equal(t, uint64(1), metrics.Snapshot().Panicked)
+}
+
+func TestSocketRecoverMiddlewareRecoversFromPanic(t *testing.T) {
+	handler := lib.ChainSocketMiddleware(func([]byte, func([]byte) error) {
+		panic("boom")
+	}, lib.SocketRecoverMiddleware(nil))
+
+	require.NotPanics(t, func() { handler([]byte("msg"), nil) })
+}
+
+func TestNymSocketManagerRecoversByDefault(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	nymSocketManager, e := lib.NewNymSocketManager("ws://unused", func(lib.NymReceived, func(lib.NymMessage) error) {
+		panic("boom")
+	}, &logger)
+	require.NoError(t, e)
+
+	msgBytes, e := lib.EncodeNymMessage(lib.NewNymReceived("msg", ""))
+	require.NoError(t, e)
+
+	require.NotPanics(t, func() { lib.MessageDispatcher(nymSocketManager, msgBytes) })
+
+	nymSocketManager.DisableRecover()
+	require.Panics(t, func() { lib.MessageDispatcher(nymSocketManager, msgBytes) })
+
+	nymSocketManager.EnableRecover()
+	require.NotPanics(t, func() { lib.MessageDispatcher(nymSocketManager, msgBytes) })
+}
+
+func TestNymFilterMiddlewareDropsRejectedMessages(t *testing.T) {
+	handled := 0
+
+	handler := lib.ChainNymMiddleware(func(lib.NymReceived, func(lib.NymMessage) error) {
+		handled++
+	}, lib.NymFilterMiddleware(func(msg lib.NymReceived) bool {
+		return len(msg.SenderTag) != 0
+	}))
+
+	handler(lib.NewNymReceived("a", "").(lib.NymReceived), noSend)
+	handler(lib.NewNymReceived("b", "tag").(lib.NymReceived), noSend)
+	require.Equal(t, 1, handled)
+}
+
+// envelope returns a layer wrapping payloads in name(...) on send and unwrapping them on receive
+func envelope(name string) (lib.NymMiddleware, lib.NymSendMiddleware) {
+	receive := func(next lib.NymHandler) lib.NymHandler {
+		return func(msg lib.NymReceived, send func(lib.NymMessage) error) {
+			inner, ok := strings.CutPrefix(msg.Message, name+"(")
+			if !ok || !strings.HasSuffix(inner, ")") {
+				return
+			}
+			msg.Message = strings.TrimSuffix(inner, ")")
+			next(msg, send)
+		}
+	}
+	send := func(next lib.NymSender) lib.NymSender {
+		return func(msg lib.NymMessage) error {
+			payload, _ := lib.GetPayload(msg)
+			wrapped, _ := lib.WithPayload(msg, name+"("+payload+")")
+			return next(wrapped)
+		}
+	}
+	return receive, send
+}
+
+func TestUseSendStacksEnvelopesInReverseOrder(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer fakeNymClient.Close()
+
+	received := make(chan string, 1)
+	nymSocketManager, e := lib.NewNymSocketManager(fakeNymClient.URI(), func(msg lib.NymReceived, _ func(lib.NymMessage) error) {
+		received <- msg.Message
+	}, &logger)
+	require.NoError(t, e)
+
+	// Layers registered in the same order on both paths: "first" is the closest to the nym-client
+	for _, name := range []string{"first", "second"} {
+		receive, send := envelope(name)
+		nymSocketManager.Use(receive)
+		nymSocketManager.UseSend(send)
+	}
+
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+	defer nymSocketManager.Stop()
+
+	require.NoError(t, nymSocketManager.Send(lib.NewNymSend("payload", fakeNymClient.Address())))
+
+	select {
+	case message := <-received:
+		require.Equal(t, "payload", message)
+	case <-time.After(time.Second):
+		require.Fail(t, "message not received")
+	}
+
+	request := <-fakeNymClient.Requests()
+	_, isSelfAddress := request.(lib.NymSelfAddressRequest)
+	require.True(t, isSelfAddress)
+	request = <-fakeNymClient.Requests()
+	payload, _ := lib.GetPayload(request)
+	require.Equal(t, "first(second(payload))", payload)
+}
@@ -0,0 +1,148 @@
+package nymsocketmanager
+
+import (
+	"math/big"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+/*
+ * A Nym address has the form "identity.encryption@gateway" where:
+ *   - identity is the base58 encoded ed25519 public identity key of the client,
+ *   - encryption is the base58 encoded x25519 public encryption key of the client,
+ *   - gateway is the base58 encoded ed25519 public identity key of the gateway the client is connected to.
+ */
+
+// NymKeyLength is the length in bytes of each key composing a Nym address
+const NymKeyLength = 32
+
+// ParseNymAddress validates address and splits it into its components
+func ParseNymAddress(address string) (NymAddress, error) {
+	clientPart, gateway, found := strings.Cut(address, "@")
+	if !found {
+		err := xerrors.Errorf("invalid Nym address %q: missing \"@\" separating the gateway", address)
+		return NymAddress{}, err
+	}
+
+	identity, encryptionKey, found := strings.Cut(clientPart, ".")
+	if !found {
+		err := xerrors.Errorf("invalid Nym address %q: missing \".\" separating the encryption key", address)
+		return NymAddress{}, err
+	}
+
+	for _, component := range []struct {
+		name  string
+		value string
+	}{
+		{"identity", identity},
+		{"encryption key", encryptionKey},
+		{"gateway", gateway},
+	} {
+		e := validateNymKey(component.value)
+		if nil != e {
+			err := xerrors.Errorf("invalid Nym address %q: %s %v", address, component.name, e)
+			return NymAddress{}, err
+		}
+	}
+
+	return NymAddress{
+		identity:      identity,
+		encryptionKey: encryptionKey,
+		gateway:       gateway,
+	}, nil
+}
+
+// MustParseNymAddress is like ParseNymAddress but panics on invalid addresses. Meant for constants and tests.
+func MustParseNymAddress(address string) NymAddress {
+	a, e := ParseNymAddress(address)
+	if nil != e {
+		panic(e)
+	}
+	return a
+}
+
+type NymAddress struct {
+	identity      string
+	encryptionKey string
+	gateway       string
+}
+
+// Identity returns the base58 encoded identity key of the client
+func (a NymAddress) Identity() string {
+	return a.identity
+}
+
+// EncryptionKey returns the base58 encoded encryption key of the client
+func (a NymAddress) EncryptionKey() string {
+	return a.encryptionKey
+}
+
+// Gateway returns the base58 encoded identity key of the gateway of the client
+func (a NymAddress) Gateway() string {
+	return a.gateway
+}
+
+// IsZero reports whether a is the zero NymAddress, i.e. not parsed from anything
+func (a NymAddress) IsZero() bool {
+	return a == NymAddress{}
+}
+
+func (a NymAddress) String() string {
+	if a.IsZero() {
+		return ""
+	}
+	return a.identity + "." + a.encryptionKey + "@" + a.gateway
+}
+
+func (a NymAddress) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *NymAddress) UnmarshalText(text []byte) error {
+	parsed, e := ParseNymAddress(string(text))
+	if nil != e {
+		return e
+	}
+	*a = parsed
+	return nil
+}
+
+func validateNymKey(key string) error {
+	if len(key) == 0 {
+		return xerrors.Errorf("is empty")
+	}
+
+	decoded, e := decodeBase58(key)
+	if nil != e {
+		return e
+	}
+
+	if len(decoded) != NymKeyLength {
+		return xerrors.Errorf("is %d bytes long instead of %d", len(decoded), NymKeyLength)
+	}
+
+	return nil
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// decodeBase58 decodes s using the bitcoin alphabet, as used by Nym for its keys
+func decodeBase58(s string) ([]byte, error) {
+	value := new(big.Int)
+	radix := big.NewInt(58)
+
+	for i, c := range s {
+		digit := strings.IndexRune(base58Alphabet, c)
+		if digit < 0 {
+			return nil, xerrors.Errorf("is not valid base58 (character %q at position %d)", c, i)
+		}
+		value.Mul(value, radix)
+		value.Add(value, big.NewInt(int64(digit)))
+	}
+
+	// Leading '1's encode leading zero bytes
+	leadingZeros := len(s) - len(strings.TrimLeft(s, "1"))
+
+	return append(make([]byte, leadingZeros), value.Bytes()...), nil
+}
@@ -0,0 +1,63 @@
+package nymsocketmanager_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testNymIdentity      = "DguTcdkWWtDyUFLvQxRdcA8qZhardhE1ZXy1YCC7Zfmq"
+	testNymEncryptionKey = "Dxreouj5RhQqMb3ZaAxgXFdGkmfbDKwk457FdeHGKmQQ"
+	testNymGateway       = "4kjgWmFU1tY4fm4iAMa7kx5YPrPLNWvmSBo9W8Lsu96c"
+	testNymAddress       = testNymIdentity + "." + testNymEncryptionKey + "@" + testNymGateway
+)
+
+func TestParseNymAddress(t *testing.T) {
+	a, e := lib.ParseNymAddress(testNymAddress)
+	require.NoError(t, e)
+
+	require.Equal(t, testNymIdentity, a.Identity())
+	require.Equal(t, testNymEncryptionKey, a.EncryptionKey())
+	require.Equal(t, testNymGateway, a.Gateway())
+	require.Equal(t, testNymAddress, a.String())
+}
+
+func TestParseNymAddressRejectsInvalidAddresses(t *testing.T) {
+	for _, address := range []string{
+		"",
+		testNymIdentity,
+		testNymIdentity + "." + testNymEncryptionKey,
+		testNymIdentity + "@" + testNymGateway,
+		testNymIdentity + "." + testNymEncryptionKey + "@",
+		testNymIdentity + "." + testNymEncryptionKey + "@" + testNymGateway[:10],
+		testNymIdentity + ".0" + testNymEncryptionKey[1:] + "@" + testNymGateway,
+	} {
+		_, e := lib.ParseNymAddress(address)
+		require.Error(t, e, address)
+	}
+}
+
+func TestNymAddressMarshalsAsString(t *testing.T) {
+	a := lib.MustParseNymAddress(testNymAddress)
+
+	b, e := json.Marshal(a)
+	require.NoError(t, e)
+	require.Equal(t, `"`+testNymAddress+`"`, string(b))
+
+	decoded := lib.NymAddress{}
+	require.NoError(t, json.Unmarshal(b, &decoded))
+	require.Equal(t, a, decoded)
+
+	require.Error(t, json.Unmarshal([]byte(`"invalid"`), &decoded))
+}
+
+func TestZeroNymAddress(t *testing.T) {
+	a := lib.NymAddress{}
+
+	require.True(t, a.IsZero())
+	require.Empty(t, a.String())
+	require.Empty(t, a.Gateway())
+}
@@ -0,0 +1,431 @@
+package nymsocketmanager
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * The NymClientPool spreads the traffic of an application over several nym-clients for redundancy.
+ * It manages one NymSocketManager per nym-client, routes sends according to a PoolPolicy, skips (and keeps
+ * reconnecting) the nym-clients which dropped, and gives every received message to a single messageHandler.
+ * With PoolStickyRecipient, the nym-clients used for the most recent recipients are remembered, up to
+ * SetMaxStickyRecipients of them.
+ */
+
+type PoolPolicy int
+
+const (
+	// PoolRoundRobin uses the running nym-clients in turn
+	PoolRoundRobin PoolPolicy = iota
+	// PoolLeastLoaded uses the running nym-client with the fewest sends in progress
+	PoolLeastLoaded
+	// PoolStickyRecipient always uses the same running nym-client for a given recipient
+	PoolStickyRecipient
+)
+
+// DefaultPoolReconnectInterval is the time waited between two attempts to restart a dropped nym-client
+const DefaultPoolReconnectInterval = 5 * time.Second
+
+// DefaultPoolMaxStickyRecipients is the number of recipients whose nym-client is remembered at most
+const DefaultPoolMaxStickyRecipients = 10000
+
+func NewNymClientPool(connectionURIs []string, messageHandler func(NymReceived, func(NymMessage) error), policy PoolPolicy, parentLogger *zerolog.Logger) (*NymClientPool, error) {
+	if len(connectionURIs) == 0 {
+		err := xerrors.Errorf("at least one connection URI is needed")
+		return nil, err
+	}
+
+	if nil == messageHandler {
+		err := xerrors.Errorf("processing function needs to be defined")
+		return nil, err
+	}
+
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	localLogger := parentLogger.With().Str(ComponentField, "NymClientPool").Logger()
+
+	replyRouter, e := NewNymReplyRouter(DefaultReplyRouteTTL, parentLogger)
+	if nil != e {
+		err := xerrors.Errorf("failed to create the NymReplyRouter: %v", e)
+		return nil, err
+	}
+
+	p := &NymClientPool{
+		policy:              policy,
+		messageHandler:      messageHandler,
+		reconnectInterval:   DefaultPoolReconnectInterval,
+		replyRouter:         replyRouter,
+		stickyRecipients:    make(map[NymAddress]*list.Element),
+		stickyOrder:         list.New(),
+		maxStickyRecipients: DefaultPoolMaxStickyRecipients,
+		logger:              &localLogger,
+	}
+
+	for _, connectionURI := range connectionURIs {
+		manager, e := NewNymSocketManager(connectionURI, p.handleReceived, parentLogger)
+		if nil != e {
+			err := xerrors.Errorf("failed to create NymSocketManager for %v: %v", connectionURI, e)
+			return nil, err
+		}
+		manager.Use(replyRouter.Middleware(manager))
+		p.members = append(p.members, &poolMember{manager: manager})
+	}
+
+	return p, nil
+}
+
+type NymClientPool struct {
+	sync.Mutex
+
+	members []*poolMember
+	policy  PoolPolicy
+
+	messageHandler    NymHandler
+	reconnectInterval time.Duration
+	replyRouter       *NymReplyRouter
+
+	nextMember uint64
+	// stickyRecipients indexes the elements of stickyOrder, which holds the stickyRecipients from the least to the
+	// most recently used
+	stickyRecipients    map[NymAddress]*list.Element
+	stickyOrder         *list.List
+	maxStickyRecipients int
+
+	poolStoppedChan chan struct{}
+	watchers        sync.WaitGroup
+
+	logger *zerolog.Logger
+}
+
+type stickyRecipient struct {
+	recipient NymAddress
+	member    *poolMember
+}
+
+type poolMember struct {
+	manager *NymSocketManager
+
+	running  int32
+	inFlight int64
+	sent     uint64
+}
+
+func (m *poolMember) isRunning() bool {
+	return atomic.LoadInt32(&m.running) == 1
+}
+
+func (m *poolMember) setRunning(running bool) {
+	value := int32(0)
+	if running {
+		value = 1
+	}
+	atomic.StoreInt32(&m.running, value)
+}
+
+// handleReceived gives the messages received by every member to the messageHandler of the pool.
+// The send function routes replies through the member which received the senderTag.
+func (p *NymClientPool) handleReceived(msg NymReceived, send func(NymMessage) error) {
+	p.messageHandler(msg, send)
+}
+
+// ReplyRouter returns the NymReplyRouter remembering which nym-client received each senderTag
+func (p *NymClientPool) ReplyRouter() *NymReplyRouter {
+	return p.replyRouter
+}
+
+// Reply sends message to senderTag through the nym-client which received it
+func (p *NymClientPool) Reply(senderTag string, message string) error {
+	return p.replyRouter.Reply(senderTag, message)
+}
+
+// SetReconnectInterval sets the time waited between two attempts to restart a dropped nym-client
+func (p *NymClientPool) SetReconnectInterval(reconnectInterval time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.reconnectInterval = reconnectInterval
+}
+
+// SetMaxStickyRecipients sets the number of recipients whose nym-client is remembered, the least recently used
+// being forgotten first
+func (p *NymClientPool) SetMaxStickyRecipients(maxStickyRecipients int) {
+	p.Lock()
+	defer p.Unlock()
+
+	if maxStickyRecipients <= 0 {
+		maxStickyRecipients = DefaultPoolMaxStickyRecipients
+	}
+	p.maxStickyRecipients = maxStickyRecipients
+	p.trimStickyRecipients()
+}
+
+// Managers returns the NymSocketManager of every nym-client of the pool
+func (p *NymClientPool) Managers() []*NymSocketManager {
+	managers := make([]*NymSocketManager, 0, len(p.members))
+	for _, member := range p.members {
+		managers = append(managers, member.manager)
+	}
+	return managers
+}
+
+// GetNymClientIds returns the addresses of the running nym-clients of the pool
+func (p *NymClientPool) GetNymClientIds() []NymAddress {
+	addresses := []NymAddress{}
+	for _, member := range p.members {
+		if member.isRunning() {
+			addresses = append(addresses, member.manager.GetNymClientId())
+		}
+	}
+	return addresses
+}
+
+func (p *NymClientPool) IsRunning() bool {
+	p.Lock()
+	defer p.Unlock()
+	return nil != p.poolStoppedChan
+}
+
+// Start starts every nym-client of the pool. It succeeds as long as one of them could be started,
+// the others being retried in the background. The returned chan is closed when the pool is stopped.
+func (p *NymClientPool) Start() (chan struct{}, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.logger.Debug().Msg("starting NymClientPool")
+
+	if nil != p.poolStoppedChan {
+		p.logger.Warn().Msg("NymClientPool already started. Resuming...")
+		return nil, nil
+	}
+
+	stoppedChans := make([]chan struct{}, len(p.members))
+	started := 0
+	for i, member := range p.members {
+		stoppedChan, e := member.manager.Start()
+		if nil != e {
+			p.logger.Warn().Msgf("failed to start member %d of the pool: %v", i, e)
+			continue
+		}
+		member.setRunning(true)
+		stoppedChans[i] = stoppedChan
+		started++
+	}
+
+	if 0 == started {
+		err := xerrors.Errorf("failed to start any of the %d nym-clients of the pool", len(p.members))
+		p.logger.Warn().Msg(err.Error())
+		return nil, err
+	}
+
+	p.poolStoppedChan = make(chan struct{})
+	for i, member := range p.members {
+		p.watchers.Add(1)
+		go p.watch(member, stoppedChans[i], p.poolStoppedChan)
+	}
+
+	p.logger.Debug().Msgf("started NymClientPool with %d/%d nym-clients", started, len(p.members))
+
+	return p.poolStoppedChan, nil
+}
+
+// watch marks member as down when it stops and tries to restart it until the pool is stopped
+func (p *NymClientPool) watch(member *poolMember, memberStoppedChan chan struct{}, poolStoppedChan chan struct{}) {
+	defer p.watchers.Done()
+
+	for {
+		if nil != memberStoppedChan {
+			select {
+			case <-memberStoppedChan:
+				member.setRunning(false)
+				p.logger.Warn().Msg("a nym-client of the pool dropped, failing over to the others")
+			case <-poolStoppedChan:
+				return
+			}
+		}
+
+		p.Lock()
+		reconnectInterval := p.reconnectInterval
+		p.Unlock()
+
+		select {
+		case <-time.After(reconnectInterval):
+		case <-poolStoppedChan:
+			return
+		}
+
+		var e error
+		memberStoppedChan, e = member.manager.Start()
+		if nil != e {
+			p.logger.Debug().Msgf("failed to restart nym-client of the pool: %v", e)
+			memberStoppedChan = nil
+			continue
+		}
+		member.setRunning(true)
+		p.logger.Info().Msg("restarted a nym-client of the pool")
+	}
+}
+
+// Stop stops every nym-client of the pool
+func (p *NymClientPool) Stop() {
+	p.Lock()
+
+	p.logger.Debug().Msg("stopping NymClientPool")
+
+	if nil == p.poolStoppedChan {
+		p.Unlock()
+		return
+	}
+
+	close(p.poolStoppedChan)
+	p.poolStoppedChan = nil
+	p.Unlock()
+
+	// Watchers need the lock to read the reconnect interval
+	p.watchers.Wait()
+
+	for _, member := range p.members {
+		member.setRunning(false)
+		member.manager.Stop()
+	}
+
+	p.logger.Debug().Msg("stopped NymClientPool")
+}
+
+// Send sends msg through one of the running nym-clients, chosen according to the policy.
+// If sending fails, the other running nym-clients are tried in turn.
+// Replies always go through the nym-client which received their senderTag.
+func (p *NymClientPool) Send(msg NymMessage) error {
+	if _, ok := msg.(NymReply); ok {
+		return p.replyRouter.Send(msg)
+	}
+
+	candidates := p.candidates(msg)
+	if len(candidates) == 0 {
+		err := xerrors.Errorf("no nym-client of the pool is running")
+		p.logger.Warn().Msg(err.Error())
+		return err
+	}
+
+	var lastErr error
+	for _, member := range candidates {
+		atomic.AddInt64(&member.inFlight, 1)
+		e := member.manager.Send(msg)
+		atomic.AddInt64(&member.inFlight, -1)
+
+		if nil == e {
+			atomic.AddUint64(&member.sent, 1)
+			p.stick(msg, member)
+			return nil
+		}
+
+		p.logger.Debug().Msgf("failed to send through %v, trying next nym-client: %v", member.manager.GetNymClientId(), e)
+		lastErr = e
+	}
+
+	err := xerrors.Errorf("failed to send through any nym-client of the pool: %v", lastErr)
+	p.logger.Warn().Msg(err.Error())
+	return err
+}
+
+// candidates returns the running members, the one chosen by the policy first
+func (p *NymClientPool) candidates(msg NymMessage) []*poolMember {
+	running := []*poolMember{}
+	for _, member := range p.members {
+		if member.isRunning() {
+			running = append(running, member)
+		}
+	}
+	if len(running) == 0 {
+		return running
+	}
+
+	chosen := 0
+	switch p.policy {
+	case PoolRoundRobin:
+		chosen = int((atomic.AddUint64(&p.nextMember, 1) - 1) % uint64(len(running)))
+
+	case PoolLeastLoaded:
+		for i, member := range running {
+			best := running[chosen]
+			inFlight, bestInFlight := atomic.LoadInt64(&member.inFlight), atomic.LoadInt64(&best.inFlight)
+			if inFlight < bestInFlight || (inFlight == bestInFlight && atomic.LoadUint64(&member.sent) < atomic.LoadUint64(&best.sent)) {
+				chosen = i
+			}
+		}
+
+	case PoolStickyRecipient:
+		chosen = int((atomic.AddUint64(&p.nextMember, 1) - 1) % uint64(len(running)))
+		if recipient, ok := messageRecipient(msg); ok {
+			p.Lock()
+			var sticky *poolMember
+			element, found := p.stickyRecipients[recipient]
+			if found {
+				p.stickyOrder.MoveToBack(element)
+				sticky = element.Value.(*stickyRecipient).member
+			}
+			p.Unlock()
+			for i, member := range running {
+				if found && member == sticky {
+					chosen = i
+					break
+				}
+			}
+		}
+	}
+
+	return append([]*poolMember{running[chosen]}, append(running[:chosen:chosen], running[chosen+1:]...)...)
+}
+
+// stick remembers which member was used for the recipient of msg, if the policy requires it
+func (p *NymClientPool) stick(msg NymMessage, member *poolMember) {
+	if PoolStickyRecipient != p.policy {
+		return
+	}
+
+	recipient, ok := messageRecipient(msg)
+	if !ok {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if element, found := p.stickyRecipients[recipient]; found {
+		element.Value.(*stickyRecipient).member = member
+		p.stickyOrder.MoveToBack(element)
+		return
+	}
+
+	p.stickyRecipients[recipient] = p.stickyOrder.PushBack(&stickyRecipient{recipient: recipient, member: member})
+	p.trimStickyRecipients()
+}
+
+// trimStickyRecipients forgets the least recently used recipients beyond maxStickyRecipients
+// called from methods that already acquired the lock
+func (p *NymClientPool) trimStickyRecipients() {
+	for p.stickyOrder.Len() > p.maxStickyRecipients {
+		element := p.stickyOrder.Front()
+		delete(p.stickyRecipients, element.Value.(*stickyRecipient).recipient)
+		p.stickyOrder.Remove(element)
+	}
+}
+
+// messageRecipient returns the recipient of the messages addressed to a NymAddress
+func messageRecipient(msg NymMessage) (NymAddress, bool) {
+	switch m := msg.(type) {
+	case NymSend:
+		return m.Recipient, true
+	case NymSendAnonymous:
+		return m.Recipient, true
+	default:
+		return NymAddress{}, false
+	}
+}
@@ -0,0 +1,154 @@
+package nymsocketmanager_test
+
+import (
+	"testing"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNymClientPoolShouldHaveConnectionURIs(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	_, e := lib.NewNymClientPool(nil, emptyProcessing, lib.PoolRoundRobin, &logger)
+	require.Error(t, e)
+}
+
+func TestNymClientPoolShouldNotStartWithoutAnyClient(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	pool, e := lib.NewNymClientPool([]string{"aaaaaaaa", "bbbbbbbb"}, emptyProcessing, lib.PoolRoundRobin, &logger)
+	require.NoError(t, e)
+
+	_, e = pool.Start()
+	require.Error(t, e)
+}
+
+func TestNymClientPoolFailsOverWhenAClientDrops(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	first := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer first.Close()
+	second := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer second.Close()
+
+	received := make(chan lib.NymReceived, 10)
+	pool, e := lib.NewNymClientPool([]string{first.URI(), second.URI()}, func(msg lib.NymReceived, _ func(lib.NymMessage) error) {
+		received <- msg
+	}, lib.PoolRoundRobin, &logger)
+	require.NoError(t, e)
+	pool.SetReconnectInterval(time.Hour)
+
+	_, e = pool.Start()
+	require.NoError(t, e)
+	defer pool.Stop()
+
+	require.ElementsMatch(t, []lib.NymAddress{first.Address(), second.Address()}, pool.GetNymClientIds())
+
+	// Fake nym-clients only deliver messages sent to their own address.
+	// With round-robin, only one of the two messages goes through the first nym-client.
+	require.NoError(t, pool.Send(lib.NewNymSend("to first", first.Address())))
+	require.NoError(t, pool.Send(lib.NewNymSend("to first", first.Address())))
+
+	messages := []string{}
+	select {
+	case msg := <-received:
+		messages = append(messages, msg.Message)
+	case <-time.After(time.Second):
+	}
+	require.Len(t, messages, 1)
+
+	first.DropConnections()
+	require.Eventually(t, func() bool {
+		return len(pool.GetNymClientIds()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, pool.Send(lib.NewNymSend("failover", second.Address())))
+		select {
+		case msg := <-received:
+			require.Equal(t, "failover", msg.Message)
+		case <-time.After(time.Second):
+			require.Fail(t, "message not received after failover")
+		}
+	}
+
+	require.Error(t, pool.Send(lib.NewNymReply("tag", "reply")))
+}
+
+func TestNymClientPoolRoutesRepliesThroughReceivingClient(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	first := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer first.Close()
+	second := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer second.Close()
+
+	received := make(chan lib.NymReceived, 10)
+	pool, e := lib.NewNymClientPool([]string{first.URI(), second.URI()}, func(msg lib.NymReceived, _ func(lib.NymMessage) error) {
+		received <- msg
+	}, lib.PoolRoundRobin, &logger)
+	require.NoError(t, e)
+
+	_, e = pool.Start()
+	require.NoError(t, e)
+	defer pool.Stop()
+
+	// Only the anonymous message going through the first nym-client is looped back, with a senderTag
+	require.NoError(t, pool.Send(lib.NewNymSendAnonymous("question", first.Address(), 1)))
+	require.NoError(t, pool.Send(lib.NewNymSendAnonymous("question", first.Address(), 1)))
+
+	var question lib.NymReceived
+	select {
+	case question = <-received:
+	case <-time.After(time.Second):
+		require.Fail(t, "question not received")
+	}
+	require.NotEmpty(t, question.SenderTag)
+
+	manager, ok := pool.ReplyRouter().Lookup(question.SenderTag)
+	require.True(t, ok)
+	require.Equal(t, first.Address(), manager.GetNymClientId())
+
+	// Replies sent twice, as round-robin would use both nym-clients if they were not routed
+	for i := 0; i < 2; i++ {
+		require.NoError(t, pool.Reply(question.SenderTag, "answer"))
+		select {
+		case answer := <-received:
+			require.Equal(t, "answer", answer.Message)
+		case <-time.After(time.Second):
+			require.Fail(t, "reply went through the wrong nym-client")
+		}
+	}
+
+	require.Error(t, pool.Reply("unknown", "answer"))
+}
+
+func TestNymClientPoolForgetsLeastRecentlyUsedStickyRecipients(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer fakeNymClient.Close()
+
+	pool, e := lib.NewNymClientPool([]string{fakeNymClient.URI()}, emptyProcessing, lib.PoolStickyRecipient, &logger)
+	require.NoError(t, e)
+	pool.SetMaxStickyRecipients(2)
+
+	_, e = pool.Start()
+	require.NoError(t, e)
+	defer pool.Stop()
+
+	alice, bob, carol := nymtest.RandomNymAddress(), nymtest.RandomNymAddress(), nymtest.RandomNymAddress()
+	require.NoError(t, pool.Send(lib.NewNymSend("hello", alice)))
+	require.NoError(t, pool.Send(lib.NewNymSend("hello", bob)))
+	require.NoError(t, pool.Send(lib.NewNymSend("hello", alice)))
+	require.NoError(t, pool.Send(lib.NewNymSend("hello", carol)))
+
+	require.Equal(t, []lib.NymAddress{alice, carol}, pool.StickyRecipients())
+
+	pool.SetMaxStickyRecipients(1)
+	require.Equal(t, []lib.NymAddress{carol}, pool.StickyRecipients())
+}
@@ -0,0 +1,211 @@
+package nymsocketmanager
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+/*
+ * A NymConnection is a logical connection handle multiplexed over the single websocket of a NymSocketManager.
+ * Every message sent through the handle carries its connectionId, which the nym-client uses to pick the
+ * corresponding lane. This allows many independent flows to share one nym-client without blocking each other.
+ */
+
+// OpenConnection allocates a new logical connection handle on this NymSocketManager
+func (n *NymSocketManager) OpenConnection() *NymConnection {
+	n.connectionsMutex.Lock()
+	defer n.connectionsMutex.Unlock()
+
+	if nil == n.connections {
+		n.connections = make(map[uint64]*NymConnection)
+	}
+
+	n.lastConnectionId++
+	connection := &NymConnection{
+		id:      n.lastConnectionId,
+		manager: n,
+	}
+	n.connections[connection.id] = connection
+
+	n.logger.Debug().Msgf("opened logical connection %d", connection.id)
+
+	return connection
+}
+
+// GetOpenConnections returns the handles of all logical connections which have not been closed yet
+func (n *NymSocketManager) GetOpenConnections() []*NymConnection {
+	n.connectionsMutex.Lock()
+	defer n.connectionsMutex.Unlock()
+
+	connections := make([]*NymConnection, 0, len(n.connections))
+	for _, connection := range n.connections {
+		connections = append(connections, connection)
+	}
+
+	return connections
+}
+
+// forgetConnection removes the handle from the open connections and drops any pending queue length request
+func (n *NymSocketManager) forgetConnection(connectionId uint64) {
+	n.connectionsMutex.Lock()
+	defer n.connectionsMutex.Unlock()
+
+	delete(n.connections, connectionId)
+	for _, waiter := range n.laneQueueWaiters[connectionId] {
+		close(waiter)
+	}
+	delete(n.laneQueueWaiters, connectionId)
+}
+
+// addLaneQueueWaiter registers a chan to be notified when the queue length of the lane is received
+func (n *NymSocketManager) addLaneQueueWaiter(connectionId uint64) chan uint64 {
+	n.connectionsMutex.Lock()
+	defer n.connectionsMutex.Unlock()
+
+	if nil == n.laneQueueWaiters {
+		n.laneQueueWaiters = make(map[uint64][]chan uint64)
+	}
+
+	waiter := make(chan uint64, 1)
+	n.laneQueueWaiters[connectionId] = append(n.laneQueueWaiters[connectionId], waiter)
+
+	return waiter
+}
+
+// removeLaneQueueWaiter unregisters a chan which did not get any answer
+func (n *NymSocketManager) removeLaneQueueWaiter(connectionId uint64, waiter chan uint64) {
+	n.connectionsMutex.Lock()
+	defer n.connectionsMutex.Unlock()
+
+	waiters := n.laneQueueWaiters[connectionId]
+	for i, w := range waiters {
+		if w == waiter {
+			n.laneQueueWaiters[connectionId] = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(n.laneQueueWaiters[connectionId]) == 0 {
+		delete(n.laneQueueWaiters, connectionId)
+	}
+}
+
+// dispatchLaneQueueLength forwards a laneQueueLength response to everyone waiting for it
+func (n *NymSocketManager) dispatchLaneQueueLength(reply NymLaneQueueLength) {
+	n.connectionsMutex.Lock()
+	defer n.connectionsMutex.Unlock()
+
+	waiters, ok := n.laneQueueWaiters[reply.Lane]
+	if !ok {
+		n.logger.Debug().Msgf("nobody is waiting for the queue length of lane %d", reply.Lane)
+		return
+	}
+	delete(n.laneQueueWaiters, reply.Lane)
+
+	for _, waiter := range waiters {
+		waiter <- reply.QueueLength
+	}
+}
+
+type NymConnection struct {
+	sync.Mutex
+
+	id      uint64
+	manager *NymSocketManager
+	closed  bool
+}
+
+// ID returns the connectionId attached to every message sent through this handle
+func (c *NymConnection) ID() uint64 {
+	return c.id
+}
+
+func (c *NymConnection) IsClosed() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.closed
+}
+
+// Send sends message to recipient on this logical connection
+func (c *NymConnection) Send(message string, recipient NymAddress) error {
+	return c.send(NewNymSendOnConnection(message, recipient, c.id))
+}
+
+// SendAnonymous sends message to recipient on this logical connection, attaching nbReplySurbs for the reply
+func (c *NymConnection) SendAnonymous(message string, recipient NymAddress, nbReplySurbs uint) error {
+	return c.send(NewNymSendAnonymousOnConnection(message, recipient, nbReplySurbs, c.id))
+}
+
+// Reply answers senderTag on this logical connection
+func (c *NymConnection) Reply(senderTag string, message string) error {
+	return c.send(NewNymReplyOnConnection(senderTag, message, c.id))
+}
+
+func (c *NymConnection) send(msg NymMessage) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		err := xerrors.Errorf("connection %d is closed", c.id)
+		c.manager.logger.Warn().Msg(err.Error())
+		return err
+	}
+
+	return c.manager.Send(msg)
+}
+
+// QueueLength asks the nym-client how many messages are still queued on this logical connection
+func (c *NymConnection) QueueLength(timeout time.Duration) (uint64, error) {
+	if c.IsClosed() {
+		err := xerrors.Errorf("connection %d is closed", c.id)
+		c.manager.logger.Warn().Msg(err.Error())
+		return 0, err
+	}
+
+	waiter := c.manager.addLaneQueueWaiter(c.id)
+
+	e := c.manager.Send(NewNymGetLaneQueueLength(c.id))
+	if nil != e {
+		c.manager.removeLaneQueueWaiter(c.id, waiter)
+		err := xerrors.Errorf("failed to request queue length of connection %d: %v", c.id, e)
+		return 0, err
+	}
+
+	select {
+	case queueLength, ok := <-waiter:
+		if !ok {
+			err := xerrors.Errorf("connection %d closed while waiting for its queue length", c.id)
+			return 0, err
+		}
+		return queueLength, nil
+
+	case <-time.After(timeout):
+		c.manager.removeLaneQueueWaiter(c.id, waiter)
+		err := xerrors.Errorf("timed-out (%v) on waiting for queue length of connection %d", timeout, c.id)
+		c.manager.logger.Warn().Msg(err.Error())
+		return 0, err
+	}
+}
+
+// Close signals the nym-client that this logical connection is over. Further sends on the handle fail.
+func (c *NymConnection) Close() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	e := c.manager.Send(NewNymClosedConnection(c.id))
+	if nil != e {
+		err := xerrors.Errorf("failed to close connection %d: %v", c.id, e)
+		return err
+	}
+
+	c.closed = true
+	c.manager.forgetConnection(c.id)
+	c.manager.logger.Debug().Msgf("closed logical connection %d", c.id)
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package nymsocketmanager_test
+
+import (
+	"testing"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// nextRequest returns the next message sent to fakeNymClient which is not a selfAddress request
+func nextRequest(t *testing.T, fakeNymClient *nymtest.FakeNymClient) lib.NymMessage {
+	for {
+		select {
+		case request := <-fakeNymClient.Requests():
+			if _, isSelfAddress := request.(lib.NymSelfAddressRequest); isSelfAddress {
+				continue
+			}
+			return request
+		case <-time.After(time.Second):
+			require.FailNow(t, "no request received")
+		}
+	}
+}
+
+func TestNymConnectionSendsItsConnectionId(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer fakeNymClient.Close()
+
+	nymSocketManager, e := lib.NewNymSocketManager(fakeNymClient.URI(), emptyProcessing, &logger)
+	require.NoError(t, e)
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+	defer nymSocketManager.Stop()
+
+	first := nymSocketManager.OpenConnection()
+	second := nymSocketManager.OpenConnection()
+	require.NotEqual(t, first.ID(), second.ID())
+	require.Len(t, nymSocketManager.GetOpenConnections(), 2)
+
+	recipient := nymtest.RandomNymAddress()
+	require.NoError(t, second.Send("hello", recipient))
+	send, isSend := nextRequest(t, fakeNymClient).(lib.NymSend)
+	require.True(t, isSend)
+	require.Equal(t, "hello", send.Message)
+	require.NotNil(t, send.ConnectionId)
+	require.Equal(t, second.ID(), *send.ConnectionId)
+
+	require.NoError(t, first.SendAnonymous("hello", recipient, 3))
+	sendAnonymous, isSendAnonymous := nextRequest(t, fakeNymClient).(lib.NymSendAnonymous)
+	require.True(t, isSendAnonymous)
+	require.NotNil(t, sendAnonymous.ConnectionId)
+	require.Equal(t, first.ID(), *sendAnonymous.ConnectionId)
+}
+
+func TestNymConnectionQueueLength(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer fakeNymClient.Close()
+
+	nymSocketManager, e := lib.NewNymSocketManager(fakeNymClient.URI(), emptyProcessing, &logger)
+	require.NoError(t, e)
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+	defer nymSocketManager.Stop()
+
+	connection := nymSocketManager.OpenConnection()
+	queueLength, e := connection.QueueLength(time.Second)
+	require.NoError(t, e)
+	require.Equal(t, uint64(0), queueLength)
+
+	request, isRequest := nextRequest(t, fakeNymClient).(lib.NymGetLaneQueueLength)
+	require.True(t, isRequest)
+	require.Equal(t, connection.ID(), request.ConnectionId)
+}
+
+func TestNymConnectionQueueLengthTimesOut(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	nymSocketManager, e := lib.NewNymSocketManager("replay://", emptyProcessing, &logger)
+	require.NoError(t, e)
+	nymSocketManager.SetDialer(silentNymClient(t))
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+	defer nymSocketManager.Stop()
+
+	connection := nymSocketManager.OpenConnection()
+	_, e = connection.QueueLength(20 * time.Millisecond)
+	require.Error(t, e)
+
+	// Closing the connection wakes up whoever is still waiting for its queue length
+	failed := make(chan error, 1)
+	go func() {
+		_, e := connection.QueueLength(time.Minute)
+		failed <- e
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, connection.Close())
+
+	select {
+	case e := <-failed:
+		require.Error(t, e)
+	case <-time.After(time.Second):
+		require.Fail(t, "QueueLength not woken up by Close")
+	}
+}
+
+func TestNymConnectionClose(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer fakeNymClient.Close()
+
+	nymSocketManager, e := lib.NewNymSocketManager(fakeNymClient.URI(), emptyProcessing, &logger)
+	require.NoError(t, e)
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+	defer nymSocketManager.Stop()
+
+	connection := nymSocketManager.OpenConnection()
+	require.NoError(t, connection.Close())
+	require.True(t, connection.IsClosed())
+	require.Empty(t, nymSocketManager.GetOpenConnections())
+
+	closed, isClosed := nextRequest(t, fakeNymClient).(lib.NymClosedConnection)
+	require.True(t, isClosed)
+	require.Equal(t, connection.ID(), closed.ConnectionId)
+
+	// Closing twice is a no-op, while sending fails
+	require.NoError(t, connection.Close())
+	require.Error(t, connection.Send("hello", nymtest.RandomNymAddress()))
+	_, e = connection.QueueLength(time.Second)
+	require.Error(t, e)
+}
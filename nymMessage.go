@@ -1,6 +1,9 @@
 package nymsocketmanager
 
-import "fmt"
+import (
+	"crypto/ed25519"
+	"fmt"
+)
 
 type NymMessageCommon struct {
 	Type string `json:"type"`
@@ -13,6 +16,42 @@ type NymMessage interface {
 	String() string
 }
 
+// GetPayload returns the application payload carried by msg, if it is a message carrying one
+func GetPayload(msg NymMessage) (string, bool) {
+	switch m := msg.(type) {
+	case NymSend:
+		return m.Message, true
+	case NymSendAnonymous:
+		return m.Message, true
+	case NymReply:
+		return m.Message, true
+	case NymReceived:
+		return m.Message, true
+	default:
+		return "", false
+	}
+}
+
+// WithPayload returns a copy of msg carrying payload instead, if it is a message carrying one
+func WithPayload(msg NymMessage, payload string) (NymMessage, bool) {
+	switch m := msg.(type) {
+	case NymSend:
+		m.Message = payload
+		return m, true
+	case NymSendAnonymous:
+		m.Message = payload
+		return m, true
+	case NymReply:
+		m.Message = payload
+		return m, true
+	case NymReceived:
+		m.Message = payload
+		return m, true
+	default:
+		return msg, false
+	}
+}
+
 /*********************************************
  * NymError
  *********************************************/
@@ -118,20 +157,31 @@ func (n NymSelfAddressReply) String() string {
 
 const NymSendType = "send"
 
-func NewNymSend(message string, recipient string) NymMessage {
+func NewNymSend(message string, recipient NymAddress) NymMessage {
+	return NymSend{
+		NymMessageCommon{
+			Type: NymSendType,
+		},
+		message, recipient, nil,
+	}
+}
+
+// NewNymSendOnConnection creates a NymSend attached to the logical connection connectionId
+func NewNymSendOnConnection(message string, recipient NymAddress, connectionId uint64) NymMessage {
 	return NymSend{
 		NymMessageCommon{
 			Type: NymSendType,
 		},
-		message, recipient,
+		message, recipient, &connectionId,
 	}
 }
 
 type NymSend struct {
 	NymMessageCommon
 
-	Message   string `json:"message"`
-	Recipient string `json:"recipient"`
+	Message      string     `json:"message"`
+	Recipient    NymAddress `json:"recipient"`
+	ConnectionId *uint64    `json:"connectionId,omitempty"`
 }
 
 func (NymSend) NewEmpty() NymMessage {
@@ -139,7 +189,7 @@ func (NymSend) NewEmpty() NymMessage {
 		NymMessageCommon{
 			Type: NymSendType,
 		},
-		"", "",
+		"", NymAddress{}, nil,
 	}
 }
 
@@ -158,21 +208,32 @@ func (n NymSend) String() string {
 
 const NymSendAnonymousType = "sendAnonymous"
 
-func NewNymSendAnonymous(message string, recipient string, nbReplySurbs uint) NymMessage {
+func NewNymSendAnonymous(message string, recipient NymAddress, nbReplySurbs uint) NymMessage {
 	return NymSendAnonymous{
 		NymMessageCommon{
-			Type: NymSendType,
+			Type: NymSendAnonymousType,
+		},
+		message, recipient, nbReplySurbs, nil,
+	}
+}
+
+// NewNymSendAnonymousOnConnection creates a NymSendAnonymous attached to the logical connection connectionId
+func NewNymSendAnonymousOnConnection(message string, recipient NymAddress, nbReplySurbs uint, connectionId uint64) NymMessage {
+	return NymSendAnonymous{
+		NymMessageCommon{
+			Type: NymSendAnonymousType,
 		},
-		message, recipient, nbReplySurbs,
+		message, recipient, nbReplySurbs, &connectionId,
 	}
 }
 
 type NymSendAnonymous struct {
 	NymMessageCommon
 
-	Message    string `json:"message"`
-	Recipient  string `json:"recipient"`
-	ReplySurbs uint   `json:"replySurbs"`
+	Message      string     `json:"message"`
+	Recipient    NymAddress `json:"recipient"`
+	ReplySurbs   uint       `json:"replySurbs"`
+	ConnectionId *uint64    `json:"connectionId,omitempty"`
 }
 
 func (NymSendAnonymous) NewEmpty() NymMessage {
@@ -180,7 +241,7 @@ func (NymSendAnonymous) NewEmpty() NymMessage {
 		NymMessageCommon{
 			Type: NymSendAnonymousType,
 		},
-		"", "", 0,
+		"", NymAddress{}, 0, nil,
 	}
 }
 
@@ -204,7 +265,7 @@ func NewNymReceived(message string, senderTag string) NymMessage {
 		NymMessageCommon{
 			Type: NymReceivedType,
 		},
-		message, senderTag,
+		message, senderTag, nil,
 	}
 }
 
@@ -213,6 +274,9 @@ type NymReceived struct {
 
 	Message   string `json:"message"`
 	SenderTag string `json:"senderTag"`
+
+	// Identity of the peer which signed the message, set by the NymSecureLayer once verified. Never sent on the wire.
+	VerifiedPeer ed25519.PublicKey `json:"-"`
 }
 
 func (NymReceived) NewEmpty() NymMessage {
@@ -220,7 +284,7 @@ func (NymReceived) NewEmpty() NymMessage {
 		NymMessageCommon{
 			Type: NymReceivedType,
 		},
-		"", "",
+		"", "", nil,
 	}
 }
 
@@ -242,7 +306,17 @@ func NewNymReply(senderTag string, message string) NymMessage {
 		NymMessageCommon{
 			Type: NymReplyType,
 		},
-		message, senderTag,
+		message, senderTag, nil,
+	}
+}
+
+// NewNymReplyOnConnection creates a NymReply attached to the logical connection connectionId
+func NewNymReplyOnConnection(senderTag string, message string, connectionId uint64) NymMessage {
+	return NymReply{
+		NymMessageCommon{
+			Type: NymReplyType,
+		},
+		message, senderTag, &connectionId,
 	}
 }
 
@@ -251,8 +325,9 @@ const NymReplyType = "reply"
 type NymReply struct {
 	NymMessageCommon
 
-	Message   string `json:"message"`
-	SenderTag string `json:"senderTag"`
+	Message      string  `json:"message"`
+	SenderTag    string  `json:"senderTag"`
+	ConnectionId *uint64 `json:"connectionId,omitempty"`
 }
 
 func (n NymReply) NewEmpty() NymMessage {
@@ -260,7 +335,7 @@ func (n NymReply) NewEmpty() NymMessage {
 		NymMessageCommon{
 			Type: NymReplyType,
 		},
-		"", "",
+		"", "", nil,
 	}
 }
 
@@ -272,3 +347,106 @@ func (n NymReply) String() string {
 	s := fmt.Sprintf("NymReply for %s: \"%s\"", n.SenderTag, n.Message)
 	return s
 }
+
+/*********************************************
+ * NymClosedConnection
+ *********************************************/
+
+const NymClosedConnectionType = "closedConnection"
+
+func NewNymClosedConnection(connectionId uint64) NymMessage {
+	return NymClosedConnection{
+		NymMessageCommon{
+			Type: NymClosedConnectionType,
+		},
+		connectionId,
+	}
+}
+
+type NymClosedConnection struct {
+	NymMessageCommon
+
+	ConnectionId uint64 `json:"connectionId"`
+}
+
+func (NymClosedConnection) NewEmpty() NymMessage {
+	return NewNymClosedConnection(0)
+}
+
+func (NymClosedConnection) Name() string {
+	return "NymClosedConnection"
+}
+
+func (n NymClosedConnection) String() string {
+	s := fmt.Sprintf("NymClosedConnection: %d", n.ConnectionId)
+	return s
+}
+
+/*********************************************
+ * NymGetLaneQueueLength
+ *********************************************/
+
+const NymGetLaneQueueLengthType = "getLaneQueueLength"
+
+func NewNymGetLaneQueueLength(connectionId uint64) NymMessage {
+	return NymGetLaneQueueLength{
+		NymMessageCommon{
+			Type: NymGetLaneQueueLengthType,
+		},
+		connectionId,
+	}
+}
+
+type NymGetLaneQueueLength struct {
+	NymMessageCommon
+
+	ConnectionId uint64 `json:"connectionId"`
+}
+
+func (NymGetLaneQueueLength) NewEmpty() NymMessage {
+	return NewNymGetLaneQueueLength(0)
+}
+
+func (NymGetLaneQueueLength) Name() string {
+	return "NymGetLaneQueueLength"
+}
+
+func (n NymGetLaneQueueLength) String() string {
+	s := fmt.Sprintf("NymGetLaneQueueLength: %d", n.ConnectionId)
+	return s
+}
+
+/*********************************************
+ * NymLaneQueueLength
+ *********************************************/
+
+const NymLaneQueueLengthType = "laneQueueLength"
+
+func NewNymLaneQueueLength(lane uint64, queueLength uint64) NymMessage {
+	return NymLaneQueueLength{
+		NymMessageCommon{
+			Type: NymLaneQueueLengthType,
+		},
+		lane, queueLength,
+	}
+}
+
+type NymLaneQueueLength struct {
+	NymMessageCommon
+
+	Lane        uint64 `json:"lane"`
+	QueueLength uint64 `json:"queueLength"`
+}
+
+func (NymLaneQueueLength) NewEmpty() NymMessage {
+	return NewNymLaneQueueLength(0, 0)
+}
+
+func (NymLaneQueueLength) Name() string {
+	return "NymLaneQueueLength"
+}
+
+func (n NymLaneQueueLength) String() string {
+	s := fmt.Sprintf("NymLaneQueueLength for lane %d: %d", n.Lane, n.QueueLength)
+	return s
+}
@@ -0,0 +1,121 @@
+package nymsocketmanager
+
+import (
+	"encoding/json"
+
+	"golang.org/x/xerrors"
+)
+
+/*
+ * Canonical wire encoding of the NymMessages exchanged with the nym-client.
+ * The "type" attribute is always derived from the Go type of the message, so that a message built by hand
+ * (or with a wrong Type) cannot go out with a type that does not match its content.
+ */
+
+// EncodeNymMessage marshals msg to the JSON expected by the nym-client, enforcing the type attribute
+func EncodeNymMessage(msg NymMessage) ([]byte, error) {
+	switch m := msg.(type) {
+	case NymError:
+		m.Type = NymErrorType
+		return marshalNymMessage(m)
+	case NymSelfAddressRequest:
+		m.Type = NymSelfAddressType
+		return marshalNymMessage(m)
+	case NymSelfAddressReply:
+		m.Type = NymSelfAddressReplyType
+		return marshalNymMessage(m)
+	case NymSend:
+		if m.Recipient.IsZero() {
+			return nil, xerrors.Errorf("cannot encode %v without recipient", m.Name())
+		}
+		m.Type = NymSendType
+		return marshalNymMessage(m)
+	case NymSendAnonymous:
+		if m.Recipient.IsZero() {
+			return nil, xerrors.Errorf("cannot encode %v without recipient", m.Name())
+		}
+		m.Type = NymSendAnonymousType
+		return marshalNymMessage(m)
+	case NymReceived:
+		m.Type = NymReceivedType
+		return marshalNymMessage(m)
+	case NymReply:
+		m.Type = NymReplyType
+		return marshalNymMessage(m)
+	case NymClosedConnection:
+		m.Type = NymClosedConnectionType
+		return marshalNymMessage(m)
+	case NymGetLaneQueueLength:
+		m.Type = NymGetLaneQueueLengthType
+		return marshalNymMessage(m)
+	case NymLaneQueueLength:
+		m.Type = NymLaneQueueLengthType
+		return marshalNymMessage(m)
+	case nil:
+		return nil, xerrors.Errorf("cannot encode undefined NymMessage")
+	default:
+		return nil, xerrors.Errorf("cannot encode unknown NymMessage %T", msg)
+	}
+}
+
+func marshalNymMessage(msg NymMessage) ([]byte, error) {
+	msgBytes, e := json.Marshal(msg)
+	if nil != e {
+		return nil, xerrors.Errorf("failed to marshal %v: %v", msg.Name(), e)
+	}
+	return msgBytes, nil
+}
+
+// DecodeNymMessage unmarshals a JSON message from (or to) the nym-client into the NymMessage matching its type.
+// As requests and replies for the self address share the same type, the presence of the address tells them apart.
+func DecodeNymMessage(msgBytes []byte) (NymMessage, error) {
+	header := struct {
+		Type    *string          `json:"type"`
+		Address *json.RawMessage `json:"address"`
+	}{}
+	e := json.Unmarshal(msgBytes, &header)
+	if nil != e {
+		return nil, xerrors.Errorf("failed to unmarshal message: %v", e)
+	}
+
+	if nil == header.Type {
+		return nil, xerrors.Errorf("message has no \"type\" attribute")
+	}
+
+	switch *header.Type {
+	case NymErrorType:
+		return unmarshalNymMessage[NymError](msgBytes)
+	case NymSelfAddressType:
+		if nil == header.Address {
+			return unmarshalNymMessage[NymSelfAddressRequest](msgBytes)
+		}
+		return unmarshalNymMessage[NymSelfAddressReply](msgBytes)
+	case NymSendType:
+		return unmarshalNymMessage[NymSend](msgBytes)
+	case NymSendAnonymousType:
+		return unmarshalNymMessage[NymSendAnonymous](msgBytes)
+	case NymReceivedType:
+		return unmarshalNymMessage[NymReceived](msgBytes)
+	case NymReplyType:
+		return unmarshalNymMessage[NymReply](msgBytes)
+	case NymClosedConnectionType:
+		return unmarshalNymMessage[NymClosedConnection](msgBytes)
+	case NymGetLaneQueueLengthType:
+		return unmarshalNymMessage[NymGetLaneQueueLength](msgBytes)
+	case NymLaneQueueLengthType:
+		return unmarshalNymMessage[NymLaneQueueLength](msgBytes)
+	default:
+		return nil, xerrors.Errorf("unknown type of message %q", *header.Type)
+	}
+}
+
+func unmarshalNymMessage[T NymMessage](msgBytes []byte) (NymMessage, error) {
+	var msg T
+	msg = msg.NewEmpty().(T)
+
+	e := json.Unmarshal(msgBytes, &msg)
+	if nil != e {
+		return nil, xerrors.Errorf("failed to unmarshal %v: %v", msg.Name(), e)
+	}
+	return msg, nil
+}
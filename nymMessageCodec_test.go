@@ -0,0 +1,111 @@
+package nymsocketmanager_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+const testSenderTag = "7vv2LmF9M6EHQaePVYwzzJQ"
+
+// Golden files follow the JSON documented for the websocket of the nym-client
+func goldenMessages() map[string]lib.NymMessage {
+	address := lib.MustParseNymAddress(testNymAddress)
+
+	return map[string]lib.NymMessage{
+		"send.json":               lib.NewNymSend("Hello Nym", address),
+		"sendOnConnection.json":   lib.NewNymSendOnConnection("Hello Nym", address, 12),
+		"sendAnonymous.json":      lib.NewNymSendAnonymous("Hello Nym", address, 20),
+		"reply.json":              lib.NewNymReply(testSenderTag, "Hello back"),
+		"selfAddressRequest.json": lib.NewSelfAddressRequest(),
+		"selfAddressReply.json":   lib.NewSelfAddressReply(testNymAddress),
+		"received.json":           lib.NewNymReceived("Hello Nym", testSenderTag),
+		"error.json":              lib.NymError{NymMessageCommon: lib.NymMessageCommon{Type: lib.NymErrorType}, Message: "recipient address is malformed"},
+		"closedConnection.json":   lib.NewNymClosedConnection(12),
+		"getLaneQueueLength.json": lib.NewNymGetLaneQueueLength(12),
+		"laneQueueLength.json":    lib.NewNymLaneQueueLength(12, 3),
+	}
+}
+
+func TestEncodeNymMessageMatchesGoldenFiles(t *testing.T) {
+	for file, msg := range goldenMessages() {
+		golden, e := os.ReadFile(filepath.Join("testdata", "golden", file))
+		require.NoError(t, e)
+
+		encoded, e := lib.EncodeNymMessage(msg)
+		require.NoError(t, e, file)
+		require.JSONEq(t, string(golden), string(encoded), file)
+	}
+}
+
+func TestDecodeNymMessageMatchesGoldenFiles(t *testing.T) {
+	for file, msg := range goldenMessages() {
+		golden, e := os.ReadFile(filepath.Join("testdata", "golden", file))
+		require.NoError(t, e)
+
+		decoded, e := lib.DecodeNymMessage(golden)
+		require.NoError(t, e, file)
+		require.Equal(t, msg, decoded, file)
+	}
+}
+
+func TestEncodeNymMessageEnforcesType(t *testing.T) {
+	msg := lib.NewNymSendAnonymous("Hello Nym", lib.MustParseNymAddress(testNymAddress), 1).(lib.NymSendAnonymous)
+	require.Equal(t, lib.NymSendAnonymousType, msg.Type)
+
+	msg.Type = lib.NymSendType
+	encoded, e := lib.EncodeNymMessage(msg)
+	require.NoError(t, e)
+
+	decoded, e := lib.DecodeNymMessage(encoded)
+	require.NoError(t, e)
+	require.IsType(t, lib.NymSendAnonymous{}, decoded)
+}
+
+func TestEncodeNymMessageRejectsUndefinedRecipients(t *testing.T) {
+	for _, msg := range []lib.NymMessage{
+		lib.NewNymSend("Hello Nym", lib.NymAddress{}),
+		lib.NewNymSendAnonymous("Hello Nym", lib.NymAddress{}, 1),
+		lib.NewNymSendOnConnection("Hello Nym", lib.NymAddress{}, 1),
+	} {
+		_, e := lib.EncodeNymMessage(msg)
+		require.Error(t, e, msg.Name())
+	}
+}
+
+func TestDecodeNymMessageRejectsInvalidMessages(t *testing.T) {
+	for _, msg := range []string{
+		``,
+		`[]`,
+		`{}`,
+		`{"type":"unknown"}`,
+		`{"type":"received","message":3}`,
+	} {
+		_, e := lib.DecodeNymMessage([]byte(msg))
+		require.Error(t, e, msg)
+	}
+}
+
+func FuzzMessageDispatcher(f *testing.F) {
+	entries, e := os.ReadDir(filepath.Join("testdata", "golden"))
+	require.NoError(f, e)
+	for _, entry := range entries {
+		golden, e := os.ReadFile(filepath.Join("testdata", "golden", entry.Name()))
+		require.NoError(f, e)
+		f.Add(golden)
+	}
+	f.Add([]byte(`{"type":"selfAddress","address":"a@b"}`))
+	f.Add([]byte(`{"type":null}`))
+
+	logger := zerolog.Nop()
+	nymSocketManager, e := lib.NewNymSocketManager("ws://127.0.0.1", emptyProcessing, &logger)
+	require.NoError(f, e)
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		lib.MessageDispatcher(nymSocketManager, msg)
+	})
+}
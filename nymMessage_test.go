@@ -1,6 +1,7 @@
 package nymsocketmanager_test
 
 import (
+	"encoding/json"
 	"math/rand"
 	"testing"
 	"time"
@@ -29,7 +30,7 @@ func RandStringBytes(n int) string {
  * NymError
  *********************************************/
 
-func TestNymErrorNewEmtpy(t *testing.T) {
+func TestNymErrorNewEmpty(t *testing.T) {
 	n := lib.NymError{}.NewEmpty()
 
 	require.Equal(t, n.(lib.NymError).Type, lib.NymErrorType)
@@ -39,7 +40,7 @@ func TestNymErrorNewEmtpy(t *testing.T) {
  * NymSelfAddressRequest
  *********************************************/
 
-func TestNymSelfAddressRequestNewEmtpy(t *testing.T) {
+func TestNymSelfAddressRequestNewEmpty(t *testing.T) {
 	n := lib.NymSelfAddressRequest{}.NewEmpty()
 
 	require.Equal(t, n.(lib.NymSelfAddressRequest).Type, lib.NymSelfAddressType)
@@ -49,7 +50,7 @@ func TestNymSelfAddressRequestNewEmtpy(t *testing.T) {
  * NymSelfAddressReply
  *********************************************/
 
-func TestNymSelfAddressReplyNewEmtpy(t *testing.T) {
+func TestNymSelfAddressReplyNewEmpty(t *testing.T) {
 	n := lib.NymSelfAddressReply{}.NewEmpty()
 
 	require.Equal(t, n.(lib.NymSelfAddressReply).Type, lib.NymSelfAddressType)
@@ -59,7 +60,7 @@ func TestNymSelfAddressReplyNewEmtpy(t *testing.T) {
  * NymMessage
  *********************************************/
 
-func TestNymReceivedNewEmtpy(t *testing.T) {
+func TestNymReceivedNewEmpty(t *testing.T) {
 	n := lib.NymReceived{}.NewEmpty()
 
 	require.Equal(t, n.(lib.NymReceived).Type, lib.NymReceivedType)
@@ -69,7 +70,7 @@ func TestNymReceivedNewEmtpy(t *testing.T) {
  * NymReply
  *********************************************/
 
-func TestNymReplyNewEmtpy(t *testing.T) {
+func TestNymReplyNewEmpty(t *testing.T) {
 	n := lib.NymReply{}.NewEmpty()
 
 	require.Equal(t, n.(lib.NymReply).Type, lib.NymReplyType)
@@ -83,3 +84,63 @@ func TestNewNymReplyCorrectlySetsValues(t *testing.T) {
 	require.Equal(t, n.(lib.NymReply).SenderTag, senderTag)
 	require.Equal(t, n.(lib.NymReply).Message, message)
 }
+
+func TestNymReplyOnConnectionSetsConnectionId(t *testing.T) {
+	n := lib.NewNymReplyOnConnection(RandStringBytes(5), RandStringBytes(5), 42)
+
+	msgBytes, e := json.Marshal(n)
+	require.NoError(t, e)
+	require.Contains(t, string(msgBytes), `"connectionId":42`)
+}
+
+/*********************************************
+ * NymSend
+ *********************************************/
+
+func TestNymSendOmitsEmptyConnectionId(t *testing.T) {
+	n := lib.NewNymSend(RandStringBytes(5), lib.MustParseNymAddress(testNymAddress))
+
+	msgBytes, e := json.Marshal(n)
+	require.NoError(t, e)
+	require.NotContains(t, string(msgBytes), "connectionId")
+}
+
+func TestNymSendOnConnectionSetsConnectionId(t *testing.T) {
+	n := lib.NewNymSendOnConnection(RandStringBytes(5), lib.MustParseNymAddress(testNymAddress), 7)
+
+	require.NotNil(t, n.(lib.NymSend).ConnectionId)
+	require.Equal(t, uint64(7), *n.(lib.NymSend).ConnectionId)
+}
+
+/*********************************************
+ * NymClosedConnection
+ *********************************************/
+
+func TestNymClosedConnectionNewEmpty(t *testing.T) {
+	n := lib.NymClosedConnection{}.NewEmpty()
+
+	require.Equal(t, n.(lib.NymClosedConnection).Type, lib.NymClosedConnectionType)
+}
+
+/*********************************************
+ * NymGetLaneQueueLength
+ *********************************************/
+
+func TestNymGetLaneQueueLengthNewEmpty(t *testing.T) {
+	n := lib.NymGetLaneQueueLength{}.NewEmpty()
+
+	require.Equal(t, n.(lib.NymGetLaneQueueLength).Type, lib.NymGetLaneQueueLengthType)
+}
+
+/*********************************************
+ * NymLaneQueueLength
+ *********************************************/
+
+func TestNymLaneQueueLengthUnmarshal(t *testing.T) {
+	n := lib.NymLaneQueueLength{}
+	e := json.Unmarshal([]byte(`{"type":"laneQueueLength","lane":3,"queueLength":12}`), &n)
+	require.NoError(t, e)
+
+	require.Equal(t, uint64(3), n.Lane)
+	require.Equal(t, uint64(12), n.QueueLength)
+}
@@ -1,8 +1,6 @@
 package nymsocketmanager
 
 import (
-	"encoding/json"
-	"strings"
 	"sync"
 	"time"
 
@@ -34,35 +32,93 @@ func NewNymSocketManager(connectionURI string, messageHandler func(NymReceived,
 
 	localLogger := parentLogger.With().Str(ComponentField, "NymSocketManager").Logger()
 
-	return &NymSocketManager{
+	n := &NymSocketManager{
 		connectionURI:  connectionURI,
+		dialer:         DialWebsocket,
 		messageHandler: messageHandler,
 		logger:         &localLogger,
-	}, nil
+	}
+	n.chainHandler()
+
+	return n, nil
 }
 
 type NymSocketManager struct {
 	sync.Mutex
 
-	clientID string
+	// Related to the address of the nym-client
+	selfAddressMutex sync.Mutex
+	// Last address accepted, the reference of the identity watch
+	clientID NymAddress
+	// Address received for Start, adopted once checked
+	startClientID           NymAddress
+	clientIDParseErr        error
+	selfAddressReceivedChan chan struct{}
+	identityWatch           *IdentityWatchConfig
+	// Address rejected by the identity watch, until accepted with AcceptIdentity
+	rejectedClientID NymAddress
 
 	connectionURI           string
-	connection              *websocket.Conn
+	dialer                  Dialer
+	connection              Conn
 	selfInstanceStoppedChan chan struct{}
 
 	// Related to listening
 	socketListener           *SocketListener
-	messageHandler           func(NymReceived, func(NymMessage) error)
+	messageHandler           NymHandler
 	closedSocketListenerChan chan struct{}
 
+	// Related to middlewares
+	handlerMutex sync.RWMutex
+	middlewares  []NymMiddleware
+	handler      NymHandler
+	noRecover    bool
+
+	sendMiddlewares []NymSendMiddleware
+	sender          NymSender
+
 	// Related to sender
 	senderMutex sync.Mutex
+	recorder    *Recorder
 
-	selfAddressReceivedChan chan struct{}
+	// Related to logical connections
+	connectionsMutex sync.Mutex
+	lastConnectionId uint64
+	connections      map[uint64]*NymConnection
+	laneQueueWaiters map[uint64][]chan uint64
+
+	// Related to probes
+	probesMutex sync.Mutex
+	probes      map[string]chan struct{}
+	selfTest    *SelfTestConfig
+	degraded    bool
 
 	logger *zerolog.Logger
 }
 
+// SetDialer replaces the Dialer opening the connection to the nym-client, nil restoring DialWebsocket.
+// It is used from the next Start.
+func (n *NymSocketManager) SetDialer(dialer Dialer) {
+	n.Lock()
+	defer n.Unlock()
+
+	if nil == dialer {
+		dialer = DialWebsocket
+	}
+	n.dialer = dialer
+}
+
+// SetRecorder records the frames exchanged with the nym-client, nil stopping the recording.
+// Sent frames are recorded right away, received ones from the next Start.
+func (n *NymSocketManager) SetRecorder(recorder *Recorder) {
+	n.Lock()
+	defer n.Unlock()
+	n.senderMutex.Lock()
+	defer n.senderMutex.Unlock()
+
+	n.recorder = recorder
+}
+
 func (n *NymSocketManager) IsRunning() bool {
 	n.Lock()
 	defer n.Unlock()
@@ -82,16 +138,24 @@ func (n *NymSocketManager) Start() (chan struct{}, error) {
 	}
 
 	// Open WS connection
-	var e error
-	n.connection, _, e = websocket.DefaultDialer.Dial(n.connectionURI, nil)
+	connection, e := n.dialer(n.connectionURI)
 	if nil != e {
 		err := xerrors.Errorf("failed to open connection to %v (%v). Is the websocket up and running?", n.connectionURI, e)
 		n.logger.Warn().Msg(err.Error())
 		return nil, err
 	}
+	n.senderMutex.Lock()
+	n.connection = connection
+	n.senderMutex.Unlock()
+
+	// From now on, selfDestruct tears down whatever got started if Start fails
+	n.selfInstanceStoppedChan = make(chan struct{}, 1)
 
-	// After which we start a listener for the packets
-	n.socketListener, n.closedSocketListenerChan, e = NewSocketListener(n.connection, n.messageDispatcher, n.Stop, n.logger)
+	// After which we start a listener for the packets, which only stops the instance it listens for
+	stoppedChan := n.selfInstanceStoppedChan
+	n.socketListener, n.closedSocketListenerChan, e = NewSocketListener(n.connection, n.messageDispatcher, func() {
+		n.stopInstance(stoppedChan)
+	}, n.logger)
 	if nil != e {
 		err := xerrors.Errorf("failed to initiate the socketListener: %v", e)
 		n.logger.Warn().Msg(err.Error())
@@ -99,14 +163,19 @@ func (n *NymSocketManager) Start() (chan struct{}, error) {
 		n.selfDestruct()
 		return nil, err
 	}
+	n.socketListener.SetRecorder(n.recorder)
 	go n.socketListener.Listen()
 
 	// To ensure everything works as expected, collect clientID
+	previousClientID := n.getClientID()
 
 	// Create chan for messageDispatcher to indicate when response received
+	n.selfAddressMutex.Lock()
 	n.selfAddressReceivedChan = make(chan struct{})
+	selfAddressReceivedChan := n.selfAddressReceivedChan
+	n.selfAddressMutex.Unlock()
 
-	e = n.Send(NewSelfAddressRequest())
+	e = n.send(NewSelfAddressRequest())
 	if nil != e {
 		err := xerrors.Errorf("failed to send SelfAddressRequest: %v", e)
 		n.logger.Warn().Msg(err.Error())
@@ -116,14 +185,28 @@ func (n *NymSocketManager) Start() (chan struct{}, error) {
 		return nil, err
 	}
 
+	var clientID NymAddress
 	timeout := time.After(5 * time.Second)
 	select {
-	case <-n.selfAddressReceivedChan:
+	case <-selfAddressReceivedChan:
+		n.selfAddressMutex.Lock()
+		clientID, e = n.startClientID, n.clientIDParseErr
+		n.selfAddressMutex.Unlock()
+		if nil != e {
+			err := xerrors.Errorf("received invalid clientID from %v: %v", n.connectionURI, e)
+			n.logger.Warn().Msg(err.Error())
+			// Cancel progress so far
+			n.selfDestruct()
+			return nil, err
+		}
 		n.logger.Debug().Msgf("successfully collected clientID with socketListener")
-		n.selfAddressReceivedChan = nil
 
 	// Fail
 	case <-timeout:
+		n.selfAddressMutex.Lock()
+		n.selfAddressReceivedChan = nil
+		n.selfAddressMutex.Unlock()
+
 		err := xerrors.Errorf("failed to collect clientID from %v", n.connectionURI)
 		n.logger.Warn().Msg(err.Error())
 		// Cancel progress so far
@@ -131,7 +214,46 @@ func (n *NymSocketManager) Start() (chan struct{}, error) {
 		return nil, err
 	}
 
-	n.selfInstanceStoppedChan = make(chan struct{}, 1)
+	// Ensure we are still talking to the same nym-client, if watching its identity
+	e = n.checkIdentity(previousClientID, clientID)
+	if nil != e {
+		// Cancel progress so far
+		n.selfDestruct()
+		return nil, e
+	}
+	n.acceptClientID(clientID)
+
+	// Optionally, ensure messages come back through the mixnet
+	n.degraded = false
+	if nil != n.selfTest {
+		selfTest := *n.selfTest
+
+		// The lock is released while probing, so that Send, IsRunning and Stop are not blocked until the timeout
+		n.Unlock()
+		_, e = n.probe(clientID, selfTest.Timeout, stoppedChan)
+		n.Lock()
+
+		if stoppedChan != n.selfInstanceStoppedChan {
+			err := xerrors.Errorf("NymSocketManager stopped during the self-test")
+			n.logger.Warn().Msg(err.Error())
+			return nil, err
+		}
+		if nil != e && !selfTest.Degrade {
+			err := xerrors.Errorf("self-test through the mixnet failed: %v", e)
+			n.logger.Warn().Msg(err.Error())
+			// Cancel progress so far
+			n.selfDestruct()
+			return nil, err
+		}
+		n.degraded = nil != e
+		if n.degraded {
+			n.logger.Warn().Msgf("self-test through the mixnet failed, running degraded: %v", e)
+		} else {
+			n.logger.Debug().Msg("self-test through the mixnet succeeded")
+		}
+	}
+
+	n.startIdentityWatch(n.selfInstanceStoppedChan)
 
 	n.logger.Debug().Msg("started NymSocketManager")
 
@@ -154,6 +276,17 @@ func (n *NymSocketManager) Stop() {
 	n.logger.Debug().Msg("stopped NymSocketManager")
 }
 
+// stopInstance stops the NymSocketManager if still running the instance of stoppedChan
+func (n *NymSocketManager) stopInstance(stoppedChan chan struct{}) {
+	n.Lock()
+	defer n.Unlock()
+
+	if stoppedChan != n.selfInstanceStoppedChan || nil == n.connection {
+		return
+	}
+	n.selfDestruct()
+}
+
 // selfDestruct will close all channel and free resources when requested
 // called from methods that already acquired the lock
 func (n *NymSocketManager) selfDestruct() {
@@ -199,7 +332,10 @@ func (n *NymSocketManager) selfDestruct() {
 		if e != nil {
 			n.logger.Warn().Msgf("error while closing connection: %v", e)
 		}
+		// send only acquires the senderMutex, e.g. when probing during Start
+		n.senderMutex.Lock()
 		n.connection = nil
+		n.senderMutex.Unlock()
 	}
 
 	// If initialized, we close the selfInstanceStoppedChan
@@ -212,8 +348,13 @@ func (n *NymSocketManager) selfDestruct() {
 	n.logger.Debug().Msg("selfDestructed")
 }
 
-// Send a message to the underlying connection
+// Send a message to the underlying connection, through the registered send middlewares
 func (n *NymSocketManager) Send(msg NymMessage) error {
+	return n.getSender()(msg)
+}
+
+// send writes a message to the underlying connection
+func (n *NymSocketManager) send(msg NymMessage) error {
 	n.senderMutex.Lock()
 	defer n.senderMutex.Unlock()
 
@@ -223,9 +364,9 @@ func (n *NymSocketManager) Send(msg NymMessage) error {
 		return err
 	}
 
-	msgBytes, e := json.Marshal(msg)
+	msgBytes, e := EncodeNymMessage(msg)
 	if nil != e {
-		err := xerrors.Errorf("failed to marshal NymMessage: %v", msg)
+		err := xerrors.Errorf("failed to encode NymMessage %v: %v", msg, e)
 		n.logger.Warn().Msg(err.Error())
 		return err
 	}
@@ -237,6 +378,10 @@ func (n *NymSocketManager) Send(msg NymMessage) error {
 		return err
 	}
 
+	if nil != n.recorder {
+		n.recorder.Record(RecordOutbound, msgBytes)
+	}
+
 	return nil
 }
 
@@ -264,72 +409,52 @@ func (n *NymSocketManager) sendCloseSignal() error {
 	return nil
 }
 
-func (n *NymSocketManager) GetNymClientId() string {
-	n.Lock()
-	defer n.Unlock()
-	return n.clientID
+// GetNymClientId returns the address of the nym-client, which is the zero NymAddress until started
+func (n *NymSocketManager) GetNymClientId() NymAddress {
+	return n.getClientID()
 }
 
+// GetConnectedGateway returns the identity of the gateway of the nym-client, empty until started
 func (n *NymSocketManager) GetConnectedGateway() string {
-	n.Lock()
-	defer n.Unlock()
-	if len(n.clientID) == 0 {
-		return ""
-	}
-	return strings.Split(n.clientID, "@")[1]
+	return n.getClientID().Gateway()
+}
+
+func (n *NymSocketManager) getClientID() NymAddress {
+	n.selfAddressMutex.Lock()
+	defer n.selfAddressMutex.Unlock()
+	return n.clientID
 }
 
 // messageDispatcher is provided to the socketListener to process the incoming messages.
 // It calls the provided messageHandler on received messages (except on errors and on selfAddress reply)
 func (n *NymSocketManager) messageDispatcher(s []byte) {
 
-	receivedMessageJSON := make(map[string]interface{})
-	e := json.Unmarshal(s, &receivedMessageJSON)
+	receivedMessage, e := DecodeNymMessage(s)
 	if nil != e {
-		n.logger.Warn().Msgf("failed to unmarshal message: %v\n", e)
+		n.logger.Warn().Msgf("failed to decode message from mixnet: %v. Message: %s", e, s)
 		return
 	}
 
-	if _, ok := receivedMessageJSON["type"]; !ok {
-		n.logger.Warn().Msgf("message from mixnet have no \"type\" attribute. Message: %v", receivedMessageJSON)
-		return
-	}
+	switch msg := receivedMessage.(type) {
+	case NymSelfAddressReply:
+		n.dispatchSelfAddress(msg)
 
-	switch receivedMessageJSON["type"] {
-	case NymSelfAddressReplyType:
-		reply := NymSelfAddressReply{}
-		e = json.Unmarshal(s, &reply)
-		if nil != e {
-			n.logger.Warn().Msgf("failed to unmarshal SelfAddressReply: %v", e)
-			return
-		}
-		n.clientID = reply.Address
-		n.logger.Debug().Msgf("Got %v reply: Address is %v", reply.Type, reply.Address)
-		if nil != n.selfAddressReceivedChan {
-			close(n.selfAddressReceivedChan)
-		}
+	case NymError:
+		n.logger.Error().Msgf("Got error from mixnet: %v", msg.Message)
 
-	case NymErrorType:
-		reply := NymError{}
-		e = json.Unmarshal(s, &reply)
-		if nil != e {
-			n.logger.Warn().Msgf("failed to unmarshal errorMessage: %v", e)
-			return
-		}
-		n.logger.Error().Msgf("Got error from mixnet: %v", reply.Message)
+	case NymReceived:
+		n.logger.Debug().Msgf("got: %v", msg)
 
-	case NymReceivedType:
-		msg := NymReceived{}
-		e = json.Unmarshal(s, &msg)
-		if nil != e {
-			n.logger.Warn().Msgf("failed to unmarshal NymMessage: %v", e)
+		if n.dispatchProbe(msg) {
 			return
 		}
-		n.logger.Debug().Msgf("got: %v", msg)
+		n.getHandler()(msg, n.Send)
 
-		n.messageHandler(msg, n.Send)
+	case NymLaneQueueLength:
+		n.logger.Debug().Msgf("got: %v", msg)
+		n.dispatchLaneQueueLength(msg)
 
 	default:
-		n.logger.Warn().Msgf("encountered unparsed type of message: %v", receivedMessageJSON)
+		n.logger.Warn().Msgf("encountered unexpected type of message: %v", msg)
 	}
 }
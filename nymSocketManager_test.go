@@ -2,8 +2,10 @@ package nymsocketmanager_test
 
 import (
 	"testing"
+	"time"
 
 	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
 )
@@ -41,6 +43,36 @@ func TestNymSocketManagerShouldNotStartWithWrongClientIDWS(t *testing.T) {
 	require.Error(t, e)
 }
 
+func TestNymSocketManagerCleansUpOnInvalidClientID(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	// Answers an empty address to the selfAddress request
+	fakeNymClient := nymtest.NewFakeNymClient(lib.NymAddress{})
+	defer fakeNymClient.Close()
+
+	nymSocketManager, e := lib.NewNymSocketManager(fakeNymClient.URI(), emptyProcessing, &logger)
+	require.NoError(t, e)
+
+	_, e = nymSocketManager.Start()
+	require.Error(t, e)
+	require.False(t, nymSocketManager.IsRunning())
+	require.Eventually(t, func() bool { return 0 == fakeNymClient.ConnectionCount() }, time.Second, 10*time.Millisecond)
+
+	// Starting again does not resume a half-started NymSocketManager
+	_, e = nymSocketManager.Start()
+	require.Error(t, e)
+	require.False(t, nymSocketManager.IsRunning())
+
+	fakeNymClient.SetAddress(nymtest.RandomNymAddress())
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+	require.True(t, nymSocketManager.IsRunning())
+	require.Equal(t, fakeNymClient.Address(), nymSocketManager.GetNymClientId())
+
+	nymSocketManager.Stop()
+	require.False(t, nymSocketManager.IsRunning())
+}
+
 func TestNymSocketManagerGetGateway(t *testing.T) {
 
 	logger := zerolog.Logger{}
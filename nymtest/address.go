@@ -0,0 +1,47 @@
+package nymtest
+
+import (
+	"crypto/rand"
+	"math/big"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// RandomNymAddress returns a valid NymAddress made of random keys
+func RandomNymAddress() lib.NymAddress {
+	return lib.MustParseNymAddress(randomKey() + "." + randomKey() + "@" + randomKey())
+}
+
+func randomKey() string {
+	key := make([]byte, lib.NymKeyLength)
+	_, e := rand.Read(key)
+	if nil != e {
+		panic(e)
+	}
+	return encodeBase58(key)
+}
+
+func encodeBase58(b []byte) string {
+	value := new(big.Int).SetBytes(b)
+	radix := big.NewInt(58)
+	modulo := new(big.Int)
+
+	encoded := []byte{}
+	for value.Sign() > 0 {
+		value.DivMod(value, radix, modulo)
+		encoded = append(encoded, base58Alphabet[modulo.Int64()])
+	}
+	for _, c := range b {
+		if 0 != c {
+			break
+		}
+		encoded = append(encoded, base58Alphabet[0])
+	}
+
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+	return string(encoded)
+}
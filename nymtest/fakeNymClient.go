@@ -0,0 +1,236 @@
+// Package nymtest provides a fake nym-client to test applications built on NymSocketManager without the mixnet.
+package nymtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	lib "github.com/notrustverify/nymsocketmanager"
+)
+
+/*
+ * The FakeNymClient serves the websocket API of the nym-client on a local port. It answers selfAddress requests
+ * with its configured address and loops back messages sent to its own address as NymReceived, which is enough
+ * to exercise the whole path of a NymSocketManager. Every message it gets is also made available on Requests.
+ */
+
+// NewFakeNymClient starts a fake nym-client answering with address
+func NewFakeNymClient(address lib.NymAddress) *FakeNymClient {
+	f := &FakeNymClient{
+		address:     address,
+		connections: make(map[*websocket.Conn]*sync.Mutex),
+		senderTags:  make(map[string]struct{}),
+		requests:    make(chan lib.NymMessage, 1024),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+type FakeNymClient struct {
+	sync.Mutex
+
+	address lib.NymAddress
+	server  *httptest.Server
+
+	// Each connection has its own write lock, as gorilla/websocket allows a single concurrent writer
+	connections map[*websocket.Conn]*sync.Mutex
+
+	lastSenderTag int
+	senderTags    map[string]struct{}
+
+	requests chan lib.NymMessage
+}
+
+// URI returns the websocket URI to give to NewNymSocketManager
+func (f *FakeNymClient) URI() string {
+	return "ws" + strings.TrimPrefix(f.server.URL, "http")
+}
+
+func (f *FakeNymClient) Address() lib.NymAddress {
+	f.Lock()
+	defer f.Unlock()
+	return f.address
+}
+
+// SetAddress changes the address of the fake nym-client, as if it was restarted with other keys or gateway
+func (f *FakeNymClient) SetAddress(address lib.NymAddress) {
+	f.Lock()
+	defer f.Unlock()
+	f.address = address
+}
+
+// Requests returns the messages sent to the fake nym-client. Messages are dropped if nobody reads them.
+func (f *FakeNymClient) Requests() <-chan lib.NymMessage {
+	return f.requests
+}
+
+// Push sends msg to every connected NymSocketManager
+func (f *FakeNymClient) Push(msg lib.NymMessage) error {
+	msgBytes, e := lib.EncodeNymMessage(msg)
+	if nil != e {
+		return e
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	for connection, writeMutex := range f.connections {
+		writeMutex.Lock()
+		e = connection.WriteMessage(websocket.TextMessage, msgBytes)
+		writeMutex.Unlock()
+		if nil != e {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// PushRaw sends msg as is to every connected NymSocketManager
+func (f *FakeNymClient) PushRaw(msg []byte) error {
+	f.Lock()
+	defer f.Unlock()
+
+	for connection, writeMutex := range f.connections {
+		writeMutex.Lock()
+		e := connection.WriteMessage(websocket.TextMessage, msg)
+		writeMutex.Unlock()
+		if nil != e {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// ConnectionCount returns the number of currently connected websockets
+func (f *FakeNymClient) ConnectionCount() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.connections)
+}
+
+// DropConnections abruptly closes every connected websocket, as a crashing nym-client would
+func (f *FakeNymClient) DropConnections() {
+	f.Lock()
+	defer f.Unlock()
+
+	for connection := range f.connections {
+		connection.Close()
+		delete(f.connections, connection)
+	}
+}
+
+// Close drops the connections and stops the server
+func (f *FakeNymClient) Close() {
+	f.DropConnections()
+	f.server.Close()
+}
+
+func (f *FakeNymClient) serve(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	connection, e := upgrader.Upgrade(w, r, nil)
+	if nil != e {
+		return
+	}
+
+	writeMutex := &sync.Mutex{}
+	f.Lock()
+	f.connections[connection] = writeMutex
+	f.Unlock()
+
+	defer func() {
+		f.Lock()
+		delete(f.connections, connection)
+		f.Unlock()
+		connection.Close()
+	}()
+
+	for {
+		messageType, msgBytes, e := connection.ReadMessage()
+		if nil != e {
+			return
+		}
+		if websocket.TextMessage != messageType {
+			continue
+		}
+
+		msg, e := lib.DecodeNymMessage(msgBytes)
+		if nil != e {
+			f.write(connection, writeMutex, lib.NymError{NymMessageCommon: lib.NymMessageCommon{Type: lib.NymErrorType}, Message: e.Error()})
+			continue
+		}
+
+		select {
+		case f.requests <- msg:
+		default:
+		}
+
+		for _, answer := range f.answer(msg) {
+			f.write(connection, writeMutex, answer)
+		}
+	}
+}
+
+func (f *FakeNymClient) write(connection *websocket.Conn, writeMutex *sync.Mutex, msg lib.NymMessage) {
+	msgBytes, e := lib.EncodeNymMessage(msg)
+	if nil != e {
+		return
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	connection.WriteMessage(websocket.TextMessage, msgBytes)
+}
+
+// answer returns what a nym-client would send back on the same websocket for msg
+func (f *FakeNymClient) answer(msg lib.NymMessage) []lib.NymMessage {
+	address := f.Address()
+
+	switch m := msg.(type) {
+	case lib.NymSelfAddressRequest:
+		return []lib.NymMessage{lib.NewSelfAddressReply(address.String())}
+
+	case lib.NymSend:
+		if m.Recipient == address {
+			return []lib.NymMessage{lib.NewNymReceived(m.Message, "")}
+		}
+
+	case lib.NymSendAnonymous:
+		if m.Recipient == address {
+			return []lib.NymMessage{lib.NewNymReceived(m.Message, f.newSenderTag())}
+		}
+
+	case lib.NymReply:
+		if f.knowsSenderTag(m.SenderTag) {
+			return []lib.NymMessage{lib.NewNymReceived(m.Message, "")}
+		}
+
+	case lib.NymGetLaneQueueLength:
+		return []lib.NymMessage{lib.NewNymLaneQueueLength(m.ConnectionId, 0)}
+	}
+
+	return nil
+}
+
+func (f *FakeNymClient) newSenderTag() string {
+	f.Lock()
+	defer f.Unlock()
+
+	f.lastSenderTag++
+	senderTag := "fakeSenderTag" + strconv.Itoa(f.lastSenderTag)
+	f.senderTags[senderTag] = struct{}{}
+
+	return senderTag
+}
+
+func (f *FakeNymClient) knowsSenderTag(senderTag string) bool {
+	f.Lock()
+	defer f.Unlock()
+	_, ok := f.senderTags[senderTag]
+	return ok
+}
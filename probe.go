@@ -0,0 +1,143 @@
+package nymsocketmanager
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+/*
+ * A probe is a message the NymSocketManager sends to its own address to check that the mixnet path works:
+ *
+ *	rtt, e := nymSocketManager.Probe(10 * time.Second)
+ *
+ * Probes skip the send middlewares and are caught by the messageDispatcher before the middlewares and the
+ * messageHandler, so that they neither depend on nor reach the layers of the application. Only the probes a Probe is
+ * still waiting for are caught: any other message, including a probe coming back after its timeout, is handed to the
+ * middlewares and the messageHandler as usual.
+ *
+ * Start can also probe once connected, to fail when the mixnet path does not work:
+ *
+ *	nymSocketManager.EnableSelfTest(SelfTestConfig{Timeout: 30 * time.Second})
+ *	_, e := nymSocketManager.Start()
+ *
+ * The NymSocketManager is running while its self-test is in progress, so that it can be used and stopped meanwhile,
+ * Start failing if it is stopped before the self-test ends.
+ */
+
+// probePrefix starts the payload of probes, followed by their ID
+const probePrefix = "nymProbe:"
+
+type SelfTestConfig struct {
+	// How long the probe has to come back. Defaults to DefaultProbeTimeout.
+	Timeout time.Duration
+	// Keeps the NymSocketManager started when the self-test fails, IsDegraded reporting it, instead of failing Start
+	Degrade bool
+}
+
+// EnableSelfTest makes the next Starts probe the mixnet path before returning
+func (n *NymSocketManager) EnableSelfTest(config SelfTestConfig) error {
+	if config.Timeout < 0 {
+		err := xerrors.Errorf("self-test timeout cannot be negative")
+		return err
+	}
+
+	if 0 == config.Timeout {
+		config.Timeout = DefaultProbeTimeout
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	n.selfTest = &config
+	return nil
+}
+
+func (n *NymSocketManager) DisableSelfTest() {
+	n.Lock()
+	defer n.Unlock()
+	n.selfTest = nil
+}
+
+// IsDegraded tells whether the last Start went on despite its self-test failing
+func (n *NymSocketManager) IsDegraded() bool {
+	n.Lock()
+	defer n.Unlock()
+	return n.degraded
+}
+
+// Probe sends a message to our own address and returns the time it took to come back through the mixnet
+func (n *NymSocketManager) Probe(timeout time.Duration) (time.Duration, error) {
+	n.Lock()
+	stopped := n.selfInstanceStoppedChan
+	n.Unlock()
+
+	return n.probe(n.GetNymClientId(), timeout, stopped)
+}
+
+// probe sends a probe to self, giving up when stopped is closed, without acquiring the lock of the NymSocketManager
+func (n *NymSocketManager) probe(self NymAddress, timeout time.Duration, stopped chan struct{}) (time.Duration, error) {
+	if self.IsZero() {
+		err := xerrors.Errorf("address of the nym-client is unknown. Is the NymSocketManager started?")
+		return 0, err
+	}
+
+	id := NewMessageId()
+	arrived := make(chan struct{})
+
+	n.probesMutex.Lock()
+	if nil == n.probes {
+		n.probes = make(map[string]chan struct{})
+	}
+	n.probes[id] = arrived
+	n.probesMutex.Unlock()
+
+	defer func() {
+		n.probesMutex.Lock()
+		delete(n.probes, id)
+		n.probesMutex.Unlock()
+	}()
+
+	start := time.Now()
+	e := n.send(NewNymSend(probePrefix+id, self))
+	if nil != e {
+		err := xerrors.Errorf("failed to send probe: %v", e)
+		return 0, err
+	}
+
+	select {
+	case <-arrived:
+		rtt := time.Since(start)
+		n.logger.Debug().Msgf("probe came back in %v", rtt)
+		return rtt, nil
+
+	case <-time.After(timeout):
+		err := xerrors.Errorf("timed-out (%v) on waiting for probe to come back", timeout)
+		n.logger.Warn().Msg(err.Error())
+		return 0, err
+
+	case <-stopped:
+		err := xerrors.Errorf("NymSocketManager stopped while waiting for probe to come back")
+		return 0, err
+	}
+}
+
+// dispatchProbe tells whether msg is a probe a Probe is waiting for, notifying it
+func (n *NymSocketManager) dispatchProbe(msg NymReceived) bool {
+	id, isProbe := strings.CutPrefix(msg.Message, probePrefix)
+	if !isProbe {
+		return false
+	}
+
+	n.probesMutex.Lock()
+	defer n.probesMutex.Unlock()
+
+	arrived, waiting := n.probes[id]
+	if !waiting {
+		return false
+	}
+
+	close(arrived)
+	delete(n.probes, id)
+	return true
+}
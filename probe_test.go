@@ -0,0 +1,130 @@
+package nymsocketmanager_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// silentNymClient returns a Dialer of nym-clients answering their address but never delivering anything
+func silentNymClient(t *testing.T) lib.Dialer {
+	reply, e := lib.EncodeNymMessage(lib.NewSelfAddressReply(nymtest.RandomNymAddress().String()))
+	require.NoError(t, e)
+
+	recording := fmt.Sprintf("{\"time\":\"2023-05-04T10:00:00Z\",\"direction\":\"out\",\"frame\":\"\"}\n{\"time\":\"2023-05-04T10:00:00Z\",\"direction\":\"in\",\"frame\":%q}\n", reply)
+	replayer, e := lib.NewReplayer(strings.NewReader(recording), lib.ReplayConfig{})
+	require.NoError(t, e)
+	return replayer.Dial
+}
+
+func TestStartRunsTheSelfTest(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer fakeNymClient.Close()
+
+	nymSocketManager, e := lib.NewNymSocketManager(fakeNymClient.URI(), func(lib.NymReceived, func(lib.NymMessage) error) {}, &logger)
+	require.NoError(t, e)
+	require.NoError(t, nymSocketManager.EnableSelfTest(lib.SelfTestConfig{Timeout: time.Second}))
+
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+	defer nymSocketManager.Stop()
+	require.False(t, nymSocketManager.IsDegraded())
+
+	probe := <-fakeNymClient.Requests()
+	_, isSelfAddress := probe.(lib.NymSelfAddressRequest)
+	require.True(t, isSelfAddress)
+	probe = <-fakeNymClient.Requests()
+	require.Equal(t, fakeNymClient.Address(), probe.(lib.NymSend).Recipient)
+}
+
+func TestStartFailsWhenTheSelfTestFails(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	nymSocketManager, e := lib.NewNymSocketManager("replay://", func(lib.NymReceived, func(lib.NymMessage) error) {}, &logger)
+	require.NoError(t, e)
+	nymSocketManager.SetDialer(silentNymClient(t))
+	require.NoError(t, nymSocketManager.EnableSelfTest(lib.SelfTestConfig{Timeout: 20 * time.Millisecond}))
+
+	_, e = nymSocketManager.Start()
+	require.Error(t, e)
+	require.False(t, nymSocketManager.IsRunning())
+
+	// Or goes on degraded
+	require.NoError(t, nymSocketManager.EnableSelfTest(lib.SelfTestConfig{Timeout: 20 * time.Millisecond, Degrade: true}))
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+	require.True(t, nymSocketManager.IsRunning())
+	require.True(t, nymSocketManager.IsDegraded())
+	nymSocketManager.Stop()
+
+	nymSocketManager.DisableSelfTest()
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+	require.False(t, nymSocketManager.IsDegraded())
+	nymSocketManager.Stop()
+
+	require.Error(t, nymSocketManager.EnableSelfTest(lib.SelfTestConfig{Timeout: -1}))
+}
+
+func TestOnlyAwaitedProbesAreCaught(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer fakeNymClient.Close()
+
+	handled := make(chan string, 1)
+	nymSocketManager, e := lib.NewNymSocketManager(fakeNymClient.URI(), func(msg lib.NymReceived, _ func(lib.NymMessage) error) {
+		handled <- msg.Message
+	}, &logger)
+	require.NoError(t, e)
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+	defer nymSocketManager.Stop()
+
+	_, e = nymSocketManager.Probe(time.Second)
+	require.NoError(t, e)
+
+	// Messages looking like probes but nobody is waiting for are handed to the messageHandler
+	require.NoError(t, fakeNymClient.Push(lib.NewNymReceived("nymProbe:unknown", "")))
+	select {
+	case message := <-handled:
+		require.Equal(t, "nymProbe:unknown", message)
+	case <-time.After(time.Second):
+		require.Fail(t, "message not handed to the messageHandler")
+	}
+}
+
+func TestStartCanBeStoppedDuringTheSelfTest(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	nymSocketManager, e := lib.NewNymSocketManager("replay://", func(lib.NymReceived, func(lib.NymMessage) error) {}, &logger)
+	require.NoError(t, e)
+	nymSocketManager.SetDialer(silentNymClient(t))
+	require.NoError(t, nymSocketManager.EnableSelfTest(lib.SelfTestConfig{Timeout: time.Minute}))
+
+	started := make(chan error, 1)
+	go func() {
+		_, e := nymSocketManager.Start()
+		started <- e
+	}()
+
+	// The self-test does not hold the NymSocketManager
+	require.Eventually(t, nymSocketManager.IsRunning, time.Second, 10*time.Millisecond)
+	nymSocketManager.Stop()
+	require.False(t, nymSocketManager.IsRunning())
+
+	select {
+	case e := <-started:
+		require.Error(t, e)
+	case <-time.After(time.Second):
+		require.Fail(t, "Start still waiting for its self-test")
+	}
+}
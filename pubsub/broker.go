@@ -0,0 +1,426 @@
+package pubsub
+
+import (
+	"sync"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * The Broker is meant to be the messageHandler of a NymSocketManager:
+ *
+ *	broker, _ := pubsub.NewBroker(pubsub.BrokerConfig{}, &logger)
+ *	nymSocketManager, _ := lib.NewNymSocketManager(uri, broker.Handle, &logger)
+ *	broker.SetSender(nymSocketManager.Send)
+ *
+ * SetSender is only needed to publish from the broker itself with Publish.
+ *
+ * The SURBs coming along the envelopes are only credited to subscribers, up to MaxSurbs each. Subscribers which
+ * did not send any envelope for IdleTimeout are dropped, and need to subscribe again.
+ */
+
+const (
+	// DefaultReplenishThreshold is the number of SURBs under which a subscriber is asked for more
+	DefaultReplenishThreshold = 5
+	// DefaultMaxSurbs is the number of SURBs credited to a subscriber at most
+	DefaultMaxSurbs = 1000
+	// DefaultSubscriberIdleTimeout is how long a subscriber is kept without sending any envelope
+	DefaultSubscriberIdleTimeout = 24 * time.Hour
+)
+
+type BrokerConfig struct {
+	// Subscribers holding ReplenishThreshold SURBs or less are asked for more. Defaults to DefaultReplenishThreshold.
+	ReplenishThreshold uint
+	// Size (in bytes) carried by a single reply. Defaults to lib.DefaultPayloadPerSurb.
+	PayloadPerSurb int
+	// SURBs credited to a subscriber at most, the extra ones being ignored. Defaults to DefaultMaxSurbs.
+	MaxSurbs uint
+	// Subscribers not sending any envelope for IdleTimeout are dropped. Defaults to DefaultSubscriberIdleTimeout.
+	IdleTimeout time.Duration
+}
+
+type BrokerStats struct {
+	Topics      int
+	Subscribers int
+	Published   uint64
+	Delivered   uint64
+	// Deliveries skipped because the subscriber had no SURB left
+	Dropped uint64
+}
+
+func NewBroker(config BrokerConfig, parentLogger *zerolog.Logger) (*Broker, error) {
+	if config.PayloadPerSurb < 0 || config.IdleTimeout < 0 {
+		err := xerrors.Errorf("payload per SURB and idle timeout cannot be negative")
+		return nil, err
+	}
+
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	if 0 == config.ReplenishThreshold {
+		config.ReplenishThreshold = DefaultReplenishThreshold
+	}
+	if 0 == config.PayloadPerSurb {
+		config.PayloadPerSurb = lib.DefaultPayloadPerSurb
+	}
+	if 0 == config.MaxSurbs {
+		config.MaxSurbs = DefaultMaxSurbs
+	}
+	if 0 == config.IdleTimeout {
+		config.IdleTimeout = DefaultSubscriberIdleTimeout
+	}
+
+	localLogger := parentLogger.With().Str(lib.ComponentField, "PubSubBroker").Logger()
+
+	return &Broker{
+		config:      config,
+		topics:      make(map[string]map[string]*subscriber),
+		subscribers: make(map[string]*subscriber),
+		lastSweep:   time.Now(),
+		logger:      &localLogger,
+	}, nil
+}
+
+type Broker struct {
+	sync.Mutex
+
+	config BrokerConfig
+	send   func(lib.NymMessage) error
+
+	topics      map[string]map[string]*subscriber
+	subscribers map[string]*subscriber
+	lastSweep   time.Time
+
+	published uint64
+	delivered uint64
+	dropped   uint64
+
+	logger *zerolog.Logger
+}
+
+type subscriber struct {
+	senderTag string
+	topics    map[string]struct{}
+
+	// Estimation of the SURBs the nym-client holds for this subscriber
+	surbs              uint
+	replenishRequested bool
+
+	lastSeen time.Time
+}
+
+// SetSender sets the function used by Publish
+func (b *Broker) SetSender(send func(lib.NymMessage) error) {
+	b.Lock()
+	defer b.Unlock()
+	b.send = send
+}
+
+// Subscribers returns the senderTags subscribed to topic
+func (b *Broker) Subscribers(topic string) []string {
+	b.Lock()
+	defer b.Unlock()
+
+	senderTags := []string{}
+	for senderTag := range b.topics[topic] {
+		senderTags = append(senderTags, senderTag)
+	}
+	return senderTags
+}
+
+func (b *Broker) Stats() BrokerStats {
+	b.Lock()
+	defer b.Unlock()
+
+	subscribers := 0
+	for _, s := range b.subscribers {
+		if len(s.topics) != 0 {
+			subscribers++
+		}
+	}
+
+	return BrokerStats{
+		Topics:      len(b.topics),
+		Subscribers: subscribers,
+		Published:   b.published,
+		Delivered:   b.delivered,
+		Dropped:     b.dropped,
+	}
+}
+
+// Publish fans payload out to the subscribers of topic from the broker itself
+func (b *Broker) Publish(topic string, payload string) error {
+	b.Lock()
+	send := b.send
+	b.Unlock()
+
+	if nil == send {
+		err := xerrors.Errorf("sender needs to be set to publish from the broker")
+		b.logger.Warn().Msg(err.Error())
+		return err
+	}
+
+	b.publish(topic, payload, "", send)
+	return nil
+}
+
+// Handle processes the envelopes received by the NymSocketManager of the broker
+func (b *Broker) Handle(msg lib.NymReceived, send func(lib.NymMessage) error) {
+	envelope, e := decodeEnvelope(msg.Message)
+	if nil != e {
+		b.logger.Debug().Msgf("dropping message from %v: %v", msg.SenderTag, e)
+		b.replyError(msg.SenderTag, e.Error(), send)
+		return
+	}
+
+	b.sweep(time.Now())
+
+	validSubscription := len(msg.SenderTag) != 0 && len(envelope.Topic) != 0
+	if ActionSubscribe == envelope.Action && validSubscription {
+		b.subscribe(msg.SenderTag, envelope.Topic)
+	}
+
+	// Every envelope comes along the SURBs the subscriber declared
+	if len(msg.SenderTag) != 0 {
+		b.addSurbs(msg.SenderTag, envelope.Surbs)
+	}
+
+	switch envelope.Action {
+	case ActionSubscribe:
+		if !validSubscription {
+			b.logger.Debug().Msg("dropping subscription without senderTag or topic")
+			b.replyError(msg.SenderTag, "subscriptions need a topic and reply SURBs", send)
+			return
+		}
+		b.reply(msg.SenderTag, Envelope{Action: ActionAck, Topic: envelope.Topic}, send)
+
+	case ActionUnsubscribe:
+		if len(msg.SenderTag) == 0 {
+			return
+		}
+		b.unsubscribe(msg.SenderTag, envelope.Topic)
+		b.reply(msg.SenderTag, Envelope{Action: ActionAck, Topic: envelope.Topic}, send)
+
+	case ActionPublish:
+		if len(envelope.Topic) == 0 {
+			b.replyError(msg.SenderTag, "publications need a topic", send)
+			return
+		}
+		b.publish(envelope.Topic, envelope.Payload, msg.SenderTag, send)
+
+	case ActionReplenish:
+		// SURBs already accounted for
+		b.Lock()
+		if s, ok := b.subscribers[msg.SenderTag]; ok {
+			s.replenishRequested = false
+		}
+		b.Unlock()
+
+	default:
+		b.replyError(msg.SenderTag, "unknown action "+envelope.Action, send)
+	}
+}
+
+// addSurbs credits surbs to the subscriber of senderTag, if any, and refreshes it
+func (b *Broker) addSurbs(senderTag string, surbs uint) {
+	b.Lock()
+	defer b.Unlock()
+
+	s, ok := b.subscribers[senderTag]
+	if !ok {
+		return
+	}
+
+	s.lastSeen = time.Now()
+	s.surbs += surbs
+	if s.surbs > b.config.MaxSurbs {
+		s.surbs = b.config.MaxSurbs
+	}
+}
+
+// ExpireIdle drops the subscribers which did not send any envelope for IdleTimeout
+func (b *Broker) ExpireIdle() {
+	b.Lock()
+	defer b.Unlock()
+	b.expire(time.Now())
+}
+
+// sweep expires the idle subscribers, at most once per IdleTimeout
+func (b *Broker) sweep(now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+
+	if now.Sub(b.lastSweep) < b.config.IdleTimeout {
+		return
+	}
+	b.expire(now)
+}
+
+// called from methods that already acquired the lock
+func (b *Broker) expire(now time.Time) {
+	b.lastSweep = now
+
+	for senderTag, s := range b.subscribers {
+		if now.Sub(s.lastSeen) < b.config.IdleTimeout {
+			continue
+		}
+		for topic := range s.topics {
+			delete(b.topics[topic], senderTag)
+			if len(b.topics[topic]) == 0 {
+				delete(b.topics, topic)
+			}
+		}
+		delete(b.subscribers, senderTag)
+		b.logger.Debug().Msgf("dropped idle subscriber %v", senderTag)
+	}
+}
+
+func (b *Broker) subscribe(senderTag string, topic string) {
+	b.Lock()
+	defer b.Unlock()
+
+	s := b.getSubscriber(senderTag)
+	s.topics[topic] = struct{}{}
+
+	if _, ok := b.topics[topic]; !ok {
+		b.topics[topic] = make(map[string]*subscriber)
+	}
+	b.topics[topic][senderTag] = s
+
+	b.logger.Debug().Msgf("%v subscribed to %v", senderTag, topic)
+}
+
+// unsubscribe removes senderTag from topic, or from every topic if topic is empty
+func (b *Broker) unsubscribe(senderTag string, topic string) {
+	b.Lock()
+	defer b.Unlock()
+
+	s, ok := b.subscribers[senderTag]
+	if !ok {
+		return
+	}
+
+	for subscribedTopic := range s.topics {
+		if len(topic) != 0 && topic != subscribedTopic {
+			continue
+		}
+		delete(s.topics, subscribedTopic)
+		delete(b.topics[subscribedTopic], senderTag)
+		if len(b.topics[subscribedTopic]) == 0 {
+			delete(b.topics, subscribedTopic)
+		}
+	}
+
+	if len(s.topics) == 0 {
+		delete(b.subscribers, senderTag)
+	}
+
+	b.logger.Debug().Msgf("%v unsubscribed from %v", senderTag, topic)
+}
+
+func (b *Broker) publish(topic string, payload string, publisher string, send func(lib.NymMessage) error) {
+	envelope := Envelope{Action: ActionMessage, Topic: topic, Payload: payload}
+	message, e := envelope.encode()
+	if nil != e {
+		b.logger.Warn().Msg(e.Error())
+		return
+	}
+
+	packets := uint((len(message) + b.config.PayloadPerSurb - 1) / b.config.PayloadPerSurb)
+
+	b.Lock()
+	b.published++
+	recipients := []string{}
+	replenish := []string{}
+	for senderTag, s := range b.topics[topic] {
+		if senderTag == publisher {
+			continue
+		}
+		if s.surbs < packets {
+			b.dropped++
+			continue
+		}
+		s.surbs -= packets
+		recipients = append(recipients, senderTag)
+
+		if s.surbs <= b.config.ReplenishThreshold && s.surbs > 0 && !s.replenishRequested {
+			s.surbs--
+			s.replenishRequested = true
+			replenish = append(replenish, senderTag)
+		}
+	}
+	b.Unlock()
+
+	for _, senderTag := range recipients {
+		e = send(lib.NewNymReply(senderTag, message))
+		if nil != e {
+			b.logger.Warn().Msgf("failed to deliver %v to %v: %v", topic, senderTag, e)
+			continue
+		}
+		b.Lock()
+		b.delivered++
+		b.Unlock()
+	}
+
+	for _, senderTag := range replenish {
+		b.logger.Debug().Msgf("asking %v to replenish its SURBs", senderTag)
+		b.sendEnvelope(senderTag, Envelope{Action: ActionReplenish}, send)
+	}
+}
+
+// reply answers senderTag, consuming one of its SURBs
+func (b *Broker) reply(senderTag string, envelope Envelope, send func(lib.NymMessage) error) {
+	b.Lock()
+	s, ok := b.subscribers[senderTag]
+	if ok {
+		if 0 == s.surbs {
+			b.Unlock()
+			b.logger.Debug().Msgf("no SURB left to answer %v", senderTag)
+			return
+		}
+		s.surbs--
+	}
+	b.Unlock()
+
+	b.sendEnvelope(senderTag, envelope, send)
+}
+
+func (b *Broker) replyError(senderTag string, errorMessage string, send func(lib.NymMessage) error) {
+	if len(senderTag) == 0 {
+		return
+	}
+	b.reply(senderTag, Envelope{Action: ActionError, Error: errorMessage}, send)
+}
+
+func (b *Broker) sendEnvelope(senderTag string, envelope Envelope, send func(lib.NymMessage) error) {
+	message, e := envelope.encode()
+	if nil != e {
+		b.logger.Warn().Msg(e.Error())
+		return
+	}
+
+	e = send(lib.NewNymReply(senderTag, message))
+	if nil != e {
+		b.logger.Warn().Msgf("failed to send %v to %v: %v", envelope.Action, senderTag, e)
+	}
+}
+
+// getSubscriber returns the subscriber of senderTag, creating it if needed
+// called from methods that already acquired the lock
+func (b *Broker) getSubscriber(senderTag string) *subscriber {
+	s, ok := b.subscribers[senderTag]
+	if !ok {
+		s = &subscriber{
+			senderTag: senderTag,
+			topics:    make(map[string]struct{}),
+			lastSeen:  time.Now(),
+		}
+		b.subscribers[senderTag] = s
+	}
+	return s
+}
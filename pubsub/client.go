@@ -0,0 +1,181 @@
+package pubsub
+
+import (
+	"sync"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * The Client subscribes to the topics of a Broker and receives its publications through reply SURBs, so the
+ * broker never learns its address. It is meant to be the messageHandler of a NymSocketManager:
+ *
+ *	client, _ := pubsub.NewClient(brokerAddress, pubsub.ClientConfig{}, &logger)
+ *	nymSocketManager, _ := lib.NewNymSocketManager(uri, client.Handle, &logger)
+ *	client.SetSender(nymSocketManager.Send)
+ */
+
+const (
+	// DefaultSurbsPerRequest is the number of SURBs attached to every request sent to the broker
+	DefaultSurbsPerRequest = 10
+	// DefaultReplenishSurbs is the number of SURBs sent when the broker asks for more
+	DefaultReplenishSurbs = 50
+)
+
+type ClientConfig struct {
+	// SURBs attached to every request. Defaults to DefaultSurbsPerRequest.
+	SurbsPerRequest uint
+	// SURBs sent when the broker asks for more. Defaults to DefaultReplenishSurbs.
+	ReplenishSurbs uint
+	// Called when the broker reports an error (optional)
+	OnError func(errorMessage string)
+}
+
+func NewClient(brokerAddress lib.NymAddress, config ClientConfig, parentLogger *zerolog.Logger) (*Client, error) {
+	if brokerAddress.IsZero() {
+		err := xerrors.Errorf("broker address needs to be defined")
+		return nil, err
+	}
+
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	if 0 == config.SurbsPerRequest {
+		config.SurbsPerRequest = DefaultSurbsPerRequest
+	}
+	if 0 == config.ReplenishSurbs {
+		config.ReplenishSurbs = DefaultReplenishSurbs
+	}
+
+	localLogger := parentLogger.With().Str(lib.ComponentField, "PubSubClient").Logger()
+
+	return &Client{
+		brokerAddress: brokerAddress,
+		config:        config,
+		callbacks:     make(map[string]func(topic string, payload string)),
+		logger:        &localLogger,
+	}, nil
+}
+
+type Client struct {
+	sync.RWMutex
+
+	brokerAddress lib.NymAddress
+	config        ClientConfig
+	send          func(lib.NymMessage) error
+
+	callbacks map[string]func(topic string, payload string)
+
+	logger *zerolog.Logger
+}
+
+// SetSender sets the function used to reach the broker, usually the Send of the NymSocketManager
+func (c *Client) SetSender(send func(lib.NymMessage) error) {
+	c.Lock()
+	defer c.Unlock()
+	c.send = send
+}
+
+// Subscribe registers callback for the publications on topic and subscribes to it
+func (c *Client) Subscribe(topic string, callback func(topic string, payload string)) error {
+	if len(topic) == 0 || nil == callback {
+		err := xerrors.Errorf("topic and callback need to be defined")
+		return err
+	}
+
+	c.Lock()
+	c.callbacks[topic] = callback
+	c.Unlock()
+
+	e := c.request(Envelope{Action: ActionSubscribe, Topic: topic}, c.config.SurbsPerRequest)
+	if nil != e {
+		c.Lock()
+		delete(c.callbacks, topic)
+		c.Unlock()
+		return e
+	}
+
+	return nil
+}
+
+// Unsubscribe stops receiving the publications on topic
+func (c *Client) Unsubscribe(topic string) error {
+	c.Lock()
+	delete(c.callbacks, topic)
+	c.Unlock()
+
+	return c.request(Envelope{Action: ActionUnsubscribe, Topic: topic}, c.config.SurbsPerRequest)
+}
+
+// Publish sends payload to the subscribers of topic
+func (c *Client) Publish(topic string, payload string) error {
+	return c.request(Envelope{Action: ActionPublish, Topic: topic, Payload: payload}, c.config.SurbsPerRequest)
+}
+
+// Handle processes the envelopes received from the broker
+func (c *Client) Handle(msg lib.NymReceived, _ func(lib.NymMessage) error) {
+	envelope, e := decodeEnvelope(msg.Message)
+	if nil != e {
+		c.logger.Debug().Msgf("dropping message: %v", e)
+		return
+	}
+
+	switch envelope.Action {
+	case ActionMessage:
+		c.RLock()
+		callback, ok := c.callbacks[envelope.Topic]
+		c.RUnlock()
+		if !ok {
+			c.logger.Debug().Msgf("dropping publication on %v, not subscribed", envelope.Topic)
+			return
+		}
+		callback(envelope.Topic, envelope.Payload)
+
+	case ActionReplenish:
+		c.logger.Debug().Msgf("replenishing broker with %d SURBs", c.config.ReplenishSurbs)
+		e = c.request(Envelope{Action: ActionReplenish}, c.config.ReplenishSurbs)
+		if nil != e {
+			c.logger.Warn().Msgf("failed to replenish SURBs: %v", e)
+		}
+
+	case ActionAck:
+		c.logger.Debug().Msgf("broker acknowledged request on %v", envelope.Topic)
+
+	case ActionError:
+		c.logger.Warn().Msgf("broker reported an error: %v", envelope.Error)
+		if nil != c.config.OnError {
+			c.config.OnError(envelope.Error)
+		}
+	}
+}
+
+// request sends envelope to the broker along with surbs reply SURBs
+func (c *Client) request(envelope Envelope, surbs uint) error {
+	c.RLock()
+	send := c.send
+	c.RUnlock()
+
+	if nil == send {
+		err := xerrors.Errorf("sender needs to be set to reach the broker")
+		c.logger.Warn().Msg(err.Error())
+		return err
+	}
+
+	envelope.Surbs = surbs
+	message, e := envelope.encode()
+	if nil != e {
+		return e
+	}
+
+	e = send(lib.NewNymSendAnonymous(message, c.brokerAddress, surbs))
+	if nil != e {
+		err := xerrors.Errorf("failed to send %v to the broker: %v", envelope.Action, e)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+// Package pubsub implements publish/subscribe topics over the Nym mixnet on top of NymSocketManager.
+//
+// A Broker runs on one nym-client and keeps its subscribers by senderTag, so they stay anonymous.
+// Publications are fanned out with NymReply, each of them consuming one of the reply SURBs of the subscriber:
+// the Broker asks subscribers running low to replenish them, which a Client does automatically.
+package pubsub
+
+import (
+	"encoding/json"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	ActionSubscribe   = "subscribe"
+	ActionUnsubscribe = "unsubscribe"
+	ActionPublish     = "publish"
+	ActionReplenish   = "replenish"
+	ActionMessage     = "message"
+	ActionAck         = "ack"
+	ActionError       = "error"
+)
+
+// Envelope is the JSON message exchanged between a Broker and its Clients
+type Envelope struct {
+	Action  string `json:"action"`
+	Topic   string `json:"topic,omitempty"`
+	Payload string `json:"payload,omitempty"`
+	// Number of reply SURBs attached to the message carrying the envelope
+	Surbs uint   `json:"surbs,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func (env Envelope) encode() (string, error) {
+	b, e := json.Marshal(env)
+	if nil != e {
+		return "", xerrors.Errorf("failed to encode %v envelope: %v", env.Action, e)
+	}
+	return string(b), nil
+}
+
+func decodeEnvelope(message string) (Envelope, error) {
+	envelope := Envelope{}
+	e := json.Unmarshal([]byte(message), &envelope)
+	if nil != e {
+		return Envelope{}, xerrors.Errorf("failed to decode envelope: %v", e)
+	}
+	if len(envelope.Action) == 0 {
+		return Envelope{}, xerrors.Errorf("envelope has no action")
+	}
+	return envelope, nil
+}
@@ -0,0 +1,176 @@
+package pubsub_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/notrustverify/nymsocketmanager/pubsub"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMixnet connects clients to a broker in memory: anonymous sends reach the broker with the senderTag
+// of the client, and replies of the broker reach the client owning the senderTag
+type fakeMixnet struct {
+	broker  *pubsub.Broker
+	clients map[string]*pubsub.Client
+}
+
+func (m *fakeMixnet) brokerSend(msg lib.NymMessage) error {
+	reply := msg.(lib.NymReply)
+	m.clients[reply.SenderTag].Handle(lib.NewNymReceived(reply.Message, "").(lib.NymReceived), nil)
+	return nil
+}
+
+func (m *fakeMixnet) addClient(t *testing.T, senderTag string, config pubsub.ClientConfig) *pubsub.Client {
+	logger := zerolog.Logger{}
+
+	client, e := pubsub.NewClient(nymtest.RandomNymAddress(), config, &logger)
+	require.NoError(t, e)
+
+	client.SetSender(func(msg lib.NymMessage) error {
+		m.broker.Handle(lib.NewNymReceived(msg.(lib.NymSendAnonymous).Message, senderTag).(lib.NymReceived), m.brokerSend)
+		return nil
+	})
+	m.clients[senderTag] = client
+
+	return client
+}
+
+func newFakeMixnet(t *testing.T, config pubsub.BrokerConfig) *fakeMixnet {
+	logger := zerolog.Logger{}
+
+	broker, e := pubsub.NewBroker(config, &logger)
+	require.NoError(t, e)
+
+	return &fakeMixnet{
+		broker:  broker,
+		clients: make(map[string]*pubsub.Client),
+	}
+}
+
+// handleEnvelope gives envelope to broker as if sent by senderTag, counting the replies of broker per action
+func handleEnvelope(t *testing.T, broker *pubsub.Broker, senderTag string, envelope pubsub.Envelope, replies map[string]int) {
+	message, e := json.Marshal(envelope)
+	require.NoError(t, e)
+
+	broker.Handle(lib.NewNymReceived(string(message), senderTag).(lib.NymReceived), func(msg lib.NymMessage) error {
+		reply := pubsub.Envelope{}
+		require.NoError(t, json.Unmarshal([]byte(msg.(lib.NymReply).Message), &reply))
+		replies[reply.Action]++
+		return nil
+	})
+}
+
+func TestClientShouldHaveABrokerAddress(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	_, e := pubsub.NewClient(lib.NymAddress{}, pubsub.ClientConfig{}, &logger)
+	require.Error(t, e)
+}
+
+func TestBrokerFansPublicationsOutToSubscribers(t *testing.T) {
+	mixnet := newFakeMixnet(t, pubsub.BrokerConfig{})
+
+	alice := mixnet.addClient(t, "alice", pubsub.ClientConfig{})
+	bob := mixnet.addClient(t, "bob", pubsub.ClientConfig{})
+	carol := mixnet.addClient(t, "carol", pubsub.ClientConfig{})
+
+	received := map[string][]string{}
+	collect := func(name string) func(string, string) {
+		return func(_ string, payload string) {
+			received[name] = append(received[name], payload)
+		}
+	}
+
+	require.NoError(t, alice.Subscribe("news", collect("alice")))
+	require.NoError(t, bob.Subscribe("news", collect("bob")))
+	require.NoError(t, carol.Subscribe("sport", collect("carol")))
+	require.ElementsMatch(t, []string{"alice", "bob"}, mixnet.broker.Subscribers("news"))
+
+	require.NoError(t, carol.Publish("news", "hello"))
+	require.Equal(t, map[string][]string{"alice": {"hello"}, "bob": {"hello"}}, received)
+
+	require.NoError(t, bob.Unsubscribe("news"))
+	require.Error(t, mixnet.broker.Publish("news", "again"))
+	require.NoError(t, carol.Publish("news", "bye"))
+	require.Equal(t, []string{"hello", "bye"}, received["alice"])
+	require.Equal(t, []string{"hello"}, received["bob"])
+
+	stats := mixnet.broker.Stats()
+	require.Equal(t, 2, stats.Topics)
+	require.Equal(t, 2, stats.Subscribers)
+}
+
+func TestBrokerAsksSubscribersToReplenishSurbs(t *testing.T) {
+	mixnet := newFakeMixnet(t, pubsub.BrokerConfig{ReplenishThreshold: 3})
+
+	subscriber := mixnet.addClient(t, "subscriber", pubsub.ClientConfig{SurbsPerRequest: 5, ReplenishSurbs: 5})
+	publisher := mixnet.addClient(t, "publisher", pubsub.ClientConfig{})
+
+	count := 0
+	require.NoError(t, subscriber.Subscribe("topic", func(string, string) { count++ }))
+
+	// Without replenishment, the 4 SURBs left after the ack would only allow 4 publications
+	for i := 0; i < 20; i++ {
+		require.NoError(t, publisher.Publish("topic", "payload"))
+	}
+
+	require.Equal(t, 20, count)
+	require.Equal(t, uint64(0), mixnet.broker.Stats().Dropped)
+}
+
+func TestBrokerOnlyCreditsSurbsToSubscribersUpToMaxSurbs(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	broker, e := pubsub.NewBroker(pubsub.BrokerConfig{ReplenishThreshold: 1, MaxSurbs: 3}, &logger)
+	require.NoError(t, e)
+	replies := map[string]int{}
+	broker.SetSender(func(lib.NymMessage) error {
+		replies[pubsub.ActionMessage]++
+		return nil
+	})
+
+	// SURBs of senderTags which did not subscribe are ignored
+	handleEnvelope(t, broker, "publisher", pubsub.Envelope{Action: pubsub.ActionPublish, Topic: "news", Surbs: 100}, replies)
+	handleEnvelope(t, broker, "publisher", pubsub.Envelope{Action: pubsub.ActionSubscribe, Topic: "news", Surbs: 1}, replies)
+	require.Equal(t, 1, replies[pubsub.ActionAck])
+
+	// 3 SURBs credited at most: one for the ack, one for a publication and one for the replenish request
+	handleEnvelope(t, broker, "alice", pubsub.Envelope{Action: pubsub.ActionSubscribe, Topic: "news", Surbs: 100}, replies)
+	require.Equal(t, 2, replies[pubsub.ActionAck])
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, broker.Publish("news", "hello"))
+	}
+
+	stats := broker.Stats()
+	require.Equal(t, uint64(1), stats.Delivered)
+	require.Equal(t, uint64(19), stats.Dropped)
+}
+
+func TestBrokerDropsIdleSubscribers(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	broker, e := pubsub.NewBroker(pubsub.BrokerConfig{IdleTimeout: 10 * time.Millisecond}, &logger)
+	require.NoError(t, e)
+	replies := map[string]int{}
+
+	handleEnvelope(t, broker, "alice", pubsub.Envelope{Action: pubsub.ActionSubscribe, Topic: "news", Surbs: 10}, replies)
+	handleEnvelope(t, broker, "bob", pubsub.Envelope{Action: pubsub.ActionSubscribe, Topic: "sport", Surbs: 10}, replies)
+	require.Equal(t, 2, broker.Stats().Subscribers)
+
+	time.Sleep(20 * time.Millisecond)
+	broker.ExpireIdle()
+	require.Equal(t, pubsub.BrokerStats{}, broker.Stats())
+
+	// Also expired on receiving envelopes
+	handleEnvelope(t, broker, "alice", pubsub.Envelope{Action: pubsub.ActionSubscribe, Topic: "news", Surbs: 10}, replies)
+	time.Sleep(20 * time.Millisecond)
+	handleEnvelope(t, broker, "bob", pubsub.Envelope{Action: pubsub.ActionSubscribe, Topic: "sport", Surbs: 10}, replies)
+	require.Empty(t, broker.Subscribers("news"))
+	require.Equal(t, []string{"bob"}, broker.Subscribers("sport"))
+}
@@ -0,0 +1,256 @@
+package nymsocketmanager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * The NymRateLimiter protects the messageHandler against senders flooding our Nym address.
+ * Each senderTag gets its own token bucket; messages without senderTag share a single global bucket since
+ * their sender cannot be told apart. As senderTags are chosen by the sender, at most MaxSenders of them get their
+ * own bucket: the messages of the others share an overflow bucket, so that rotating senderTags neither grows the
+ * memory nor escapes the limits beyond MaxSenders. It is plugged on a NymSocketManager as a middleware:
+ *
+ *	limiter, _ := NewNymRateLimiter(RateLimiterConfig{...}, &logger)
+ *	nymSocketManager.Use(limiter.Middleware())
+ */
+
+type RateLimitReaction int
+
+const (
+	// RateLimitDrop silently drops throttled messages
+	RateLimitDrop RateLimitReaction = iota
+	// RateLimitReply answers throttled messages carrying a senderTag with ReplyMessage
+	RateLimitReply
+	// RateLimitCallback gives throttled messages to OnThrottled
+	RateLimitCallback
+)
+
+type RateLimiterConfig struct {
+	// Rate (messages per second) and Burst of the bucket of each senderTag
+	Rate  float64
+	Burst int
+
+	// Rate (messages per second) and Burst of the bucket shared by all messages without senderTag
+	UntaggedRate  float64
+	UntaggedBurst int
+
+	Reaction     RateLimitReaction
+	ReplyMessage string
+	OnThrottled  NymHandler
+
+	// Buckets of senders not seen for IdleTimeout are forgotten. Defaults to 10 minutes.
+	IdleTimeout time.Duration
+
+	// Maximum number of senderTags with their own bucket. Defaults to 10000.
+	// Messages of further senderTags share a bucket with the UntaggedRate and UntaggedBurst.
+	MaxSenders int
+}
+
+type RateLimiterStats struct {
+	Allowed   uint64
+	Throttled uint64
+
+	// Number of throttled messages per senderTag still tracked
+	ThrottledSenders  map[string]uint64
+	UntaggedThrottled uint64
+
+	// Number of senderTags with their own bucket, and throttled messages of the senderTags beyond MaxSenders
+	Senders           int
+	OverflowThrottled uint64
+}
+
+const (
+	defaultRateLimiterIdleTimeout = 10 * time.Minute
+	defaultRateLimiterMaxSenders  = 10000
+)
+
+func NewNymRateLimiter(config RateLimiterConfig, parentLogger *zerolog.Logger) (*NymRateLimiter, error) {
+	if config.Rate <= 0 || config.Burst <= 0 {
+		err := xerrors.Errorf("rate and burst of senders need to be positive")
+		return nil, err
+	}
+
+	if config.UntaggedRate <= 0 || config.UntaggedBurst <= 0 {
+		err := xerrors.Errorf("rate and burst of untagged messages need to be positive")
+		return nil, err
+	}
+
+	if RateLimitCallback == config.Reaction && nil == config.OnThrottled {
+		err := xerrors.Errorf("OnThrottled needs to be defined to use the callback reaction")
+		return nil, err
+	}
+
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = defaultRateLimiterIdleTimeout
+	}
+	if config.MaxSenders <= 0 {
+		config.MaxSenders = defaultRateLimiterMaxSenders
+	}
+
+	localLogger := parentLogger.With().Str(ComponentField, "NymRateLimiter").Logger()
+
+	now := time.Now()
+	return &NymRateLimiter{
+		config:    config,
+		buckets:   make(map[string]*tokenBucket),
+		untagged:  newTokenBucket(config.UntaggedRate, config.UntaggedBurst, now),
+		overflow:  newTokenBucket(config.UntaggedRate, config.UntaggedBurst, now),
+		lastSweep: now,
+		logger:    &localLogger,
+	}, nil
+}
+
+type NymRateLimiter struct {
+	sync.Mutex
+
+	config RateLimiterConfig
+
+	buckets   map[string]*tokenBucket
+	untagged  *tokenBucket
+	overflow  *tokenBucket
+	lastSweep time.Time
+
+	allowed   uint64
+	throttled uint64
+
+	logger *zerolog.Logger
+}
+
+// Allow consumes a token from the bucket of the sender of msg and reports whether it is within its limit
+func (l *NymRateLimiter) Allow(msg NymReceived) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	bucket := l.untagged
+	if len(msg.SenderTag) != 0 {
+		var ok bool
+		bucket, ok = l.buckets[msg.SenderTag]
+		if !ok && len(l.buckets) >= l.config.MaxSenders {
+			bucket = l.overflow
+		} else if !ok {
+			bucket = newTokenBucket(l.config.Rate, l.config.Burst, now)
+			l.buckets[msg.SenderTag] = bucket
+		}
+	}
+
+	if bucket.take(now) {
+		l.allowed++
+		return true
+	}
+
+	l.throttled++
+	return false
+}
+
+// Middleware returns the NymMiddleware applying the limits before the rest of the chain
+func (l *NymRateLimiter) Middleware() NymMiddleware {
+	return func(next NymHandler) NymHandler {
+		return func(msg NymReceived, send func(NymMessage) error) {
+			if l.Allow(msg) {
+				next(msg, send)
+				return
+			}
+			l.react(msg, send)
+		}
+	}
+}
+
+func (l *NymRateLimiter) react(msg NymReceived, send func(NymMessage) error) {
+	l.logger.Debug().Msgf("throttled message from %v", msg.SenderTag)
+
+	switch l.config.Reaction {
+	case RateLimitReply:
+		if len(msg.SenderTag) == 0 {
+			return
+		}
+		e := send(NewNymReply(msg.SenderTag, l.config.ReplyMessage))
+		if nil != e {
+			l.logger.Warn().Msgf("failed to reply to throttled sender %v: %v", msg.SenderTag, e)
+		}
+
+	case RateLimitCallback:
+		l.config.OnThrottled(msg, send)
+	}
+}
+
+func (l *NymRateLimiter) Stats() RateLimiterStats {
+	l.Lock()
+	defer l.Unlock()
+
+	stats := RateLimiterStats{
+		Allowed:           l.allowed,
+		Throttled:         l.throttled,
+		ThrottledSenders:  make(map[string]uint64),
+		UntaggedThrottled: l.untagged.throttled,
+		Senders:           len(l.buckets),
+		OverflowThrottled: l.overflow.throttled,
+	}
+	for senderTag, bucket := range l.buckets {
+		if bucket.throttled > 0 {
+			stats.ThrottledSenders[senderTag] = bucket.throttled
+		}
+	}
+
+	return stats
+}
+
+// sweep forgets the buckets of idle senders, at most once per IdleTimeout
+// called from methods that already acquired the lock
+func (l *NymRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.config.IdleTimeout {
+		return
+	}
+	l.lastSweep = now
+
+	for senderTag, bucket := range l.buckets {
+		if now.Sub(bucket.lastSeen) >= l.config.IdleTimeout {
+			delete(l.buckets, senderTag)
+		}
+	}
+}
+
+type tokenBucket struct {
+	rate      float64
+	burst     float64
+	tokens    float64
+	lastSeen  time.Time
+	throttled uint64
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:     rate,
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		lastSeen: now,
+	}
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	b.tokens += now.Sub(b.lastSeen).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.lastSeen = now
+
+	if b.tokens < 1 {
+		b.throttled++
+		return false
+	}
+
+	b.tokens--
+	return true
+}
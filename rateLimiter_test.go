@@ -0,0 +1,93 @@
+package nymsocketmanager_test
+
+import (
+	"fmt"
+	"testing"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNymRateLimiterShouldHaveValidLimits(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	_, e := lib.NewNymRateLimiter(lib.RateLimiterConfig{Rate: 1, Burst: 1}, &logger)
+	require.Error(t, e)
+
+	_, e = lib.NewNymRateLimiter(lib.RateLimiterConfig{Rate: 1, Burst: 1, UntaggedRate: 1, UntaggedBurst: 1, Reaction: lib.RateLimitCallback}, &logger)
+	require.Error(t, e)
+}
+
+func TestNymRateLimiterThrottlesPerSender(t *testing.T) {
+	logger := zerolog.Logger{}
+	limiter, e := lib.NewNymRateLimiter(lib.RateLimiterConfig{
+		Rate:          0.001,
+		Burst:         2,
+		UntaggedRate:  0.001,
+		UntaggedBurst: 1,
+		Reaction:      lib.RateLimitReply,
+		ReplyMessage:  "slow down",
+	}, &logger)
+	require.NoError(t, e)
+
+	handled := 0
+	handler := lib.ChainNymMiddleware(func(lib.NymReceived, func(lib.NymMessage) error) {
+		handled++
+	}, limiter.Middleware())
+
+	replies := []lib.NymMessage{}
+	send := func(m lib.NymMessage) error {
+		replies = append(replies, m)
+		return nil
+	}
+
+	for i := 0; i < 3; i++ {
+		handler(lib.NewNymReceived("flood", "flooder").(lib.NymReceived), send)
+	}
+	handler(lib.NewNymReceived("hello", "other").(lib.NymReceived), send)
+	handler(lib.NewNymReceived("a", "").(lib.NymReceived), send)
+	handler(lib.NewNymReceived("b", "").(lib.NymReceived), send)
+
+	require.Equal(t, 4, handled)
+	require.Len(t, replies, 1)
+	require.Equal(t, "slow down", replies[0].(lib.NymReply).Message)
+
+	stats := limiter.Stats()
+	require.Equal(t, uint64(4), stats.Allowed)
+	require.Equal(t, uint64(2), stats.Throttled)
+	require.Equal(t, map[string]uint64{"flooder": 1}, stats.ThrottledSenders)
+	require.Equal(t, uint64(1), stats.UntaggedThrottled)
+}
+
+func TestNymRateLimiterChargesRotatingSenderTagsToTheOverflow(t *testing.T) {
+	logger := zerolog.Logger{}
+	limiter, e := lib.NewNymRateLimiter(lib.RateLimiterConfig{
+		Rate:          0.001,
+		Burst:         5,
+		UntaggedRate:  0.001,
+		UntaggedBurst: 3,
+		MaxSenders:    10,
+	}, &logger)
+	require.NoError(t, e)
+
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if limiter.Allow(lib.NewNymReceived("flood", fmt.Sprintf("rotating%d", i)).(lib.NymReceived)) {
+			allowed++
+		}
+	}
+
+	// 10 senderTags with their own bucket, then 3 messages from the overflow
+	require.Equal(t, 13, allowed)
+
+	stats := limiter.Stats()
+	require.Equal(t, 10, stats.Senders)
+	require.Equal(t, uint64(87), stats.OverflowThrottled)
+	require.Empty(t, stats.ThrottledSenders)
+
+	// Tracked senderTags keep their own bucket
+	require.True(t, limiter.Allow(lib.NewNymReceived("hello", "rotating0").(lib.NymReceived)))
+	// Untagged messages do not share the overflow
+	require.True(t, limiter.Allow(lib.NewNymReceived("hello", "").(lib.NymReceived)))
+}
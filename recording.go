@@ -0,0 +1,147 @@
+package nymsocketmanager
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+/*
+ * A Recorder writes the frames exchanged with the nym-client as JSON lines, to reproduce a session later with a
+ * Replayer:
+ *
+ *	recorder, _ := OpenRecorder("session.jsonl")
+ *	defer recorder.Close()
+ *	nymSocketManager.SetRecorder(recorder)
+ *
+ * Each line holds the time of the frame, its direction and the frame itself:
+ *
+ *	{"time":"2023-05-04T10:00:00.123456Z","direction":"out","frame":"{\"type\":\"selfAddress\"}"}
+ */
+
+type RecordDirection string
+
+const (
+	// RecordInbound frames were received from the nym-client
+	RecordInbound RecordDirection = "in"
+	// RecordOutbound frames were sent to the nym-client
+	RecordOutbound RecordDirection = "out"
+)
+
+type RecordedFrame struct {
+	Time      time.Time       `json:"time"`
+	Direction RecordDirection `json:"direction"`
+	Frame     string          `json:"frame"`
+}
+
+func NewRecorder(w io.Writer) (*Recorder, error) {
+	if nil == w {
+		err := xerrors.Errorf("writer needs to be defined")
+		return nil, err
+	}
+
+	return &Recorder{
+		encoder: json.NewEncoder(w),
+		writer:  w,
+	}, nil
+}
+
+// OpenRecorder creates or truncates the file at path to record into it, the file being closed by Close
+func OpenRecorder(path string) (*Recorder, error) {
+	file, e := os.Create(path)
+	if nil != e {
+		err := xerrors.Errorf("failed to create recording %v: %v", path, e)
+		return nil, err
+	}
+	return NewRecorder(file)
+}
+
+type Recorder struct {
+	sync.Mutex
+
+	encoder *json.Encoder
+	writer  io.Writer
+	err     error
+}
+
+// Record writes frame with the current time. After a failure, nothing more is recorded and Err returns it.
+func (r *Recorder) Record(direction RecordDirection, frame []byte) {
+	r.Lock()
+	defer r.Unlock()
+
+	if nil != r.err {
+		return
+	}
+
+	e := r.encoder.Encode(RecordedFrame{
+		Time:      time.Now().UTC(),
+		Direction: direction,
+		Frame:     string(frame),
+	})
+	if nil != e {
+		r.err = xerrors.Errorf("failed to record frame: %v", e)
+	}
+}
+
+// Err returns the error which stopped the recording, if any
+func (r *Recorder) Err() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.err
+}
+
+// Close closes the underlying writer if it is an io.Closer
+func (r *Recorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if nil == r.err {
+		r.err = xerrors.Errorf("recorder closed")
+	}
+
+	if closer, ok := r.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// ReadRecording parses the frames written by a Recorder
+func ReadRecording(recording io.Reader) ([]RecordedFrame, error) {
+	frames := []RecordedFrame{}
+
+	scanner := bufio.NewScanner(recording)
+	scanner.Buffer(nil, maxRecordedLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		if 0 == len(scanner.Bytes()) {
+			continue
+		}
+
+		frame := RecordedFrame{}
+		e := json.Unmarshal(scanner.Bytes(), &frame)
+		if nil != e {
+			err := xerrors.Errorf("invalid frame on line %d of the recording: %v", line, e)
+			return nil, err
+		}
+		if RecordInbound != frame.Direction && RecordOutbound != frame.Direction {
+			err := xerrors.Errorf("invalid direction %q on line %d of the recording", frame.Direction, line)
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+
+	e := scanner.Err()
+	if nil != e {
+		err := xerrors.Errorf("failed to read the recording: %v", e)
+		return nil, err
+	}
+
+	return frames, nil
+}
+
+// maxRecordedLineSize bounds the lines of a recording, frames being escaped in them
+const maxRecordedLineSize = 64 << 20
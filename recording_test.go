@@ -0,0 +1,138 @@
+package nymsocketmanager_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// recordSession records a NymSocketManager sending messages to itself through a FakeNymClient
+func recordSession(t *testing.T, messages ...string) []byte {
+	logger := zerolog.Logger{}
+
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer fakeNymClient.Close()
+
+	received := make(chan string, len(messages))
+	nymSocketManager, e := lib.NewNymSocketManager(fakeNymClient.URI(), func(msg lib.NymReceived, _ func(lib.NymMessage) error) {
+		received <- msg.Message
+	}, &logger)
+	require.NoError(t, e)
+
+	recording := &bytes.Buffer{}
+	recorder, e := lib.NewRecorder(recording)
+	require.NoError(t, e)
+	nymSocketManager.SetRecorder(recorder)
+
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+
+	for _, message := range messages {
+		require.NoError(t, nymSocketManager.Send(lib.NewNymSend(message, fakeNymClient.Address())))
+		require.Equal(t, message, <-received)
+	}
+	nymSocketManager.Stop()
+
+	require.NoError(t, recorder.Err())
+	return recording.Bytes()
+}
+
+func TestRecorderWritesFramesInBothDirections(t *testing.T) {
+	frames, e := lib.ReadRecording(bytes.NewReader(recordSession(t, "first")))
+	require.NoError(t, e)
+
+	require.Len(t, frames, 4)
+	directions := []lib.RecordDirection{lib.RecordOutbound, lib.RecordInbound, lib.RecordOutbound, lib.RecordInbound}
+	for i, frame := range frames {
+		require.Equal(t, directions[i], frame.Direction)
+		require.False(t, frame.Time.IsZero())
+	}
+	require.True(t, strings.Contains(frames[0].Frame, "selfAddress"))
+	require.True(t, strings.Contains(frames[3].Frame, "first"))
+}
+
+func TestReplayerFeedsRecordingBackIntoNymSocketManager(t *testing.T) {
+	logger := zerolog.Logger{}
+	recording := recordSession(t, "first", "second")
+
+	frames, e := lib.ReadRecording(bytes.NewReader(recording))
+	require.NoError(t, e)
+
+	replayer, e := lib.NewReplayer(bytes.NewReader(recording), lib.ReplayConfig{Instant: true})
+	require.NoError(t, e)
+
+	received := make(chan string, 2)
+	nymSocketManager, e := lib.NewNymSocketManager("replay://", func(msg lib.NymReceived, _ func(lib.NymMessage) error) {
+		received <- msg.Message
+	}, &logger)
+	require.NoError(t, e)
+	nymSocketManager.SetDialer(replayer.Dial)
+
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+	defer nymSocketManager.Stop()
+
+	// Received messages are held back until what preceded them in the recording is sent
+	select {
+	case <-received:
+		t.Fatal("received a message before sending anything")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for _, frame := range frames[2:] {
+		if lib.RecordOutbound == frame.Direction {
+			msg, e := lib.DecodeNymMessage([]byte(frame.Frame))
+			require.NoError(t, e)
+			require.NoError(t, nymSocketManager.Send(msg))
+		}
+	}
+
+	// Handlers run concurrently, their order is not guaranteed
+	require.ElementsMatch(t, []string{"first", "second"}, []string{<-received, <-received})
+	<-replayer.Done()
+
+	written := replayer.Written()
+	require.Len(t, written, 3)
+	require.Equal(t, frames[4].Frame, string(written[2]))
+}
+
+func TestReplayerKeepsRecordedTiming(t *testing.T) {
+	recording := `{"time":"2023-05-04T10:00:00Z","direction":"in","frame":"one"}
+{"time":"2023-05-04T10:00:01Z","direction":"in","frame":"two"}
+`
+	replayer, e := lib.NewReplayer(strings.NewReader(recording), lib.ReplayConfig{Speed: 10, CloseAtEnd: true})
+	require.NoError(t, e)
+
+	conn, e := replayer.Dial("")
+	require.NoError(t, e)
+
+	_, frame, e := conn.ReadMessage()
+	require.NoError(t, e)
+	require.Equal(t, "one", string(frame))
+
+	start := time.Now()
+	_, frame, e = conn.ReadMessage()
+	require.NoError(t, e)
+	require.Equal(t, "two", string(frame))
+	require.InDelta(t, 100*time.Millisecond, time.Since(start), float64(50*time.Millisecond))
+
+	_, _, e = conn.ReadMessage()
+	require.Error(t, e)
+}
+
+func TestReadRecordingRejectsInvalidFrames(t *testing.T) {
+	_, e := lib.ReadRecording(strings.NewReader(`{"time":"2023-05-04T10:00:00Z","direction":"sideways","frame":""}`))
+	require.Error(t, e)
+
+	_, e = lib.ReadRecording(strings.NewReader("not JSON"))
+	require.Error(t, e)
+
+	_, e = lib.NewReplayer(strings.NewReader(""), lib.ReplayConfig{Speed: -1})
+	require.Error(t, e)
+}
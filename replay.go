@@ -0,0 +1,249 @@
+package nymsocketmanager
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * A Replayer plays a recording back into a SocketManager or a NymSocketManager, in place of the nym-client:
+ *
+ *	replayer, _ := OpenReplayer("session.jsonl", ReplayConfig{Speed: 10})
+ *	nymSocketManager.SetDialer(replayer.Dial)
+ *	nymSocketManager.Start()
+ *	<-replayer.Done()
+ *
+ * Every connection it opens replays the inbound frames of the recording from the start. To stay deterministic,
+ * an inbound frame is only delivered once the manager wrote as many frames as were sent before it in the
+ * recording, e.g. the selfAddress reply waits for the selfAddress request. The time elapsed between a frame and
+ * the one before it is then waited, divided by Speed, unless the replay is Instant.
+ */
+
+type ReplayConfig struct {
+	// Pace of the replay, 2 replaying twice as fast as recorded. Defaults to 1.
+	Speed float64
+	// Delivers the inbound frames as soon as their turn comes, ignoring the recorded timing
+	Instant bool
+	// Closes the connection once the recording is over, instead of keeping it open until closed by the manager
+	CloseAtEnd bool
+}
+
+func NewReplayer(recording io.Reader, config ReplayConfig) (*Replayer, error) {
+	if config.Speed < 0 {
+		err := xerrors.Errorf("replay speed cannot be negative")
+		return nil, err
+	}
+
+	frames, e := ReadRecording(recording)
+	if nil != e {
+		return nil, e
+	}
+
+	if 0 == config.Speed {
+		config.Speed = 1
+	}
+
+	lastInbound := -1
+	for i, frame := range frames {
+		if RecordInbound == frame.Direction {
+			lastInbound = i
+		}
+	}
+
+	return &Replayer{
+		config:      config,
+		frames:      frames,
+		lastInbound: lastInbound,
+		done:        make(chan struct{}),
+	}, nil
+}
+
+// OpenReplayer replays the recording written to the file at path
+func OpenReplayer(path string, config ReplayConfig) (*Replayer, error) {
+	file, e := os.Open(path)
+	if nil != e {
+		err := xerrors.Errorf("failed to open recording %v: %v", path, e)
+		return nil, err
+	}
+	defer file.Close()
+
+	return NewReplayer(file, config)
+}
+
+type Replayer struct {
+	sync.Mutex
+
+	config      ReplayConfig
+	frames      []RecordedFrame
+	lastInbound int
+
+	written  [][]byte
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// Dial opens a connection replaying the recording, it is meant to be given to SetDialer
+func (r *Replayer) Dial(connectionURI string) (Conn, error) {
+	return &replayConn{
+		replayer:    r,
+		dialed:      time.Now(),
+		writeSignal: make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}, nil
+}
+
+// Done is closed once a connection delivered every inbound frame of the recording
+func (r *Replayer) Done() <-chan struct{} {
+	return r.done
+}
+
+// Written returns the frames written by the managers to the connections of the Replayer, to compare them with
+// the outbound frames of the recording
+func (r *Replayer) Written() [][]byte {
+	r.Lock()
+	defer r.Unlock()
+
+	written := make([][]byte, len(r.written))
+	copy(written, r.written)
+	return written
+}
+
+func (r *Replayer) finish() {
+	r.doneOnce.Do(func() { close(r.done) })
+}
+
+type replayConn struct {
+	replayer *Replayer
+	dialed   time.Time
+
+	// Only used by ReadMessage
+	next         int
+	outbound     int
+	lastDelivery time.Time
+
+	writeMutex  sync.Mutex
+	writeTimes  []time.Time
+	writeSignal chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *replayConn) ReadMessage() (int, []byte, error) {
+	frames := c.replayer.frames
+
+	for c.next < len(frames) {
+		index := c.next
+		frame := frames[index]
+		c.next++
+
+		if RecordOutbound == frame.Direction {
+			c.outbound++
+			continue
+		}
+
+		// Waiting for the frames sent before this one in the recording
+		e := c.waitWrites(c.outbound)
+		if nil != e {
+			return 0, nil, e
+		}
+
+		if !c.replayer.config.Instant && 0 < index {
+			previous := frames[index-1]
+			since := c.lastDelivery
+			if RecordOutbound == previous.Direction {
+				since = c.writeTime(c.outbound - 1)
+			}
+			delay := time.Duration(float64(frame.Time.Sub(previous.Time)) / c.replayer.config.Speed)
+
+			select {
+			case <-time.After(time.Until(since.Add(delay))):
+			case <-c.closed:
+				return 0, nil, closeError()
+			}
+		}
+
+		c.lastDelivery = time.Now()
+		if index == c.replayer.lastInbound {
+			c.replayer.finish()
+		}
+		return websocket.TextMessage, []byte(frame.Frame), nil
+	}
+
+	c.replayer.finish()
+	if !c.replayer.config.CloseAtEnd {
+		<-c.closed
+	}
+	return 0, nil, closeError()
+}
+
+// waitWrites blocks until count frames were written to the connection
+func (c *replayConn) waitWrites(count int) error {
+	for {
+		c.writeMutex.Lock()
+		written := len(c.writeTimes)
+		c.writeMutex.Unlock()
+
+		if count <= written {
+			return nil
+		}
+
+		select {
+		case <-c.writeSignal:
+		case <-c.closed:
+			return closeError()
+		}
+	}
+}
+
+// writeTime returns when the frame at index was written, or when the connection was dialed if none was
+func (c *replayConn) writeTime(index int) time.Time {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if index < 0 {
+		return c.dialed
+	}
+	return c.writeTimes[index]
+}
+
+func (c *replayConn) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-c.closed:
+		return xerrors.Errorf("replay connection closed")
+	default:
+	}
+
+	if websocket.CloseMessage == messageType {
+		c.Close()
+		return nil
+	}
+
+	c.replayer.Lock()
+	c.replayer.written = append(c.replayer.written, append([]byte{}, data...))
+	c.replayer.Unlock()
+
+	c.writeMutex.Lock()
+	c.writeTimes = append(c.writeTimes, time.Now())
+	c.writeMutex.Unlock()
+
+	select {
+	case c.writeSignal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (c *replayConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func closeError() error {
+	return &websocket.CloseError{Code: websocket.CloseNormalClosure}
+}
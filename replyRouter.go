@@ -0,0 +1,147 @@
+package nymsocketmanager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * A senderTag is only known by the nym-client which received the original message, so a NymReply has to go out
+ * through the same NymSocketManager. The NymReplyRouter remembers which NymSocketManager received each senderTag
+ * and routes replies accordingly, both for the send function given to the messageHandler and for code that only
+ * knows the senderTag (Reply).
+ */
+
+// DefaultReplyRouteTTL is how long the NymSocketManager which received a senderTag is remembered
+const DefaultReplyRouteTTL = time.Hour
+
+func NewNymReplyRouter(ttl time.Duration, parentLogger *zerolog.Logger) (*NymReplyRouter, error) {
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	if ttl <= 0 {
+		ttl = DefaultReplyRouteTTL
+	}
+
+	localLogger := parentLogger.With().Str(ComponentField, "NymReplyRouter").Logger()
+
+	return &NymReplyRouter{
+		ttl:       ttl,
+		routes:    make(map[string]replyRoute),
+		lastSweep: time.Now(),
+		logger:    &localLogger,
+	}, nil
+}
+
+type NymReplyRouter struct {
+	sync.Mutex
+
+	ttl       time.Duration
+	routes    map[string]replyRoute
+	lastSweep time.Time
+
+	logger *zerolog.Logger
+}
+
+type replyRoute struct {
+	manager  *NymSocketManager
+	lastSeen time.Time
+}
+
+// Middleware records the senderTags received by manager and gives the rest of the chain a send function
+// routing replies through the right NymSocketManager
+func (r *NymReplyRouter) Middleware(manager *NymSocketManager) NymMiddleware {
+	return func(next NymHandler) NymHandler {
+		return func(msg NymReceived, send func(NymMessage) error) {
+			if len(msg.SenderTag) != 0 {
+				r.record(msg.SenderTag, manager)
+			}
+
+			next(msg, func(m NymMessage) error {
+				if _, ok := m.(NymReply); ok {
+					return r.Send(m)
+				}
+				return send(m)
+			})
+		}
+	}
+}
+
+// Lookup returns the NymSocketManager which received senderTag
+func (r *NymReplyRouter) Lookup(senderTag string) (*NymSocketManager, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	route, ok := r.routes[senderTag]
+	if !ok || time.Since(route.lastSeen) >= r.ttl {
+		return nil, false
+	}
+	return route.manager, true
+}
+
+// Send sends a NymReply through the NymSocketManager which received its senderTag
+func (r *NymReplyRouter) Send(msg NymMessage) error {
+	reply, ok := msg.(NymReply)
+	if !ok {
+		err := xerrors.Errorf("only replies can be routed, got %v", msg.Name())
+		r.logger.Warn().Msg(err.Error())
+		return err
+	}
+
+	manager, ok := r.Lookup(reply.SenderTag)
+	if !ok {
+		err := xerrors.Errorf("unknown senderTag %v, cannot route reply", reply.SenderTag)
+		r.logger.Warn().Msg(err.Error())
+		return err
+	}
+
+	return manager.Send(reply)
+}
+
+// Reply sends message to senderTag through the NymSocketManager which received it
+func (r *NymReplyRouter) Reply(senderTag string, message string) error {
+	return r.Send(NewNymReply(senderTag, message))
+}
+
+// Forget drops the route of senderTag
+func (r *NymReplyRouter) Forget(senderTag string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.routes, senderTag)
+}
+
+func (r *NymReplyRouter) record(senderTag string, manager *NymSocketManager) {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	r.sweep(now)
+
+	if route, ok := r.routes[senderTag]; ok && route.manager != manager {
+		r.logger.Debug().Msgf("senderTag %v moved to another NymSocketManager", senderTag)
+	}
+	r.routes[senderTag] = replyRoute{
+		manager:  manager,
+		lastSeen: now,
+	}
+}
+
+// sweep forgets the expired routes, at most once per ttl
+// called from methods that already acquired the lock
+func (r *NymReplyRouter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < r.ttl {
+		return
+	}
+	r.lastSweep = now
+
+	for senderTag, route := range r.routes {
+		if now.Sub(route.lastSeen) >= r.ttl {
+			delete(r.routes, senderTag)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package nymsocketmanager_test
+
+import (
+	"testing"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNymReplyRouterShouldHaveAValidLogger(t *testing.T) {
+	_, e := lib.NewNymReplyRouter(0, nil)
+	require.Error(t, e)
+}
+
+func TestNymReplyRouterRemembersReceivingManager(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	router, e := lib.NewNymReplyRouter(0, &logger)
+	require.NoError(t, e)
+
+	manager, e := lib.NewNymSocketManager("ws://127.0.0.1", emptyProcessing, &logger)
+	require.NoError(t, e)
+
+	handler := lib.ChainNymMiddleware(func(msg lib.NymReceived, send func(lib.NymMessage) error) {
+		// The manager is not started, so routing works but sending fails
+		require.Error(t, send(lib.NewNymReply(msg.SenderTag, "answer")))
+	}, router.Middleware(manager))
+
+	handler(lib.NewNymReceived("question", "tag").(lib.NymReceived), noSend)
+
+	found, ok := router.Lookup("tag")
+	require.True(t, ok)
+	require.Same(t, manager, found)
+
+	router.Forget("tag")
+	_, ok = router.Lookup("tag")
+	require.False(t, ok)
+	require.Error(t, router.Reply("tag", "answer"))
+}
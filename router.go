@@ -0,0 +1,193 @@
+package nymsocketmanager
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * The NymRouter dispatches received messages to handlers depending on their content, so that several
+ * sub-protocols can be multiplexed over one nym-client address. Routes are evaluated in the order they were
+ * registered and the first matching one handles the message. Its Handle method is a NymHandler, so it can be
+ * given directly to NewNymSocketManager.
+ */
+
+func NewNymRouter(parentLogger *zerolog.Logger) (*NymRouter, error) {
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	localLogger := parentLogger.With().Str(ComponentField, "NymRouter").Logger()
+
+	return &NymRouter{
+		logger: &localLogger,
+	}, nil
+}
+
+type NymRouter struct {
+	sync.RWMutex
+
+	routes   []nymRoute
+	notFound NymHandler
+
+	logger *zerolog.Logger
+}
+
+type nymRoute struct {
+	description string
+	match       func(NymReceived, *lazyJSON) bool
+	handler     NymHandler
+}
+
+// HandlePrefix routes messages starting with prefix to handler
+func (r *NymRouter) HandlePrefix(prefix string, handler NymHandler) error {
+	return r.addRoute("prefix "+prefix, func(msg NymReceived, _ *lazyJSON) bool {
+		return strings.HasPrefix(msg.Message, prefix)
+	}, handler)
+}
+
+// HandleRegexp routes messages matching the regular expression pattern to handler
+func (r *NymRouter) HandleRegexp(pattern string, handler NymHandler) error {
+	re, e := regexp.Compile(pattern)
+	if nil != e {
+		err := xerrors.Errorf("failed to compile route pattern %v: %v", pattern, e)
+		r.logger.Warn().Msg(err.Error())
+		return err
+	}
+
+	return r.addRoute("regexp "+pattern, func(msg NymReceived, _ *lazyJSON) bool {
+		return re.MatchString(msg.Message)
+	}, handler)
+}
+
+// HandleJSONValue routes messages which are JSON objects whose value at path equals value to handler.
+// The path is made of the object keys separated by dots, e.g. "request.method".
+func (r *NymRouter) HandleJSONValue(path string, value interface{}, handler NymHandler) error {
+	if len(path) == 0 {
+		err := xerrors.Errorf("JSON path cannot be empty")
+		r.logger.Warn().Msg(err.Error())
+		return err
+	}
+
+	// Normalize the expected value to what encoding/json produces when decoding into interface{}
+	var expected interface{}
+	valueBytes, e := json.Marshal(value)
+	if nil == e {
+		e = json.Unmarshal(valueBytes, &expected)
+	}
+	if nil != e {
+		err := xerrors.Errorf("failed to use %v as JSON value: %v", value, e)
+		r.logger.Warn().Msg(err.Error())
+		return err
+	}
+
+	keys := strings.Split(path, ".")
+
+	return r.addRoute("JSON "+path, func(_ NymReceived, parsed *lazyJSON) bool {
+		found, ok := parsed.lookup(keys)
+		return ok && reflect.DeepEqual(found, expected)
+	}, handler)
+}
+
+// NotFound sets the handler called when no route matches. By default, such messages are logged and dropped.
+func (r *NymRouter) NotFound(handler NymHandler) {
+	r.Lock()
+	defer r.Unlock()
+	r.notFound = handler
+}
+
+func (r *NymRouter) addRoute(description string, match func(NymReceived, *lazyJSON) bool, handler NymHandler) error {
+	if nil == handler {
+		err := xerrors.Errorf("handler of route %v needs to be defined", description)
+		r.logger.Warn().Msg(err.Error())
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.routes = append(r.routes, nymRoute{
+		description: description,
+		match:       match,
+		handler:     handler,
+	})
+
+	return nil
+}
+
+// Handle dispatches msg to the first matching route
+func (r *NymRouter) Handle(msg NymReceived, send func(NymMessage) error) {
+	r.RLock()
+	routes := r.routes
+	notFound := r.notFound
+	r.RUnlock()
+
+	parsed := &lazyJSON{raw: msg.Message}
+	for _, route := range routes {
+		if route.match(msg, parsed) {
+			r.logger.Trace().Msgf("routing %v to %v", msg, route.description)
+			route.handler(msg, send)
+			return
+		}
+	}
+
+	if nil == notFound {
+		r.logger.Debug().Msgf("no route found for %v, dropping it", msg)
+		return
+	}
+	notFound(msg, send)
+}
+
+// ReplyErrorHandler returns a handler replying errorMessage to the sender of the message, if it can be answered.
+// It is meant to be used as NotFound handler of the NymRouter.
+func (r *NymRouter) ReplyErrorHandler(errorMessage string) NymHandler {
+	return func(msg NymReceived, send func(NymMessage) error) {
+		if len(msg.SenderTag) == 0 {
+			return
+		}
+
+		e := send(NewNymReply(msg.SenderTag, errorMessage))
+		if nil != e {
+			r.logger.Warn().Msgf("failed to reply error to %v: %v", msg.SenderTag, e)
+		}
+	}
+}
+
+// lazyJSON parses the message only once, and only if a route needs it
+type lazyJSON struct {
+	raw    string
+	parsed bool
+	value  interface{}
+	valid  bool
+}
+
+func (l *lazyJSON) lookup(keys []string) (interface{}, bool) {
+	if !l.parsed {
+		l.parsed = true
+		l.valid = nil == json.Unmarshal([]byte(l.raw), &l.value)
+	}
+	if !l.valid {
+		return nil, false
+	}
+
+	current := l.value
+	for _, key := range keys {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = object[key]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return current, true
+}
@@ -0,0 +1,74 @@
+package nymsocketmanager_test
+
+import (
+	"testing"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNymRouterShouldHaveAValidLogger(t *testing.T) {
+	_, e := lib.NewNymRouter(nil)
+	require.Error(t, e)
+}
+
+func TestNymRouterDispatchesToFirstMatchingRoute(t *testing.T) {
+	logger := zerolog.Logger{}
+	router, e := lib.NewNymRouter(&logger)
+	require.NoError(t, e)
+
+	routed := ""
+	route := func(name string) lib.NymHandler {
+		return func(lib.NymReceived, func(lib.NymMessage) error) {
+			routed = name
+		}
+	}
+
+	require.NoError(t, router.HandlePrefix("chat:", route("chat")))
+	require.NoError(t, router.HandleRegexp(`^ping \d+$`, route("ping")))
+	require.NoError(t, router.HandleJSONValue("request.method", "subscribe", route("subscribe")))
+	require.NoError(t, router.HandleJSONValue("version", 2, route("v2")))
+
+	for message, expected := range map[string]string{
+		"chat:hello":                         "chat",
+		"ping 42":                            "ping",
+		`{"request":{"method":"subscribe"}}`: "subscribe",
+		`{"version":2}`:                      "v2",
+	} {
+		routed = ""
+		router.Handle(lib.NewNymReceived(message, "").(lib.NymReceived), noSend)
+		require.Equal(t, expected, routed, message)
+	}
+}
+
+func TestNymRouterRejectsInvalidRoutes(t *testing.T) {
+	logger := zerolog.Logger{}
+	router, e := lib.NewNymRouter(&logger)
+	require.NoError(t, e)
+
+	require.Error(t, router.HandleRegexp("(", func(lib.NymReceived, func(lib.NymMessage) error) {}))
+	require.Error(t, router.HandlePrefix("a", nil))
+	require.Error(t, router.HandleJSONValue("", "a", func(lib.NymReceived, func(lib.NymMessage) error) {}))
+}
+
+func TestNymRouterNotFoundRepliesWhenPossible(t *testing.T) {
+	logger := zerolog.Logger{}
+	router, e := lib.NewNymRouter(&logger)
+	require.NoError(t, e)
+	router.NotFound(router.ReplyErrorHandler("unknown request"))
+
+	sent := []lib.NymMessage{}
+	send := func(m lib.NymMessage) error {
+		sent = append(sent, m)
+		return nil
+	}
+
+	router.Handle(lib.NewNymReceived("anything", "").(lib.NymReceived), send)
+	require.Empty(t, sent)
+
+	router.Handle(lib.NewNymReceived("anything", "tag").(lib.NymReceived), send)
+	require.Len(t, sent, 1)
+	require.Equal(t, "tag", sent[0].(lib.NymReply).SenderTag)
+	require.Equal(t, "unknown request", sent[0].(lib.NymReply).Message)
+}
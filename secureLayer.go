@@ -0,0 +1,495 @@
+package nymsocketmanager
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * The NymSecureLayer authenticates and/or encrypts payloads end-to-end between known peers.
+ * The mixnet hides who is talking to whom, so without it an anonymous sender cannot be identified.
+ *
+ * Payloads are signed with the Ed25519 identity of the sender. The signature covers a message ID, the time of
+ * sending, the identity of the recipient when it is a known peer and its encryption key when the payload is
+ * encrypted. Encryption uses an ephemeral X25519 key agreed with the X25519 key of the recipient, from which an
+ * AES-256-GCM key is derived. Received envelopes are decrypted and verified before the messageHandler runs, which
+ * gets the identity of the peer in NymReceived.VerifiedPeer. Messages signed by a known peer are dropped when
+ * addressed to another identity, sent outside of ReplayWindow, or already received within it.
+ *
+ * Remaining limits:
+ *   - messages signed for a recipient which is not a known peer are not bound to it, and can be forwarded by the
+ *     recipient to any other peer of the sender within ReplayWindow
+ *   - replays are only detected for messages signed by a known peer, and within the last MaxReplayEntries of them
+ *   - encrypted messages which are not signed can come from anyone knowing our encryption key
+ *   - the clocks of the peers need to agree within ReplayWindow
+ *
+ *	layer, _ := NewNymSecureLayer(SecureLayerConfig{...}, &logger)
+ *	nymSocketManager.Use(layer.Middleware())
+ *	nymSocketManager.UseSend(layer.SendMiddleware())
+ */
+
+const secureEnvelopeVersion = 2
+
+// secureSignatureContext is prepended to every signed content to avoid cross-protocol signatures
+const secureSignatureContext = "nymsocketmanager-secure-v2"
+
+const (
+	// DefaultSecureReplayWindow is how far the time of sending of a signed message can be from ours
+	DefaultSecureReplayWindow = 5 * time.Minute
+	// DefaultSecureMaxReplayEntries is the number of received message IDs remembered at most
+	DefaultSecureMaxReplayEntries = 100000
+)
+
+// SecurePeer holds the public keys of a peer
+type SecurePeer struct {
+	Identity      ed25519.PublicKey
+	EncryptionKey *ecdh.PublicKey
+}
+
+type SecureLayerConfig struct {
+	// Our identity, needed to sign and to accept the messages signed for it
+	Identity ed25519.PrivateKey
+	// Our X25519 key, needed to decrypt
+	EncryptionKey *ecdh.PrivateKey
+
+	// Sign and/or encrypt outgoing payloads. Encryption needs the SecurePeer of the recipient to be known.
+	Sign    bool
+	Encrypt bool
+
+	// Drop received messages which are not signed by a known peer
+	RequireVerified bool
+
+	// Signed messages sent further in the past or the future are dropped. Defaults to DefaultSecureReplayWindow.
+	ReplayWindow time.Duration
+	// Number of received message IDs remembered to detect replays. Defaults to DefaultSecureMaxReplayEntries.
+	MaxReplayEntries int
+}
+
+// NewSecureEncryptionKey generates a X25519 key to be used as SecureLayerConfig.EncryptionKey
+func NewSecureEncryptionKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+func NewNymSecureLayer(config SecureLayerConfig, parentLogger *zerolog.Logger) (*NymSecureLayer, error) {
+	if config.Sign && len(config.Identity) != ed25519.PrivateKeySize {
+		err := xerrors.Errorf("identity needs to be defined to sign")
+		return nil, err
+	}
+
+	if 0 != len(config.Identity) && len(config.Identity) != ed25519.PrivateKeySize {
+		err := xerrors.Errorf("identity needs to be an Ed25519 private key")
+		return nil, err
+	}
+
+	if nil != config.EncryptionKey && ecdh.X25519() != config.EncryptionKey.Curve() {
+		err := xerrors.Errorf("encryption key needs to be a X25519 key")
+		return nil, err
+	}
+
+	if config.ReplayWindow < 0 || config.MaxReplayEntries < 0 {
+		err := xerrors.Errorf("replay window and maximum replay entries cannot be negative")
+		return nil, err
+	}
+
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	if 0 == config.ReplayWindow {
+		config.ReplayWindow = DefaultSecureReplayWindow
+	}
+	if 0 == config.MaxReplayEntries {
+		config.MaxReplayEntries = DefaultSecureMaxReplayEntries
+	}
+
+	localLogger := parentLogger.With().Str(ComponentField, "NymSecureLayer").Logger()
+
+	return &NymSecureLayer{
+		config:           config,
+		peersByAddress:   make(map[NymAddress]SecurePeer),
+		peersByIdentity:  make(map[string]SecurePeer),
+		peersBySenderTag: make(map[string]SecurePeer),
+		received:         make(map[string]*list.Element),
+		receivedOrder:    list.New(),
+		logger:           &localLogger,
+	}, nil
+}
+
+type NymSecureLayer struct {
+	sync.RWMutex
+
+	config SecureLayerConfig
+
+	peersByAddress   map[NymAddress]SecurePeer
+	peersByIdentity  map[string]SecurePeer
+	peersBySenderTag map[string]SecurePeer
+
+	// received indexes the elements of receivedOrder, which holds the receivedMessages from the oldest to the newest
+	replayMutex   sync.Mutex
+	received      map[string]*list.Element
+	receivedOrder *list.List
+
+	logger *zerolog.Logger
+}
+
+type receivedMessage struct {
+	key        string
+	receivedAt time.Time
+}
+
+// AddPeer registers a known peer. The address is only needed to send it messages, it can be the zero NymAddress
+// for peers which only reach us anonymously.
+func (l *NymSecureLayer) AddPeer(address NymAddress, peer SecurePeer) error {
+	if len(peer.Identity) != ed25519.PublicKeySize {
+		err := xerrors.Errorf("peer identity needs to be defined")
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if !address.IsZero() {
+		l.peersByAddress[address] = peer
+	}
+	l.peersByIdentity[string(peer.Identity)] = peer
+
+	return nil
+}
+
+// secureEnvelope is the JSON carried in the Message of NymMessages going through the NymSecureLayer
+type secureEnvelope struct {
+	Version int `json:"nymSecure"`
+
+	// Set when encrypted, the ciphertext holding a signedPayload
+	Ephemeral  []byte `json:"eph,omitempty"`
+	Nonce      []byte `json:"nonce,omitempty"`
+	Ciphertext []byte `json:"ct,omitempty"`
+
+	// Set when not encrypted
+	Signed *signedPayload `json:"signed,omitempty"`
+}
+
+type signedPayload struct {
+	From      []byte `json:"from,omitempty"`
+	Signature []byte `json:"sig,omitempty"`
+	// Identity of the recipient, when known by the sender
+	To []byte `json:"to,omitempty"`
+	Id string `json:"id,omitempty"`
+	// Time of sending, in milliseconds since the epoch
+	Time    int64  `json:"time,omitempty"`
+	Payload string `json:"payload"`
+}
+
+// SendMiddleware seals the payloads of outgoing messages
+func (l *NymSecureLayer) SendMiddleware() NymSendMiddleware {
+	return func(next NymSender) NymSender {
+		return func(msg NymMessage) error {
+			payload, ok := GetPayload(msg)
+			if !ok {
+				return next(msg)
+			}
+
+			sealed, e := l.seal(msg, payload)
+			if nil != e {
+				err := xerrors.Errorf("failed to seal %v: %v", msg.Name(), e)
+				l.logger.Warn().Msg(err.Error())
+				return err
+			}
+
+			msg, _ = WithPayload(msg, sealed)
+			return next(msg)
+		}
+	}
+}
+
+// Middleware opens received envelopes before the rest of the chain, setting VerifiedPeer when signed by a known peer
+func (l *NymSecureLayer) Middleware() NymMiddleware {
+	return func(next NymHandler) NymHandler {
+		return func(msg NymReceived, send func(NymMessage) error) {
+			opened, e := l.open(msg)
+			if nil != e {
+				l.logger.Warn().Msgf("dropping message from %v: %v", msg.SenderTag, e)
+				return
+			}
+
+			if l.config.RequireVerified && nil == opened.VerifiedPeer {
+				l.logger.Warn().Msgf("dropping message from %v: not signed by a known peer", msg.SenderTag)
+				return
+			}
+
+			next(opened, send)
+		}
+	}
+}
+
+func (l *NymSecureLayer) seal(msg NymMessage, payload string) (string, error) {
+	if !l.config.Sign && !l.config.Encrypt {
+		return payload, nil
+	}
+
+	peer, known := l.recipientPeer(msg)
+	if l.config.Encrypt && (!known || nil == peer.EncryptionKey) {
+		return "", xerrors.Errorf("encryption key of the recipient is unknown")
+	}
+
+	signed := signedPayload{Payload: payload}
+	if l.config.Sign {
+		signed.From = l.config.Identity.Public().(ed25519.PublicKey)
+		signed.To = peer.Identity
+		signed.Id = NewMessageId()
+		signed.Time = time.Now().UnixMilli()
+
+		var recipientKey *ecdh.PublicKey
+		if l.config.Encrypt {
+			recipientKey = peer.EncryptionKey
+		}
+		signed.Signature = ed25519.Sign(l.config.Identity, signatureContent(recipientKey, signed))
+	}
+
+	envelope := secureEnvelope{Version: secureEnvelopeVersion}
+	if l.config.Encrypt {
+		plaintext, e := json.Marshal(signed)
+		if nil != e {
+			return "", e
+		}
+		envelope.Ephemeral, envelope.Nonce, envelope.Ciphertext, e = encryptFor(peer.EncryptionKey, plaintext)
+		if nil != e {
+			return "", e
+		}
+	} else {
+		envelope.Signed = &signed
+	}
+
+	envelopeBytes, e := json.Marshal(envelope)
+	if nil != e {
+		return "", e
+	}
+	return string(envelopeBytes), nil
+}
+
+func (l *NymSecureLayer) open(msg NymReceived) (NymReceived, error) {
+	envelope := secureEnvelope{}
+	e := json.Unmarshal([]byte(msg.Message), &envelope)
+	if nil != e || secureEnvelopeVersion != envelope.Version {
+		// Not an envelope, given as is to the messageHandler
+		return msg, nil
+	}
+
+	signed := envelope.Signed
+	var recipientKey *ecdh.PublicKey
+	if nil != envelope.Ciphertext {
+		if nil == l.config.EncryptionKey {
+			return msg, xerrors.Errorf("received encrypted message but no encryption key is configured")
+		}
+
+		plaintext, e := decryptWith(l.config.EncryptionKey, envelope.Ephemeral, envelope.Nonce, envelope.Ciphertext)
+		if nil != e {
+			return msg, e
+		}
+
+		signed = &signedPayload{}
+		e = json.Unmarshal(plaintext, signed)
+		if nil != e {
+			return msg, xerrors.Errorf("failed to unmarshal decrypted payload: %v", e)
+		}
+		recipientKey = l.config.EncryptionKey.PublicKey()
+	}
+
+	if nil == signed {
+		return msg, xerrors.Errorf("envelope has no payload")
+	}
+
+	msg.Message = signed.Payload
+	msg.VerifiedPeer = nil
+
+	if nil == signed.From {
+		return msg, nil
+	}
+
+	l.RLock()
+	peer, known := l.peersByIdentity[string(signed.From)]
+	l.RUnlock()
+	if !known {
+		l.logger.Debug().Msgf("message from %v signed by unknown peer", msg.SenderTag)
+		return msg, nil
+	}
+
+	if !ed25519.Verify(peer.Identity, signatureContent(recipientKey, *signed), signed.Signature) {
+		return msg, xerrors.Errorf("invalid signature")
+	}
+
+	if nil != signed.To && (nil == l.config.Identity || !bytes.Equal(signed.To, l.config.Identity.Public().(ed25519.PublicKey))) {
+		return msg, xerrors.Errorf("message addressed to another identity")
+	}
+
+	e = l.checkReplay(peer, *signed, time.Now())
+	if nil != e {
+		return msg, e
+	}
+
+	msg.VerifiedPeer = peer.Identity
+	if len(msg.SenderTag) != 0 {
+		l.Lock()
+		l.peersBySenderTag[msg.SenderTag] = peer
+		l.Unlock()
+	}
+
+	return msg, nil
+}
+
+// recipientPeer returns the peer msg is sent to: by address for sends, by senderTag for replies
+func (l *NymSecureLayer) recipientPeer(msg NymMessage) (SecurePeer, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if reply, ok := msg.(NymReply); ok {
+		peer, ok := l.peersBySenderTag[reply.SenderTag]
+		return peer, ok
+	}
+
+	recipient, ok := messageRecipient(msg)
+	if !ok {
+		return SecurePeer{}, false
+	}
+	peer, ok := l.peersByAddress[recipient]
+	return peer, ok
+}
+
+// checkReplay fails if signed was sent outside of the replay window or was already received from peer
+func (l *NymSecureLayer) checkReplay(peer SecurePeer, signed signedPayload, now time.Time) error {
+	if 0 == len(signed.Id) {
+		return xerrors.Errorf("signed message has no ID")
+	}
+
+	sentAt := time.UnixMilli(signed.Time)
+	if sentAt.Before(now.Add(-l.config.ReplayWindow)) || sentAt.After(now.Add(l.config.ReplayWindow)) {
+		return xerrors.Errorf("message sent at %v, outside of the replay window", sentAt)
+	}
+
+	l.replayMutex.Lock()
+	defer l.replayMutex.Unlock()
+
+	// Messages older than the window are rejected by their time, so they do not need to be remembered
+	for element := l.receivedOrder.Front(); nil != element; element = l.receivedOrder.Front() {
+		if now.Sub(element.Value.(*receivedMessage).receivedAt) < 2*l.config.ReplayWindow {
+			break
+		}
+		delete(l.received, element.Value.(*receivedMessage).key)
+		l.receivedOrder.Remove(element)
+	}
+
+	key := string(peer.Identity) + signed.Id
+	if _, replayed := l.received[key]; replayed {
+		return xerrors.Errorf("message %v already received", signed.Id)
+	}
+
+	l.received[key] = l.receivedOrder.PushBack(&receivedMessage{key: key, receivedAt: now})
+	for l.receivedOrder.Len() > l.config.MaxReplayEntries {
+		element := l.receivedOrder.Front()
+		delete(l.received, element.Value.(*receivedMessage).key)
+		l.receivedOrder.Remove(element)
+	}
+
+	return nil
+}
+
+// signatureContent returns what is signed for signed, each field being prefixed with its length
+func signatureContent(recipientKey *ecdh.PublicKey, signed signedPayload) []byte {
+	content := bytes.NewBufferString(secureSignatureContext)
+	writeField := func(field []byte) {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(field)))
+		content.Write(length)
+		content.Write(field)
+	}
+
+	var recipientKeyBytes []byte
+	if nil != recipientKey {
+		recipientKeyBytes = recipientKey.Bytes()
+	}
+	sentAt := make([]byte, 8)
+	binary.BigEndian.PutUint64(sentAt, uint64(signed.Time))
+
+	writeField(signed.From)
+	writeField(signed.To)
+	writeField(recipientKeyBytes)
+	writeField([]byte(signed.Id))
+	writeField(sentAt)
+	writeField([]byte(signed.Payload))
+	return content.Bytes()
+}
+
+func encryptFor(recipientKey *ecdh.PublicKey, plaintext []byte) ([]byte, []byte, []byte, error) {
+	ephemeral, e := ecdh.X25519().GenerateKey(rand.Reader)
+	if nil != e {
+		return nil, nil, nil, xerrors.Errorf("failed to generate ephemeral key: %v", e)
+	}
+
+	aead, e := secureAEAD(ephemeral, recipientKey, ephemeral.PublicKey().Bytes())
+	if nil != e {
+		return nil, nil, nil, e
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, e = rand.Read(nonce)
+	if nil != e {
+		return nil, nil, nil, xerrors.Errorf("failed to generate nonce: %v", e)
+	}
+
+	return ephemeral.PublicKey().Bytes(), nonce, aead.Seal(nil, nonce, plaintext, nil), nil
+}
+
+func decryptWith(key *ecdh.PrivateKey, ephemeralBytes []byte, nonce []byte, ciphertext []byte) ([]byte, error) {
+	ephemeral, e := ecdh.X25519().NewPublicKey(ephemeralBytes)
+	if nil != e {
+		return nil, xerrors.Errorf("invalid ephemeral key: %v", e)
+	}
+
+	aead, e := secureAEAD(key, ephemeral, ephemeralBytes)
+	if nil != e {
+		return nil, e
+	}
+
+	if len(nonce) != aead.NonceSize() {
+		return nil, xerrors.Errorf("invalid nonce")
+	}
+
+	plaintext, e := aead.Open(nil, nonce, ciphertext, nil)
+	if nil != e {
+		return nil, xerrors.Errorf("failed to decrypt: %v", e)
+	}
+	return plaintext, nil
+}
+
+// secureAEAD derives the AES-256-GCM key from the X25519 agreement, bound to the ephemeral key
+func secureAEAD(private *ecdh.PrivateKey, public *ecdh.PublicKey, ephemeralBytes []byte) (cipher.AEAD, error) {
+	shared, e := private.ECDH(public)
+	if nil != e {
+		return nil, xerrors.Errorf("failed key agreement: %v", e)
+	}
+
+	h := sha256.New()
+	h.Write([]byte(secureSignatureContext))
+	h.Write(shared)
+	h.Write(ephemeralBytes)
+
+	block, e := aes.NewCipher(h.Sum(nil))
+	if nil != e {
+		return nil, e
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,203 @@
+package nymsocketmanager_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+type securePeer struct {
+	address lib.NymAddress
+	peer    lib.SecurePeer
+	layer   *lib.NymSecureLayer
+}
+
+func newSecurePeer(t *testing.T, sign bool, encrypt bool) securePeer {
+	return newSecurePeerWithWindow(t, sign, encrypt, 0)
+}
+
+func newSecurePeerWithWindow(t *testing.T, sign bool, encrypt bool, replayWindow time.Duration) securePeer {
+	logger := zerolog.Logger{}
+
+	identityPublic, identity, e := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, e)
+	encryptionKey, e := lib.NewSecureEncryptionKey()
+	require.NoError(t, e)
+
+	layer, e := lib.NewNymSecureLayer(lib.SecureLayerConfig{
+		Identity:        identity,
+		EncryptionKey:   encryptionKey,
+		Sign:            sign,
+		Encrypt:         encrypt,
+		RequireVerified: true,
+		ReplayWindow:    replayWindow,
+	}, &logger)
+	require.NoError(t, e)
+
+	return securePeer{
+		address: nymtest.RandomNymAddress(),
+		peer:    lib.SecurePeer{Identity: identityPublic, EncryptionKey: encryptionKey.PublicKey()},
+		layer:   layer,
+	}
+}
+
+// transmit seals msg with the layer of from and opens it with the layer of to, as if sent through the mixnet
+func transmit(t *testing.T, from securePeer, to securePeer, msg lib.NymMessage, senderTag string) (lib.NymReceived, bool) {
+	return receive(to, seal(t, from, msg), senderTag)
+}
+
+// seal returns the payload of msg sealed by the layer of from
+func seal(t *testing.T, from securePeer, msg lib.NymMessage) string {
+	var sealed lib.NymMessage
+	e := lib.ChainNymSendMiddleware(func(m lib.NymMessage) error {
+		sealed = m
+		return nil
+	}, from.layer.SendMiddleware())(msg)
+	require.NoError(t, e)
+
+	payload, _ := lib.GetPayload(sealed)
+	return payload
+}
+
+// receive opens payload with the layer of to
+func receive(to securePeer, payload string, senderTag string) (lib.NymReceived, bool) {
+	var opened *lib.NymReceived
+	lib.ChainNymMiddleware(func(m lib.NymReceived, _ func(lib.NymMessage) error) {
+		opened = &m
+	}, to.layer.Middleware())(lib.NewNymReceived(payload, senderTag).(lib.NymReceived), noSend)
+
+	if nil == opened {
+		return lib.NymReceived{}, false
+	}
+	return *opened, true
+}
+
+func TestNymSecureLayerShouldHaveAnIdentityToSign(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	_, e := lib.NewNymSecureLayer(lib.SecureLayerConfig{Sign: true}, &logger)
+	require.Error(t, e)
+}
+
+func TestNymSecureLayerSignsAndEncryptsBetweenKnownPeers(t *testing.T) {
+	alice := newSecurePeer(t, true, true)
+	bob := newSecurePeer(t, true, true)
+	require.NoError(t, alice.layer.AddPeer(bob.address, bob.peer))
+	require.NoError(t, bob.layer.AddPeer(lib.NymAddress{}, alice.peer))
+
+	received, ok := transmit(t, alice, bob, lib.NewNymSendAnonymous("secret", bob.address, 1), "aliceTag")
+	require.True(t, ok)
+	require.Equal(t, "secret", received.Message)
+	require.Equal(t, alice.peer.Identity, received.VerifiedPeer)
+
+	// Bob learnt which peer is behind the senderTag and can encrypt the reply
+	reply, ok := transmit(t, bob, alice, lib.NewNymReply("aliceTag", "answer"), "")
+	require.True(t, ok)
+	require.Equal(t, "answer", reply.Message)
+	require.Equal(t, bob.peer.Identity, reply.VerifiedPeer)
+}
+
+func TestNymSecureLayerKeepsPayloadsConfidential(t *testing.T) {
+	alice := newSecurePeer(t, true, true)
+	bob := newSecurePeer(t, true, true)
+	require.NoError(t, alice.layer.AddPeer(bob.address, bob.peer))
+
+	var sealed lib.NymMessage
+	e := lib.ChainNymSendMiddleware(func(m lib.NymMessage) error {
+		sealed = m
+		return nil
+	}, alice.layer.SendMiddleware())(lib.NewNymSend("secret", bob.address))
+	require.NoError(t, e)
+
+	payload, _ := lib.GetPayload(sealed)
+	require.False(t, strings.Contains(payload, "secret"))
+
+	// Unknown recipients cannot be encrypted for
+	e = alice.layer.SendMiddleware()(func(lib.NymMessage) error { return nil })(lib.NewNymSend("secret", nymtest.RandomNymAddress()))
+	require.Error(t, e)
+}
+
+func TestNymSecureLayerDropsUnverifiedMessages(t *testing.T) {
+	alice := newSecurePeer(t, true, false)
+	bob := newSecurePeer(t, true, false)
+	mallory := newSecurePeer(t, true, false)
+	require.NoError(t, bob.layer.AddPeer(alice.address, alice.peer))
+
+	received, ok := transmit(t, alice, bob, lib.NewNymSend("signed", bob.address), "")
+	require.True(t, ok)
+	require.Equal(t, "signed", received.Message)
+
+	_, ok = transmit(t, mallory, bob, lib.NewNymSend("unknown signer", bob.address), "")
+	require.False(t, ok)
+
+	// Mallory pretends to be Alice
+	forged := lib.NewNymReceived(`{"nymSecure":2,"signed":{"from":"`+encodeBase64(alice.peer.Identity)+`","sig":"AAAA","payload":"forged"}}`, "")
+	handled := false
+	lib.ChainNymMiddleware(func(lib.NymReceived, func(lib.NymMessage) error) {
+		handled = true
+	}, bob.layer.Middleware())(forged.(lib.NymReceived), noSend)
+	require.False(t, handled)
+}
+
+func TestNymSecureLayerDropsReplays(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		alice := newSecurePeer(t, true, encrypt)
+		bob := newSecurePeer(t, true, encrypt)
+		require.NoError(t, alice.layer.AddPeer(bob.address, bob.peer))
+		require.NoError(t, bob.layer.AddPeer(alice.address, alice.peer))
+
+		payload := seal(t, alice, lib.NewNymSend("once", bob.address))
+		received, ok := receive(bob, payload, "")
+		require.True(t, ok)
+		require.Equal(t, "once", received.Message)
+
+		_, ok = receive(bob, payload, "")
+		require.False(t, ok, "encrypt: %v", encrypt)
+
+		// Sending the same payload again gives it a new ID
+		_, ok = transmit(t, alice, bob, lib.NewNymSend("once", bob.address), "")
+		require.True(t, ok)
+	}
+}
+
+func TestNymSecureLayerDropsMessagesOutsideOfTheReplayWindow(t *testing.T) {
+	alice := newSecurePeerWithWindow(t, true, false, 10*time.Millisecond)
+	bob := newSecurePeerWithWindow(t, true, false, 10*time.Millisecond)
+	require.NoError(t, bob.layer.AddPeer(alice.address, alice.peer))
+
+	payload := seal(t, alice, lib.NewNymSend("late", bob.address))
+	time.Sleep(20 * time.Millisecond)
+
+	_, ok := receive(bob, payload, "")
+	require.False(t, ok)
+}
+
+func TestNymSecureLayerBindsSignaturesToTheRecipient(t *testing.T) {
+	alice := newSecurePeer(t, true, false)
+	bob := newSecurePeer(t, true, false)
+	mallory := newSecurePeer(t, true, false)
+	require.NoError(t, alice.layer.AddPeer(bob.address, bob.peer))
+	require.NoError(t, bob.layer.AddPeer(alice.address, alice.peer))
+	require.NoError(t, mallory.layer.AddPeer(alice.address, alice.peer))
+
+	// Bob cannot forward to Mallory what Alice signed for him
+	payload := seal(t, alice, lib.NewNymSend("for bob", bob.address))
+	_, ok := receive(mallory, payload, "")
+	require.False(t, ok)
+
+	received, ok := receive(bob, payload, "")
+	require.True(t, ok)
+	require.Equal(t, alice.peer.Identity, received.VerifiedPeer)
+}
+
+func encodeBase64(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
@@ -0,0 +1,435 @@
+package nymsocketmanager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * Sessions keep per-SenderTag state across the messages of an anonymous peer.
+ * The NymSessionManager creates a Session when a new senderTag shows up, refreshes it on every message and
+ * ends it once it has been idle for too long. Sessions are held by a SessionStore, in memory by default.
+ * Messages without senderTag cannot be tied to a peer and are handled without session.
+ */
+
+type SessionEndReason int
+
+const (
+	// SessionExpired is given when the session has been idle for longer than IdleTimeout
+	SessionExpired SessionEndReason = iota
+	// SessionEnded is given when the session has been ended by the application
+	SessionEnded
+	// SessionManagerStopped is given when the NymSessionManager has been stopped
+	SessionManagerStopped
+)
+
+func (r SessionEndReason) String() string {
+	switch r {
+	case SessionExpired:
+		return "expired"
+	case SessionEnded:
+		return "ended"
+	case SessionManagerStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+/*********************************************
+ * Session
+ *********************************************/
+
+func NewSession(senderTag string) *Session {
+	now := time.Now()
+	return &Session{
+		senderTag: senderTag,
+		values:    make(map[string]interface{}),
+		startedAt: now,
+		lastSeen:  now,
+	}
+}
+
+type Session struct {
+	sync.Mutex
+
+	senderTag string
+	values    map[string]interface{}
+	startedAt time.Time
+	lastSeen  time.Time
+}
+
+func (s *Session) SenderTag() string {
+	return s.senderTag
+}
+
+func (s *Session) StartedAt() time.Time {
+	return s.startedAt
+}
+
+func (s *Session) LastSeen() time.Time {
+	s.Lock()
+	defer s.Unlock()
+	return s.lastSeen
+}
+
+func (s *Session) Touch() {
+	s.Lock()
+	defer s.Unlock()
+	s.lastSeen = time.Now()
+}
+
+func (s *Session) Get(key string) (interface{}, bool) {
+	s.Lock()
+	defer s.Unlock()
+	value, ok := s.values[key]
+	return value, ok
+}
+
+func (s *Session) Set(key string, value interface{}) {
+	s.Lock()
+	defer s.Unlock()
+	s.values[key] = value
+}
+
+func (s *Session) Delete(key string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.values, key)
+}
+
+/*********************************************
+ * SessionStore
+ *********************************************/
+
+// SessionStore holds the sessions of a NymSessionManager. Implementations need to be safe for concurrent use.
+type SessionStore interface {
+	Get(senderTag string) (*Session, bool)
+	Put(session *Session) error
+	// Delete removes the session of senderTag, telling whether it was there
+	Delete(senderTag string) (bool, error)
+	Len() int
+	// Range calls f on every session until it returns false
+	Range(f func(*Session) bool)
+}
+
+func NewInMemorySessionStore() *InMemorySessionStore {
+	return &InMemorySessionStore{
+		sessions: make(map[string]*Session),
+	}
+}
+
+type InMemorySessionStore struct {
+	sync.RWMutex
+
+	sessions map[string]*Session
+}
+
+func (m *InMemorySessionStore) Get(senderTag string) (*Session, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	session, ok := m.sessions[senderTag]
+	return session, ok
+}
+
+func (m *InMemorySessionStore) Put(session *Session) error {
+	m.Lock()
+	defer m.Unlock()
+	m.sessions[session.SenderTag()] = session
+	return nil
+}
+
+func (m *InMemorySessionStore) Delete(senderTag string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	_, ok := m.sessions[senderTag]
+	delete(m.sessions, senderTag)
+	return ok, nil
+}
+
+func (m *InMemorySessionStore) Len() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.sessions)
+}
+
+func (m *InMemorySessionStore) Range(f func(*Session) bool) {
+	m.RLock()
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	m.RUnlock()
+
+	for _, session := range sessions {
+		if !f(session) {
+			return
+		}
+	}
+}
+
+/*********************************************
+ * NymSessionManager
+ *********************************************/
+
+// SessionHandler is a messageHandler also receiving the session of the sender (nil if the message has no senderTag)
+type SessionHandler func(NymReceived, *Session, func(NymMessage) error)
+
+type SessionManagerConfig struct {
+	// Sessions idle for longer than IdleTimeout are ended. Defaults to 10 minutes.
+	IdleTimeout time.Duration
+	// Maximum number of concurrent sessions, 0 meaning unlimited.
+	// Messages from new senders are dropped while the cap is reached.
+	MaxSessions int
+
+	// Store holding the sessions. Defaults to an InMemorySessionStore.
+	Store SessionStore
+
+	// Called once per session, outside of the locks of the NymSessionManager
+	OnSessionStart func(*Session)
+	OnSessionEnd   func(*Session, SessionEndReason)
+}
+
+const defaultSessionIdleTimeout = 10 * time.Minute
+
+func NewNymSessionManager(config SessionManagerConfig, parentLogger *zerolog.Logger) (*NymSessionManager, error) {
+	if config.MaxSessions < 0 {
+		err := xerrors.Errorf("maximum number of sessions cannot be negative")
+		return nil, err
+	}
+
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = defaultSessionIdleTimeout
+	}
+	if nil == config.Store {
+		config.Store = NewInMemorySessionStore()
+	}
+
+	localLogger := parentLogger.With().Str(ComponentField, "NymSessionManager").Logger()
+
+	return &NymSessionManager{
+		config: config,
+		logger: &localLogger,
+	}, nil
+}
+
+type NymSessionManager struct {
+	// Serializes session creation so that the cap is respected
+	sync.Mutex
+
+	config SessionManagerConfig
+
+	stopExpiryChan chan struct{}
+
+	logger *zerolog.Logger
+}
+
+// Session returns the session of senderTag, if any
+func (m *NymSessionManager) Session(senderTag string) (*Session, bool) {
+	return m.config.Store.Get(senderTag)
+}
+
+// Len returns the number of active sessions
+func (m *NymSessionManager) Len() int {
+	return m.config.Store.Len()
+}
+
+// Handle wraps handler into a NymHandler that can be given to NewNymSocketManager
+func (m *NymSessionManager) Handle(handler SessionHandler) NymHandler {
+	return func(msg NymReceived, send func(NymMessage) error) {
+		if len(msg.SenderTag) == 0 {
+			handler(msg, nil, send)
+			return
+		}
+
+		session, e := m.sessionFor(msg.SenderTag)
+		if nil != e {
+			m.logger.Warn().Msgf("dropping message from %v: %v", msg.SenderTag, e)
+			return
+		}
+
+		handler(msg, session, send)
+	}
+}
+
+// Middleware keeps sessions up to date for the rest of the chain, which can get them with Session
+func (m *NymSessionManager) Middleware() NymMiddleware {
+	return func(next NymHandler) NymHandler {
+		return m.Handle(func(msg NymReceived, _ *Session, send func(NymMessage) error) {
+			next(msg, send)
+		})
+	}
+}
+
+// sessionFor returns the refreshed session of senderTag, starting a new one if needed
+func (m *NymSessionManager) sessionFor(senderTag string) (*Session, error) {
+	if session, ok := m.config.Store.Get(senderTag); ok {
+		session.Touch()
+		return session, nil
+	}
+
+	session, started, expired, e := m.startSession(senderTag)
+	m.notifyEnd(expired, SessionExpired)
+	if nil != e {
+		return nil, e
+	}
+
+	if started && nil != m.config.OnSessionStart {
+		m.config.OnSessionStart(session)
+	}
+
+	return session, nil
+}
+
+// startSession starts the session of senderTag under the lock, unless it was created while waiting for it.
+// It also returns the sessions expired to make room for it, whose OnSessionEnd is left to the caller.
+func (m *NymSessionManager) startSession(senderTag string) (*Session, bool, []*Session, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	// Could have been created while waiting for the lock
+	if session, ok := m.config.Store.Get(senderTag); ok {
+		session.Touch()
+		return session, false, nil, nil
+	}
+
+	expired := []*Session{}
+	if m.config.MaxSessions > 0 && m.config.Store.Len() >= m.config.MaxSessions {
+		expired = m.removeIdle()
+		if m.config.Store.Len() >= m.config.MaxSessions {
+			err := xerrors.Errorf("maximum number of sessions (%d) reached", m.config.MaxSessions)
+			return nil, false, expired, err
+		}
+	}
+
+	session := NewSession(senderTag)
+	e := m.config.Store.Put(session)
+	if nil != e {
+		err := xerrors.Errorf("failed to store session: %v", e)
+		return nil, false, expired, err
+	}
+
+	m.logger.Debug().Msgf("started session of %v", senderTag)
+	return session, true, expired, nil
+}
+
+// End ends the session of senderTag, if any
+func (m *NymSessionManager) End(senderTag string) {
+	session, ok := m.config.Store.Get(senderTag)
+	if !ok {
+		return
+	}
+	m.end(session, SessionEnded)
+}
+
+func (m *NymSessionManager) end(session *Session, reason SessionEndReason) {
+	if m.remove(session, reason) {
+		m.notifyEnd([]*Session{session}, reason)
+	}
+}
+
+// remove deletes session from the store, telling whether this call removed it.
+// Only the caller which removed a session calls its OnSessionEnd, so that it is called once.
+func (m *NymSessionManager) remove(session *Session, reason SessionEndReason) bool {
+	deleted, e := m.config.Store.Delete(session.SenderTag())
+	if nil != e {
+		m.logger.Warn().Msgf("failed to delete session of %v: %v", session.SenderTag(), e)
+		return false
+	}
+	if !deleted {
+		return false
+	}
+
+	m.logger.Debug().Msgf("session of %v %v", session.SenderTag(), reason)
+	return true
+}
+
+func (m *NymSessionManager) notifyEnd(sessions []*Session, reason SessionEndReason) {
+	if nil == m.config.OnSessionEnd {
+		return
+	}
+	for _, session := range sessions {
+		m.config.OnSessionEnd(session, reason)
+	}
+}
+
+// ExpireIdle ends all the sessions idle for longer than IdleTimeout
+func (m *NymSessionManager) ExpireIdle() {
+	m.notifyEnd(m.removeIdle(), SessionExpired)
+}
+
+// removeIdle removes the sessions idle for longer than IdleTimeout and returns them
+func (m *NymSessionManager) removeIdle() []*Session {
+	deadline := time.Now().Add(-m.config.IdleTimeout)
+
+	idle := []*Session{}
+	m.config.Store.Range(func(session *Session) bool {
+		if session.LastSeen().Before(deadline) {
+			idle = append(idle, session)
+		}
+		return true
+	})
+
+	removed := []*Session{}
+	for _, session := range idle {
+		if m.remove(session, SessionExpired) {
+			removed = append(removed, session)
+		}
+	}
+	return removed
+}
+
+// StartExpiry periodically ends idle sessions until Stop is called
+func (m *NymSessionManager) StartExpiry(interval time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+
+	if nil != m.stopExpiryChan {
+		return
+	}
+
+	stopExpiryChan := make(chan struct{})
+	m.stopExpiryChan = stopExpiryChan
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				m.ExpireIdle()
+			case <-stopExpiryChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic expiry and ends all remaining sessions
+func (m *NymSessionManager) Stop() {
+	m.Lock()
+	if nil != m.stopExpiryChan {
+		close(m.stopExpiryChan)
+		m.stopExpiryChan = nil
+	}
+	m.Unlock()
+
+	remaining := []*Session{}
+	m.config.Store.Range(func(session *Session) bool {
+		remaining = append(remaining, session)
+		return true
+	})
+
+	for _, session := range remaining {
+		m.end(session, SessionManagerStopped)
+	}
+}
@@ -0,0 +1,172 @@
+package nymsocketmanager_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNymSessionManagerShouldHaveAValidLogger(t *testing.T) {
+	_, e := lib.NewNymSessionManager(lib.SessionManagerConfig{}, nil)
+	require.Error(t, e)
+}
+
+func TestNymSessionManagerKeepsStatePerSenderTag(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	started := 0
+	sessions, e := lib.NewNymSessionManager(lib.SessionManagerConfig{
+		OnSessionStart: func(*lib.Session) { started++ },
+	}, &logger)
+	require.NoError(t, e)
+
+	handler := sessions.Handle(func(msg lib.NymReceived, session *lib.Session, _ func(lib.NymMessage) error) {
+		if nil == session {
+			return
+		}
+		count, _ := session.Get("count")
+		c, _ := count.(int)
+		session.Set("count", c+1)
+	})
+
+	handler(lib.NewNymReceived("a", "alice").(lib.NymReceived), noSend)
+	handler(lib.NewNymReceived("b", "alice").(lib.NymReceived), noSend)
+	handler(lib.NewNymReceived("c", "bob").(lib.NymReceived), noSend)
+	handler(lib.NewNymReceived("d", "").(lib.NymReceived), noSend)
+
+	require.Equal(t, 2, started)
+	require.Equal(t, 2, sessions.Len())
+
+	alice, ok := sessions.Session("alice")
+	require.True(t, ok)
+	count, _ := alice.Get("count")
+	require.Equal(t, 2, count)
+}
+
+func TestNymSessionManagerCapsSessions(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	sessions, e := lib.NewNymSessionManager(lib.SessionManagerConfig{MaxSessions: 1}, &logger)
+	require.NoError(t, e)
+
+	handled := 0
+	handler := sessions.Handle(func(lib.NymReceived, *lib.Session, func(lib.NymMessage) error) { handled++ })
+
+	handler(lib.NewNymReceived("a", "alice").(lib.NymReceived), noSend)
+	handler(lib.NewNymReceived("b", "bob").(lib.NymReceived), noSend)
+	handler(lib.NewNymReceived("c", "alice").(lib.NymReceived), noSend)
+
+	require.Equal(t, 2, handled)
+	require.Equal(t, 1, sessions.Len())
+}
+
+func TestNymSessionManagerExpiresIdleSessions(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	reasons := []lib.SessionEndReason{}
+	sessions, e := lib.NewNymSessionManager(lib.SessionManagerConfig{
+		IdleTimeout:  time.Millisecond,
+		OnSessionEnd: func(_ *lib.Session, reason lib.SessionEndReason) { reasons = append(reasons, reason) },
+	}, &logger)
+	require.NoError(t, e)
+
+	sessions.Middleware()(func(lib.NymReceived, func(lib.NymMessage) error) {})(lib.NewNymReceived("a", "alice").(lib.NymReceived), noSend)
+	require.Equal(t, 1, sessions.Len())
+
+	time.Sleep(5 * time.Millisecond)
+	sessions.ExpireIdle()
+
+	require.Equal(t, 0, sessions.Len())
+	require.Equal(t, []lib.SessionEndReason{lib.SessionExpired}, reasons)
+}
+
+func TestNymSessionManagerEndsSessionsOnce(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	endedMutex := sync.Mutex{}
+	ended := map[string]int{}
+	sessions, e := lib.NewNymSessionManager(lib.SessionManagerConfig{
+		IdleTimeout: time.Millisecond,
+		OnSessionEnd: func(session *lib.Session, _ lib.SessionEndReason) {
+			endedMutex.Lock()
+			defer endedMutex.Unlock()
+			ended[session.SenderTag()]++
+		},
+	}, &logger)
+	require.NoError(t, e)
+
+	handler := sessions.Middleware()(func(lib.NymReceived, func(lib.NymMessage) error) {})
+	for i := 0; i < 20; i++ {
+		handler(lib.NewNymReceived("a", fmt.Sprintf("sender%d", i)).(lib.NymReceived), noSend)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// Expiring and ending concurrently
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			sessions.ExpireIdle()
+		}()
+		go func(i int) {
+			defer wg.Done()
+			sessions.End(fmt.Sprintf("sender%d", i))
+		}(i)
+	}
+	wg.Wait()
+
+	require.Equal(t, 0, sessions.Len())
+	require.Len(t, ended, 20)
+	for senderTag, count := range ended {
+		require.Equal(t, 1, count, senderTag)
+	}
+}
+
+func TestNymSessionManagerCallsOnSessionEndOutsideOfItsLock(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	var handler lib.NymHandler
+	started := []string{}
+
+	sessions, e := lib.NewNymSessionManager(lib.SessionManagerConfig{
+		IdleTimeout: time.Millisecond,
+		MaxSessions: 1,
+		// Starting a session from the callback would deadlock if it was called under the lock
+		OnSessionEnd: func(session *lib.Session, _ lib.SessionEndReason) {
+			if "alice" == session.SenderTag() {
+				handler(lib.NewNymReceived("bye", "carol").(lib.NymReceived), noSend)
+			}
+		},
+		OnSessionStart: func(session *lib.Session) {
+			started = append(started, session.SenderTag())
+		},
+	}, &logger)
+	require.NoError(t, e)
+	handler = sessions.Middleware()(func(lib.NymReceived, func(lib.NymMessage) error) {})
+
+	handler(lib.NewNymReceived("a", "alice").(lib.NymReceived), noSend)
+	time.Sleep(5 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		handler(lib.NewNymReceived("b", "bob").(lib.NymReceived), noSend)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("deadlocked on calling OnSessionEnd")
+	}
+
+	// Bob took the room freed by alice before the callback, so carol was dropped
+	require.Equal(t, []string{"alice", "bob"}, started)
+	_, ok := sessions.Session("carol")
+	require.False(t, ok)
+}
@@ -1,12 +1,11 @@
 package nymsocketmanager
 
 import (
-	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
 	"golang.org/x/xerrors"
 )
 
-func NewSocketListener(socket *websocket.Conn, messageHandler func([]byte), toCallWhenClosed func(), parentLogger *zerolog.Logger) (*SocketListener, chan struct{}, error) {
+func NewSocketListener(socket Conn, messageHandler func([]byte), toCallWhenClosed func(), parentLogger *zerolog.Logger) (*SocketListener, chan struct{}, error) {
 
 	if nil == socket {
 		err := xerrors.Errorf("websocket connection cannot be undefined")
@@ -39,16 +38,22 @@ func NewSocketListener(socket *websocket.Conn, messageHandler func([]byte), toCa
 }
 
 type SocketListener struct {
-	socket *websocket.Conn
+	socket Conn
 
 	messageHandler func([]byte)
 
 	toCallWhenClosed func()
 
 	closedSocketChan chan struct{}
+	recorder         *Recorder
 	logger           *zerolog.Logger
 }
 
+// SetRecorder records the received frames with recorder, it needs to be called before Listen
+func (s *SocketListener) SetRecorder(recorder *Recorder) {
+	s.recorder = recorder
+}
+
 func (s *SocketListener) Listen() {
 
 	// If provided, execute some cleaning code from parent after closing
@@ -64,6 +69,10 @@ func (s *SocketListener) Listen() {
 			break
 		}
 
+		if nil != s.recorder {
+			s.recorder.Record(RecordInbound, receivedMessage)
+		}
+
 		// Process msg: start a goroutine to handle the request
 		s.logger.Trace().Msgf("recv: \"%s\"", string(receivedMessage))
 		go s.messageHandler(receivedMessage)
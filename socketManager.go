@@ -22,31 +22,66 @@ func NewSocketManager(connectionURI string, messageHandler func([]byte, func([]b
 
 	socketLogger := parentLogger.With().Str(ComponentField, "SocketManager").Logger()
 
-	return &SocketManager{
+	s := &SocketManager{
 		connectionURI:  connectionURI,
+		dialer:         DialWebsocket,
 		messageHandler: messageHandler,
 		logger:         &socketLogger,
-	}, nil
+	}
+	s.chainHandler()
+
+	return s, nil
 }
 
 type SocketManager struct {
 	sync.Mutex
 
 	connectionURI           string
-	connection              *websocket.Conn
+	dialer                  Dialer
+	connection              Conn
 	selfInstanceStoppedChan chan struct{}
 
 	// Related to listening
 	socketListener           *SocketListener
-	messageHandler           func([]byte, func([]byte) error)
+	messageHandler           SocketHandler
 	closedSocketListenerChan chan struct{}
 
+	// Related to middlewares
+	handlerMutex sync.RWMutex
+	middlewares  []SocketMiddleware
+	handler      SocketHandler
+	noRecover    bool
+
 	// Related to sending
 	senderMutex sync.Mutex
+	recorder    *Recorder
 
 	logger *zerolog.Logger
 }
 
+// SetDialer replaces the Dialer opening the connection to the nym-client, nil restoring DialWebsocket.
+// It is used from the next Start.
+func (s *SocketManager) SetDialer(dialer Dialer) {
+	s.Lock()
+	defer s.Unlock()
+
+	if nil == dialer {
+		dialer = DialWebsocket
+	}
+	s.dialer = dialer
+}
+
+// SetRecorder records the frames exchanged with the nym-client, nil stopping the recording.
+// Sent frames are recorded right away, received ones from the next Start.
+func (s *SocketManager) SetRecorder(recorder *Recorder) {
+	s.Lock()
+	defer s.Unlock()
+	s.senderMutex.Lock()
+	defer s.senderMutex.Unlock()
+
+	s.recorder = recorder
+}
+
 func (s *SocketManager) IsRunning() bool {
 	s.Lock()
 	defer s.Unlock()
@@ -67,17 +102,21 @@ func (s *SocketManager) Start() (chan struct{}, error) {
 
 	// Open WS connection
 	var e error
-	s.connection, _, e = websocket.DefaultDialer.Dial(s.connectionURI, nil)
+	s.connection, e = s.dialer(s.connectionURI)
 	if nil != e {
 		err := xerrors.Errorf("failed to open connection to \"%v\". Is the websocket up and running?", s.connectionURI)
 		s.logger.Warn().Msg(err.Error())
+		s.connection = nil
 		return nil, err
 	}
 	s.logger.Debug().Msgf("successfully opened connection to \"%v\"", s.connectionURI)
 
+	// From now on, selfDestruct tears down whatever got started if Start fails
+	s.selfInstanceStoppedChan = make(chan struct{}, 1)
+
 	// After which we start a listener for the packets
 	s.socketListener, s.closedSocketListenerChan, e = NewSocketListener(s.connection, func(msg []byte) {
-		s.messageHandler(msg, s.Send)
+		s.getHandler()(msg, s.Send)
 	}, s.Stop, s.logger)
 	if nil != e {
 		err := xerrors.Errorf("failed to initiate the socketListener: %v", e)
@@ -86,10 +125,9 @@ func (s *SocketManager) Start() (chan struct{}, error) {
 		s.selfDestruct()
 		return nil, err
 	}
+	s.socketListener.SetRecorder(s.recorder)
 	go s.socketListener.Listen()
 
-	s.selfInstanceStoppedChan = make(chan struct{}, 1)
-
 	s.logger.Debug().Msg("started SocketManager")
 
 	return s.selfInstanceStoppedChan, nil
@@ -186,6 +224,10 @@ func (s *SocketManager) Send(message []byte) error {
 		return err
 	}
 
+	if nil != s.recorder {
+		s.recorder.Record(RecordOutbound, message)
+	}
+
 	return nil
 }
 
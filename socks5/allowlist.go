@@ -0,0 +1,124 @@
+package socks5
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Allowlist tells which targets an Exit may dial. Its patterns are made of a host and an optional port:
+//
+//	example.com:443    exact host name and port
+//	*.example.com      any subdomain of example.com, any port
+//	10.0.0.0/8:*       any IP address of the network, any port
+//	[::1]:22           IPv6 addresses need brackets when followed by a port
+//	*                  anything
+//
+// Host names are matched as requested, the addresses they resolve to are not checked.
+type Allowlist struct {
+	rules []allowRule
+}
+
+type allowRule struct {
+	// Empty for any host
+	host string
+	// Set for wildcard subdomains, e.g. ".example.com"
+	suffix  string
+	ip      net.IP
+	network *net.IPNet
+	// Empty for any port
+	port string
+}
+
+func NewAllowlist(patterns []string) (*Allowlist, error) {
+	allowlist := &Allowlist{}
+	for _, pattern := range patterns {
+		rule, e := parseAllowRule(pattern)
+		if nil != e {
+			return nil, e
+		}
+		allowlist.rules = append(allowlist.rules, rule)
+	}
+	return allowlist, nil
+}
+
+func parseAllowRule(pattern string) (allowRule, error) {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if 0 == len(pattern) {
+		return allowRule{}, xerrors.Errorf("empty allowlist pattern")
+	}
+
+	host, port := pattern, ""
+	// Bare IPv6 addresses and networks contain colons but no port
+	if _, _, e := net.ParseCIDR(pattern); nil != e && nil == net.ParseIP(pattern) {
+		if h, p, e := net.SplitHostPort(pattern); nil == e {
+			host, port = h, p
+		}
+	}
+
+	rule := allowRule{}
+	if "*" != port {
+		rule.port = port
+	}
+
+	switch {
+	case "*" == host:
+	case strings.HasPrefix(host, "*."):
+		rule.suffix = host[1:]
+	case strings.Contains(host, "/"):
+		_, network, e := net.ParseCIDR(host)
+		if nil != e {
+			return allowRule{}, xerrors.Errorf("invalid network in allowlist pattern %v: %v", pattern, e)
+		}
+		rule.network = network
+	case nil != net.ParseIP(host):
+		rule.ip = net.ParseIP(host)
+	default:
+		if strings.Contains(host, "*") {
+			return allowRule{}, xerrors.Errorf("wildcards are only allowed as first label in allowlist pattern %v", pattern)
+		}
+		rule.host = host
+	}
+
+	return rule, nil
+}
+
+// Allows tells whether target, formatted as host:port, matches one of the patterns
+func (a *Allowlist) Allows(target string) bool {
+	host, port, e := net.SplitHostPort(target)
+	if nil != e {
+		return false
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, rule := range a.rules {
+		if 0 != len(rule.port) && rule.port != port {
+			continue
+		}
+
+		switch {
+		case 0 != len(rule.suffix):
+			if strings.HasSuffix(host, rule.suffix) && nil == ip {
+				return true
+			}
+		case nil != rule.network:
+			if nil != ip && rule.network.Contains(ip) {
+				return true
+			}
+		case nil != rule.ip:
+			if nil != ip && rule.ip.Equal(ip) {
+				return true
+			}
+		case 0 != len(rule.host):
+			if rule.host == host {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,106 @@
+package socks5
+
+import (
+	"net"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/tunnel"
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * The Exit dials the targets requested through a Server, within its Allowlist. It is meant to be the
+ * messageHandler of a NymSocketManager:
+ *
+ *	exit, _ := socks5.NewExit(socks5.ExitConfig{Allow: []string{"*.example.com:443"}}, &logger)
+ *	nymSocketManager, _ := lib.NewNymSocketManager(uri, exit.Handle, &logger)
+ */
+
+type ExitConfig struct {
+	// Patterns of the targets the Exit may dial, see Allowlist
+	Allow []string
+	// Defaults to tunnel.DefaultDialTimeout
+	DialTimeout time.Duration
+	// Settings of the streams, e.g. the Token required from the Servers and the IdleTimeout.
+	// Target and Dial are set by the Exit.
+	Tunnel tunnel.ServerConfig
+}
+
+func NewExit(config ExitConfig, parentLogger *zerolog.Logger) (*Exit, error) {
+	if 0 == len(config.Allow) {
+		err := xerrors.Errorf("allowlist needs to be defined, use \"*\" to allow any target")
+		return nil, err
+	}
+
+	allowlist, e := NewAllowlist(config.Allow)
+	if nil != e {
+		return nil, e
+	}
+
+	if config.DialTimeout < 0 {
+		err := xerrors.Errorf("dial timeout cannot be negative")
+		return nil, err
+	}
+
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	if 0 == config.DialTimeout {
+		config.DialTimeout = tunnel.DefaultDialTimeout
+	}
+
+	localLogger := parentLogger.With().Str(lib.ComponentField, "SocksExit").Logger()
+
+	exit := &Exit{
+		config:    config,
+		allowlist: allowlist,
+		logger:    &localLogger,
+	}
+
+	tunnelConfig := config.Tunnel
+	tunnelConfig.Target = ""
+	tunnelConfig.Dial = exit.dial
+	exit.server, e = tunnel.NewServer(tunnelConfig, parentLogger)
+	if nil != e {
+		return nil, e
+	}
+
+	return exit, nil
+}
+
+type Exit struct {
+	config    ExitConfig
+	allowlist *Allowlist
+	server    *tunnel.Server
+
+	logger *zerolog.Logger
+}
+
+// Handle processes the Frames received by the NymSocketManager of the Exit
+func (x *Exit) Handle(msg lib.NymReceived, send func(lib.NymMessage) error) {
+	x.server.Handle(msg, send)
+}
+
+// Streams returns the number of open streams
+func (x *Exit) Streams() int {
+	return x.server.Streams()
+}
+
+// Close resets every open stream
+func (x *Exit) Close() {
+	x.server.Close()
+}
+
+func (x *Exit) dial(target string) (net.Conn, error) {
+	if !x.allowlist.Allows(target) {
+		x.logger.Info().Msgf("refusing to dial %v, not in the allowlist", target)
+		return nil, xerrors.Errorf("target %v not allowed", target)
+	}
+
+	x.logger.Debug().Msgf("dialing %v", target)
+	return net.DialTimeout("tcp", target, x.config.DialTimeout)
+}
@@ -0,0 +1,299 @@
+// Package socks5 lets tools speaking SOCKS5 reach the Internet through the Nym mixnet.
+//
+// A Server accepts SOCKS5 CONNECT requests locally and tunnels each connection, with the tunnel package, to an
+// Exit which dials the requested target if its Allowlist permits it. Local clients can be required to authenticate
+// with a username and password, and Servers to present a token to the Exit.
+package socks5
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/tunnel"
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * The Server is meant to be the messageHandler of a NymSocketManager:
+ *
+ *	server, _ := socks5.NewServer(exitAddress, socks5.ServerConfig{}, &logger)
+ *	nymSocketManager, _ := lib.NewNymSocketManager(uri, server.Handle, &logger)
+ *	server.SetSender(nymSocketManager.Send)
+ *	listener, _ := net.Listen("tcp", "127.0.0.1:1080")
+ *	server.Serve(listener)
+ *
+ * The success of a CONNECT is replied as soon as the stream is opened: if the Exit fails to dial the target, the
+ * connection is closed afterwards.
+ */
+
+// DefaultHandshakeTimeout is how long a SOCKS5 client has to authenticate and send its request
+const DefaultHandshakeTimeout = 10 * time.Second
+
+const (
+	socksVersion         = 0x05
+	userPassVersion      = 0x01
+	methodNoAuth         = 0x00
+	methodUserPass       = 0x02
+	methodNoneAcceptable = 0xFF
+	commandConnect       = 0x01
+	addressIPv4          = 0x01
+	addressDomain        = 0x03
+	addressIPv6          = 0x04
+
+	replySucceeded               = 0x00
+	replyCommandNotSupported     = 0x07
+	replyAddressTypeNotSupported = 0x08
+)
+
+type ServerConfig struct {
+	// Username and password pairs local clients authenticate with, no authentication if empty
+	Users map[string]string
+	// Defaults to DefaultHandshakeTimeout
+	HandshakeTimeout time.Duration
+	// Settings of the streams, e.g. the Token presented to the Exit and the IdleTimeout
+	Tunnel tunnel.ClientConfig
+}
+
+func NewServer(exitAddress lib.NymAddress, config ServerConfig, parentLogger *zerolog.Logger) (*Server, error) {
+	if config.HandshakeTimeout < 0 {
+		err := xerrors.Errorf("handshake timeout cannot be negative")
+		return nil, err
+	}
+
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	client, e := tunnel.NewClient(exitAddress, config.Tunnel, parentLogger)
+	if nil != e {
+		return nil, e
+	}
+
+	if 0 == config.HandshakeTimeout {
+		config.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+
+	localLogger := parentLogger.With().Str(lib.ComponentField, "SocksServer").Logger()
+
+	return &Server{
+		config: config,
+		client: client,
+		logger: &localLogger,
+	}, nil
+}
+
+type Server struct {
+	config ServerConfig
+	client *tunnel.Client
+
+	logger *zerolog.Logger
+}
+
+// SetSender sets the function used to reach the Exit, usually the Send of the NymSocketManager
+func (s *Server) SetSender(send func(lib.NymMessage) error) {
+	s.client.SetSender(send)
+}
+
+// Handle processes the Frames received from the Exit
+func (s *Server) Handle(msg lib.NymReceived, send func(lib.NymMessage) error) {
+	s.client.Handle(msg, send)
+}
+
+// Streams returns the number of open streams
+func (s *Server) Streams() int {
+	return s.client.Streams()
+}
+
+// Close resets every open stream
+func (s *Server) Close() {
+	s.client.Close()
+}
+
+// Serve handles the SOCKS5 connections accepted by listener until it fails
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, e := listener.Accept()
+		if nil != e {
+			return e
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn handles a SOCKS5 connection, tunnelling it to the Exit once the client is authenticated
+func (s *Server) ServeConn(conn net.Conn) {
+	target, e := s.handshake(conn)
+	if nil != e {
+		s.logger.Debug().Msgf("closing connection from %v: %v", conn.RemoteAddr(), e)
+		conn.Close()
+		return
+	}
+
+	// Replied before opening the stream, so that it comes before what the Exit sends back
+	e = reply(conn, replySucceeded)
+	if nil != e {
+		conn.Close()
+		return
+	}
+
+	e = s.client.ForwardTo(conn, target)
+	if nil != e {
+		s.logger.Warn().Msgf("failed to tunnel connection to %v: %v", target, e)
+		conn.Close()
+	}
+}
+
+// handshake authenticates the client and returns the target of its CONNECT request
+func (s *Server) handshake(conn net.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(s.config.HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	header := make([]byte, 2)
+	_, e := io.ReadFull(conn, header)
+	if nil != e {
+		return "", e
+	}
+	if socksVersion != header[0] {
+		return "", xerrors.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	_, e = io.ReadFull(conn, methods)
+	if nil != e {
+		return "", e
+	}
+
+	method := byte(methodNoAuth)
+	if 0 != len(s.config.Users) {
+		method = methodUserPass
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, methodNoneAcceptable})
+		return "", xerrors.Errorf("no acceptable authentication method")
+	}
+
+	_, e = conn.Write([]byte{socksVersion, method})
+	if nil != e {
+		return "", e
+	}
+
+	if methodUserPass == method {
+		e = s.authenticate(conn)
+		if nil != e {
+			return "", e
+		}
+	}
+
+	return readRequest(conn)
+}
+
+// authenticate runs the username/password authentication of RFC 1929
+func (s *Server) authenticate(conn net.Conn) error {
+	version := make([]byte, 1)
+	_, e := io.ReadFull(conn, version)
+	if nil != e {
+		return e
+	}
+	if userPassVersion != version[0] {
+		return xerrors.Errorf("unsupported authentication version %d", version[0])
+	}
+
+	username, e := readShortString(conn)
+	if nil != e {
+		return e
+	}
+	password, e := readShortString(conn)
+	if nil != e {
+		return e
+	}
+
+	expected, known := s.config.Users[username]
+	if !known || subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		conn.Write([]byte{userPassVersion, 0x01})
+		return xerrors.Errorf("authentication failed for %v", username)
+	}
+
+	_, e = conn.Write([]byte{userPassVersion, 0x00})
+	return e
+}
+
+func readRequest(conn net.Conn) (string, error) {
+	header := make([]byte, 4)
+	_, e := io.ReadFull(conn, header)
+	if nil != e {
+		return "", e
+	}
+	if socksVersion != header[0] {
+		return "", xerrors.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	var host string
+	switch header[3] {
+	case addressIPv4, addressIPv6:
+		ip := make([]byte, net.IPv4len)
+		if addressIPv6 == header[3] {
+			ip = make([]byte, net.IPv6len)
+		}
+		_, e = io.ReadFull(conn, ip)
+		if nil != e {
+			return "", e
+		}
+		host = net.IP(ip).String()
+
+	case addressDomain:
+		host, e = readShortString(conn)
+		if nil != e {
+			return "", e
+		}
+
+	default:
+		reply(conn, replyAddressTypeNotSupported)
+		return "", xerrors.Errorf("unsupported address type %d", header[3])
+	}
+
+	port := make([]byte, 2)
+	_, e = io.ReadFull(conn, port)
+	if nil != e {
+		return "", e
+	}
+
+	if commandConnect != header[1] {
+		reply(conn, replyCommandNotSupported)
+		return "", xerrors.Errorf("unsupported command %d", header[1])
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// readShortString reads a string prefixed by its length on one byte
+func readShortString(conn net.Conn) (string, error) {
+	length := make([]byte, 1)
+	_, e := io.ReadFull(conn, length)
+	if nil != e {
+		return "", e
+	}
+
+	value := make([]byte, length[0])
+	_, e = io.ReadFull(conn, value)
+	if nil != e {
+		return "", e
+	}
+	return string(value), nil
+}
+
+// reply answers a request, the bound address being unknown
+func reply(conn net.Conn, code byte) error {
+	_, e := conn.Write([]byte{socksVersion, code, 0x00, addressIPv4, 0, 0, 0, 0, 0, 0})
+	return e
+}
@@ -0,0 +1,239 @@
+package socks5_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/notrustverify/nymsocketmanager/socks5"
+	"github.com/notrustverify/nymsocketmanager/tunnel"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMixnet connects a Server to an Exit in memory
+type fakeMixnet struct {
+	server *socks5.Server
+	exit   *socks5.Exit
+}
+
+func (m *fakeMixnet) serverSend(msg lib.NymMessage) error {
+	sendAnonymous := msg.(lib.NymSendAnonymous)
+	go m.exit.Handle(lib.NewNymReceived(sendAnonymous.Message, "serverTag").(lib.NymReceived), m.exitSend)
+	return nil
+}
+
+func (m *fakeMixnet) exitSend(msg lib.NymMessage) error {
+	reply := msg.(lib.NymReply)
+	go m.server.Handle(lib.NewNymReceived(reply.Message, "").(lib.NymReceived), nil)
+	return nil
+}
+
+// newFakeMixnet returns the address of a SOCKS5 Server tunnelling to an Exit
+func newFakeMixnet(t *testing.T, serverConfig socks5.ServerConfig, exitConfig socks5.ExitConfig) (*fakeMixnet, string) {
+	logger := zerolog.Logger{}
+
+	server, e := socks5.NewServer(nymtest.RandomNymAddress(), serverConfig, &logger)
+	require.NoError(t, e)
+	exit, e := socks5.NewExit(exitConfig, &logger)
+	require.NoError(t, e)
+
+	m := &fakeMixnet{server: server, exit: exit}
+	server.SetSender(m.serverSend)
+
+	listener := listenLocal(t)
+	go server.Serve(listener)
+
+	return m, listener.Addr().String()
+}
+
+func listenLocal(t *testing.T) net.Listener {
+	listener, e := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, e)
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+// echoService returns the address of a TCP service echoing what it receives
+func echoService(t *testing.T) string {
+	listener := listenLocal(t)
+	go func() {
+		for {
+			conn, e := listener.Accept()
+			if nil != e {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// socksConnect runs the SOCKS5 handshake, authenticating if username is set, and returns the reply code
+func socksConnect(t *testing.T, conn net.Conn, username string, password string, target string) byte {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	method := byte(0x00)
+	if 0 != len(username) {
+		method = 0x02
+	}
+	_, e := conn.Write([]byte{0x05, 0x01, method})
+	require.NoError(t, e)
+
+	selected := make([]byte, 2)
+	_, e = io.ReadFull(conn, selected)
+	require.NoError(t, e)
+	if method != selected[1] {
+		return 0xFF
+	}
+
+	if 0 != len(username) {
+		request := append([]byte{0x01, byte(len(username))}, username...)
+		request = append(append(request, byte(len(password))), password...)
+		_, e = conn.Write(request)
+		require.NoError(t, e)
+
+		status := make([]byte, 2)
+		_, e = io.ReadFull(conn, status)
+		require.NoError(t, e)
+		if 0x00 != status[1] {
+			return 0xFF
+		}
+	}
+
+	host, portString, e := net.SplitHostPort(target)
+	require.NoError(t, e)
+	port, e := net.LookupPort("tcp", portString)
+	require.NoError(t, e)
+
+	request := append([]byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}, host...)
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	_, e = conn.Write(request)
+	require.NoError(t, e)
+
+	reply := make([]byte, 10)
+	_, e = io.ReadFull(conn, reply)
+	require.NoError(t, e)
+	return reply[1]
+}
+
+func TestAllowlist(t *testing.T) {
+	allowlist, e := socks5.NewAllowlist([]string{"example.com:443", "*.nymtech.net", "10.0.0.0/8:*", "[::1]:22", "fd00::/8"})
+	require.NoError(t, e)
+
+	for target, allowed := range map[string]bool{
+		"example.com:443":      true,
+		"EXAMPLE.com:443":      true,
+		"example.com:80":       false,
+		"www.example.com:443":  false,
+		"mixnet.nymtech.net:1": true,
+		"nymtech.net:1":        false,
+		"10.1.2.3:8080":        true,
+		"11.1.2.3:8080":        false,
+		"[::1]:22":             true,
+		"[::1]:23":             false,
+		"[fd00::1]:80":         true,
+		"no port":              false,
+	} {
+		require.Equal(t, allowed, allowlist.Allows(target), target)
+	}
+
+	_, e = socks5.NewAllowlist([]string{"www.*.com"})
+	require.Error(t, e)
+	_, e = socks5.NewAllowlist([]string{"10.0.0.0/33"})
+	require.Error(t, e)
+}
+
+func TestNewExitNeedsAnAllowlist(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	_, e := socks5.NewExit(socks5.ExitConfig{}, &logger)
+	require.Error(t, e)
+}
+
+func TestSocksConnectThroughExit(t *testing.T) {
+	target := echoService(t)
+	mixnet, address := newFakeMixnet(t,
+		socks5.ServerConfig{Users: map[string]string{"user": "password"}, Tunnel: tunnel.ClientConfig{Token: "secret"}},
+		socks5.ExitConfig{Allow: []string{"127.0.0.1:*"}, Tunnel: tunnel.ServerConfig{Token: "secret"}})
+
+	// Wrong password
+	conn, e := net.Dial("tcp", address)
+	require.NoError(t, e)
+	require.Equal(t, byte(0xFF), socksConnect(t, conn, "user", "wrong", target))
+	conn.Close()
+
+	conn, e = net.Dial("tcp", address)
+	require.NoError(t, e)
+	defer conn.Close()
+	require.Equal(t, byte(0x00), socksConnect(t, conn, "user", "password", target))
+
+	_, e = conn.Write([]byte("hello"))
+	require.NoError(t, e)
+	received := make([]byte, 5)
+	_, e = io.ReadFull(conn, received)
+	require.NoError(t, e)
+	require.Equal(t, "hello", string(received))
+
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return 0 == mixnet.server.Streams() && 0 == mixnet.exit.Streams()
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestExitRefusesTargetsAndServersNotAllowed(t *testing.T) {
+	target := echoService(t)
+
+	for name, config := range map[string]struct {
+		server socks5.ServerConfig
+		exit   socks5.ExitConfig
+	}{
+		"target not allowed": {
+			exit: socks5.ExitConfig{Allow: []string{"example.com:443"}},
+		},
+		"invalid token": {
+			server: socks5.ServerConfig{Tunnel: tunnel.ClientConfig{Token: "wrong"}},
+			exit:   socks5.ExitConfig{Allow: []string{"*"}, Tunnel: tunnel.ServerConfig{Token: "secret"}},
+		},
+	} {
+		_, address := newFakeMixnet(t, config.server, config.exit)
+
+		conn, e := net.Dial("tcp", address)
+		require.NoError(t, e, name)
+		require.Equal(t, byte(0x00), socksConnect(t, conn, "", "", target), name)
+
+		// The stream is reset by the Exit
+		_, e = conn.Read(make([]byte, 1))
+		require.Error(t, e, name)
+		netErr, ok := e.(net.Error)
+		require.False(t, ok && netErr.Timeout(), name)
+		conn.Close()
+	}
+}
+
+func TestStreamsAreResetWhenIdle(t *testing.T) {
+	target := echoService(t)
+	mixnet, address := newFakeMixnet(t,
+		socks5.ServerConfig{},
+		socks5.ExitConfig{Allow: []string{"*"}, Tunnel: tunnel.ServerConfig{IdleTimeout: 100 * time.Millisecond}})
+
+	conn, e := net.Dial("tcp", address)
+	require.NoError(t, e)
+	defer conn.Close()
+	require.Equal(t, byte(0x00), socksConnect(t, conn, "", "", target))
+
+	_, e = conn.Read(make([]byte, 1))
+	require.Error(t, e)
+	netErr, ok := e.(net.Error)
+	require.False(t, ok && netErr.Timeout())
+	require.Eventually(t, func() bool {
+		return 0 == mixnet.server.Streams() && 0 == mixnet.exit.Streams()
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,340 @@
+package nymsocketmanager
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * The SurbBudget computes how many reply SURBs to attach to anonymous sends and keeps track, per recipient,
+ * of how many of them are still available to the peer. Each SURB allows the peer to send back one packet,
+ * so the amount needed for a reply depends on how many packets the reply will be fragmented into.
+ *
+ * Once registered on a NymSocketManager, the SurbBudget accounts for the SURBs of every anonymous message sent and,
+ * after each reply, tops the recipient up to what a reply of ExpectedReplySize needs:
+ *
+ *	budget, _ := nymSocketManager.UseSurbBudget(SurbBudgetConfig{
+ *		ExpectedReplySize: 4000,
+ *		ReplyFrom: func(msg NymReceived) (NymAddress, bool) { ... },
+ *	})
+ *
+ * Replies carry no senderTag and cannot be attributed to a recipient by the nym-client, so ReplyFrom tells which
+ * recipient a received message is the reply of. Without it, the application reports replies with RecordReply.
+ * Top-ups are anonymous messages with the surbTopUpMessage payload, dropped on receive by the middleware of the
+ * SurbBudget. The peers of a conversation therefore both need a SurbBudget registered, or a middleware of their own
+ * dropping the top-ups.
+ */
+
+// DefaultPayloadPerSurb is a conservative estimate of the payload (in bytes) one reply packet can carry
+// once the nym-client fragmentation and packet overheads are accounted for
+const DefaultPayloadPerSurb = 1500
+
+// DefaultMaxSurbsPerMessage caps the number of SURBs attached to a single message
+const DefaultMaxSurbsPerMessage = 100
+
+// surbTopUpMessage is the payload of the anonymous messages only carrying SURBs
+const surbTopUpMessage = "nymSurbTopUp"
+
+type SurbBudgetPolicy int
+
+const (
+	// SurbBudgetTopUp sends the missing SURBs to the recipient when its budget is too low for the expected reply
+	SurbBudgetTopUp SurbBudgetPolicy = iota
+	// SurbBudgetWarn only logs and calls OnLowBudget when the budget is too low for the expected reply
+	SurbBudgetWarn
+)
+
+type SurbBudgetConfig struct {
+	// Payload (in bytes) carried by one reply packet. Defaults to DefaultPayloadPerSurb.
+	PayloadPerSurb int
+	// Extra SURBs attached to every message to absorb retransmissions
+	Margin uint
+	// Cap on the SURBs attached to a single message. Defaults to DefaultMaxSurbsPerMessage.
+	MaxSurbsPerMessage uint
+
+	Policy SurbBudgetPolicy
+	// Called when the budget of recipient is lower than what the expected reply needs (optional)
+	OnLowBudget func(recipient NymAddress, remaining uint, needed uint)
+
+	// Size (in bytes) of the replies the budget of a recipient is kept sufficient for, after each of its replies
+	ExpectedReplySize int
+	// Tells which recipient msg is the reply of, if any, so that replies are accounted for on receive (optional)
+	ReplyFrom func(msg NymReceived) (NymAddress, bool)
+}
+
+func NewSurbBudget(nymSocketManager *NymSocketManager, config SurbBudgetConfig, parentLogger *zerolog.Logger) (*SurbBudget, error) {
+	if nil == nymSocketManager {
+		err := xerrors.Errorf("NymSocketManager needs to be defined")
+		return nil, err
+	}
+
+	if config.PayloadPerSurb < 0 {
+		err := xerrors.Errorf("payload per SURB cannot be negative")
+		return nil, err
+	}
+
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	if 0 == config.PayloadPerSurb {
+		config.PayloadPerSurb = DefaultPayloadPerSurb
+	}
+	if 0 == config.MaxSurbsPerMessage {
+		config.MaxSurbsPerMessage = DefaultMaxSurbsPerMessage
+	}
+
+	localLogger := parentLogger.With().Str(ComponentField, "SurbBudget").Logger()
+
+	return &SurbBudget{
+		nymSocketManager: nymSocketManager,
+		config:           config,
+		budgets:          make(map[NymAddress]*surbConversation),
+		logger:           &localLogger,
+	}, nil
+}
+
+type SurbBudget struct {
+	sync.Mutex
+
+	nymSocketManager *NymSocketManager
+	config           SurbBudgetConfig
+
+	budgets map[NymAddress]*surbConversation
+	// The send middleware accounts for the SURBs of the anonymous messages sent
+	hooked bool
+
+	logger *zerolog.Logger
+}
+
+// UseSurbBudget creates a SurbBudget and registers it on both the received and sent messages of n
+func (n *NymSocketManager) UseSurbBudget(config SurbBudgetConfig) (*SurbBudget, error) {
+	budget, e := NewSurbBudget(n, config, n.logger)
+	if nil != e {
+		return nil, e
+	}
+
+	n.Use(budget.Middleware())
+	n.UseSend(budget.SendMiddleware())
+	return budget, nil
+}
+
+type surbConversation struct {
+	provided uint
+	consumed uint
+}
+
+func (c *surbConversation) remaining() uint {
+	if c.consumed >= c.provided {
+		return 0
+	}
+	return c.provided - c.consumed
+}
+
+// PacketsFor returns the number of reply packets needed to carry size bytes
+func (b *SurbBudget) PacketsFor(size int) uint {
+	if size <= 0 {
+		return 1
+	}
+	return uint((size + b.config.PayloadPerSurb - 1) / b.config.PayloadPerSurb)
+}
+
+// SurbsFor returns the number of SURBs to attach for a reply of expectedReplySize bytes
+func (b *SurbBudget) SurbsFor(expectedReplySize int) uint {
+	surbs := b.PacketsFor(expectedReplySize) + b.config.Margin
+	if surbs > b.config.MaxSurbsPerMessage {
+		b.logger.Warn().Msgf("reply of %d bytes needs %d SURBs, capping to %d", expectedReplySize, surbs, b.config.MaxSurbsPerMessage)
+		surbs = b.config.MaxSurbsPerMessage
+	}
+	return surbs
+}
+
+// SendAnonymous sends message to recipient with enough SURBs for a reply of expectedReplySize bytes
+func (b *SurbBudget) SendAnonymous(message string, recipient NymAddress, expectedReplySize int) error {
+	surbs := b.SurbsFor(expectedReplySize)
+
+	e := b.nymSocketManager.Send(NewNymSendAnonymous(message, recipient, surbs))
+	if nil != e {
+		err := xerrors.Errorf("failed to send anonymous message to %v: %v", recipient, e)
+		return err
+	}
+
+	if !b.isHooked() {
+		b.addProvided(recipient, surbs)
+	}
+	return nil
+}
+
+// SendMiddleware accounts for the SURBs attached to the anonymous messages sent, top-ups excepted
+func (b *SurbBudget) SendMiddleware() NymSendMiddleware {
+	b.Lock()
+	b.hooked = true
+	b.Unlock()
+
+	return func(next NymSender) NymSender {
+		return func(msg NymMessage) error {
+			sendAnonymous, ok := msg.(NymSendAnonymous)
+			if !ok || surbTopUpMessage == sendAnonymous.Message {
+				return next(msg)
+			}
+
+			e := next(msg)
+			if nil == e {
+				b.addProvided(sendAnonymous.Recipient, sendAnonymous.ReplySurbs)
+			}
+			return e
+		}
+	}
+}
+
+// Middleware drops the top-ups and, with ReplyFrom, accounts for the replies before topping their sender up
+func (b *SurbBudget) Middleware() NymMiddleware {
+	return func(next NymHandler) NymHandler {
+		return func(msg NymReceived, send func(NymMessage) error) {
+			if isSurbTopUp(msg) {
+				b.logger.Debug().Msgf("dropping SURB top-up from %v", msg.SenderTag)
+				return
+			}
+
+			if nil != b.config.ReplyFrom {
+				if recipient, isReply := b.config.ReplyFrom(msg); isReply {
+					b.RecordReply(recipient, len(msg.Message))
+					e := b.Ensure(recipient, b.config.ExpectedReplySize)
+					if nil != e {
+						b.logger.Warn().Msg(e.Error())
+					}
+				}
+			}
+
+			next(msg, send)
+		}
+	}
+}
+
+// RecordReply accounts for the SURBs consumed by a reply of replySize bytes received from recipient
+func (b *SurbBudget) RecordReply(recipient NymAddress, replySize int) {
+	b.Lock()
+	defer b.Unlock()
+
+	conversation := b.getConversation(recipient)
+	conversation.consumed += b.PacketsFor(replySize)
+
+	if conversation.consumed > conversation.provided {
+		b.logger.Debug().Msgf("%v used more SURBs than provided (%d > %d), the nym-client must have requested more", recipient, conversation.consumed, conversation.provided)
+		conversation.provided = conversation.consumed
+	}
+}
+
+// Remaining returns the SURBs that recipient should still hold for us
+func (b *SurbBudget) Remaining(recipient NymAddress) uint {
+	b.Lock()
+	defer b.Unlock()
+
+	conversation, ok := b.budgets[recipient]
+	if !ok {
+		return 0
+	}
+	return conversation.remaining()
+}
+
+// Ensure checks that recipient holds enough SURBs for a reply of expectedReplySize bytes.
+// Depending on the policy, missing SURBs are sent along an empty anonymous message, or a warning is emitted.
+// The missing SURBs are accounted for before being sent, so that concurrent calls do not top up twice.
+func (b *SurbBudget) Ensure(recipient NymAddress, expectedReplySize int) error {
+	needed := b.SurbsFor(expectedReplySize)
+	remaining, missing := b.reserve(recipient, needed)
+	if 0 == missing {
+		return nil
+	}
+
+	if nil != b.config.OnLowBudget {
+		b.config.OnLowBudget(recipient, remaining, needed)
+	}
+
+	if SurbBudgetWarn == b.config.Policy {
+		b.logger.Warn().Msgf("%v holds %d SURBs but a reply of %d bytes needs %d", recipient, remaining, expectedReplySize, needed)
+		return nil
+	}
+
+	b.logger.Debug().Msgf("topping up %v with %d SURBs", recipient, missing)
+
+	e := b.nymSocketManager.Send(NewNymSendAnonymous(surbTopUpMessage, recipient, missing))
+	if nil != e {
+		b.release(recipient, missing)
+		err := xerrors.Errorf("failed to top up SURBs of %v: %v", recipient, e)
+		return err
+	}
+	return nil
+}
+
+// reserve returns the SURBs recipient holds and the ones missing for needed, accounting for the missing ones as
+// provided when topping up
+func (b *SurbBudget) reserve(recipient NymAddress, needed uint) (uint, uint) {
+	b.Lock()
+	defer b.Unlock()
+
+	conversation := b.getConversation(recipient)
+	remaining := conversation.remaining()
+	if remaining >= needed {
+		return remaining, 0
+	}
+
+	missing := needed - remaining
+	if SurbBudgetTopUp == b.config.Policy {
+		conversation.provided += missing
+	}
+	return remaining, missing
+}
+
+// release gives back the SURBs reserved for a top-up which could not be sent
+func (b *SurbBudget) release(recipient NymAddress, surbs uint) {
+	b.Lock()
+	defer b.Unlock()
+
+	conversation, ok := b.budgets[recipient]
+	if !ok {
+		return
+	}
+	if surbs > conversation.provided {
+		surbs = conversation.provided
+	}
+	conversation.provided -= surbs
+}
+
+// Forget drops the budget tracked for recipient, e.g. when the conversation is over
+func (b *SurbBudget) Forget(recipient NymAddress) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.budgets, recipient)
+}
+
+func (b *SurbBudget) isHooked() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.hooked
+}
+
+func (b *SurbBudget) addProvided(recipient NymAddress, surbs uint) {
+	b.Lock()
+	defer b.Unlock()
+	b.getConversation(recipient).provided += surbs
+}
+
+// getConversation returns the budget of recipient, creating it if needed
+// called from methods that already acquired the lock
+func (b *SurbBudget) getConversation(recipient NymAddress) *surbConversation {
+	conversation, ok := b.budgets[recipient]
+	if !ok {
+		conversation = &surbConversation{}
+		b.budgets[recipient] = conversation
+	}
+	return conversation
+}
+
+// isSurbTopUp tells whether msg only carries SURBs
+func isSurbTopUp(msg NymReceived) bool {
+	return surbTopUpMessage == msg.Message
+}
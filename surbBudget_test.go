@@ -0,0 +1,230 @@
+package nymsocketmanager_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSurbBudget(t *testing.T, config lib.SurbBudgetConfig) *lib.SurbBudget {
+	logger := zerolog.Logger{}
+
+	nymSocketManager, e := lib.NewNymSocketManager("ws://127.0.0.1", emptyProcessing, &logger)
+	require.NoError(t, e)
+
+	budget, e := lib.NewSurbBudget(nymSocketManager, config, &logger)
+	require.NoError(t, e)
+
+	return budget
+}
+
+// startSurbBudget starts a NymSocketManager on a FakeNymClient, its SurbBudget registered with UseSurbBudget
+func startSurbBudget(t *testing.T, config lib.SurbBudgetConfig, messageHandler lib.NymHandler) (*lib.NymSocketManager, *lib.SurbBudget, *nymtest.FakeNymClient) {
+	logger := zerolog.Logger{}
+
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	t.Cleanup(fakeNymClient.Close)
+
+	nymSocketManager, e := lib.NewNymSocketManager(fakeNymClient.URI(), messageHandler, &logger)
+	require.NoError(t, e)
+
+	budget, e := nymSocketManager.UseSurbBudget(config)
+	require.NoError(t, e)
+
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+	t.Cleanup(nymSocketManager.Stop)
+
+	return nymSocketManager, budget, fakeNymClient
+}
+
+func TestSurbBudgetShouldHaveANymSocketManager(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	_, e := lib.NewSurbBudget(nil, lib.SurbBudgetConfig{}, &logger)
+	require.Error(t, e)
+}
+
+func TestSurbBudgetComputesSurbsFromReplySize(t *testing.T) {
+	budget := newTestSurbBudget(t, lib.SurbBudgetConfig{PayloadPerSurb: 1000, Margin: 1, MaxSurbsPerMessage: 5})
+
+	require.Equal(t, uint(2), budget.SurbsFor(0))
+	require.Equal(t, uint(2), budget.SurbsFor(1000))
+	require.Equal(t, uint(3), budget.SurbsFor(1001))
+	require.Equal(t, uint(5), budget.SurbsFor(100000))
+}
+
+func TestSurbBudgetTracksRepliesPerRecipient(t *testing.T) {
+	peer := lib.MustParseNymAddress(testNymAddress)
+	nymSocketManager, budget, fakeNymClient := startSurbBudget(t, lib.SurbBudgetConfig{PayloadPerSurb: 1000}, emptyProcessing)
+
+	require.Equal(t, uint(0), budget.Remaining(peer))
+
+	require.NoError(t, budget.SendAnonymous("hello", peer, 3000))
+	sent, isSendAnonymous := nextRequest(t, fakeNymClient).(lib.NymSendAnonymous)
+	require.True(t, isSendAnonymous)
+	require.Equal(t, uint(3), sent.ReplySurbs)
+	// Accounted for once, although both SendAnonymous and the send middleware saw it
+	require.Equal(t, uint(3), budget.Remaining(peer))
+
+	// Messages sent directly are accounted for as well
+	require.NoError(t, nymSocketManager.Send(lib.NewNymSendAnonymous("again", peer, 1)))
+	require.Equal(t, uint(4), budget.Remaining(peer))
+
+	budget.RecordReply(peer, 2500)
+	require.Equal(t, uint(1), budget.Remaining(peer))
+
+	budget.Forget(peer)
+	require.Equal(t, uint(0), budget.Remaining(peer))
+}
+
+func TestSurbBudgetEnsureOnlyTopsUpWhatIsMissing(t *testing.T) {
+	peer := lib.MustParseNymAddress(testNymAddress)
+	_, budget, fakeNymClient := startSurbBudget(t, lib.SurbBudgetConfig{PayloadPerSurb: 1000}, emptyProcessing)
+
+	require.NoError(t, budget.SendAnonymous("hello", peer, 2000))
+	nextRequest(t, fakeNymClient)
+
+	// Enough SURBs, nothing is sent
+	require.NoError(t, budget.Ensure(peer, 2000))
+	select {
+	case request := <-fakeNymClient.Requests():
+		t.Fatalf("unexpected request %v", request)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, budget.Ensure(peer, 5000))
+	topUp, isSendAnonymous := nextRequest(t, fakeNymClient).(lib.NymSendAnonymous)
+	require.True(t, isSendAnonymous)
+	require.Equal(t, uint(3), topUp.ReplySurbs)
+	require.Equal(t, peer, topUp.Recipient)
+	require.Equal(t, uint(5), budget.Remaining(peer))
+}
+
+func TestSurbBudgetTopsUpAfterRepliesAndDropsTopUps(t *testing.T) {
+	handled := make(chan lib.NymReceived, 16)
+	var address lib.NymAddress
+
+	_, budget, fakeNymClient := startSurbBudget(t, lib.SurbBudgetConfig{
+		PayloadPerSurb:    1000,
+		ExpectedReplySize: 2000,
+		// The FakeNymClient delivers replies without senderTag
+		ReplyFrom: func(msg lib.NymReceived) (lib.NymAddress, bool) {
+			return address, 0 == len(msg.SenderTag)
+		},
+	}, func(msg lib.NymReceived, send func(lib.NymMessage) error) {
+		handled <- msg
+		if 0 != len(msg.SenderTag) {
+			send(lib.NewNymReply(msg.SenderTag, strings.Repeat("x", 1500)))
+		}
+	})
+	address = fakeNymClient.Address()
+
+	// The FakeNymClient loops the request back to us, and the handler replies with 2 packets
+	require.NoError(t, budget.SendAnonymous("request", address, 2000))
+	require.Equal(t, "request", (<-handled).Message)
+	require.Len(t, (<-handled).Message, 1500)
+
+	// The reply consumed the 2 SURBs, which got topped up
+	require.Eventually(t, func() bool { return 2 == budget.Remaining(address) }, time.Second, 10*time.Millisecond)
+
+	topUps := 0
+	for done := false; !done; {
+		select {
+		case request := <-fakeNymClient.Requests():
+			if m, ok := request.(lib.NymSendAnonymous); ok && "request" != m.Message {
+				topUps++
+				require.Equal(t, uint(2), m.ReplySurbs)
+			}
+		case <-time.After(50 * time.Millisecond):
+			done = true
+		}
+	}
+	require.Equal(t, 1, topUps)
+
+	// The top-up looped back by the FakeNymClient never reached the handler
+	select {
+	case msg := <-handled:
+		t.Fatalf("top-up handed to the messageHandler: %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSurbBudgetWarnPolicyCallsOnLowBudget(t *testing.T) {
+	var needed uint
+	budget := newTestSurbBudget(t, lib.SurbBudgetConfig{
+		PayloadPerSurb: 1000,
+		Policy:         lib.SurbBudgetWarn,
+		OnLowBudget: func(_ lib.NymAddress, _ uint, n uint) {
+			needed = n
+		},
+	})
+
+	require.NoError(t, budget.Ensure(lib.MustParseNymAddress(testNymAddress), 4000))
+	require.Equal(t, uint(4), needed)
+}
+
+func TestTopUpsAreOnlyDroppedBySurbBudgets(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	fakeNymClient := nymtest.NewFakeNymClient(nymtest.RandomNymAddress())
+	defer fakeNymClient.Close()
+
+	handled := make(chan string, 1)
+	nymSocketManager, e := lib.NewNymSocketManager(fakeNymClient.URI(), func(msg lib.NymReceived, _ func(lib.NymMessage) error) {
+		handled <- msg.Message
+	}, &logger)
+	require.NoError(t, e)
+	_, e = nymSocketManager.Start()
+	require.NoError(t, e)
+	defer nymSocketManager.Stop()
+
+	// Without SurbBudget, nothing is reserved
+	require.NoError(t, fakeNymClient.Push(lib.NewNymReceived("nymSurbTopUp", "")))
+	select {
+	case message := <-handled:
+		require.Equal(t, "nymSurbTopUp", message)
+	case <-time.After(time.Second):
+		require.Fail(t, "message not handed to the messageHandler")
+	}
+}
+
+func TestSurbBudgetEnsureTopsUpOnceWhenConcurrent(t *testing.T) {
+	peer := lib.MustParseNymAddress(testNymAddress)
+	_, budget, fakeNymClient := startSurbBudget(t, lib.SurbBudgetConfig{PayloadPerSurb: 1000}, emptyProcessing)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, budget.Ensure(peer, 3000))
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, uint(3), budget.Remaining(peer))
+
+	topUp, isSendAnonymous := nextRequest(t, fakeNymClient).(lib.NymSendAnonymous)
+	require.True(t, isSendAnonymous)
+	require.Equal(t, uint(3), topUp.ReplySurbs)
+	select {
+	case request := <-fakeNymClient.Requests():
+		t.Fatalf("unexpected request %v", request)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSurbBudgetEnsureReleasesFailedTopUps(t *testing.T) {
+	peer := lib.MustParseNymAddress(testNymAddress)
+	// Not started, so sending fails
+	budget := newTestSurbBudget(t, lib.SurbBudgetConfig{PayloadPerSurb: 1000})
+
+	require.Error(t, budget.Ensure(peer, 3000))
+	require.Equal(t, uint(0), budget.Remaining(peer))
+}
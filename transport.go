@@ -0,0 +1,32 @@
+package nymsocketmanager
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+/*
+ * SocketManager and NymSocketManager reach the nym-client through a Conn opened by their Dialer, which defaults
+ * to DialWebsocket. Tests can replace it to talk to something else than a websocket, e.g. a Replayer:
+ *
+ *	nymSocketManager.SetDialer(replayer.Dial)
+ */
+
+// Conn is the connection to the nym-client, implemented by *websocket.Conn.
+// Writes are serialised by the managers, reads only happen in their SocketListener.
+type Conn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
+// Dialer opens a Conn to connectionURI
+type Dialer func(connectionURI string) (Conn, error)
+
+// DialWebsocket opens a websocket connection to connectionURI with the default websocket dialer
+func DialWebsocket(connectionURI string) (Conn, error) {
+	connection, _, e := websocket.DefaultDialer.Dial(connectionURI, nil)
+	if nil != e {
+		return nil, e
+	}
+	return connection, nil
+}
@@ -0,0 +1,220 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * The Client tunnels local TCP connections to a Server. It is meant to be the messageHandler of a NymSocketManager:
+ *
+ *	client, _ := tunnel.NewClient(serverAddress, tunnel.ClientConfig{}, &logger)
+ *	nymSocketManager, _ := lib.NewNymSocketManager(uri, client.Handle, &logger)
+ *	client.SetSender(nymSocketManager.Send)
+ *	listener, _ := net.Listen("tcp", "127.0.0.1:8080")
+ *	client.Serve(listener)
+ */
+
+// DefaultSurbsPerFrame is the number of SURBs attached to every Frame sent to the Server
+const DefaultSurbsPerFrame = 2
+
+type ClientConfig struct {
+	// SURBs attached to every Frame, the open Frame getting Window more. Defaults to DefaultSurbsPerFrame.
+	SurbsPerFrame uint
+	// Defaults to DefaultWindow
+	Window uint64
+	// Defaults to DefaultMaxFrameData
+	MaxFrameData int
+	// Token presented to the Server on open (optional)
+	Token string
+	// Streams idle for IdleTimeout are reset (optional)
+	IdleTimeout time.Duration
+}
+
+func NewClient(serverAddress lib.NymAddress, config ClientConfig, parentLogger *zerolog.Logger) (*Client, error) {
+	if serverAddress.IsZero() {
+		err := xerrors.Errorf("server address needs to be defined")
+		return nil, err
+	}
+
+	if config.IdleTimeout < 0 || config.MaxFrameData < 0 {
+		err := xerrors.Errorf("idle timeout and maximum frame data cannot be negative")
+		return nil, err
+	}
+
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	if 0 == config.SurbsPerFrame {
+		config.SurbsPerFrame = DefaultSurbsPerFrame
+	}
+	if 0 == config.Window {
+		config.Window = DefaultWindow
+	}
+	if 0 == config.MaxFrameData {
+		config.MaxFrameData = DefaultMaxFrameData
+	}
+
+	localLogger := parentLogger.With().Str(lib.ComponentField, "TunnelClient").Logger()
+
+	return &Client{
+		serverAddress: serverAddress,
+		config:        config,
+		streams:       make(map[string]*stream),
+		logger:        &localLogger,
+	}, nil
+}
+
+type Client struct {
+	sync.Mutex
+
+	serverAddress lib.NymAddress
+	config        ClientConfig
+	send          func(lib.NymMessage) error
+
+	streams map[string]*stream
+
+	logger *zerolog.Logger
+}
+
+// SetSender sets the function used to reach the Server, usually the Send of the NymSocketManager
+func (c *Client) SetSender(send func(lib.NymMessage) error) {
+	c.Lock()
+	defer c.Unlock()
+	c.send = send
+}
+
+// Streams returns the number of open streams
+func (c *Client) Streams() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.streams)
+}
+
+// Serve tunnels the connections accepted by listener until it fails
+func (c *Client) Serve(listener net.Listener) error {
+	for {
+		conn, e := listener.Accept()
+		if nil != e {
+			return e
+		}
+
+		e = c.Forward(conn)
+		if nil != e {
+			c.logger.Warn().Msgf("failed to forward connection from %v: %v", conn.RemoteAddr(), e)
+			conn.Close()
+		}
+	}
+}
+
+// Forward tunnels conn to the Server, which pipes it to its target
+func (c *Client) Forward(conn net.Conn) error {
+	return c.ForwardTo(conn, "")
+}
+
+// ForwardTo tunnels conn to the Server, asking it to pipe it to target
+func (c *Client) ForwardTo(conn net.Conn, target string) error {
+	c.Lock()
+	send := c.send
+	c.Unlock()
+
+	if nil == send {
+		err := xerrors.Errorf("sender needs to be set to reach the server")
+		return err
+	}
+
+	id, e := newStreamId()
+	if nil != e {
+		return e
+	}
+
+	sendFrame := func(f Frame) error {
+		message, e := f.encode()
+		if nil != e {
+			return e
+		}
+
+		surbs := c.config.SurbsPerFrame
+		if FrameOpen == f.Kind {
+			// The Server can send a full window before getting more SURBs
+			surbs += uint(c.config.Window)
+		}
+		return send(lib.NewNymSendAnonymous(message, c.serverAddress, surbs))
+	}
+
+	st := newStream(id, conn, c.config.Window, c.config.MaxFrameData, sendFrame, nil, func() {
+		c.Lock()
+		delete(c.streams, id)
+		c.Unlock()
+	}, c.logger)
+	st.setIdleTimeout(c.config.IdleTimeout)
+
+	c.Lock()
+	c.streams[id] = st
+	c.Unlock()
+
+	// The local connection is only read once the open Frame is sent, so that it comes first
+	st.start()
+
+	e = st.sendSequenced(Frame{Kind: FrameOpen, Target: target, Token: c.config.Token})
+	if nil != e {
+		st.end(e.Error(), false)
+		return xerrors.Errorf("failed to open stream: %v", e)
+	}
+
+	go st.pump(conn)
+
+	c.logger.Debug().Msgf("forwarding %v on stream %v", conn.RemoteAddr(), id)
+	return nil
+}
+
+// Handle processes the Frames received from the Server
+func (c *Client) Handle(msg lib.NymReceived, _ func(lib.NymMessage) error) {
+	frame, e := decodeFrame(msg.Message)
+	if nil != e {
+		c.logger.Debug().Msgf("dropping message: %v", e)
+		return
+	}
+
+	c.Lock()
+	st, ok := c.streams[frame.Stream]
+	c.Unlock()
+	if !ok {
+		c.logger.Debug().Msgf("dropping %v frame on unknown stream %v", frame.Kind, frame.Stream)
+		return
+	}
+
+	st.receive(frame)
+}
+
+// Close resets every open stream
+func (c *Client) Close() {
+	c.Lock()
+	streams := make([]*stream, 0, len(c.streams))
+	for _, st := range c.streams {
+		streams = append(streams, st)
+	}
+	c.Unlock()
+
+	for _, st := range streams {
+		st.end("client closed", true)
+	}
+}
+
+func newStreamId() (string, error) {
+	id := make([]byte, 16)
+	_, e := rand.Read(id)
+	if nil != e {
+		return "", xerrors.Errorf("failed to generate stream ID: %v", e)
+	}
+	return hex.EncodeToString(id), nil
+}
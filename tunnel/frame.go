@@ -0,0 +1,78 @@
+// Package tunnel forwards TCP connections over the Nym mixnet on top of NymSocketManager.
+//
+// A Client listens on a local TCP port and tunnels each accepted connection as a stream of sequenced Frames sent
+// anonymously to a Server, which pipes the stream to a local TCP address. The Server answers through reply SURBs, so
+// it never learns the address of the Client: every Frame sent by the Client carries the SURBs the Server needs to
+// acknowledge it and to send data back.
+//
+// The mixnet may reorder messages, so the sequenced Frames (open, data and close) are reordered by the receiver
+// before being delivered. Each side acknowledges the Frames it delivered to its local connection, and a side never
+// has more than Window Frames unacknowledged per stream, which bounds the memory used by a slow reader. Frames are
+// not retransmitted, the nym-client already retransmitting lost packets.
+package tunnel
+
+import (
+	"encoding/json"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// FrameOpen opens a stream, to Target if set
+	FrameOpen = "open"
+	// FrameData carries the bytes read from the local connection
+	FrameData = "data"
+	// FrameClose tells the local connection reached EOF, the other direction of the stream staying open
+	FrameClose = "close"
+	// FrameReset aborts the stream in both directions
+	FrameReset = "reset"
+	// FrameAck acknowledges the sequenced Frames delivered, up to Ack excluded
+	FrameAck = "ack"
+)
+
+const (
+	// DefaultWindow is the number of sequenced Frames a side can have unacknowledged per stream
+	DefaultWindow = 16
+	// DefaultMaxFrameData is the number of bytes carried by a data Frame at most
+	DefaultMaxFrameData = 1024
+)
+
+// Frame is the JSON message exchanged between a Client and a Server
+type Frame struct {
+	Stream string `json:"stream"`
+	Kind   string `json:"kind"`
+	// Sequence number of open, data and close Frames
+	Seq uint64 `json:"seq,omitempty"`
+	// Next sequence number expected by the sender of an ack Frame
+	Ack    uint64 `json:"ack,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+	Target string `json:"target,omitempty"`
+	// Token authenticating the Client on open
+	Token string `json:"token,omitempty"`
+	// Reason of a reset
+	Error string `json:"error,omitempty"`
+}
+
+func (f Frame) isSequenced() bool {
+	return FrameOpen == f.Kind || FrameData == f.Kind || FrameClose == f.Kind
+}
+
+func (f Frame) encode() (string, error) {
+	b, e := json.Marshal(f)
+	if nil != e {
+		return "", xerrors.Errorf("failed to encode %v frame: %v", f.Kind, e)
+	}
+	return string(b), nil
+}
+
+func decodeFrame(message string) (Frame, error) {
+	frame := Frame{}
+	e := json.Unmarshal([]byte(message), &frame)
+	if nil != e {
+		return Frame{}, xerrors.Errorf("failed to decode frame: %v", e)
+	}
+	if 0 == len(frame.Stream) || 0 == len(frame.Kind) {
+		return Frame{}, xerrors.Errorf("frame has no stream or kind")
+	}
+	return frame, nil
+}
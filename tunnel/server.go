@@ -0,0 +1,320 @@
+package tunnel
+
+import (
+	"crypto/subtle"
+	"net"
+	"sync"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * The Server is meant to be the messageHandler of the NymSocketManager exposing the local service:
+ *
+ *	server, _ := tunnel.NewServer(tunnel.ServerConfig{Target: "127.0.0.1:8080"}, &logger)
+ *	nymSocketManager, _ := lib.NewNymSocketManager(uri, server.Handle, &logger)
+ *
+ * Streams are only created by an open Frame, with the first sequence number and the Token if configured, and at
+ * most MaxStreams of them are open at once. A stream belongs to the senderTag which opened it, the Frames of other
+ * senderTags being dropped. The Frames a stream receives ahead of the next one it expects are
+ * buffered, up to Window Frames of MaxFrameData bytes.
+ *
+ * As the mixnet reorders messages, the Frames of a stream can arrive before its open Frame. They are buffered per
+ * senderTag and stream, within the same bounds, until the open Frame arrives or for earlyFrameRetention, and dropped
+ * if the stream is refused.
+ */
+
+const (
+	// DefaultDialTimeout is how long the Server waits for the local service to accept a connection
+	DefaultDialTimeout = 10 * time.Second
+	// DefaultMaxStreams is the number of streams a Server keeps open at most
+	DefaultMaxStreams = 1024
+	// DefaultServerIdleTimeout is how long a stream of the Server can be idle before being reset
+	DefaultServerIdleTimeout = 5 * time.Minute
+	// endedStreamRetention is how long the IDs of ended streams are kept to drop their late Frames
+	endedStreamRetention = 10 * time.Minute
+	// earlyFrameRetention is how long the Frames received before the open Frame of their stream are kept
+	earlyFrameRetention = time.Minute
+)
+
+type ServerConfig struct {
+	// TCP address of the local service
+	Target string
+	// Dials the targets requested by Clients instead of Target (optional)
+	Dial func(target string) (net.Conn, error)
+	// Streams are only opened by Clients presenting Token (optional)
+	Token string
+	// Streams idle for IdleTimeout are reset. Defaults to DefaultServerIdleTimeout.
+	IdleTimeout time.Duration
+	// Defaults to DefaultDialTimeout
+	DialTimeout time.Duration
+	// Open Frames beyond MaxStreams open streams are refused. Defaults to DefaultMaxStreams.
+	MaxStreams int
+	// Defaults to DefaultWindow
+	Window uint64
+	// Defaults to DefaultMaxFrameData
+	MaxFrameData int
+}
+
+func NewServer(config ServerConfig, parentLogger *zerolog.Logger) (*Server, error) {
+	if 0 == len(config.Target) && nil == config.Dial {
+		err := xerrors.Errorf("target or dial needs to be defined")
+		return nil, err
+	}
+
+	if config.DialTimeout < 0 || config.IdleTimeout < 0 || config.MaxFrameData < 0 || config.MaxStreams < 0 {
+		err := xerrors.Errorf("timeouts, maximum frame data and maximum streams cannot be negative")
+		return nil, err
+	}
+
+	if nil == parentLogger {
+		err := xerrors.Errorf("logger needs to be defined")
+		return nil, err
+	}
+
+	if 0 == config.DialTimeout {
+		config.DialTimeout = DefaultDialTimeout
+	}
+	if 0 == config.IdleTimeout {
+		config.IdleTimeout = DefaultServerIdleTimeout
+	}
+	if 0 == config.MaxStreams {
+		config.MaxStreams = DefaultMaxStreams
+	}
+	if 0 == config.Window {
+		config.Window = DefaultWindow
+	}
+	if 0 == config.MaxFrameData {
+		config.MaxFrameData = DefaultMaxFrameData
+	}
+
+	localLogger := parentLogger.With().Str(lib.ComponentField, "TunnelServer").Logger()
+
+	return &Server{
+		config:         config,
+		streams:        make(map[string]*stream),
+		endedStreams:   make(map[string]time.Time),
+		lastEndedSweep: time.Now(),
+		early:          make(map[earlyKey]*earlyFrames),
+		logger:         &localLogger,
+	}, nil
+}
+
+type Server struct {
+	sync.Mutex
+
+	config ServerConfig
+
+	streams        map[string]*stream
+	endedStreams   map[string]time.Time
+	lastEndedSweep time.Time
+
+	// Frames received before the open Frame of their stream
+	early map[earlyKey]*earlyFrames
+
+	logger *zerolog.Logger
+}
+
+type earlyKey struct {
+	senderTag string
+	stream    string
+}
+
+type earlyFrames struct {
+	frames     []Frame
+	receivedAt time.Time
+}
+
+// Streams returns the number of open streams
+func (s *Server) Streams() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.streams)
+}
+
+// Handle processes the Frames received by the NymSocketManager of the Server
+func (s *Server) Handle(msg lib.NymReceived, send func(lib.NymMessage) error) {
+	if 0 == len(msg.SenderTag) {
+		s.logger.Debug().Msg("dropping message without senderTag, cannot answer it")
+		return
+	}
+
+	frame, e := decodeFrame(msg.Message)
+	if nil != e {
+		s.logger.Debug().Msgf("dropping message from %v: %v", msg.SenderTag, e)
+		return
+	}
+
+	// Frames are answered through the SURBs of the senderTag which opened the stream
+	sendFrame := func(f Frame) error {
+		message, e := f.encode()
+		if nil != e {
+			return e
+		}
+		return send(lib.NewNymReply(msg.SenderTag, message))
+	}
+
+	var early *earlyFrames
+	s.Lock()
+	st, ok := s.streams[frame.Stream]
+	if !ok {
+		if _, ended := s.endedStreams[frame.Stream]; ended {
+			s.Unlock()
+			s.logger.Debug().Msgf("dropping %v frame on ended stream %v", frame.Kind, frame.Stream)
+			return
+		}
+
+		key := earlyKey{senderTag: msg.SenderTag, stream: frame.Stream}
+		if FrameOpen != frame.Kind || 0 != frame.Seq {
+			s.bufferEarly(key, frame)
+			s.Unlock()
+			return
+		}
+		early = s.early[key]
+		delete(s.early, key)
+
+		if e := s.accept(frame); nil != e {
+			s.Unlock()
+			s.logger.Debug().Msgf("refusing stream %v from %v: %v", frame.Stream, msg.SenderTag, e)
+			e = sendFrame(Frame{Stream: frame.Stream, Kind: FrameReset, Error: e.Error()})
+			if nil != e {
+				s.logger.Warn().Msgf("failed to reset stream %v: %v", frame.Stream, e)
+			}
+			return
+		}
+
+		st = s.newStream(frame.Stream, msg.SenderTag, sendFrame)
+		s.streams[frame.Stream] = st
+		s.Unlock()
+
+		s.logger.Debug().Msgf("new stream %v from %v", frame.Stream, msg.SenderTag)
+		st.start()
+	} else {
+		s.Unlock()
+		if st.remote != msg.SenderTag {
+			s.logger.Debug().Msgf("dropping %v frame on stream %v from %v, not its opener", frame.Kind, frame.Stream, msg.SenderTag)
+			return
+		}
+	}
+
+	st.receive(frame)
+	if nil != early {
+		for _, f := range early.frames {
+			st.receive(f)
+		}
+	}
+}
+
+// Close resets every open stream
+func (s *Server) Close() {
+	s.Lock()
+	streams := make([]*stream, 0, len(s.streams))
+	for _, st := range s.streams {
+		streams = append(streams, st)
+	}
+	s.Unlock()
+
+	for _, st := range streams {
+		st.end("server closed", true)
+	}
+}
+
+// bufferEarly keeps frame until the open Frame of its stream arrives, within the bounds of the streams
+// called from methods that already acquired the lock
+func (s *Server) bufferEarly(key earlyKey, frame Frame) {
+	if !frame.isSequenced() || frame.Seq >= s.config.Window || len(frame.Data) > s.config.MaxFrameData {
+		s.logger.Debug().Msgf("dropping %v frame %d on unknown stream %v", frame.Kind, frame.Seq, frame.Stream)
+		return
+	}
+
+	now := time.Now()
+	early, ok := s.early[key]
+	if !ok {
+		if len(s.early) >= s.config.MaxStreams {
+			s.expireEarly(now)
+		}
+		if len(s.early) >= s.config.MaxStreams {
+			s.logger.Debug().Msgf("dropping %v frame on unknown stream %v, too many streams waiting for open", frame.Kind, frame.Stream)
+			return
+		}
+		early = &earlyFrames{receivedAt: now}
+		s.early[key] = early
+	}
+
+	if uint64(len(early.frames)) >= s.config.Window {
+		s.logger.Debug().Msgf("dropping %v frame on unknown stream %v, window exceeded", frame.Kind, frame.Stream)
+		return
+	}
+	early.frames = append(early.frames, frame)
+}
+
+// expireEarly drops the Frames waiting for open for longer than earlyFrameRetention
+// called from methods that already acquired the lock
+func (s *Server) expireEarly(now time.Time) {
+	for key, early := range s.early {
+		if now.Sub(early.receivedAt) >= earlyFrameRetention {
+			delete(s.early, key)
+		}
+	}
+}
+
+// accept checks that the stream opened by open can be created
+// called from methods that already acquired the lock
+func (s *Server) accept(open Frame) error {
+	if 0 != len(s.config.Token) && subtle.ConstantTimeCompare([]byte(s.config.Token), []byte(open.Token)) != 1 {
+		return xerrors.Errorf("invalid token")
+	}
+	if len(s.streams) >= s.config.MaxStreams {
+		return xerrors.Errorf("too many streams")
+	}
+	return nil
+}
+
+// called from methods that already acquired the lock
+func (s *Server) newStream(id string, senderTag string, sendFrame func(Frame) error) *stream {
+	st := newStream(id, nil, s.config.Window, s.config.MaxFrameData, sendFrame, s.dial, func() { s.ended(id) }, s.logger)
+	st.remote = senderTag
+	st.setIdleTimeout(s.config.IdleTimeout)
+	return st
+}
+
+// dial connects the stream opened by open, once accepted
+func (s *Server) dial(open Frame) (net.Conn, error) {
+	if nil != s.config.Dial {
+		target := open.Target
+		if 0 == len(target) {
+			target = s.config.Target
+		}
+		if 0 == len(target) {
+			return nil, xerrors.Errorf("no target requested")
+		}
+		return s.config.Dial(target)
+	}
+
+	if 0 != len(open.Target) && open.Target != s.config.Target {
+		return nil, xerrors.Errorf("target %v not allowed", open.Target)
+	}
+	return net.DialTimeout("tcp", s.config.Target, s.config.DialTimeout)
+}
+
+func (s *Server) ended(id string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.streams, id)
+
+	now := time.Now()
+	s.endedStreams[id] = now
+	if now.Sub(s.lastEndedSweep) < endedStreamRetention {
+		return
+	}
+	s.lastEndedSweep = now
+	for endedId, endedAt := range s.endedStreams {
+		if now.Sub(endedAt) >= endedStreamRetention {
+			delete(s.endedStreams, endedId)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/xerrors"
+)
+
+// stream pipes a local connection to the remote side of the tunnel, both the Client and the Server using it
+type stream struct {
+	sync.Mutex
+	// Signaled when acks are received or the stream ends
+	cond *sync.Cond
+
+	id           string
+	window       uint64
+	maxFrameData int
+	sendFrame    func(Frame) error
+	// Dials the local connection on open, only set on the Server side
+	dial func(open Frame) (net.Conn, error)
+	// senderTag of the Client which opened the stream, only set on the Server side
+	remote string
+	onEnd  func()
+	logger *zerolog.Logger
+
+	conn net.Conn
+
+	// The stream is reset when nothing goes through it for idleTimeout, if set
+	idleTimeout  time.Duration
+	lastActivity time.Time
+	idleTimer    *time.Timer
+
+	nextSendSeq uint64
+	ackedSeq    uint64
+	nextRecvSeq uint64
+	// Sequenced Frames received ahead of nextRecvSeq
+	pending map[uint64]Frame
+	// In order Frames waiting to be delivered to conn
+	deliveries chan Frame
+
+	localClosed  bool
+	remoteClosed bool
+	ended        bool
+	done         chan struct{}
+}
+
+func newStream(id string, conn net.Conn, window uint64, maxFrameData int, sendFrame func(Frame) error,
+	dial func(Frame) (net.Conn, error), onEnd func(), logger *zerolog.Logger) *stream {
+	s := &stream{
+		id:           id,
+		window:       window,
+		maxFrameData: maxFrameData,
+		sendFrame:    sendFrame,
+		dial:         dial,
+		onEnd:        onEnd,
+		logger:       logger,
+		conn:         conn,
+		pending:      make(map[uint64]Frame),
+		deliveries:   make(chan Frame, window),
+		done:         make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.Mutex)
+	return s
+}
+
+// setIdleTimeout resets the stream when nothing goes through it for timeout, to be called before start
+func (s *stream) setIdleTimeout(timeout time.Duration) {
+	s.idleTimeout = timeout
+	s.lastActivity = time.Now()
+}
+
+// active records activity on the stream, delaying the idle timeout
+func (s *stream) active() {
+	s.Lock()
+	defer s.Unlock()
+	s.lastActivity = time.Now()
+}
+
+func (s *stream) checkIdle() {
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+
+	idle := time.Since(s.lastActivity)
+	if idle < s.idleTimeout {
+		s.idleTimer.Reset(s.idleTimeout - idle)
+		s.Unlock()
+		return
+	}
+	s.Unlock()
+
+	s.end("idle timeout", true)
+}
+
+// send sends an unsequenced Frame
+func (s *stream) send(frame Frame) error {
+	s.Lock()
+	sendFrame := s.sendFrame
+	s.Unlock()
+
+	frame.Stream = s.id
+	return sendFrame(frame)
+}
+
+// sendSequenced numbers frame and sends it once the window allows it
+func (s *stream) sendSequenced(frame Frame) error {
+	s.Lock()
+	for !s.ended && s.nextSendSeq-s.ackedSeq >= s.window {
+		s.cond.Wait()
+	}
+	if s.ended {
+		s.Unlock()
+		return xerrors.Errorf("stream %v ended", s.id)
+	}
+	frame.Seq = s.nextSendSeq
+	s.nextSendSeq++
+	sendFrame := s.sendFrame
+	s.Unlock()
+
+	frame.Stream = s.id
+	return sendFrame(frame)
+}
+
+// receive processes a Frame from the remote side
+func (s *stream) receive(frame Frame) {
+	s.active()
+
+	switch frame.Kind {
+	case FrameAck:
+		s.Lock()
+		if frame.Ack > s.ackedSeq && frame.Ack <= s.nextSendSeq {
+			s.ackedSeq = frame.Ack
+			s.cond.Broadcast()
+		}
+		s.Unlock()
+
+	case FrameReset:
+		s.logger.Debug().Msgf("stream %v reset by remote: %v", s.id, frame.Error)
+		s.end("", false)
+
+	default:
+		if !frame.isSequenced() {
+			s.logger.Debug().Msgf("dropping unknown %v frame on stream %v", frame.Kind, s.id)
+			return
+		}
+		s.receiveSequenced(frame)
+	}
+}
+
+func (s *stream) receiveSequenced(frame Frame) {
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+
+	if _, ok := s.pending[frame.Seq]; ok || frame.Seq < s.nextRecvSeq {
+		s.Unlock()
+		s.logger.Debug().Msgf("dropping duplicate frame %d on stream %v", frame.Seq, s.id)
+		return
+	}
+
+	// The remote side cannot be further ahead than the window, so that at most window Frames of maxFrameData bytes
+	// are pending
+	if frame.Seq >= s.nextRecvSeq+s.window {
+		s.Unlock()
+		s.end("window exceeded", true)
+		return
+	}
+	if len(frame.Data) > s.maxFrameData {
+		s.Unlock()
+		s.end("frame too large", true)
+		return
+	}
+
+	s.pending[frame.Seq] = frame
+	for {
+		next, ok := s.pending[s.nextRecvSeq]
+		if !ok {
+			break
+		}
+		delete(s.pending, s.nextRecvSeq)
+		s.nextRecvSeq++
+
+		select {
+		case s.deliveries <- next:
+		default:
+			s.Unlock()
+			s.end("window exceeded", true)
+			return
+		}
+	}
+	s.Unlock()
+}
+
+// start runs the delivery of the received Frames, conn being read once the stream is opened
+func (s *stream) start() {
+	if s.idleTimeout > 0 {
+		s.Lock()
+		s.idleTimer = time.AfterFunc(s.idleTimeout, s.checkIdle)
+		s.Unlock()
+	}
+
+	go s.deliverLoop()
+}
+
+// deliverLoop delivers the received Frames in order to conn, acknowledging them once delivered
+func (s *stream) deliverLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+
+		case frame := <-s.deliveries:
+			if !s.deliver(frame) {
+				return
+			}
+
+			e := s.send(Frame{Kind: FrameAck, Ack: frame.Seq + 1})
+			if nil != e {
+				s.logger.Warn().Msgf("failed to acknowledge frame %d on stream %v: %v", frame.Seq, s.id, e)
+			}
+
+			if FrameClose == frame.Kind {
+				s.endIfClosed()
+			}
+		}
+	}
+}
+
+func (s *stream) deliver(frame Frame) bool {
+	s.Lock()
+	conn := s.conn
+	s.Unlock()
+
+	switch frame.Kind {
+	case FrameOpen:
+		if nil != conn || nil == s.dial {
+			s.end("unexpected open", true)
+			return false
+		}
+
+		conn, e := s.dial(frame)
+		if nil != e {
+			s.logger.Debug().Msgf("failed to open stream %v: %v", s.id, e)
+			s.end(e.Error(), true)
+			return false
+		}
+
+		s.Lock()
+		if s.ended {
+			s.Unlock()
+			conn.Close()
+			return false
+		}
+		s.conn = conn
+		s.Unlock()
+
+		go s.pump(conn)
+
+	case FrameData:
+		if nil == conn {
+			s.end("data before open", true)
+			return false
+		}
+
+		_, e := conn.Write(frame.Data)
+		if nil != e {
+			s.end(e.Error(), true)
+			return false
+		}
+
+	case FrameClose:
+		s.Lock()
+		s.remoteClosed = true
+		s.Unlock()
+
+		// Half-close the connection, the other direction can still be read
+		if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+			closer.CloseWrite()
+		}
+	}
+
+	return true
+}
+
+// pump sends what is read from conn to the remote side
+func (s *stream) pump(conn net.Conn) {
+	buffer := make([]byte, s.maxFrameData)
+	for {
+		n, e := conn.Read(buffer)
+		if n > 0 {
+			s.active()
+
+			data := make([]byte, n)
+			copy(data, buffer[:n])
+
+			sendErr := s.sendSequenced(Frame{Kind: FrameData, Data: data})
+			if nil != sendErr {
+				s.end(sendErr.Error(), true)
+				return
+			}
+		}
+
+		if io.EOF == e {
+			e = s.sendSequenced(Frame{Kind: FrameClose})
+			if nil != e {
+				s.end(e.Error(), true)
+				return
+			}
+
+			s.Lock()
+			s.localClosed = true
+			s.Unlock()
+			s.endIfClosed()
+			return
+		}
+
+		if nil != e {
+			s.end(e.Error(), true)
+			return
+		}
+	}
+}
+
+// endIfClosed ends the stream once both directions are closed
+func (s *stream) endIfClosed() {
+	s.Lock()
+	closed := s.localClosed && s.remoteClosed
+	s.Unlock()
+
+	if closed {
+		s.end("", false)
+	}
+}
+
+// end closes the stream, resetting the remote side if notify is set
+func (s *stream) end(reason string, notify bool) {
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	conn := s.conn
+	if nil != s.idleTimer {
+		s.idleTimer.Stop()
+	}
+	close(s.done)
+	s.cond.Broadcast()
+	s.Unlock()
+
+	if nil != conn {
+		conn.Close()
+	}
+
+	if notify {
+		s.logger.Debug().Msgf("resetting stream %v: %v", s.id, reason)
+		e := s.send(Frame{Kind: FrameReset, Error: reason})
+		if nil != e {
+			s.logger.Warn().Msgf("failed to reset stream %v: %v", s.id, e)
+		}
+	}
+
+	s.onEnd()
+}
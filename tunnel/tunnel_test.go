@@ -0,0 +1,238 @@
+package tunnel_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/notrustverify/nymsocketmanager/nymtest"
+	"github.com/notrustverify/nymsocketmanager/tunnel"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMixnet connects a Client to a Server in memory, delivering every message in its own goroutine so that
+// messages get reordered
+type fakeMixnet struct {
+	client *tunnel.Client
+	server *tunnel.Server
+}
+
+func (m *fakeMixnet) clientSend(msg lib.NymMessage) error {
+	sendAnonymous := msg.(lib.NymSendAnonymous)
+	go m.server.Handle(lib.NewNymReceived(sendAnonymous.Message, "clientTag").(lib.NymReceived), m.serverSend)
+	return nil
+}
+
+func (m *fakeMixnet) serverSend(msg lib.NymMessage) error {
+	reply := msg.(lib.NymReply)
+	go m.client.Handle(lib.NewNymReceived(reply.Message, "").(lib.NymReceived), nil)
+	return nil
+}
+
+func newFakeMixnet(t *testing.T, target string, window uint64) *fakeMixnet {
+	logger := zerolog.Logger{}
+
+	server, e := tunnel.NewServer(tunnel.ServerConfig{Target: target, Window: window, MaxFrameData: 64}, &logger)
+	require.NoError(t, e)
+	client, e := tunnel.NewClient(nymtest.RandomNymAddress(), tunnel.ClientConfig{Window: window, MaxFrameData: 64}, &logger)
+	require.NoError(t, e)
+
+	m := &fakeMixnet{client: client, server: server}
+	client.SetSender(m.clientSend)
+	return m
+}
+
+// listenLocal returns a listener on a random local port, closed at the end of the test
+func listenLocal(t *testing.T) net.Listener {
+	listener, e := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, e)
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+func TestNewServerAndClientNeedTheirPeer(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	_, e := tunnel.NewServer(tunnel.ServerConfig{}, &logger)
+	require.Error(t, e)
+	_, e = tunnel.NewClient(lib.NymAddress{}, tunnel.ClientConfig{}, &logger)
+	require.Error(t, e)
+}
+
+func TestTunnelForwardsConnections(t *testing.T) {
+	// The local service echoes what it receives
+	service := listenLocal(t)
+	go func() {
+		for {
+			conn, e := service.Accept()
+			if nil != e {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	mixnet := newFakeMixnet(t, service.Addr().String(), 2)
+	local := listenLocal(t)
+	go mixnet.client.Serve(local)
+
+	conn, e := net.Dial("tcp", local.Addr().String())
+	require.NoError(t, e)
+	defer conn.Close()
+
+	// Much more than a window of frames
+	sent := make([]byte, 10*1024)
+	_, e = rand.Read(sent)
+	require.NoError(t, e)
+
+	go func() {
+		conn.Write(sent)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received, e := io.ReadAll(conn)
+	require.NoError(t, e)
+	require.True(t, bytes.Equal(sent, received))
+
+	require.Eventually(t, func() bool {
+		return 0 == mixnet.client.Streams() && 0 == mixnet.server.Streams()
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestTunnelResetsStreamsToUnreachableTargets(t *testing.T) {
+	// Nothing listens on the target anymore
+	closed := listenLocal(t)
+	target := closed.Addr().String()
+	closed.Close()
+
+	mixnet := newFakeMixnet(t, target, 0)
+	local := listenLocal(t)
+	go mixnet.client.Serve(local)
+
+	conn, e := net.Dial("tcp", local.Addr().String())
+	require.NoError(t, e)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, e = conn.Read(make([]byte, 1))
+	require.Error(t, e)
+	require.False(t, isTimeout(e))
+
+	require.Eventually(t, func() bool {
+		return 0 == mixnet.client.Streams() && 0 == mixnet.server.Streams()
+	}, time.Second, 10*time.Millisecond)
+}
+
+// sendFrame hands frame to server as if sent by senderTag, returning the Frames it answered
+func sendFrame(t *testing.T, server *tunnel.Server, senderTag string, frame tunnel.Frame) []tunnel.Frame {
+	message, e := json.Marshal(frame)
+	require.NoError(t, e)
+
+	// The streams created keep answering, e.g. acks, after Handle returned
+	mutex := sync.Mutex{}
+	answers := []tunnel.Frame{}
+	server.Handle(lib.NewNymReceived(string(message), senderTag).(lib.NymReceived), func(msg lib.NymMessage) error {
+		answer := tunnel.Frame{}
+		e := json.Unmarshal([]byte(msg.(lib.NymReply).Message), &answer)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if nil == e {
+			answers = append(answers, answer)
+		}
+		return e
+	})
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	return append([]tunnel.Frame{}, answers...)
+}
+
+func TestServerOnlyOpensAcceptedStreams(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	service := listenLocal(t)
+	server, e := tunnel.NewServer(tunnel.ServerConfig{Target: service.Addr().String(), Token: "secret", MaxStreams: 1}, &logger)
+	require.NoError(t, e)
+	defer server.Close()
+
+	// Only an open Frame with the first sequence number creates a stream
+	require.Empty(t, sendFrame(t, server, "tag", tunnel.Frame{Stream: "data", Kind: tunnel.FrameData, Seq: 0, Data: []byte("x")}))
+	require.Empty(t, sendFrame(t, server, "tag", tunnel.Frame{Stream: "late", Kind: tunnel.FrameOpen, Seq: 1, Token: "secret"}))
+	require.Equal(t, 0, server.Streams())
+
+	answers := sendFrame(t, server, "tag", tunnel.Frame{Stream: "wrong", Kind: tunnel.FrameOpen, Token: "wrong"})
+	require.Len(t, answers, 1)
+	require.Equal(t, tunnel.FrameReset, answers[0].Kind)
+	require.Equal(t, "wrong", answers[0].Stream)
+	require.Equal(t, 0, server.Streams())
+
+	sendFrame(t, server, "tag", tunnel.Frame{Stream: "first", Kind: tunnel.FrameOpen, Token: "secret"})
+	require.Equal(t, 1, server.Streams())
+
+	// Beyond MaxStreams
+	answers = sendFrame(t, server, "tag", tunnel.Frame{Stream: "second", Kind: tunnel.FrameOpen, Token: "secret"})
+	require.Len(t, answers, 1)
+	require.Equal(t, tunnel.FrameReset, answers[0].Kind)
+	require.Equal(t, 1, server.Streams())
+}
+
+func TestServerKeepsFramesArrivingBeforeOpen(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	service := listenLocal(t)
+	server, e := tunnel.NewServer(tunnel.ServerConfig{Target: service.Addr().String()}, &logger)
+	require.NoError(t, e)
+	defer server.Close()
+
+	// The mixnet delivered the data Frame first
+	require.Empty(t, sendFrame(t, server, "tag", tunnel.Frame{Stream: "stream", Kind: tunnel.FrameData, Seq: 1, Data: []byte("early")}))
+	require.Equal(t, 0, server.Streams())
+	sendFrame(t, server, "tag", tunnel.Frame{Stream: "stream", Kind: tunnel.FrameOpen})
+	require.Equal(t, 1, server.Streams())
+
+	conn, e := service.Accept()
+	require.NoError(t, e)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make([]byte, 5)
+	_, e = io.ReadFull(conn, received)
+	require.NoError(t, e)
+	require.Equal(t, "early", string(received))
+}
+
+func TestServerBindsStreamsToTheirOpener(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	service := listenLocal(t)
+	server, e := tunnel.NewServer(tunnel.ServerConfig{Target: service.Addr().String()}, &logger)
+	require.NoError(t, e)
+	defer server.Close()
+
+	sendFrame(t, server, "opener", tunnel.Frame{Stream: "stream", Kind: tunnel.FrameOpen})
+	require.Equal(t, 1, server.Streams())
+
+	// Other senderTags can neither reset the stream nor get its answers
+	require.Empty(t, sendFrame(t, server, "other", tunnel.Frame{Stream: "stream", Kind: tunnel.FrameData, Seq: 1, Data: []byte("x")}))
+	require.Empty(t, sendFrame(t, server, "other", tunnel.Frame{Stream: "stream", Kind: tunnel.FrameReset}))
+	require.Equal(t, 1, server.Streams())
+
+	sendFrame(t, server, "opener", tunnel.Frame{Stream: "stream", Kind: tunnel.FrameReset})
+	require.Equal(t, 0, server.Streams())
+}
+
+func isTimeout(e error) bool {
+	netErr, ok := e.(net.Error)
+	return ok && netErr.Timeout()
+}
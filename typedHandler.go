@@ -0,0 +1,256 @@
+package nymsocketmanager
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/rs/zerolog"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/xerrors"
+)
+
+/*
+ * Typed handlers decode the Message of a NymReceived into a user-defined type before calling the business handler.
+ * The nym-client carries the payload as a string, so binary codecs (CBOR, MessagePack) are base64 encoded on the wire.
+ */
+
+// Codec encodes a payload into the Message string of a NymMessage and back
+type Codec interface {
+	Name() string
+	Encode(v interface{}) (string, error)
+	Decode(message string, v interface{}) error
+}
+
+/*********************************************
+ * Codecs
+ *********************************************/
+
+var (
+	JSONCodec    Codec = jsonCodec{}
+	CBORCodec    Codec = cborCodec{}
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Encode(v interface{}) (string, error) {
+	b, e := json.Marshal(v)
+	if nil != e {
+		return "", xerrors.Errorf("failed to encode json payload: %v", e)
+	}
+	return string(b), nil
+}
+
+func (jsonCodec) Decode(message string, v interface{}) error {
+	e := json.Unmarshal([]byte(message), v)
+	if nil != e {
+		return xerrors.Errorf("failed to decode json payload: %v", e)
+	}
+	return nil
+}
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string {
+	return "cbor"
+}
+
+func (cborCodec) Encode(v interface{}) (string, error) {
+	b, e := cbor.Marshal(v)
+	if nil != e {
+		return "", xerrors.Errorf("failed to encode cbor payload: %v", e)
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func (cborCodec) Decode(message string, v interface{}) error {
+	b, e := base64.StdEncoding.DecodeString(message)
+	if nil != e {
+		return xerrors.Errorf("failed to decode base64 of cbor payload: %v", e)
+	}
+	e = cbor.Unmarshal(b, v)
+	if nil != e {
+		return xerrors.Errorf("failed to decode cbor payload: %v", e)
+	}
+	return nil
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Encode(v interface{}) (string, error) {
+	b, e := msgpack.Marshal(v)
+	if nil != e {
+		return "", xerrors.Errorf("failed to encode msgpack payload: %v", e)
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func (msgpackCodec) Decode(message string, v interface{}) error {
+	b, e := base64.StdEncoding.DecodeString(message)
+	if nil != e {
+		return xerrors.Errorf("failed to decode base64 of msgpack payload: %v", e)
+	}
+	e = msgpack.Unmarshal(b, v)
+	if nil != e {
+		return xerrors.Errorf("failed to decode msgpack payload: %v", e)
+	}
+	return nil
+}
+
+/*********************************************
+ * Sender
+ *********************************************/
+
+// Sender is given to typed handlers to answer with payloads encoded by the same Codec
+type Sender struct {
+	codec    Codec
+	received NymReceived
+	send     func(NymMessage) error
+}
+
+// SenderTag returns the tag of the received message, empty if the sender did not attach any reply SURB
+func (s Sender) SenderTag() string {
+	return s.received.SenderTag
+}
+
+// Received returns the raw message the payload was decoded from
+func (s Sender) Received() NymReceived {
+	return s.received
+}
+
+// Reply encodes payload and sends it back to the sender of the received message
+func (s Sender) Reply(payload interface{}) error {
+	if len(s.received.SenderTag) == 0 {
+		return xerrors.Errorf("cannot reply to a message without senderTag")
+	}
+
+	message, e := s.codec.Encode(payload)
+	if nil != e {
+		return e
+	}
+
+	return s.send(NewNymReply(s.received.SenderTag, message))
+}
+
+// Send encodes payload and sends it to recipient
+func (s Sender) Send(recipient NymAddress, payload interface{}) error {
+	message, e := s.codec.Encode(payload)
+	if nil != e {
+		return e
+	}
+
+	return s.send(NewNymSend(message, recipient))
+}
+
+// SendAnonymous encodes payload and sends it to recipient, attaching nbReplySurbs for the reply
+func (s Sender) SendAnonymous(recipient NymAddress, payload interface{}, nbReplySurbs uint) error {
+	message, e := s.codec.Encode(payload)
+	if nil != e {
+		return e
+	}
+
+	return s.send(NewNymSendAnonymous(message, recipient, nbReplySurbs))
+}
+
+// SendMessage sends an already built NymMessage
+func (s Sender) SendMessage(msg NymMessage) error {
+	return s.send(msg)
+}
+
+/*********************************************
+ * TypedHandler
+ *********************************************/
+
+// HandleTyped wraps handler so that it can be used as messageHandler of a NymSocketManager.
+// Messages that cannot be decoded into T never reach handler, they are given to the decode error handler instead.
+// Until a logger is given with WithLogger or by NewTypedNymSocketManager, decode errors are logged to stderr.
+func HandleTyped[T any](codec Codec, handler func(T, Sender)) *TypedHandler[T] {
+	defaultLogger := zerolog.New(os.Stderr).With().Timestamp().Str(ComponentField, "TypedHandler").Logger()
+
+	return &TypedHandler[T]{
+		codec:   codec,
+		handler: handler,
+		logger:  &defaultLogger,
+	}
+}
+
+type TypedHandler[T any] struct {
+	codec              Codec
+	handler            func(T, Sender)
+	decodeErrorHandler func(NymReceived, error, Sender)
+
+	logger *zerolog.Logger
+	// The logger was given by the user, NewTypedNymSocketManager keeps it
+	customLogger bool
+}
+
+// WithLogger sets the logger of the decode errors
+func (h *TypedHandler[T]) WithLogger(parentLogger *zerolog.Logger) *TypedHandler[T] {
+	if nil == parentLogger {
+		return h
+	}
+
+	localLogger := parentLogger.With().Str(ComponentField, "TypedHandler").Logger()
+	h.logger = &localLogger
+	h.customLogger = true
+	return h
+}
+
+// OnDecodeError sets the function called when a received message cannot be decoded.
+// By default, such messages are logged and dropped.
+func (h *TypedHandler[T]) OnDecodeError(decodeErrorHandler func(NymReceived, error, Sender)) *TypedHandler[T] {
+	h.decodeErrorHandler = decodeErrorHandler
+	return h
+}
+
+// Handle has the signature of the messageHandler expected by NewNymSocketManager
+func (h *TypedHandler[T]) Handle(msg NymReceived, send func(NymMessage) error) {
+	sender := Sender{
+		codec:    h.codec,
+		received: msg,
+		send:     send,
+	}
+
+	var payload T
+	e := h.codec.Decode(msg.Message, &payload)
+	if nil != e {
+		if nil != h.decodeErrorHandler {
+			h.decodeErrorHandler(msg, e, sender)
+		} else {
+			h.logger.Warn().Msgf("dropping message from %v that could not be decoded as %s: %v", msg.SenderTag, h.codec.Name(), e)
+		}
+		return
+	}
+
+	h.handler(payload, sender)
+}
+
+// NewTypedNymSocketManager creates a NymSocketManager whose received messages are decoded by handler
+func NewTypedNymSocketManager[T any](connectionURI string, handler *TypedHandler[T], parentLogger *zerolog.Logger) (*NymSocketManager, error) {
+	if nil == handler || nil == handler.handler {
+		err := xerrors.Errorf("typed handler needs to be defined")
+		return nil, err
+	}
+
+	if nil == handler.codec {
+		err := xerrors.Errorf("codec needs to be defined")
+		return nil, err
+	}
+
+	if !handler.customLogger && nil != parentLogger {
+		localLogger := parentLogger.With().Str(ComponentField, "TypedHandler").Logger()
+		handler.logger = &localLogger
+	}
+
+	return NewNymSocketManager(connectionURI, handler.Handle, parentLogger)
+}
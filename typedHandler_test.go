@@ -0,0 +1,82 @@
+package nymsocketmanager_test
+
+import (
+	"bytes"
+	"testing"
+
+	lib "github.com/notrustverify/nymsocketmanager"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+type typedPayload struct {
+	Name  string `json:"name" cbor:"name" msgpack:"name"`
+	Count int    `json:"count" cbor:"count" msgpack:"count"`
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	for _, codec := range []lib.Codec{lib.JSONCodec, lib.CBORCodec, lib.MsgpackCodec} {
+		payload := typedPayload{Name: RandStringBytes(8), Count: 3}
+
+		message, e := codec.Encode(payload)
+		require.NoError(t, e, codec.Name())
+
+		decoded := typedPayload{}
+		e = codec.Decode(message, &decoded)
+		require.NoError(t, e, codec.Name())
+		require.Equal(t, payload, decoded, codec.Name())
+	}
+}
+
+func TestTypedHandlerDecodesPayloadAndReplies(t *testing.T) {
+	var received typedPayload
+	var sent lib.NymMessage
+
+	handler := lib.HandleTyped(lib.JSONCodec, func(p typedPayload, s lib.Sender) {
+		received = p
+		require.NoError(t, s.Reply(typedPayload{Name: "pong"}))
+	})
+
+	handler.Handle(lib.NewNymReceived(`{"name":"ping","count":1}`, "tag").(lib.NymReceived), func(m lib.NymMessage) error {
+		sent = m
+		return nil
+	})
+
+	require.Equal(t, typedPayload{Name: "ping", Count: 1}, received)
+	require.Equal(t, "tag", sent.(lib.NymReply).SenderTag)
+	require.Equal(t, `{"name":"pong","count":0}`, sent.(lib.NymReply).Message)
+}
+
+func TestTypedHandlerRoutesDecodeErrors(t *testing.T) {
+	called := false
+	var decodeError error
+
+	handler := lib.HandleTyped(lib.JSONCodec, func(typedPayload, lib.Sender) {
+		called = true
+	}).OnDecodeError(func(_ lib.NymReceived, e error, _ lib.Sender) {
+		decodeError = e
+	})
+
+	handler.Handle(lib.NewNymReceived("not json", "").(lib.NymReceived), func(lib.NymMessage) error { return nil })
+
+	require.False(t, called)
+	require.Error(t, decodeError)
+}
+
+func TestTypedHandlerLogsDecodeErrors(t *testing.T) {
+	output := &bytes.Buffer{}
+	logger := zerolog.New(output)
+
+	handler := lib.HandleTyped(lib.JSONCodec, func(typedPayload, lib.Sender) {}).WithLogger(&logger)
+	handler.Handle(lib.NewNymReceived("not json", "tag").(lib.NymReceived), func(lib.NymMessage) error { return nil })
+
+	require.Contains(t, output.String(), "could not be decoded")
+	require.Contains(t, output.String(), "TypedHandler")
+}
+
+func TestTypedNymSocketManagerShouldHaveAHandler(t *testing.T) {
+	logger := zerolog.Logger{}
+
+	_, e := lib.NewTypedNymSocketManager[typedPayload]("ws://127.0.0.1", nil, &logger)
+	require.Error(t, e)
+}